@@ -1,11 +1,9 @@
 package chflg
 
 import (
-	"encoding/binary"
 	"fmt"
 	"io/fs"
 	"os"
-	"strconv"
 	"strings"
 
 	"github.com/pg9182/tf2vpk"
@@ -62,7 +60,7 @@ func init() {
 
 func main() {
 	var failed int
-	if err := vpkutil.UpdateDir(Flags.VPK, Flags.DryRun, func(root *tf2vpk.ValvePakDir) error {
+	if err := vpkutil.UpdateDirOptions(Flags.VPK, root.Flags.Options, Flags.DryRun, func(root *tf2vpk.ValvePakDir) error {
 		var (
 			err          error
 			loadFlags    uint32
@@ -89,7 +87,7 @@ func main() {
 				os.Exit(1)
 			}
 		} else {
-			loadFlags, textureFlags, err = parseFlags(Flags.Flags)
+			loadFlags, textureFlags, err = vpkutil.ParseFlags(Flags.Flags)
 			if err != nil {
 				fmt.Fprintf(os.Stderr, "error: invalid flags %q: %v\n", Flags.Flags, err)
 				os.Exit(1)
@@ -138,38 +136,3 @@ func main() {
 		os.Exit(1)
 	}
 }
-
-func parseFlags(s string) (uint32, uint16, error) {
-	load, texture, ok := strings.Cut(s, ":")
-	if !ok {
-		return 0, 0, fmt.Errorf("expected load and texture flags separated by a colon")
-	}
-	loadFlags, err := parseFlag[uint32](load)
-	if err != nil {
-		return 0, 0, fmt.Errorf("parse load flags: %v", err)
-	}
-	textureFlags, err := parseFlag[uint16](texture)
-	if err != nil {
-		return 0, 0, fmt.Errorf("parse texture flags: %v", err)
-	}
-	return loadFlags, textureFlags, nil
-}
-
-func parseFlag[T uint16 | uint32](s string) (T, error) {
-	bits := binary.Size(T(0)) * 8
-	if s, ok := strings.CutPrefix(s, "0x"); ok {
-		if v, err := strconv.ParseUint(s, 16, bits); err != nil {
-			return 0, fmt.Errorf("parse hex flags %q: %w", s, err)
-		} else {
-			return T(v), nil
-		}
-	}
-	if v, err := strconv.ParseUint(s, 2, bits); err == nil {
-		if len(s) != bits {
-			return 0, fmt.Errorf("parse binary flags %q: must be exactly %d bits", s, bits)
-		} else {
-			return T(v), nil
-		}
-	}
-	return 0, fmt.Errorf("unknown flag format %q (expected 0x hex or fixed-width binary)", s)
-}
@@ -4,14 +4,27 @@ import (
 	"github.com/pg9182/tf2vpk/cmd/root"
 
 	_ "github.com/pg9182/tf2vpk/cmd/chflg"
+	_ "github.com/pg9182/tf2vpk/cmd/compress"
+	_ "github.com/pg9182/tf2vpk/cmd/convert"
+	_ "github.com/pg9182/tf2vpk/cmd/cp"
+	_ "github.com/pg9182/tf2vpk/cmd/diff"
 	_ "github.com/pg9182/tf2vpk/cmd/filter"
+	_ "github.com/pg9182/tf2vpk/cmd/gc"
 	_ "github.com/pg9182/tf2vpk/cmd/get"
 	_ "github.com/pg9182/tf2vpk/cmd/init"
 	_ "github.com/pg9182/tf2vpk/cmd/list"
-	_ "github.com/pg9182/tf2vpk/cmd/lzham"
+	_ "github.com/pg9182/tf2vpk/cmd/merge"
+	_ "github.com/pg9182/tf2vpk/cmd/optimize"
+	_ "github.com/pg9182/tf2vpk/cmd/pack"
+	_ "github.com/pg9182/tf2vpk/cmd/put"
 	_ "github.com/pg9182/tf2vpk/cmd/rm"
+	_ "github.com/pg9182/tf2vpk/cmd/serve"
+	_ "github.com/pg9182/tf2vpk/cmd/split"
+	_ "github.com/pg9182/tf2vpk/cmd/stats"
+	_ "github.com/pg9182/tf2vpk/cmd/status"
 	_ "github.com/pg9182/tf2vpk/cmd/tarzip"
 	_ "github.com/pg9182/tf2vpk/cmd/unpack"
+	_ "github.com/pg9182/tf2vpk/cmd/update"
 	_ "github.com/pg9182/tf2vpk/cmd/verify"
 	_ "github.com/pg9182/tf2vpk/cmd/version"
 	_ "github.com/pg9182/tf2vpk/cmd/vpkfiles"
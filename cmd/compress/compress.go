@@ -0,0 +1,311 @@
+package compress
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/pg9182/tf2vpk"
+	"github.com/pg9182/tf2vpk/cmd/root"
+	"github.com/spf13/cobra"
+)
+
+var CompressCommand = command(false)
+var DecompressCommand = command(true)
+
+func command(decompress bool) *cobra.Command {
+	var main func()
+	var Flags struct {
+		Files     []string
+		Stdout    bool
+		Keep      bool
+		Force     bool
+		Verbose   bool
+		Raw       bool
+		BlockSize uint
+		Buffer    uint
+	}
+	var Command = &cobra.Command{
+		Use:   "compress [file...]",
+		Short: "Compresses files using a chunk codec",
+		Long: `Compresses files using a chunk codec
+
+The codec is selected with --codec (default lzham), and the output file has the codec name as its extension.
+
+By default, the output is a framed codec stream, which splits the input into independently compressed blocks of --block-size bytes, so files of any size can be compressed with bounded memory. The stream starts with a header containing the magic bytes "\x89TFZ", the version (1), the codec name (length-prefixed), and the block size (uint32). Each block has a header with the compressed size, the uncompressed size, the adler32, and the crc32 (little-endian uint32s), followed by the data, which is stored as-is if the sizes are equal. The stream ends with a block header with zero sizes and the checksums of all of the data.
+
+With --raw, each file is compressed in memory as a single chunk, like a VPK chunk. The output buffer is limited to --buffer bytes.
+
+Multiple files are processed in parallel (see --threads).
+`,
+		Run: func(cmd *cobra.Command, args []string) {
+			if len(args) == 0 {
+				Flags.Files = []string{"-"}
+			} else {
+				Flags.Files = args
+			}
+			main()
+		},
+	}
+	if decompress {
+		Command.Use = "decompress [file...]"
+		Command.Short = "Decompresses files using a chunk codec"
+		Command.Long = `Decompresses files using a chunk codec
+
+Framed codec streams (see the compress command) are detected automatically, and are decompressed one block at a time using the codec from the stream header, verifying the checksums of each block and of the entire stream. Otherwise (or with --raw), the file is decompressed in memory as a single chunk, with the codec selected with --codec (default lzham), or detected from the data with --codec=auto. Since the decompressed size isn't known, the output buffer is grown while the codec reports it as too small, up to --buffer bytes.
+
+The codec name is removed from the extension of the output file. Multiple files are processed in parallel (see --threads).
+`
+		Command.ValidArgsFunction = func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+			return tf2vpk.Codecs(), cobra.ShellCompDirectiveFilterFileExt
+		}
+	}
+	Command.Flags().BoolVarP(&Flags.Stdout, "stdout", "c", false, "write to stdout, keep original file unchanged (always enabled if reading from stdin)")
+	Command.Flags().BoolVarP(&Flags.Keep, "keep", "k", false, "keep (don't delete) input files (always enabled if writing to stdout)")
+	Command.Flags().BoolVarP(&Flags.Force, "force", "f", false, "force overwrite of output file")
+	Command.Flags().BoolVarP(&Flags.Verbose, "verbose", "v", false, "verbose mode")
+	if decompress {
+		Command.Flags().BoolVar(&Flags.Raw, "raw", false, "always decompress the input as a single chunk")
+	} else {
+		Command.Flags().BoolVar(&Flags.Raw, "raw", false, "compress the input as a single chunk instead of writing a framed codec stream")
+		Command.Flags().UintVar(&Flags.BlockSize, "block-size", uint(tf2vpk.CodecStreamBlockSize), "uncompressed block size for framed codec streams")
+	}
+	Command.Flags().UintVarP(&Flags.Buffer, "buffer", "b", 0, "maximum output buffer size for single chunks (0 for 4 GiB)")
+	main = func() {
+		if !decompress && root.Flags.Options.Codec == nil && root.Flags.Options.DetectCodec {
+			fmt.Fprintf(os.Stderr, "error: a codec must be specified to compress files\n")
+			os.Exit(2)
+		}
+		if !decompress && (Flags.BlockSize == 0 || Flags.BlockSize > tf2vpk.CodecStreamMaxBlockSize) {
+			fmt.Fprintf(os.Stderr, "error: block size must be between 1 and %d\n", tf2vpk.CodecStreamMaxBlockSize)
+			os.Exit(2)
+		}
+
+		// stdin/stdout can only be used by one file at a time
+		threads := max(root.Flags.Threads, 1)
+		if Flags.Stdout || slices.Contains(Flags.Files, "-") {
+			threads = 1
+		}
+
+		var prompt sync.Mutex
+		process := func(input string) (err error) {
+			stdio := input == "-" || Flags.Stdout
+
+			var in io.Reader
+			if input == "-" {
+				in = os.Stdin
+			} else {
+				f, err := os.Open(input)
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+				in = f
+			}
+			br := bufio.NewReader(in)
+
+			// determine the codec and how to process the input
+			var (
+				codec  = root.Flags.Options.Codec
+				framed *tf2vpk.CodecReader
+				buf    []byte
+			)
+			if decompress {
+				if magic, _ := br.Peek(len(tf2vpk.CodecStreamMagic)); !Flags.Raw && tf2vpk.IsCodecStream(magic) {
+					if framed, err = tf2vpk.NewCodecReader(br); err != nil {
+						return err
+					}
+					if codec != nil && codec != framed.Codec() {
+						return fmt.Errorf("stream was compressed with %s, not %s", framed.Codec().Name(), codec.Name())
+					}
+					codec = framed.Codec()
+				} else {
+					if buf, err = io.ReadAll(br); err != nil {
+						return err
+					}
+					if len(buf) == 0 {
+						return fmt.Errorf("input is empty")
+					}
+					if codec == nil {
+						if root.Flags.Options.DetectCodec {
+							if codec = tf2vpk.DetectCodec(buf); codec == nil {
+								return fmt.Errorf("failed to detect codec")
+							}
+						} else {
+							codec = tf2vpk.LZHAM
+						}
+					}
+				}
+			} else {
+				if codec == nil {
+					codec = tf2vpk.LZHAM
+				}
+				if Flags.Raw {
+					if buf, err = io.ReadAll(br); err != nil {
+						return err
+					}
+					if len(buf) == 0 {
+						return fmt.Errorf("input is empty")
+					}
+				}
+			}
+			ext := "." + codec.Name()
+
+			var output string
+			if stdio {
+				output = "stdout"
+			} else if decompress {
+				var ok bool
+				if output, ok = strings.CutSuffix(input, ext); !ok {
+					return fmt.Errorf("unknown extension (expected %s), ignoring", ext)
+				}
+			} else {
+				output = input + ext
+			}
+
+			var mode fs.FileMode
+			if s, err := os.Stat(input); err == nil {
+				mode = s.Mode()
+			} else {
+				mode = 0666
+			}
+
+			// open the output
+			var out io.Writer
+			if stdio {
+				out = os.Stdout
+			} else {
+				f, ferr := os.OpenFile(output, os.O_CREATE|os.O_TRUNC|os.O_WRONLY|os.O_EXCL, mode)
+				if errors.Is(ferr, fs.ErrExist) {
+					if !Flags.Force {
+						prompt.Lock()
+						fmt.Fprintf(os.Stderr, "warning: %s already exists; overwrite (y or n)? ", output)
+						os.Stderr.Sync()
+
+						var s string
+						_, _ = fmt.Fscanln(os.Stdin, &s)
+						prompt.Unlock()
+
+						if strings.TrimSpace(s) != "y" {
+							return fmt.Errorf("%s already exists, not overwriting", output)
+						}
+					}
+					f, ferr = os.OpenFile(output, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode)
+				}
+				if ferr != nil {
+					return ferr
+				}
+				defer f.Close()
+				defer func() { // remove partial output
+					if err != nil {
+						f.Close()
+						os.Remove(output)
+					}
+				}()
+				out = f
+			}
+			bw := bufio.NewWriterSize(out, 256*1024)
+
+			// process it
+			var isz, osz int64
+			switch {
+			case framed != nil:
+				if osz, err = io.Copy(bw, framed); err != nil {
+					return fmt.Errorf("%s: %w", codec.Name(), err)
+				}
+				if _, err := br.Peek(1); err == nil {
+					return fmt.Errorf("trailing data after end of stream")
+				} else if err != io.EOF {
+					return err
+				}
+				isz = framed.Offset()
+			case buf != nil:
+				var zbuf []byte
+				if decompress {
+					zbuf, err = tf2vpk.DecompressRaw(codec, buf, int(min(Flags.Buffer, tf2vpk.CodecRawMaxSize)))
+				} else {
+					zbuf, err = tf2vpk.CompressRaw(codec, buf, int(min(Flags.Buffer, tf2vpk.CodecRawMaxSize)))
+				}
+				if err != nil {
+					return err // already prefixed by the codec
+				}
+				if _, err := bw.Write(zbuf); err != nil {
+					return err
+				}
+				isz, osz = int64(len(buf)), int64(len(zbuf))
+			default:
+				cw, err := tf2vpk.NewCodecWriter(bw, codec, int(Flags.BlockSize))
+				if err != nil {
+					return err
+				}
+				if isz, err = io.Copy(cw, br); err != nil {
+					return fmt.Errorf("%s: %w", codec.Name(), err)
+				}
+				if err := cw.Close(); err != nil {
+					return fmt.Errorf("%s: %w", codec.Name(), err)
+				}
+				osz = cw.Offset()
+			}
+			if err := bw.Flush(); err != nil {
+				return err
+			}
+			if f, ok := out.(*os.File); ok && !stdio {
+				if err := f.Close(); err != nil {
+					return err
+				}
+			}
+
+			var action string
+			if !(Flags.Keep || stdio) {
+				if err := os.Remove(input); err != nil && !errors.Is(err, fs.ErrNotExist) {
+					return err
+				}
+				action = "replaced with"
+			} else {
+				action = "created"
+			}
+
+			if Flags.Verbose {
+				csz, usz := osz, isz
+				if decompress {
+					csz, usz = isz, osz
+				}
+				if usz == 0 {
+					usz = 1
+				}
+				fmt.Fprintf(os.Stderr, "%s: %5.1f%% %s -- %s %s\n", input, float64(csz)/float64(usz)*100, codec.Name(), action, output)
+			}
+			return nil
+		}
+
+		errs := make([]error, len(Flags.Files))
+
+		var wg sync.WaitGroup
+		for w := 0; w < min(threads, len(Flags.Files)); w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				for i := w; i < len(Flags.Files); i += threads {
+					if errs[i] = process(Flags.Files[i]); errs[i] != nil {
+						fmt.Fprintf(os.Stderr, "error: %s: %v\n", Flags.Files[i], errs[i])
+					}
+				}
+			}(w)
+		}
+		wg.Wait()
+
+		for _, err := range errs {
+			if err != nil {
+				os.Exit(1)
+			}
+		}
+	}
+	root.Command.AddCommand(Command)
+	return Command
+}
@@ -0,0 +1,235 @@
+package convert
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+
+	"github.com/pg9182/tf2vpk"
+	"github.com/pg9182/tf2vpk/cmd/root"
+	"github.com/pg9182/tf2vpk/internal"
+	"github.com/pg9182/tf2vpk/vpkutil"
+	"github.com/spf13/cobra"
+)
+
+var Flags struct {
+	VPK            tf2vpk.ValvePakRef
+	Output         tf2vpk.ValvePakRef
+	OutputPrefix   string
+	To             string
+	VPKFlags       string
+	Force          bool
+	Verbose        bool
+	DryRun         bool
+	IncludeExclude func(tf2vpk.ValvePakFile) (bool, error)
+}
+
+var Command = &cobra.Command{
+	GroupID: root.GroupVPKRepack.ID,
+	Use:     "convert vpk_path out_vpk_path",
+	Short:   "Converts a VPK between the Titanfall 2 and Source formats",
+	Long: `Converts a VPK between the Titanfall 2 and Source formats
+
+The output format is set with --to, and can be respawn (the chunked and LZHAM-compressed Titanfall 2 format), source1, or source2 (the classic Source engine formats, e.g., pak01_dir.vpk). By default, Titanfall 2 VPKs are converted to source2, and Source VPKs are converted to respawn.
+
+Source VPKs do not have load/texture flags, so when converting a Titanfall 2 VPK to a Source one, the flags are saved to the file specified by --vpkflags. When converting to a Titanfall 2 VPK, the flags are read from it (see the vpkflags command for the format), and it is required if the input is a Source VPK.
+
+Files are decompressed and written uncompressed as a single entry for Source VPKs, or recompressed for Titanfall 2 ones. All files are written to block 000.
+`,
+	Args: cobra.MatchAll(cobra.ExactArgs(2), func(cmd *cobra.Command, args []string) error {
+		prefix := root.Flags.VPKPrefix
+		if cmd.Flags().Changed("output-prefix") {
+			prefix = Flags.OutputPrefix
+		}
+		vpk, err := root.VPKPrefix(args[1], prefix)
+		if err != nil {
+			return fmt.Errorf("output: %w", err)
+		}
+		Flags.Output = vpk
+		return nil
+	}),
+	Run: func(cmd *cobra.Command, args []string) {
+		main()
+	},
+}
+
+func init() {
+	root.ArgVPK(&Flags.VPK, Command, -1, false, false, false)
+	Command.Flags().StringVar(&Flags.To, "to", "", "output format (respawn, source1, source2)")
+	Command.Flags().StringVar(&Flags.OutputPrefix, "output-prefix", "", "the vpk locale prefix to use for the output vpk (default is --vpk-prefix; source vpks usually don't have one)")
+	Command.Flags().StringVar(&Flags.VPKFlags, "vpkflags", "", "file to save the flags to when converting to a source vpk, or to read them from when converting to a respawn one")
+	Command.Flags().BoolVarP(&Flags.Force, "force", "f", false, "overwrite the output vpk if it already exists")
+	Command.Flags().BoolVarP(&Flags.DryRun, "dry-run", "n", false, "do not write the output vpk")
+	Command.Flags().BoolVarP(&Flags.Verbose, "verbose", "v", false, "display progress information")
+	root.FlagIncludeExclude(&Flags.IncludeExclude, Command, true)
+	Command.RegisterFlagCompletionFunc("to", cobra.FixedCompletions([]string{"respawn", "source1", "source2"}, cobra.ShellCompDirectiveNoFileComp))
+	root.Command.AddCommand(Command)
+}
+
+func main() {
+	if Flags.VPK.Resolve(tf2vpk.ValvePakIndexDir) == Flags.Output.Resolve(tf2vpk.ValvePakIndexDir) {
+		fmt.Fprintf(os.Stderr, "error: output vpk must not replace the input vpk\n")
+		os.Exit(1)
+	}
+
+	r, err := tf2vpk.NewReaderOptions(Flags.VPK, root.Flags.Options)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: open vpk: %v\n", err)
+		os.Exit(1)
+	}
+	defer r.Close()
+
+	var source uint16
+	switch Flags.To {
+	case "":
+		if !r.Root.IsSource() {
+			source = tf2vpk.ValvePakVersionSource2
+		}
+	case "respawn":
+	case "source1":
+		source = tf2vpk.ValvePakVersionSource1
+	case "source2":
+		source = tf2vpk.ValvePakVersionSource2
+	default:
+		fmt.Fprintf(os.Stderr, "error: invalid output format %q\n", Flags.To)
+		os.Exit(2)
+	}
+
+	var vpkflags *vpkutil.VPKFlags
+	switch {
+	case source != 0 && r.Root.IsSource():
+		if Flags.VPKFlags != "" {
+			fmt.Fprintf(os.Stderr, "error: --vpkflags is not used when converting between source vpks\n")
+			os.Exit(2)
+		}
+	case source != 0 && Flags.VPKFlags != "":
+		var generated vpkutil.VPKFlags
+		if err := generated.Generate(r.Root); err != nil {
+			fmt.Fprintf(os.Stderr, "error: generate vpkflags: %v\n", err)
+			os.Exit(1)
+		}
+		if !Flags.DryRun {
+			if err := os.WriteFile(Flags.VPKFlags, []byte(generated.String()), 0666); err != nil {
+				fmt.Fprintf(os.Stderr, "error: write vpkflags: %v\n", err)
+				os.Exit(1)
+			}
+		}
+	case source != 0:
+		for _, f := range r.Root.File {
+			load, _ := f.LoadFlags()
+			texture, _ := f.TextureFlags()
+			if load != 0 || texture != 0 {
+				fmt.Fprintf(os.Stderr, "error: vpk has load/texture flags, which would be lost (use --vpkflags to save them)\n")
+				os.Exit(1)
+			}
+		}
+	case Flags.VPKFlags != "":
+		vpkflags = new(vpkutil.VPKFlags)
+		if err := vpkflags.ParseFile(Flags.VPKFlags); err != nil {
+			fmt.Fprintf(os.Stderr, "error: read vpkflags: %v\n", err)
+			os.Exit(1)
+		}
+	case r.Root.IsSource():
+		fmt.Fprintf(os.Stderr, "error: --vpkflags is required to convert a source vpk to a respawn one\n")
+		os.Exit(2)
+	}
+
+	if !Flags.Force && !Flags.DryRun {
+		if _, err := os.Stat(Flags.Output.Resolve(tf2vpk.ValvePakIndexDir)); err == nil {
+			fmt.Fprintf(os.Stderr, "error: vpk %q already exists (use --force to overwrite it)\n", Flags.Output.Resolve(tf2vpk.ValvePakIndexDir))
+			os.Exit(1)
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			fmt.Fprintf(os.Stderr, "error: check vpk: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if prefixes, err := Flags.Output.Prefixes(); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		fmt.Fprintf(os.Stderr, "error: find vpk locales: %v\n", err)
+		os.Exit(1)
+	} else {
+		for _, prefix := range prefixes {
+			if prefix != Flags.Output.Prefix {
+				fmt.Fprintf(os.Stderr, "error: vpk blocks are shared with the dir for prefix %q, which would be invalidated by replacing them\n", prefix)
+				os.Exit(1)
+			}
+		}
+	}
+
+	var files []tf2vpk.ValvePakFile
+	for _, f := range r.Root.File {
+		if skip, err := Flags.IncludeExclude(f); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(1)
+		} else if skip {
+			if Flags.Verbose {
+				fmt.Printf("%s (excluded)\n", f.Path)
+			}
+			continue
+		}
+		files = append(files, f)
+	}
+
+	if !Flags.DryRun && Flags.Output.Path != "" {
+		if err := os.MkdirAll(Flags.Output.Path, 0777); err != nil {
+			fmt.Fprintf(os.Stderr, "error: create output directory: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	var uncompressed, compressed uint64
+	if _, err := vpkutil.CreateVPK(Flags.Output, root.Flags.Options, Flags.DryRun, func(w *tf2vpk.Writer) error {
+		if source != 0 {
+			if err := w.SetSourceVersion(source); err != nil {
+				return err
+			}
+		}
+		return r.Extract(files, tf2vpk.ExtractOptions{
+			Threads: max(root.Flags.Threads, 1),
+		}, func(f tf2vpk.ValvePakFile, fr io.Reader) error {
+			var (
+				load    uint32
+				texture uint16
+				err     error
+			)
+			switch {
+			case source != 0:
+			case vpkflags != nil:
+				load, texture = vpkflags.Match(f.Path)
+			default:
+				if load, err = f.LoadFlags(); err != nil {
+					return fmt.Errorf("compute load flags for %q: %w", f.Path, err)
+				}
+				if texture, err = f.TextureFlags(); err != nil {
+					return fmt.Errorf("compute texture flags for %q: %w", f.Path, err)
+				}
+			}
+			vf, err := w.WriteFileParallel(f.Path, fr, load, texture, max(root.Flags.Threads, 1))
+			if err != nil {
+				return err
+			}
+			var c, u uint64
+			for _, x := range vf.Chunk {
+				c += x.CompressedSize
+				u += x.UncompressedSize
+			}
+			compressed += c
+			uncompressed += u
+			if Flags.Verbose {
+				fmt.Printf("%s (%s -> %s)\n", f.Path, internal.FormatBytesSI(int64(u)), internal.FormatBytesSI(int64(c)))
+			}
+			return nil
+		})
+	}); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+
+	format := "respawn"
+	if source != 0 {
+		format = fmt.Sprintf("source%d", source)
+	}
+	fmt.Printf("converted %d files to %s (%s -> %s)\n", len(files), format, internal.FormatBytesSI(int64(uncompressed)), internal.FormatBytesSI(int64(compressed)))
+}
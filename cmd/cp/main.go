@@ -0,0 +1,140 @@
+package cp
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/signal"
+	"strings"
+
+	"github.com/pg9182/tf2vpk"
+	"github.com/pg9182/tf2vpk/cmd/root"
+	"github.com/pg9182/tf2vpk/internal"
+	"github.com/pg9182/tf2vpk/vpkutil"
+	"github.com/spf13/cobra"
+)
+
+var Flags struct {
+	VPK      tf2vpk.ValvePakRef
+	Dest     tf2vpk.ValvePakRef
+	Files    []string
+	Conflict vpkutil.ConflictPolicy
+	Block    func(tf2vpk.ValvePakRef) (tf2vpk.ValvePakIndex, error)
+	Verbose  bool
+	DryRun   bool
+}
+
+var Command = &cobra.Command{
+	GroupID: root.GroupVPKWrite.ID,
+	Use:     "cp vpk_path dst_vpk_path file...",
+	Aliases: []string{"copy"},
+	Short:   "Copies files or directories from one VPK to another without recompressing them",
+	Long: `Copies files or directories from one VPK to another without recompressing them
+
+The raw chunk data is appended to the last block of the destination VPK (or the one selected with --block or --new-block), keeping the checksums and flags, and the dir index is updated in-place. Identical chunks are only copied once. Compressed chunks are only recompressed if the codec differs from the destination one (see --codec).
+
+If a file already exists in the destination VPK, --conflict determines whether to fail, keep the existing file (first), or replace it (last). The chunks of replaced files are not removed; use the gc command to do that afterwards.
+
+The provided file can also be a directory to copy all files under it (use / to copy everything).
+`,
+	Args: cobra.MatchAll(cobra.MinimumNArgs(3), func(cmd *cobra.Command, args []string) error {
+		vpk, err := root.VPK(args[1])
+		if err != nil {
+			return fmt.Errorf("destination: %w", err)
+		}
+		Flags.Dest = vpk
+		return nil
+	}),
+	Run: func(cmd *cobra.Command, args []string) {
+		Flags.Files = args[2:]
+		main()
+	},
+}
+
+func init() {
+	root.ArgVPK(&Flags.VPK, Command, 2, true, true, true)
+	root.FlagConflict(&Flags.Conflict, Command)
+	root.FlagBlock(&Flags.Block, Command)
+	Command.Flags().BoolVarP(&Flags.DryRun, "dry-run", "n", false, "do not write changes")
+	Command.Flags().BoolVarP(&Flags.Verbose, "verbose", "v", false, "print information about each processed file")
+	root.Command.AddCommand(Command)
+}
+
+func main() {
+	if Flags.VPK.Resolve(tf2vpk.ValvePakIndexDir) == Flags.Dest.Resolve(tf2vpk.ValvePakIndexDir) {
+		fmt.Fprintf(os.Stderr, "error: source and destination vpk must be different\n")
+		os.Exit(1)
+	}
+
+	r, err := tf2vpk.NewReaderOptions(Flags.VPK, root.Flags.Options)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: open vpk: %v\n", err)
+		os.Exit(1)
+	}
+	defer r.Close()
+
+	index, err := Flags.Block(Flags.Dest)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+
+	ctx, done := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer done()
+
+	var res vpkutil.CopyResult
+	if err := vpkutil.AppendFiles(Flags.Dest, root.Flags.Options, Flags.DryRun, func(dir *tf2vpk.ValvePakDir, w *tf2vpk.Writer) error {
+		existing := make(map[string]bool, len(dir.File))
+		for _, f := range dir.File {
+			existing[f.Path] = true
+		}
+
+		var (
+			files   []vpkutil.CopyFile
+			matched = make([]bool, len(Flags.Files))
+		)
+		for _, f := range r.Root.File {
+			var match bool
+			for i, name := range Flags.Files {
+				if name == "/" || strings.HasPrefix(f.Path+"/", strings.TrimPrefix(name, "/")+"/") {
+					matched[i] = true
+					match = true
+				}
+			}
+			if !match {
+				continue
+			}
+			if existing[f.Path] {
+				if replace, err := Flags.Conflict.Replace(f.Path); err != nil {
+					return fmt.Errorf("copy %q: %w (use --conflict to choose which one to use)", f.Path, err)
+				} else if !replace {
+					if Flags.Verbose {
+						fmt.Printf("keep %s\n", f.Path)
+					}
+					continue
+				}
+				if Flags.Verbose {
+					fmt.Printf("replace %s\n", f.Path)
+				}
+			} else if Flags.Verbose {
+				fmt.Printf("copy %s\n", f.Path)
+			}
+			files = append(files, vpkutil.CopyFile{Reader: r, File: f})
+		}
+		for i, name := range Flags.Files {
+			if !matched[i] {
+				return fmt.Errorf("copy %q: %w", name, fs.ErrNotExist)
+			}
+		}
+
+		res, err = vpkutil.CopyChunks(ctx, w, index, files)
+		return err
+	}); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+	if Flags.Verbose {
+		fmt.Printf("\ncopied %d files to block %s (%s; de-duplicated %d/%d chunks, recompressed %d)\n", res.Files, index, internal.FormatBytesSI(int64(res.Size)), res.Duplicate, res.Chunks, res.Recompressed)
+	}
+}
@@ -0,0 +1,224 @@
+package diff
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/pg9182/tf2vpk"
+	"github.com/pg9182/tf2vpk/cmd/root"
+	"github.com/pg9182/tf2vpk/internal"
+	"github.com/pg9182/tf2vpk/vpkutil"
+	"github.com/spf13/cobra"
+)
+
+var Flags struct {
+	VPK            tf2vpk.ValvePakRef
+	Other          tf2vpk.ValvePakRef
+	Content        bool
+	Context        int
+	MaxSize        uint64
+	JSON           bool
+	IncludeExclude func(tf2vpk.ValvePakFile) (bool, error)
+}
+
+// TextExt contains the extensions of files which are shown as unified diffs in
+// content mode.
+var TextExt = []string{".nut", ".txt", ".cfg", ".res"}
+
+var Command = &cobra.Command{
+	GroupID: root.GroupVPKRead.ID,
+	Use:     "diff vpk_path other_vpk_path",
+	Short:   "Compares the contents of two VPKs",
+	Long: `Compares the contents of two VPKs
+
+Files are compared using the metadata in the dir index (the CRC32, uncompressed size, load/texture flags, and number of chunks), so files which only differ in where their chunks are stored are considered identical. Each added (A), removed (D), or modified (M) file is shown, along with the metadata which changed.
+
+If --content is specified, unified diffs are also shown for text files (` + strings.Join(TextExt, ", ") + `) up to --max-size bytes.
+
+Like diff(1), the exit status is 0 if the VPKs are identical, 1 if they differ, and 2 if an error occurred.
+`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		if vpk, err := root.VPK(args[1]); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(2)
+		} else {
+			Flags.Other = vpk
+		}
+		main()
+	},
+}
+
+func init() {
+	root.ArgVPK(&Flags.VPK, Command, -1, false, false, false)
+	Command.Flags().BoolVarP(&Flags.Content, "content", "c", false, "show unified diffs for text files")
+	Command.Flags().IntVarP(&Flags.Context, "unified", "U", 3, "number of lines of context to show in unified diffs")
+	Command.Flags().Uint64Var(&Flags.MaxSize, "max-size", 1<<20, "maximum uncompressed size of files to show unified diffs for")
+	Command.Flags().BoolVar(&Flags.JSON, "json", false, "output the changes as json")
+	root.FlagIncludeExclude(&Flags.IncludeExclude, Command, true)
+	root.Command.AddCommand(Command)
+}
+
+type entry struct {
+	vpkutil.DiffEntry
+	Changed []string `json:"changed,omitempty"`
+	Diff    string   `json:"diff,omitempty"`
+}
+
+func main() {
+	a, err := tf2vpk.NewReaderOptions(Flags.VPK, root.Flags.Options)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: open vpk %q: %v\n", Flags.VPK.Resolve(tf2vpk.ValvePakIndexDir), err)
+		os.Exit(2)
+	}
+	defer a.Close()
+
+	b, err := tf2vpk.NewReaderOptions(Flags.Other, root.Flags.Options)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: open vpk %q: %v\n", Flags.Other.Resolve(tf2vpk.ValvePakIndexDir), err)
+		os.Exit(2)
+	}
+	defer b.Close()
+
+	es, err := vpkutil.Diff(a.Root, b.Root, Flags.IncludeExclude)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: compare vpks: %v\n", err)
+		os.Exit(2)
+	}
+
+	aFiles, bFiles := map[string]tf2vpk.ValvePakFile{}, map[string]tf2vpk.ValvePakFile{}
+	if Flags.Content {
+		for _, f := range a.Root.File {
+			aFiles[f.Path] = f
+		}
+		for _, f := range b.Root.File {
+			bFiles[f.Path] = f
+		}
+	}
+
+	var added, removed, modified int
+	entries := make([]entry, 0, len(es))
+	for _, e := range es {
+		switch e.Kind {
+		case vpkutil.DiffAdded:
+			added++
+		case vpkutil.DiffRemoved:
+			removed++
+		case vpkutil.DiffModified:
+			modified++
+		}
+		x := entry{
+			DiffEntry: e,
+			Changed:   e.Changed(),
+		}
+		if Flags.Content && isText(e.Path) {
+			if x.Diff, err = contentDiff(a, b, aFiles[e.Path], bFiles[e.Path], e); err != nil {
+				fmt.Fprintf(os.Stderr, "error: diff %q: %v\n", e.Path, err)
+				os.Exit(2)
+			}
+		}
+		entries = append(entries, x)
+	}
+
+	if Flags.JSON {
+		e := json.NewEncoder(os.Stdout)
+		e.SetIndent("", "  ")
+		if err := e.Encode(entries); err != nil {
+			fmt.Fprintf(os.Stderr, "error: write changes: %v\n", err)
+			os.Exit(2)
+		}
+	} else {
+		for _, e := range entries {
+			switch e.Kind {
+			case vpkutil.DiffAdded:
+				fmt.Printf("A %s\n", e.Path)
+			case vpkutil.DiffRemoved:
+				fmt.Printf("D %s\n", e.Path)
+			case vpkutil.DiffModified:
+				fmt.Printf("M %s (%s)\n", e.Path, describeChanges(e.DiffEntry))
+			}
+			fmt.Print(e.Diff)
+		}
+		fmt.Fprintf(os.Stderr, "%d added, %d removed, %d modified\n", added, removed, modified)
+	}
+	if len(entries) != 0 {
+		os.Exit(1)
+	}
+}
+
+func isText(name string) bool {
+	ext := strings.ToLower(path.Ext(name))
+	for _, x := range TextExt {
+		if ext == x {
+			return true
+		}
+	}
+	return false
+}
+
+func describeChanges(e vpkutil.DiffEntry) string {
+	var s []string
+	for _, c := range e.Changed() {
+		switch c {
+		case "crc32":
+			s = append(s, fmt.Sprintf("crc32 %08X -> %08X", e.A.CRC32, e.B.CRC32))
+		case "size":
+			s = append(s, fmt.Sprintf("size %d -> %d", e.A.Size, e.B.Size))
+		case "load_flags":
+			s = append(s, fmt.Sprintf("load %032b -> %032b", e.A.LoadFlags, e.B.LoadFlags))
+		case "texture_flags":
+			s = append(s, fmt.Sprintf("texture %016b -> %016b", e.A.TextureFlags, e.B.TextureFlags))
+		case "chunks":
+			s = append(s, fmt.Sprintf("chunks %d -> %d", e.A.Chunks, e.B.Chunks))
+		}
+	}
+	return strings.Join(s, ", ")
+}
+
+func contentDiff(a, b *tf2vpk.Reader, af, bf tf2vpk.ValvePakFile, e vpkutil.DiffEntry) (string, error) {
+	aName, bName := "/dev/null", "/dev/null"
+	if e.A != nil {
+		aName = "a/" + e.Path
+	}
+	if e.B != nil {
+		bName = "b/" + e.Path
+	}
+	tooLarge := "Files " + aName + " and " + bName + " differ (larger than --max-size)\n"
+	if (e.A != nil && e.A.Size > Flags.MaxSize) || (e.B != nil && e.B.Size > Flags.MaxSize) {
+		return tooLarge, nil
+	}
+
+	var aBuf, bBuf []byte
+	if e.A != nil {
+		buf, err := readFile(a, af)
+		if err != nil {
+			return "", err
+		}
+		aBuf = buf
+	}
+	if e.B != nil {
+		buf, err := readFile(b, bf)
+		if err != nil {
+			return "", err
+		}
+		bBuf = buf
+	}
+	if uint64(len(aBuf)) > Flags.MaxSize || uint64(len(bBuf)) > Flags.MaxSize {
+		return tooLarge, nil
+	}
+	return internal.UnifiedDiff(aName, bName, string(aBuf), string(bBuf), Flags.Context), nil
+}
+
+// readFile reads up to one byte more than --max-size from f.
+func readFile(r *tf2vpk.Reader, f tf2vpk.ValvePakFile) ([]byte, error) {
+	fr, err := r.OpenFile(f)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(io.LimitReader(fr, int64(min(Flags.MaxSize, math.MaxInt64-1))+1))
+}
@@ -42,7 +42,7 @@ func init() {
 
 func main() {
 	var failed int
-	if err := vpkutil.UpdateDir(Flags.VPK, Flags.DryRun, func(root *tf2vpk.ValvePakDir) error {
+	if err := vpkutil.UpdateDirOptions(Flags.VPK, root.Flags.Options, Flags.DryRun, func(root *tf2vpk.ValvePakDir) error {
 		var errs []error
 		root.File = slices.DeleteFunc(root.File, func(f tf2vpk.ValvePakFile) bool {
 			skip, err := Flags.IncludeExclude(f)
@@ -0,0 +1,84 @@
+package gc
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/pg9182/tf2vpk"
+	"github.com/pg9182/tf2vpk/cmd/root"
+	"github.com/pg9182/tf2vpk/internal"
+	"github.com/pg9182/tf2vpk/vpkutil"
+	"github.com/spf13/cobra"
+)
+
+var Flags struct {
+	VPK    tf2vpk.ValvePakRef
+	DryRun bool
+}
+
+var Command = &cobra.Command{
+	GroupID: root.GroupVPKWrite.ID,
+	Use:     "gc vpk_path",
+	Short:   "Removes unused chunk data from VPK blocks",
+	Long: `Removes unused chunk data from VPK blocks
+
+Rewrites each block to only contain the chunk data which is still referenced by the files in the VPK (e.g., after using the rm or filter commands), and deletes blocks which aren't referenced at all. Shared chunks are preserved.
+
+Since the blocks are shared by the dir indexes for every locale prefix, all of them are updated. If they disagree about the chunk layout of a file, nothing is changed.
+
+The blocks are rewritten to temporary files, then renamed over the original ones.
+`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		main()
+	},
+}
+
+func init() {
+	root.ArgVPK(&Flags.VPK, Command, -1, false, false, false)
+	Command.Flags().BoolVarP(&Flags.DryRun, "dry-run", "n", false, "only show the amount of space which would be reclaimed")
+	root.Command.AddCommand(Command)
+}
+
+func main() {
+	blocks, err := vpkutil.GC(Flags.VPK, root.Flags.Options, Flags.DryRun)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+
+	var size, unused uint64
+	for _, b := range blocks {
+		var prefix string
+		if b.Index == tf2vpk.ValvePakIndexDir {
+			prefix = " (" + tf2vpk.JoinName(b.Prefix, Flags.VPK.Name, b.Index) + ")"
+		}
+		fmt.Printf("%s %9s %9s  %s unused%s\n", b.Index, formatBytesSIAligned(b.Size), formatBytesSIAligned(b.Unused()), formatPercent(b.Unused(), b.Size), prefix)
+		size += b.Size
+		unused += b.Unused()
+	}
+
+	var what string
+	if Flags.DryRun {
+		what = "reclaimable"
+	} else {
+		what = "reclaimed"
+	}
+	fmt.Printf("%s of %s (%s) %s\n", internal.FormatBytesSI(int64(unused)), internal.FormatBytesSI(int64(size)), strings.TrimSpace(formatPercent(unused, size)), what)
+}
+
+func formatPercent(n, d uint64) string {
+	if d == 0 {
+		return "  0.00 %"
+	}
+	return fmt.Sprintf("%6.2f %%", float64(n)/float64(d)*100)
+}
+
+func formatBytesSIAligned(b uint64) string {
+	s := internal.FormatBytesSI(int64(b))
+	if s, isB := strings.CutSuffix(s, " B"); isB {
+		return s + "  B"
+	}
+	return s
+}
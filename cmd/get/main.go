@@ -8,12 +8,16 @@ import (
 
 	"github.com/pg9182/tf2vpk"
 	"github.com/pg9182/tf2vpk/cmd/root"
+	"github.com/pg9182/tf2vpk/vpkutil"
 	"github.com/spf13/cobra"
 )
 
 var Flags struct {
-	VPK   tf2vpk.ValvePakRef
-	Files []string
+	VPK     tf2vpk.ValvePakRef
+	Files   []string
+	Offset  int64
+	Length  int64
+	Overlay func(tf2vpk.ValvePakRef) (*vpkutil.Overlay, error)
 }
 
 var Command = &cobra.Command{
@@ -21,7 +25,13 @@ var Command = &cobra.Command{
 	Use:     "get vpk_path file...",
 	Aliases: []string{"cat"},
 	Short:   "Reads files from a VPK to stdout",
-	Args:    cobra.MinimumNArgs(2),
+	Long: `Reads files from a VPK to stdout
+
+If --offset or --length is set, only the chunks containing the requested range are decompressed, and the checksum is not verified.
+
+If --all is set, files are read from whichever VPK in the directory provides them.
+`,
+	Args: cobra.MinimumNArgs(2),
 	Run: func(cmd *cobra.Command, args []string) {
 		Flags.Files = args[1:]
 		main()
@@ -30,30 +40,75 @@ var Command = &cobra.Command{
 
 func init() {
 	root.ArgVPK(&Flags.VPK, Command, 1, true, false, true)
+	Command.Flags().Int64Var(&Flags.Offset, "offset", 0, "start reading at the specified byte offset (negative to count from the end)")
+	Command.Flags().Int64Var(&Flags.Length, "length", -1, "read at most the specified number of bytes (negative for no limit)")
+	root.FlagOverlay(&Flags.Overlay, Command)
 	root.Command.AddCommand(Command)
 }
 
 func main() {
-	r, err := tf2vpk.NewReader(Flags.VPK)
+	o, err := Flags.Overlay(Flags.VPK)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "error: open vpk: %v\n", err)
+		fmt.Fprintf(os.Stderr, "error: open vpks: %v\n", err)
 		os.Exit(1)
 	}
 
+	var r *tf2vpk.Reader
+	if o == nil {
+		if r, err = tf2vpk.NewReaderOptions(Flags.VPK, root.Flags.Options); err != nil {
+			fmt.Fprintf(os.Stderr, "error: open vpk: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	find := func(name string) (*tf2vpk.Reader, tf2vpk.ValvePakFile, bool) {
+		if o != nil {
+			if x := o.Lookup(name); len(x) != 0 {
+				return x[0].Reader, x[0].File, true
+			}
+			return nil, tf2vpk.ValvePakFile{}, false
+		}
+		for _, f := range r.Root.File {
+			if f.Path == name {
+				return r, f, true
+			}
+		}
+		return nil, tf2vpk.ValvePakFile{}, false
+	}
+
 	var failed int
 	for _, name := range Flags.Files {
 		if err := func() error {
-			for _, f := range r.Root.File {
-				if f.Path == name {
-					r, err := r.OpenFileParallel(f, root.Flags.Threads)
+			if r, f, ok := find(name); ok {
+				if Flags.Offset != 0 || Flags.Length >= 0 {
+					fr, err := r.OpenFileReader(f)
 					if err != nil {
 						return err
 					}
-					if _, err := io.Copy(os.Stdout, r); err != nil {
+					off := Flags.Offset
+					if off < 0 {
+						off = max(fr.Size()+off, 0)
+					}
+					if off > fr.Size() {
+						return fmt.Errorf("offset %d is past the end of the file (size %d)", off, fr.Size())
+					}
+					n := fr.Size() - off
+					if Flags.Length >= 0 {
+						n = min(n, Flags.Length)
+					}
+					if _, err := io.Copy(os.Stdout, io.NewSectionReader(fr, off, n)); err != nil {
 						return err
 					}
 					return nil
 				}
+				r, err := r.OpenFileParallel(f, root.Flags.Threads)
+				if err != nil {
+					return err
+				}
+				if _, err := io.Copy(os.Stdout, r); err != nil {
+					return err
+				}
+				return nil
 			}
 			return fs.ErrNotExist
 		}(); err != nil {
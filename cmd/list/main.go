@@ -9,6 +9,7 @@ import (
 	"github.com/pg9182/tf2vpk"
 	"github.com/pg9182/tf2vpk/cmd/root"
 	"github.com/pg9182/tf2vpk/internal"
+	"github.com/pg9182/tf2vpk/vpkutil"
 	"github.com/spf13/cobra"
 )
 
@@ -18,7 +19,9 @@ var Flags struct {
 	HumanReadableFlags bool
 	Long               bool
 	Test               bool
+	Shadowed           bool
 	IncludeExclude     func(tf2vpk.ValvePakFile) (bool, error)
+	Overlay            func(tf2vpk.ValvePakRef) (*vpkutil.Overlay, error)
 }
 
 var Command = &cobra.Command{
@@ -27,6 +30,10 @@ var Command = &cobra.Command{
 	Short:   "Lists the contents of a VPK",
 	Args:    cobra.ExactArgs(1),
 	Aliases: []string{"ls"},
+	Long: `Lists the contents of a VPK
+
+If --all is set, the files from all VPKs in the directory are listed, with the name of the VPK providing each one as the first column. If --shadowed is also set, files shadowed by a higher-priority VPK are listed after the one which is used, with the VPK name in parentheses.
+`,
 	Run: func(cmd *cobra.Command, args []string) {
 		main()
 	},
@@ -36,27 +43,63 @@ func init() {
 	Command.Flags().Bool("help", false, "help for "+Command.Name()) // prevent the default short help flag from being set
 	Command.Flags().BoolVarP(&Flags.HumanReadable, "human-readable", "h", false, "show values in human-readable form")
 	Command.Flags().BoolVarP(&Flags.HumanReadableFlags, "human-readable-flags", "f", false, "if displaying flags, also show them in human-readable form at the very end of the line (delimited by a #)")
-	Command.Flags().BoolVarP(&Flags.Long, "long", "l", false, "show detailed file metadata (adds the following columns to the beginning: block_index load_flags[binary] texture_flags[binary] crc32[hex] compressed_size[bytes] uncompressed_size[bytes] compressed_percent)")
+	Command.Flags().BoolVarP(&Flags.Long, "long", "l", false, "show detailed file metadata (adds the following columns to the beginning: block_index load_flags[binary] texture_flags[binary] crc32[hex] preload_size[bytes] compressed_size[bytes] uncompressed_size[bytes] compressed_percent)")
 	Command.Flags().BoolVarP(&Flags.Test, "test", "t", false, "also attempt to read contents and compute checksums (adds a column with OK/ERR to the end)")
+	Command.Flags().BoolVar(&Flags.Shadowed, "shadowed", false, "with --all, also list files shadowed by higher-priority vpks")
 	root.FlagIncludeExclude(&Flags.IncludeExclude, Command, true)
+	root.FlagOverlay(&Flags.Overlay, Command)
 	root.ArgVPK(&Flags.VPK, Command, -1, false, false, false)
 	root.Command.AddCommand(Command)
 }
 
+type entry struct {
+	r   *tf2vpk.Reader
+	f   tf2vpk.ValvePakFile
+	vpk string // with --all, the providing vpk name (in parentheses if shadowed)
+}
+
 func main() {
-	r, err := tf2vpk.NewReader(Flags.VPK)
+	o, err := Flags.Overlay(Flags.VPK)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "error: open vpk: %v\n", err)
+		fmt.Fprintf(os.Stderr, "error: open vpks: %v\n", err)
 		os.Exit(1)
 	}
+	if Flags.Shadowed && o == nil {
+		fmt.Fprintf(os.Stderr, "error: --shadowed requires --all\n")
+		os.Exit(2)
+	}
 
-	var pathLen int
-	for _, f := range r.Root.File {
-		pathLen = max(pathLen, min(len(f.Path), 64))
+	var entries []entry
+	if o != nil {
+		for _, x := range o.Files() {
+			for i, y := range o.Lookup(x.File.Path) {
+				if i == 0 {
+					entries = append(entries, entry{y.Reader, y.File, y.VPK.Name})
+				} else if Flags.Shadowed {
+					entries = append(entries, entry{y.Reader, y.File, "(" + y.VPK.Name + ")"})
+				}
+			}
+		}
+	} else {
+		r, err := tf2vpk.NewReaderOptions(Flags.VPK, root.Flags.Options)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: open vpk: %v\n", err)
+			os.Exit(1)
+		}
+		for _, f := range r.Root.File {
+			entries = append(entries, entry{r, f, ""})
+		}
 	}
 
-	var testErrCount int
-	for _, f := range r.Root.File {
+	var pathLen, vpkLen int
+	for _, e := range entries {
+		pathLen = max(pathLen, min(len(e.f.Path), 64))
+		vpkLen = max(vpkLen, len(e.vpk))
+	}
+
+	var testErrCount, testCount int
+	for _, e := range entries {
+		f := e.f
 		if skip, err := Flags.IncludeExclude(f); err != nil {
 			fmt.Fprintf(os.Stderr, "error: %v\n", err)
 			os.Exit(1)
@@ -83,11 +126,14 @@ func main() {
 			uncompressed += c.UncompressedSize
 		}
 
+		if o != nil {
+			fmt.Printf("%*s  ", -vpkLen, e.vpk)
+		}
 		if Flags.Long {
 			if Flags.HumanReadable {
-				fmt.Printf("%s %032b %016b %08X %6.2f %% %9s %9s  ", f.Index, load, texture, f.CRC32, float64(compressed)/float64(uncompressed)*100, formatBytesSIAligned(int64(compressed)), formatBytesSIAligned(int64(uncompressed)))
+				fmt.Printf("%s %032b %016b %08X %5d %6.2f %% %9s %9s  ", f.Index, load, texture, f.CRC32, f.PreloadBytes, float64(compressed)/float64(uncompressed)*100, formatBytesSIAligned(int64(compressed)), formatBytesSIAligned(int64(uncompressed)))
 			} else {
-				fmt.Printf("%s %032b %016b %08X %6.2f %% %9d %9d  ", f.Index, load, texture, f.CRC32, float64(compressed)/float64(uncompressed)*100, compressed, uncompressed)
+				fmt.Printf("%s %032b %016b %08X %5d %6.2f %% %9d %9d  ", f.Index, load, texture, f.CRC32, f.PreloadBytes, float64(compressed)/float64(uncompressed)*100, compressed, uncompressed)
 			}
 		}
 		if Flags.Test || (Flags.Long && Flags.HumanReadableFlags) {
@@ -101,7 +147,8 @@ func main() {
 
 		var testErr error
 		if Flags.Test {
-			if fr, err := r.OpenFileParallel(f, root.Flags.Threads); err != nil {
+			testCount++
+			if fr, err := e.r.OpenFileParallel(f, root.Flags.Threads); err != nil {
 				testErr = err
 			} else if _, err = io.Copy(io.Discard, fr); err != nil {
 				testErr = err
@@ -124,11 +171,11 @@ func main() {
 		fmt.Printf("\n")
 
 		if Flags.Test && testErr != nil {
-			fmt.Fprintf(os.Stderr, "warning: entry %q: test: %v\n", f.Path, testErr)
+			fmt.Fprintf(os.Stderr, "warning: entry %q: test (%s): %v\n", f.Path, root.ErrorCategory(testErr), testErr)
 		}
 	}
 	if Flags.Test {
-		fmt.Fprintf(os.Stderr, "%d/%d files valid", testErrCount, len(r.Root.File))
+		fmt.Fprintf(os.Stderr, "%d/%d files valid\n", testCount-testErrCount, testCount)
 		if testErrCount != 0 {
 			os.Exit(1)
 		}
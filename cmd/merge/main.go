@@ -0,0 +1,144 @@
+package merge
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/signal"
+
+	"github.com/pg9182/tf2vpk"
+	"github.com/pg9182/tf2vpk/cmd/root"
+	"github.com/pg9182/tf2vpk/internal"
+	"github.com/pg9182/tf2vpk/vpkutil"
+	"github.com/spf13/cobra"
+)
+
+var Flags struct {
+	VPK            tf2vpk.ValvePakRef
+	Input          []tf2vpk.ValvePakRef
+	Conflict       vpkutil.ConflictPolicy
+	Force          bool
+	Verbose        bool
+	DryRun         bool
+	IncludeExclude func(tf2vpk.ValvePakFile) (bool, error)
+}
+
+var Command = &cobra.Command{
+	GroupID: root.GroupVPKRepack.ID,
+	Use:     "merge vpk_path in_vpk_path...",
+	Short:   "Merges VPKs into a new VPK without recompressing them",
+	Long: `Merges VPKs into a new VPK without recompressing them
+
+The raw chunk data of the files in each input VPK is copied to block 000 of the new VPK, keeping the checksums and flags. Identical chunks are only copied once. Compressed chunks are only recompressed if the codec differs from the destination one (see --codec).
+
+If multiple input VPKs contain the same file, --conflict determines whether to fail, or use the one from the first or last VPK it is in.
+`,
+	Args: cobra.MatchAll(cobra.MinimumNArgs(2), func(cmd *cobra.Command, args []string) error {
+		Flags.Input = Flags.Input[:0]
+		for _, arg := range args[1:] {
+			vpk, err := root.VPK(arg)
+			if err != nil {
+				return err
+			}
+			Flags.Input = append(Flags.Input, vpk)
+		}
+		return nil
+	}),
+	Run: func(cmd *cobra.Command, args []string) {
+		main()
+	},
+}
+
+func init() {
+	root.ArgVPK(&Flags.VPK, Command, -1, false, false, false)
+	root.FlagConflict(&Flags.Conflict, Command)
+	Command.Flags().BoolVarP(&Flags.Force, "force", "f", false, "overwrite the vpk if it already exists")
+	Command.Flags().BoolVarP(&Flags.DryRun, "dry-run", "n", false, "do not write the vpk")
+	Command.Flags().BoolVarP(&Flags.Verbose, "verbose", "v", false, "display progress information")
+	root.FlagIncludeExclude(&Flags.IncludeExclude, Command, true)
+	root.Command.AddCommand(Command)
+}
+
+func main() {
+	for _, vpk := range Flags.Input {
+		if vpk.Resolve(tf2vpk.ValvePakIndexDir) == Flags.VPK.Resolve(tf2vpk.ValvePakIndexDir) {
+			fmt.Fprintf(os.Stderr, "error: output vpk must not be one of the input vpks\n")
+			os.Exit(1)
+		}
+	}
+
+	if !Flags.Force && !Flags.DryRun {
+		if _, err := os.Stat(Flags.VPK.Resolve(tf2vpk.ValvePakIndexDir)); err == nil {
+			fmt.Fprintf(os.Stderr, "error: vpk %q already exists (use --force to overwrite it)\n", Flags.VPK.Resolve(tf2vpk.ValvePakIndexDir))
+			os.Exit(1)
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			fmt.Fprintf(os.Stderr, "error: check vpk: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if prefixes, err := Flags.VPK.Prefixes(); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		fmt.Fprintf(os.Stderr, "error: find vpk locales: %v\n", err)
+		os.Exit(1)
+	} else {
+		for _, prefix := range prefixes {
+			if prefix != Flags.VPK.Prefix {
+				fmt.Fprintf(os.Stderr, "error: vpk blocks are shared with the dir for prefix %q, which would be invalidated by replacing them\n", prefix)
+				os.Exit(1)
+			}
+		}
+	}
+
+	var files []vpkutil.CopyFile
+	for _, vpk := range Flags.Input {
+		r, err := tf2vpk.NewReaderOptions(vpk, root.Flags.Options)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: open vpk %q: %v\n", vpk.Resolve(tf2vpk.ValvePakIndexDir), err)
+			os.Exit(1)
+		}
+		defer r.Close()
+
+		for _, f := range r.Root.File {
+			if skip, err := Flags.IncludeExclude(f); err != nil {
+				fmt.Fprintf(os.Stderr, "error: %v\n", err)
+				os.Exit(1)
+			} else if skip {
+				if Flags.Verbose {
+					fmt.Printf("%s: %s (excluded)\n", vpk.Name, f.Path)
+				}
+				continue
+			}
+			files = append(files, vpkutil.CopyFile{Reader: r, File: f})
+		}
+	}
+
+	files, err := vpkutil.ResolveConflicts(files, Flags.Conflict)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v (use --conflict to choose which one to use)\n", err)
+		os.Exit(1)
+	}
+
+	if !Flags.DryRun && Flags.VPK.Path != "" {
+		if err := os.MkdirAll(Flags.VPK.Path, 0777); err != nil {
+			fmt.Fprintf(os.Stderr, "error: create output directory: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	ctx, done := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer done()
+
+	var res vpkutil.CopyResult
+	if _, err := vpkutil.CreateVPK(Flags.VPK, root.Flags.Options, Flags.DryRun, func(w *tf2vpk.Writer) (err error) {
+		res, err = vpkutil.CopyChunks(ctx, w, 0, files)
+		return err
+	}); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+	if Flags.Verbose {
+		fmt.Printf("merged %d files from %d vpks (%s; de-duplicated %d/%d chunks, recompressed %d)\n", res.Files, len(Flags.Input), internal.FormatBytesSI(int64(res.Size)), res.Duplicate, res.Chunks, res.Recompressed)
+	}
+}
@@ -0,0 +1,169 @@
+package optimize
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pg9182/tf2vpk"
+	"github.com/pg9182/tf2vpk/cmd/root"
+	"github.com/pg9182/tf2vpk/internal"
+	"github.com/pg9182/tf2vpk/vpkutil"
+	"github.com/spf13/cobra"
+)
+
+var Flags struct {
+	VPK            []tf2vpk.ValvePakRef
+	Output         string
+	Merge          bool
+	MergeDir       bool
+	Verbose        bool
+	DryRun         bool
+	IncludeExclude func(tf2vpk.ValvePakFile) (bool, error)
+}
+
+var Command = &cobra.Command{
+	GroupID: root.GroupVPKRepack.ID,
+	Use:     "optimize [vpk_path...]",
+	Aliases: []string{"optim"},
+	Short:   "Repacks and filters VPKs without recompressing them",
+	Long: `Repacks and filters VPKs without recompressing them
+
+Only the chunk data referenced by the (non-excluded) files is kept, and identical chunks are de-duplicated. The output is never larger than the input.
+
+The dir indexes for all locale prefixes sharing the blocks are rewritten (--merge-dir can only be used if there is a single one).
+
+If --vpk-dir is set and no vpk names are provided, all VPKs in the directory are optimized.
+`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		if len(args) == 0 {
+			if root.Flags.VPKDir == "" {
+				return fmt.Errorf("vpk path is required (or use --vpk-dir to optimize all vpks in a directory)")
+			}
+			es, err := os.ReadDir(root.Flags.VPKDir)
+			if err != nil {
+				return fmt.Errorf("find vpks: %w", err)
+			}
+			for _, e := range es {
+				if name, idx, err := tf2vpk.SplitName(e.Name(), root.Flags.VPKPrefix); err == nil && idx == tf2vpk.ValvePakIndexDir {
+					args = append(args, name)
+				}
+			}
+		}
+		for _, arg := range args {
+			vpk, err := root.VPK(arg)
+			if err != nil {
+				return err
+			}
+			Flags.VPK = append(Flags.VPK, vpk)
+		}
+		return nil
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		main()
+	},
+}
+
+func init() {
+	Command.Flags().StringVarP(&Flags.Output, "output", "o", "", "the output directory (must be different from the input dir)")
+	Command.Flags().BoolVarP(&Flags.Merge, "merge", "m", false, "merge all blocks into block 000")
+	Command.Flags().BoolVar(&Flags.MergeDir, "merge-dir", false, "merge all blocks into the dir index (implies --merge)")
+	Command.Flags().BoolVarP(&Flags.DryRun, "dry-run", "n", false, "do not write output files")
+	Command.Flags().BoolVarP(&Flags.Verbose, "verbose", "v", false, "show information about each excluded file")
+	Command.MarkFlagRequired("output")
+	root.FlagIncludeExclude(&Flags.IncludeExclude, Command, true)
+	root.Command.AddCommand(Command)
+}
+
+func main() {
+	if err := os.Mkdir(Flags.Output, 0777); err != nil && !errors.Is(err, fs.ErrExist) {
+		fmt.Fprintf(os.Stderr, "error: create output directory: %v\n", err)
+		os.Exit(1)
+	}
+
+	outputDir, err := resolveDir(Flags.Output)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: resolve output directory: %v\n", err)
+		os.Exit(1)
+	}
+
+	opt := vpkutil.OptimizeOptions{
+		Merge:   Flags.Merge || Flags.MergeDir,
+		Threads: root.Flags.Threads,
+		DryRun:  Flags.DryRun,
+		VPK:     root.Flags.Options,
+		Skip: func(f tf2vpk.ValvePakFile) (bool, error) {
+			skip, err := Flags.IncludeExclude(f)
+			if skip && Flags.Verbose {
+				fmt.Printf("--- excluding %s\n", f.Path)
+			}
+			return skip, err
+		},
+	}
+	if Flags.MergeDir {
+		opt.MergeIndex = tf2vpk.ValvePakIndexDir
+	}
+
+	ctx, done := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer done()
+
+	for _, vpk := range Flags.VPK {
+		inputDir, err := resolveDir(vpk.Path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: resolve input directory: %v\n", err)
+			os.Exit(1)
+		}
+		if inputDir == outputDir {
+			fmt.Fprintf(os.Stderr, "error: output directory must be different from the input directory\n")
+			os.Exit(1)
+		}
+
+		fmt.Printf("optimizing %s\n", vpk.Name)
+
+		res, err := vpkutil.Optimize(ctx, vpk, tf2vpk.ValvePakRef{
+			Path:   outputDir,
+			Prefix: vpk.Prefix,
+			Name:   vpk.Name,
+		}, opt)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: optimize %q: %v\n", vpk.Name, err)
+			os.Exit(1)
+		}
+
+		fmt.Printf("--- excluded %d files\n", res.Excluded)
+		fmt.Printf("--- de-duplicated %d/%d chunks\n", res.Duplicate, res.Chunks)
+		fmt.Printf("--- wrote %d block(s) (%s; delta %s)\n", len(res.Block), internal.FormatBytesSI(int64(res.OutputSize)), internal.FormatBytesSI(int64(res.OutputSize)-int64(res.InputSize)))
+		fmt.Printf("--- wrote %d vpk dir(s) (%s; %d files; delta %d)\n", len(res.Prefixes), formatPrefixes(res.Prefixes), res.Files, -res.Excluded)
+		fmt.Println()
+	}
+	if Flags.DryRun {
+		fmt.Printf("done (dry run)\n")
+	} else {
+		fmt.Printf("done\n")
+	}
+}
+
+func resolveDir(name string) (string, error) {
+	if name == "" {
+		name = "."
+	}
+	x, err := filepath.EvalSymlinks(name)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Abs(x)
+}
+
+func formatPrefixes(ps []string) string {
+	qs := make([]string, len(ps))
+	for i, p := range ps {
+		qs[i] = strconv.Quote(p)
+	}
+	return "prefix " + strings.Join(qs, ", ")
+}
@@ -0,0 +1,299 @@
+package pack
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/pg9182/tf2vpk"
+	"github.com/pg9182/tf2vpk/cmd/root"
+	"github.com/pg9182/tf2vpk/internal"
+	"github.com/pg9182/tf2vpk/vpkutil"
+	"github.com/spf13/cobra"
+)
+
+var Flags struct {
+	VPK            tf2vpk.ValvePakRef
+	Path           string
+	Force          bool
+	Verbose        bool
+	DryRun         bool
+	NoLayout       bool
+	LayoutSource   string
+	IncludeExclude func(tf2vpk.ValvePakFile) (bool, error)
+}
+
+var Command = &cobra.Command{
+	GroupID: root.GroupVPKRepack.ID,
+	Use:     "pack vpk_path in_path",
+	Short:   "Packs a directory into a new VPK",
+	Long: `Packs a directory into a new VPK
+
+The directory must contain a .vpkflags file (see the init and unpack commands), which is used to set the load/texture flags for each file. If the directory contains a .vpkignore file, matching files are not packed.
+
+If the vpk is overwritten (--force), any of its existing blocks which aren't written by the new vpk are removed.
+
+If the directory contains a .vpklayout file (see unpack --layout), unchanged files are written with their original chunk placement, reusing the original compressed chunk data from the layout source (which defaults to the vpk being replaced). If no files were changed, added, or removed, the new vpk will be identical to the original one.
+`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		Flags.Path = args[1]
+		main()
+	},
+}
+
+func init() {
+	root.ArgVPK(&Flags.VPK, Command, -1, false, false, false)
+	Command.Flags().BoolVarP(&Flags.Force, "force", "f", false, "overwrite the vpk if it already exists")
+	Command.Flags().BoolVarP(&Flags.DryRun, "dry-run", "n", false, "do not write the vpk")
+	Command.Flags().BoolVarP(&Flags.Verbose, "verbose", "v", false, "display progress information")
+	Command.Flags().BoolVar(&Flags.NoLayout, "no-layout", false, "ignore the .vpklayout file")
+	Command.Flags().StringVar(&Flags.LayoutSource, "layout-source", "", "vpk to copy the original chunk data for unchanged files from (default is the vpk being replaced, if it exists)")
+	root.FlagIncludeExclude(&Flags.IncludeExclude, Command, true)
+	root.Command.AddCommand(Command)
+}
+
+func main() {
+	var vpkflags vpkutil.VPKFlags
+	if err := vpkflags.ParseFile(filepath.Join(Flags.Path, vpkutil.VPKFlagsFilename)); err != nil {
+		fmt.Fprintf(os.Stderr, "error: read %s: %v\n", vpkutil.VPKFlagsFilename, err)
+		os.Exit(1)
+	}
+
+	var vpkignore vpkutil.VPKIgnore
+	if err := vpkignore.ParseFile(filepath.Join(Flags.Path, vpkutil.VPKIgnoreFilename)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		fmt.Fprintf(os.Stderr, "error: read %s: %v\n", vpkutil.VPKIgnoreFilename, err)
+		os.Exit(1)
+	}
+
+	var vpklayout *vpkutil.VPKLayout
+	if !Flags.NoLayout {
+		var l vpkutil.VPKLayout
+		if err := l.ParseFile(filepath.Join(Flags.Path, vpkutil.VPKLayoutFilename)); err == nil {
+			vpklayout = &l
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			fmt.Fprintf(os.Stderr, "error: read %s: %v\n", vpkutil.VPKLayoutFilename, err)
+			os.Exit(1)
+		}
+	}
+
+	// open this before the vpk may be replaced
+	var layoutSource *tf2vpk.Reader
+	if vpklayout != nil {
+		if Flags.LayoutSource != "" {
+			vpk, err := root.VPK(Flags.LayoutSource)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "error: layout source: %v\n", err)
+				os.Exit(1)
+			}
+			if layoutSource, err = tf2vpk.NewReaderOptions(vpk, root.Flags.Options); err != nil {
+				fmt.Fprintf(os.Stderr, "error: open layout source: %v\n", err)
+				os.Exit(1)
+			}
+		} else if r, err := tf2vpk.NewReaderOptions(Flags.VPK, root.Flags.Options); err == nil {
+			layoutSource = r
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			fmt.Fprintf(os.Stderr, "error: open existing vpk as layout source: %v\n", err)
+			os.Exit(1)
+		}
+		if layoutSource != nil {
+			defer layoutSource.Close()
+		}
+	}
+
+	if !Flags.Force && !Flags.DryRun {
+		if _, err := os.Stat(Flags.VPK.Resolve(tf2vpk.ValvePakIndexDir)); err == nil {
+			fmt.Fprintf(os.Stderr, "error: vpk %q already exists (use --force to overwrite it)\n", Flags.VPK.Resolve(tf2vpk.ValvePakIndexDir))
+			os.Exit(1)
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			fmt.Fprintf(os.Stderr, "error: check vpk: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if prefixes, err := Flags.VPK.Prefixes(); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		fmt.Fprintf(os.Stderr, "error: find vpk locales: %v\n", err)
+		os.Exit(1)
+	} else {
+		for _, prefix := range prefixes {
+			if prefix != Flags.VPK.Prefix {
+				fmt.Fprintf(os.Stderr, "error: vpk blocks are shared with the dir for prefix %q, which would be invalidated by repacking them\n", prefix)
+				os.Exit(1)
+			}
+		}
+	}
+
+	if !Flags.DryRun && Flags.VPK.Path != "" {
+		if err := os.MkdirAll(Flags.VPK.Path, 0777); err != nil {
+			fmt.Fprintf(os.Stderr, "error: create output directory: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	var files []string
+	if err := filepath.WalkDir(Flags.Path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(Flags.Path, p)
+		if err != nil {
+			return err
+		}
+		if rel = filepath.ToSlash(rel); rel == "." {
+			return nil
+		}
+		if rel == vpkutil.VPKFlagsFilename || rel == vpkutil.VPKIgnoreFilename || rel == vpkutil.VPKLayoutFilename || vpkignore.Match(rel) {
+			if Flags.Verbose {
+				fmt.Printf("%s (ignored)\n", rel)
+			}
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			return nil
+		}
+		if skip, err := Flags.IncludeExclude(tf2vpk.ValvePakFile{Path: rel}); err != nil {
+			return err
+		} else if skip {
+			if Flags.Verbose {
+				fmt.Printf("%s (excluded)\n", rel)
+			}
+			return nil
+		}
+		files = append(files, rel)
+		return nil
+	}); err != nil {
+		fmt.Fprintf(os.Stderr, "error: walk %q: %v\n", Flags.Path, err)
+		os.Exit(1)
+	}
+	slices.Sort(files)
+
+	var total uint64
+	removed, err := vpkutil.CreateVPK(Flags.VPK, root.Flags.Options, Flags.DryRun, func(w *tf2vpk.Writer) error {
+		var (
+			reused map[string]bool
+			order  = map[string]int{}
+			index  = map[string]tf2vpk.ValvePakIndex{}
+		)
+		if vpklayout != nil {
+			included := make(map[string]bool, len(files))
+			for _, name := range files {
+				included[name] = true
+			}
+			for i, f := range vpklayout.File {
+				order[f.Path] = i
+				index[f.Path] = f.Index
+			}
+			if Flags.Verbose {
+				fmt.Printf("... writing unchanged files using the original layout\n")
+			}
+			var err error
+			if reused, err = vpkutil.WriteLayout(w, *vpklayout, os.DirFS(Flags.Path), layoutSource, func(f vpkutil.VPKLayoutFile) bool {
+				if !included[f.Path] {
+					return false
+				}
+				load, texture := vpkflags.Match(f.Path)
+				for _, c := range f.Chunk {
+					if c.LoadFlags != load || c.TextureFlags != texture {
+						return false
+					}
+				}
+				return true
+			}); err != nil {
+				return fmt.Errorf("write unchanged files: %w", err)
+			}
+		}
+
+		for i, name := range files {
+			if reused[name] {
+				for _, c := range vpklayout.File[order[name]].Chunk {
+					total += c.CompressedSize
+				}
+				if Flags.Verbose {
+					fmt.Printf("[%4d/%4d] %s (unchanged)\n", i+1, len(files), name)
+				}
+				continue
+			}
+			if err := func() error {
+				f, err := os.Open(filepath.Join(Flags.Path, filepath.FromSlash(name)))
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+
+				if fi, err := f.Stat(); err != nil {
+					return err
+				} else if !fi.Mode().IsRegular() {
+					return fmt.Errorf("not a regular file")
+				}
+
+				if i, ok := index[name]; ok && i != tf2vpk.ValvePakIndexDir {
+					if err := w.SetIndex(i); err != nil {
+						return err
+					}
+				} else if err := w.SetIndex(0); err != nil {
+					return err
+				}
+
+				load, texture := vpkflags.Match(name)
+				vf, err := w.WriteFileParallel(name, f, load, texture, root.Flags.Threads)
+				if err != nil {
+					return err
+				}
+
+				var compressed, uncompressed uint64
+				for _, c := range vf.Chunk {
+					compressed += c.CompressedSize
+					uncompressed += c.UncompressedSize
+				}
+				total += compressed
+				if Flags.Verbose {
+					fmt.Printf("[%4d/%4d] %s (%s -> %s)\n", i+1, len(files), name, internal.FormatBytesSI(int64(uncompressed)), internal.FormatBytesSI(int64(compressed)))
+				}
+				return nil
+			}(); err != nil {
+				return fmt.Errorf("pack %q: %w", name, err)
+			}
+		}
+		if vpklayout != nil {
+			// use the original order if possible
+			slices.SortStableFunc(w.Root.File, func(a, b tf2vpk.ValvePakFile) int {
+				ai, ok := order[a.Path]
+				if !ok {
+					ai = len(order)
+				}
+				bi, ok := order[b.Path]
+				if !ok {
+					bi = len(order)
+				}
+				return cmp.Compare(ai, bi)
+			})
+			if _, err := w.Root.TreeSize(); err != nil {
+				if err := w.Root.SortFiles(); err != nil {
+					return fmt.Errorf("sort files: %w", err)
+				}
+			}
+			w.PreserveOrder()
+		}
+		return nil
+	})
+	if Flags.Verbose {
+		// we already checked that they aren't shared with another locale
+		for _, i := range removed {
+			fmt.Printf("removed unused vpk block %s\n", filepath.Base(Flags.VPK.Resolve(i)))
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+	if Flags.Verbose {
+		fmt.Printf("\npacked %d files (%s)\n", len(files), internal.FormatBytesSI(int64(total)))
+	}
+}
@@ -0,0 +1,249 @@
+package put
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/pg9182/tf2vpk"
+	"github.com/pg9182/tf2vpk/cmd/root"
+	"github.com/pg9182/tf2vpk/internal"
+	"github.com/pg9182/tf2vpk/vpkutil"
+	"github.com/spf13/cobra"
+)
+
+var PutCommand = command(false)
+var AddCommand = command(true)
+
+func command(recursive bool) *cobra.Command {
+	var main func()
+	var Flags struct {
+		VPK      tf2vpk.ValvePakRef
+		Local    string
+		Target   string
+		Flags    string
+		VPKFlags string
+		Block    func(tf2vpk.ValvePakRef) (tf2vpk.ValvePakIndex, error)
+		Verbose  bool
+		DryRun   bool
+	}
+	var Command = &cobra.Command{
+		GroupID: root.GroupVPKWrite.ID,
+		Use:     "put vpk_path local_file vpk_file",
+		Short:   "Adds or replaces a file in a VPK",
+		Long: `Adds or replaces a file in a VPK
+
+The file is compressed and appended to the last block of the VPK (or the one selected with --block or --new-block), and the dir index is updated in-place. The chunks of a replaced file are not removed; use the gc command to do that afterwards.
+
+Flags are taken from --flags (see chflg), from the rule in --vpkflags matching the path in the VPK, or from the file being replaced, in that order.
+`,
+		Args: cobra.ExactArgs(3),
+		Run: func(cmd *cobra.Command, args []string) {
+			Flags.Local = args[1]
+			Flags.Target = args[2]
+			main()
+		},
+	}
+	if recursive {
+		Command.Use = "add vpk_path local_dir [vpk_dir]"
+		Command.Short = "Adds or replaces the files in a directory in a VPK"
+		Command.Long = `Adds or replaces the files in a directory in a VPK
+
+The files are compressed and appended to the last block of the VPK (or the one selected with --block or --new-block), and the dir index is updated in-place. The chunks of replaced files are not removed; use the gc command to do that afterwards.
+
+If the directory contains a .vpkignore file, matching files are not added. Flags are taken from --flags (see chflg), from the rule in --vpkflags (default is the .vpkflags file in the directory, if it exists) matching the path in the VPK, or from the file being replaced, in that order.
+`
+		Command.Args = cobra.RangeArgs(2, 3)
+		Command.Run = func(cmd *cobra.Command, args []string) {
+			Flags.Local = args[1]
+			if len(args) > 2 {
+				Flags.Target = args[2]
+			}
+			main()
+		}
+	}
+	main = func() {
+		var vpkflags *vpkutil.VPKFlags
+		if Flags.VPKFlags != "" {
+			var v vpkutil.VPKFlags
+			if err := v.ParseFile(Flags.VPKFlags); err != nil {
+				fmt.Fprintf(os.Stderr, "error: read vpkflags: %v\n", err)
+				os.Exit(1)
+			}
+			vpkflags = &v
+		} else if recursive && Flags.Flags == "" {
+			var v vpkutil.VPKFlags
+			if err := v.ParseFile(filepath.Join(Flags.Local, vpkutil.VPKFlagsFilename)); err == nil {
+				vpkflags = &v
+			} else if !errors.Is(err, fs.ErrNotExist) {
+				fmt.Fprintf(os.Stderr, "error: read %s: %v\n", vpkutil.VPKFlagsFilename, err)
+				os.Exit(1)
+			}
+		}
+
+		var vpkignore vpkutil.VPKIgnore
+		if recursive {
+			if err := vpkignore.ParseFile(filepath.Join(Flags.Local, vpkutil.VPKIgnoreFilename)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				fmt.Fprintf(os.Stderr, "error: read %s: %v\n", vpkutil.VPKIgnoreFilename, err)
+				os.Exit(1)
+			}
+		}
+
+		// local path -> vpk path
+		var files [][2]string
+		if recursive {
+			target := strings.Trim(Flags.Target, "/")
+			if err := filepath.WalkDir(Flags.Local, func(p string, d fs.DirEntry, err error) error {
+				if err != nil {
+					return err
+				}
+				rel, err := filepath.Rel(Flags.Local, p)
+				if err != nil {
+					return err
+				}
+				if rel = filepath.ToSlash(rel); rel == "." {
+					return nil
+				}
+				if rel == vpkutil.VPKFlagsFilename || rel == vpkutil.VPKIgnoreFilename || rel == vpkutil.VPKLayoutFilename || vpkignore.Match(rel) {
+					if Flags.Verbose {
+						fmt.Printf("%s (ignored)\n", rel)
+					}
+					if d.IsDir() {
+						return filepath.SkipDir
+					}
+					return nil
+				}
+				if d.IsDir() {
+					return nil
+				}
+				files = append(files, [2]string{p, path.Join(target, rel)})
+				return nil
+			}); err != nil {
+				fmt.Fprintf(os.Stderr, "error: walk %q: %v\n", Flags.Local, err)
+				os.Exit(1)
+			}
+		} else {
+			files = append(files, [2]string{Flags.Local, strings.TrimPrefix(Flags.Target, "/")})
+		}
+		if len(files) == 0 {
+			fmt.Fprintf(os.Stderr, "error: no files to add\n")
+			os.Exit(1)
+		}
+
+		index, err := Flags.Block(Flags.VPK)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(1)
+		}
+
+		if err := vpkutil.AppendFiles(Flags.VPK, root.Flags.Options, Flags.DryRun, func(dir *tf2vpk.ValvePakDir, w *tf2vpk.Writer) error {
+			var (
+				err          error
+				hasFlags     bool
+				loadFlags    uint32
+				textureFlags uint16
+			)
+			if p, ok := strings.CutPrefix(Flags.Flags, "@"); ok {
+				for _, f := range dir.File {
+					if f.Path == strings.TrimPrefix(p, "/") {
+						if loadFlags, err = f.LoadFlags(); err != nil {
+							return fmt.Errorf("compute load flags for reference file %q: %w", p, err)
+						}
+						if textureFlags, err = f.TextureFlags(); err != nil {
+							return fmt.Errorf("compute texture flags for reference file %q: %w", p, err)
+						}
+						hasFlags = true
+						break
+					}
+				}
+				if !hasFlags {
+					return fmt.Errorf("reference file %q does not exist in vpk", p)
+				}
+			} else if Flags.Flags != "" {
+				if loadFlags, textureFlags, err = vpkutil.ParseFlags(Flags.Flags); err != nil {
+					return fmt.Errorf("invalid flags %q: %w", Flags.Flags, err)
+				}
+				hasFlags = true
+			}
+
+			existing := make(map[string]tf2vpk.ValvePakFile, len(dir.File))
+			for _, f := range dir.File {
+				existing[f.Path] = f
+			}
+
+			if err := w.SetIndex(index); err != nil {
+				return err
+			}
+			for i, x := range files {
+				local, name := x[0], x[1]
+				if err := func() error {
+					load, texture := loadFlags, textureFlags
+					orig, replace := existing[name]
+					switch {
+					case hasFlags:
+					case vpkflags != nil:
+						load, texture = vpkflags.Match(name)
+					case replace:
+						if load, err = orig.LoadFlags(); err != nil {
+							return fmt.Errorf("compute load flags of existing file: %w", err)
+						}
+						if texture, err = orig.TextureFlags(); err != nil {
+							return fmt.Errorf("compute texture flags of existing file: %w", err)
+						}
+					default:
+						return fmt.Errorf("no flags for new file (use --flags or --vpkflags)")
+					}
+
+					f, err := os.Open(local)
+					if err != nil {
+						return err
+					}
+					defer f.Close()
+
+					if fi, err := f.Stat(); err != nil {
+						return err
+					} else if !fi.Mode().IsRegular() {
+						return fmt.Errorf("not a regular file")
+					}
+
+					vf, err := w.WriteFileParallel(name, f, load, texture, root.Flags.Threads)
+					if err != nil {
+						return err
+					}
+
+					if Flags.Verbose {
+						var compressed, uncompressed uint64
+						for _, c := range vf.Chunk {
+							compressed += c.CompressedSize
+							uncompressed += c.UncompressedSize
+						}
+						what := "add"
+						if replace {
+							what = "replace"
+						}
+						fmt.Printf("[%4d/%4d] %s %s (%s -> %s) with flags 0x%08X:0x%04X in block %s\n", i+1, len(files), what, name, internal.FormatBytesSI(int64(uncompressed)), internal.FormatBytesSI(int64(compressed)), load, texture, index)
+					}
+					return nil
+				}(); err != nil {
+					return fmt.Errorf("put %q as %q: %w", local, name, err)
+				}
+			}
+			return nil
+		}); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	root.ArgVPK(&Flags.VPK, Command, 2, false, recursive, !recursive)
+	Command.Flags().StringVarP(&Flags.Flags, "flags", "F", "", "load_flags:texture_flags or @reference_file to set for the files")
+	Command.Flags().StringVar(&Flags.VPKFlags, "vpkflags", "", "vpkflags file to match paths in the vpk against for setting flags")
+	root.FlagBlock(&Flags.Block, Command)
+	Command.Flags().BoolVarP(&Flags.DryRun, "dry-run", "n", false, "do not write changes")
+	Command.Flags().BoolVarP(&Flags.Verbose, "verbose", "v", false, "print information about each processed file")
+	root.Command.AddCommand(Command)
+	return Command
+}
@@ -47,7 +47,7 @@ func init() {
 
 func main() {
 	var failed int
-	if err := vpkutil.UpdateDir(Flags.VPK, Flags.DryRun, func(root *tf2vpk.ValvePakDir) error {
+	if err := vpkutil.UpdateDirOptions(Flags.VPK, root.Flags.Options, Flags.DryRun, func(root *tf2vpk.ValvePakDir) error {
 		for _, name := range Flags.Files {
 			if err := func() error {
 				orig := len(root.File)
@@ -1,6 +1,7 @@
 package root
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -11,6 +12,7 @@ import (
 
 	"github.com/pg9182/tf2vpk"
 	"github.com/pg9182/tf2vpk/internal"
+	"github.com/pg9182/tf2vpk/vpkutil"
 	"github.com/spf13/cobra"
 )
 
@@ -18,11 +20,21 @@ var Flags struct {
 	VPKDir    string
 	VPKPrefix string
 	Threads   int
+	Options   tf2vpk.Options
 }
 
 var Command = &cobra.Command{
 	Use:   "tf2vpk",
 	Short: "Manipulates Respawn VPK archives",
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		// the library ignores invalid values
+		if v, ok := os.LookupEnv("TF2VPK_LZHAM_DECODER"); ok && !cmd.Flags().Changed("lzham-decoder") {
+			if err := (lzhamDecoderFlag{}).Set(v); err != nil {
+				fmt.Fprintf(os.Stderr, "error: invalid TF2VPK_LZHAM_DECODER: %v\n", err)
+				os.Exit(2)
+			}
+		}
+	},
 	PreRun: func(cmd *cobra.Command, args []string) {
 		if Flags.Threads < 0 {
 			Flags.Threads = 0
@@ -53,21 +65,90 @@ func init() {
 	Command.PersistentFlags().StringVar(&Flags.VPKDir, "vpk-dir", "", "set the vpk directory, and use vpk names instead of paths")
 	Command.PersistentFlags().StringVar(&Flags.VPKPrefix, "vpk-prefix", "english", "the vpk locale prefix to use")
 	Command.PersistentFlags().IntVarP(&Flags.Threads, "threads", "j", runtime.NumCPU(), "number of threads to use for decompression (-1 to disable, default is cpu count)")
+	Command.PersistentFlags().BoolVar(&Flags.Options.Lenient, "lenient", false, "disable sanity checks based on observations of the Titanfall 2 VPKs")
+	Command.PersistentFlags().BoolVar(&Flags.Options.NoCRC, "no-crc", false, "do not verify file checksums")
+	Command.PersistentFlags().IntVar(&Flags.Options.MaxFiles, "max-files", 0, "maximum number of files in a vpk dir index (0 for no limit)")
+	Command.PersistentFlags().Uint32Var(&Flags.Options.MaxTreeSize, "max-tree-size", 0, "maximum size of a vpk dir tree in bytes (0 for no limit)")
+	Command.PersistentFlags().Uint64Var(&Flags.Options.MaxChunkSize, "max-chunk-size", 0, "maximum compressed or uncompressed size of a chunk in bytes (0 for no limit)")
+	Command.PersistentFlags().Var(codecFlag{}, "codec", "the codec to use for compressed chunks ("+strings.Join(tf2vpk.Codecs(), ", ")+", or auto to detect it when reading)")
+	Command.RegisterFlagCompletionFunc("codec", func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return append(tf2vpk.Codecs(), "auto"), cobra.ShellCompDirectiveNoFileComp
+	})
+	Command.PersistentFlags().Var(lzhamDecoderFlag{}, "lzham-decoder", "the lzham decompressor to use (auto, native, tf2lzham, or diff to check native against tf2lzham)")
+	Command.RegisterFlagCompletionFunc("lzham-decoder", func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		var ds []string
+		for _, d := range tf2vpk.LZHAMDecoders() {
+			ds = append(ds, string(d))
+		}
+		return ds, cobra.ShellCompDirectiveNoFileComp
+	})
+}
+
+// codecFlag sets the codec in Flags.Options.
+type codecFlag struct{}
+
+func (codecFlag) String() string {
+	switch {
+	case Flags.Options.Codec != nil:
+		return Flags.Options.Codec.Name()
+	case Flags.Options.DetectCodec:
+		return "auto"
+	default:
+		return tf2vpk.LZHAM.Name()
+	}
+}
+
+func (codecFlag) Set(s string) error {
+	if s == "auto" {
+		Flags.Options.Codec, Flags.Options.DetectCodec = nil, true
+		return nil
+	}
+	c, ok := tf2vpk.LookupCodec(s)
+	if !ok {
+		return fmt.Errorf("unknown codec %q", s)
+	}
+	Flags.Options.Codec, Flags.Options.DetectCodec = c, false
+	return nil
+}
+
+func (codecFlag) Type() string {
+	return "codec"
+}
+
+// lzhamDecoderFlag sets the global LZHAM decoder.
+type lzhamDecoderFlag struct{}
+
+func (lzhamDecoderFlag) String() string {
+	return string(tf2vpk.GetLZHAMDecoder())
+}
+
+func (lzhamDecoderFlag) Set(s string) error {
+	return tf2vpk.SetLZHAMDecoder(tf2vpk.LZHAMDecoder(s))
+}
+
+func (lzhamDecoderFlag) Type() string {
+	return "decoder"
 }
 
 // VPK resolves the provided name to a VPK.
 func VPK(name string) (tf2vpk.ValvePakRef, error) {
+	return VPKPrefix(name, Flags.VPKPrefix)
+}
+
+// VPKPrefix is like VPK, but uses the provided locale prefix instead of the
+// one from the flags.
+func VPKPrefix(name, prefix string) (tf2vpk.ValvePakRef, error) {
 	if Flags.VPKDir != "" {
 		if name == "" {
 			return tf2vpk.ValvePakRef{}, fmt.Errorf("invalid vpk name %q", name)
 		}
 		return tf2vpk.ValvePakRef{
 			Path:   Flags.VPKDir,
-			Prefix: Flags.VPKPrefix,
+			Prefix: prefix,
 			Name:   name,
 		}, nil
 	}
-	if vpk, err := tf2vpk.PathToValvePakRef(name, Flags.VPKPrefix); err != nil {
+	if vpk, err := tf2vpk.PathToValvePakRef(name, prefix); err != nil {
 		return tf2vpk.ValvePakRef{}, fmt.Errorf("invalid vpk path %q: %w", name, err)
 	} else {
 		return vpk, nil
@@ -160,7 +241,7 @@ func ArgVPKFileCompletions(args []string, toComplete string, dirs, files bool) (
 	defer r.Close()
 
 	var root tf2vpk.ValvePakDir
-	if err := root.Deserialize(io.NewSectionReader(r, 0, 1<<63-1)); err != nil {
+	if err := root.DeserializeOptions(io.NewSectionReader(r, 0, 1<<63-1), Flags.Options); err != nil {
 		return nil, cobra.ShellCompDirectiveError
 	}
 
@@ -199,6 +280,24 @@ func ArgVPKFileCompletions(args []string, toComplete string, dirs, files bool) (
 	return cs, cobra.ShellCompDirectiveNoFileComp
 }
 
+// ErrorCategory returns a short name for the category of a tf2vpk error.
+func ErrorCategory(err error) string {
+	switch {
+	case errors.Is(err, tf2vpk.ErrChecksum):
+		return "checksum"
+	case errors.Is(err, tf2vpk.ErrDecompress):
+		return "decompress"
+	case errors.Is(err, tf2vpk.ErrSanity):
+		return "sanity"
+	case errors.Is(err, tf2vpk.ErrLimit):
+		return "limit"
+	case errors.Is(err, tf2vpk.ErrCorrupt), errors.Is(err, io.ErrUnexpectedEOF):
+		return "corrupt"
+	default:
+		return "io"
+	}
+}
+
 // FlagIncludeExclude adds --exclude and --include flags, returning a function
 // checking if a file is excluded.
 func FlagIncludeExclude(out *func(tf2vpk.ValvePakFile) (bool, error), cmd *cobra.Command, short bool) {
@@ -235,3 +334,95 @@ func FlagIncludeExclude(out *func(tf2vpk.ValvePakFile) (bool, error), cmd *cobra
 		return !included, nil
 	}
 }
+
+// FlagOverlay adds --all and --priority flags, returning a function opening the
+// VPKs in the same directory as the provided one as a [vpkutil.Overlay], or nil
+// if --all was not specified.
+func FlagOverlay(out *func(tf2vpk.ValvePakRef) (*vpkutil.Overlay, error), cmd *cobra.Command) {
+	var (
+		All      = cmd.Flags().BoolP("all", "a", false, "read from all vpks with the same prefix in the same directory as vpk_path, which has the highest priority when files are shadowed")
+		Priority = cmd.Flags().StringSlice("priority", nil, "with --all, globs matching vpk names in descending order of priority (after vpk_path, and before the rest in name order)")
+	)
+	*out = func(vpk tf2vpk.ValvePakRef) (*vpkutil.Overlay, error) {
+		if !*All {
+			if len(*Priority) != 0 {
+				return nil, fmt.Errorf("--priority requires --all")
+			}
+			return nil, nil
+		}
+		dir := vpk.Path
+		if dir == "" {
+			dir = "."
+		}
+		found, err := vpkutil.FindVPKs(dir, vpk.Prefix)
+		if err != nil {
+			return nil, fmt.Errorf("find vpks: %w", err)
+		}
+		vpks := []tf2vpk.ValvePakRef{vpk}
+		for _, glob := range append(*Priority, "*") {
+			for _, x := range found {
+				if m, err := path.Match(glob, x.Name); err != nil {
+					return nil, fmt.Errorf("match %q against priority glob %q: %w", x.Name, glob, err)
+				} else if m && !slices.ContainsFunc(vpks, func(y tf2vpk.ValvePakRef) bool { return y.Name == x.Name }) {
+					vpks = append(vpks, x)
+				}
+			}
+		}
+		return vpkutil.OpenOverlay(vpks, Flags.Options)
+	}
+}
+
+// FlagOnUnsafePath adds the --on-unsafe-path flag, which determines what to do
+// with VPK file paths which are unsafe to extract.
+func FlagOnUnsafePath(out *vpkutil.UnsafePathPolicy, cmd *cobra.Command) {
+	*out = vpkutil.UnsafePathReject
+	cmd.Flags().Var(out, "on-unsafe-path", "what to do with files with paths which are unsafe to extract (e.g., absolute, containing .., invalid on windows, or differing only in case)")
+}
+
+// FlagConflict adds the --conflict flag, which determines which file is used
+// when multiple ones have the same path.
+func FlagConflict(out *vpkutil.ConflictPolicy, cmd *cobra.Command) {
+	*out = vpkutil.ConflictReject
+	cmd.Flags().Var(out, "conflict", "what to do with files with the same path (error, or use the first or last one)")
+}
+
+// FlagBlock adds --block and --new-block flags, returning a function returning
+// the block of the provided VPK to append chunks to (the last existing one by
+// default).
+func FlagBlock(out *func(tf2vpk.ValvePakRef) (tf2vpk.ValvePakIndex, error), cmd *cobra.Command) {
+	var (
+		Block    = cmd.Flags().IntP("block", "b", -1, "block index to append chunks to (default is the last existing block)")
+		NewBlock = cmd.Flags().Bool("new-block", false, "append chunks to a new block after the last existing block")
+	)
+	cmd.MarkFlagsMutuallyExclusive("block", "new-block")
+	*out = func(vpk tf2vpk.ValvePakRef) (tf2vpk.ValvePakIndex, error) {
+		if *Block >= 0 {
+			if *Block >= int(tf2vpk.ValvePakIndexDir) {
+				return 0, fmt.Errorf("invalid block index %d", *Block)
+			}
+			return tf2vpk.ValvePakIndex(*Block), nil
+		}
+		ns, err := vpk.List()
+		if err != nil {
+			return 0, fmt.Errorf("list vpk blocks: %w", err)
+		}
+		var (
+			last  tf2vpk.ValvePakIndex
+			found bool
+		)
+		for _, n := range ns {
+			if _, idx, err := tf2vpk.SplitName(n, vpk.Prefix); err == nil && idx < tf2vpk.ValvePakIndexDir {
+				if !found || idx > last {
+					last, found = idx, true
+				}
+			}
+		}
+		if *NewBlock && found {
+			if last+1 == tf2vpk.ValvePakIndexDir {
+				return 0, fmt.Errorf("no more block indexes available")
+			}
+			return last + 1, nil
+		}
+		return last, nil
+	}
+}
@@ -0,0 +1,207 @@
+package serve
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/pg9182/tf2vpk"
+	"github.com/pg9182/tf2vpk/cmd/root"
+	"github.com/pg9182/tf2vpk/vpkutil"
+	"github.com/spf13/cobra"
+)
+
+var Flags struct {
+	VPK    []tf2vpk.ValvePakRef
+	Listen string
+}
+
+var Command = &cobra.Command{
+	GroupID: root.GroupVPKRead.ID,
+	Use:     "serve [vpk_path]",
+	Short:   "Serves the contents of VPKs over HTTP",
+	Long: `Serves the contents of VPKs over HTTP
+
+Directories are served as HTML listings, and files are served with support for range requests, using the CRC32 as the ETag. If the "meta" query parameter is present (e.g., /path/to/file?meta), JSON metadata about the file (including the block, flags, and chunks) or directory is served instead.
+
+If --vpk-dir is set and no vpk name is provided, all VPKs in the directory are served, each under a path named after the vpk. The VPKs are opened when they are first requested.
+`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		if len(args) > 1 {
+			return fmt.Errorf("at most one vpk can be served (use --vpk-dir to serve all vpks in a directory)")
+		}
+		if len(args) == 0 {
+			if root.Flags.VPKDir == "" {
+				return fmt.Errorf("vpk path is required (or use --vpk-dir to serve all vpks in a directory)")
+			}
+			es, err := os.ReadDir(root.Flags.VPKDir)
+			if err != nil {
+				return fmt.Errorf("find vpks: %w", err)
+			}
+			for _, e := range es {
+				if name, idx, err := tf2vpk.SplitName(e.Name(), root.Flags.VPKPrefix); err == nil && idx == tf2vpk.ValvePakIndexDir {
+					args = append(args, name)
+				}
+			}
+			if len(args) == 0 {
+				return fmt.Errorf("no vpks found in %q", root.Flags.VPKDir)
+			}
+		}
+		for _, arg := range args {
+			vpk, err := root.VPK(arg)
+			if err != nil {
+				return err
+			}
+			Flags.VPK = append(Flags.VPK, vpk)
+		}
+		return nil
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		main(len(args) == 0)
+	},
+}
+
+func init() {
+	Command.Flags().StringVarP(&Flags.Listen, "listen", "l", "localhost:8080", "the address to listen on")
+	root.Command.AddCommand(Command)
+}
+
+func main(multi bool) {
+	var h http.Handler
+	if multi {
+		h = newMultiHandler(Flags.VPK)
+	} else {
+		r, err := tf2vpk.NewReaderOptions(Flags.VPK[0], root.Flags.Options)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: open vpk: %v\n", err)
+			os.Exit(1)
+		}
+		defer r.Close()
+		h = vpkutil.NewHTTPHandler(r)
+	}
+
+	ln, err := net.Listen("tcp", Flags.Listen)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: listen: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stderr, "serving %d vpk(s) on http://%s/\n", len(Flags.VPK), ln.Addr())
+
+	ctx, done := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer done()
+
+	srv := &http.Server{
+		Handler: h,
+	}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		fmt.Fprintf(os.Stderr, "error: serve: %v\n", err)
+		os.Exit(1)
+	}
+	if h, ok := h.(*multiHandler); ok {
+		h.Close()
+	}
+}
+
+// multiHandler serves multiple VPKs, opening them as needed.
+type multiHandler struct {
+	name []string
+	vpk  map[string]tf2vpk.ValvePakRef
+
+	mu sync.Mutex
+	h  map[string]*vpkutil.HTTPHandler
+	r  []*tf2vpk.Reader
+}
+
+func newMultiHandler(vpks []tf2vpk.ValvePakRef) *multiHandler {
+	m := &multiHandler{
+		vpk: map[string]tf2vpk.ValvePakRef{},
+		h:   map[string]*vpkutil.HTTPHandler{},
+	}
+	for _, vpk := range vpks {
+		m.name = append(m.name, vpk.Name)
+		m.vpk[vpk.Name] = vpk
+	}
+	slices.Sort(m.name)
+	return m
+}
+
+func (m *multiHandler) handler(name string) (*vpkutil.HTTPHandler, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if h, ok := m.h[name]; ok {
+		return h, nil
+	}
+	r, err := tf2vpk.NewReaderOptions(m.vpk[name], root.Flags.Options)
+	if err != nil {
+		return nil, err
+	}
+	h := vpkutil.NewHTTPHandler(r)
+	m.h[name] = h
+	m.r = append(m.r, r)
+	return h, nil
+}
+
+func (m *multiHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if name == "" {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if r.Method == http.MethodHead {
+			return
+		}
+		io.WriteString(w, "<!DOCTYPE html>\n<meta charset=\"utf-8\">\n<meta name=\"viewport\" content=\"width=device-width\">\n<title>/</title>\n<pre>\n")
+		for _, n := range m.name {
+			fmt.Fprintf(w, "<a href=\"%s\">%s</a>\n", (&url.URL{Path: n + "/"}).String(), html.EscapeString(n+"/"))
+		}
+		io.WriteString(w, "</pre>\n")
+		return
+	}
+	if _, ok := m.vpk[name]; !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if !strings.HasPrefix(strings.TrimPrefix(r.URL.Path, "/"), name+"/") {
+		w.Header().Set("Location", (&url.URL{Path: name + "/", RawQuery: r.URL.RawQuery}).String())
+		w.WriteHeader(http.StatusMovedPermanently)
+		return
+	}
+	h, err := m.handler(name)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("open vpk: %v", err), http.StatusInternalServerError)
+		return
+	}
+	r2 := *r
+	r2.URL = new(url.URL)
+	*r2.URL = *r.URL
+	r2.URL.Path = "/" + rest
+	r2.URL.RawPath = ""
+	h.ServeHTTP(w, &r2)
+}
+
+func (m *multiHandler) Close() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, r := range m.r {
+		r.Close()
+	}
+}
@@ -0,0 +1,204 @@
+package split
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+
+	"github.com/pg9182/tf2vpk"
+	"github.com/pg9182/tf2vpk/cmd/root"
+	"github.com/pg9182/tf2vpk/internal"
+	"github.com/pg9182/tf2vpk/vpkutil"
+	"github.com/spf13/cobra"
+)
+
+var Flags struct {
+	VPK       tf2vpk.ValvePakRef
+	Output    string
+	Rule      []string
+	Remainder string
+	Report    string
+	Force     bool
+	Verbose   bool
+	DryRun    bool
+}
+
+var Command = &cobra.Command{
+	GroupID: root.GroupVPKRepack.ID,
+	Use:     "split vpk_path",
+	Short:   "Splits a VPK into multiple VPKs without recompressing them",
+	Long: `Splits a VPK into multiple VPKs without recompressing them
+
+Each rule is specified as name=glob[,glob...], and files matching one of the globs (or under a directory matching one) are written to the VPK with that name in the output directory. Files are assigned to the first matching rule, and files which don't match any rule are written to the remainder VPK (which has the same name as the input VPK by default).
+
+The raw chunk data is copied to block 000 of each new VPK, keeping the checksums and flags. Identical chunks are only copied once per VPK. VPKs which would be empty are not written.
+`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		main()
+	},
+}
+
+func init() {
+	root.ArgVPK(&Flags.VPK, Command, -1, false, false, false)
+	Command.Flags().StringVarP(&Flags.Output, "output", "o", "", "the output directory")
+	Command.Flags().StringArrayVarP(&Flags.Rule, "rule", "r", nil, "name=glob[,glob...] to write matching files to the vpk with the specified name (can be specified multiple times)")
+	Command.Flags().StringVar(&Flags.Remainder, "remainder", "", "name of the vpk for files not matching any rule (default is the input vpk name)")
+	Command.Flags().StringVar(&Flags.Report, "report", "", "write the name of the vpk each file was written to to the specified file (- for stdout)")
+	Command.Flags().BoolVarP(&Flags.Force, "force", "f", false, "overwrite the output vpks if they already exist")
+	Command.Flags().BoolVarP(&Flags.DryRun, "dry-run", "n", false, "do not write the output vpks")
+	Command.Flags().BoolVarP(&Flags.Verbose, "verbose", "v", false, "display progress information")
+	Command.MarkFlagRequired("output")
+	Command.MarkFlagRequired("rule")
+	root.Command.AddCommand(Command)
+}
+
+func main() {
+	var rules []vpkutil.SplitRule
+	for _, x := range Flags.Rule {
+		rule, err := vpkutil.ParseSplitRule(x)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(2)
+		}
+		rules = append(rules, rule)
+	}
+	if Flags.Remainder == "" {
+		Flags.Remainder = Flags.VPK.Name
+	}
+	rules = append(rules, vpkutil.SplitRule{Name: Flags.Remainder}) // matches everything
+
+	outputs := make([]tf2vpk.ValvePakRef, len(rules))
+	for i, rule := range rules {
+		if strings.ContainsAny(rule.Name, `/\`) {
+			fmt.Fprintf(os.Stderr, "error: invalid vpk name %q\n", rule.Name)
+			os.Exit(2)
+		}
+		for _, o := range outputs[:i] {
+			if o.Name == rule.Name {
+				fmt.Fprintf(os.Stderr, "error: duplicate output vpk %q (note that the remainder vpk is %q)\n", rule.Name, Flags.Remainder)
+				os.Exit(2)
+			}
+		}
+		outputs[i] = tf2vpk.ValvePakRef{
+			Path:   Flags.Output,
+			Prefix: Flags.VPK.Prefix,
+			Name:   rule.Name,
+		}
+	}
+
+	input, err := filepath.Abs(Flags.VPK.Resolve(tf2vpk.ValvePakIndexDir))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: resolve input vpk: %v\n", err)
+		os.Exit(1)
+	}
+	for _, vpk := range outputs {
+		if x, err := filepath.Abs(vpk.Resolve(tf2vpk.ValvePakIndexDir)); err != nil {
+			fmt.Fprintf(os.Stderr, "error: resolve output vpk: %v\n", err)
+			os.Exit(1)
+		} else if x == input {
+			fmt.Fprintf(os.Stderr, "error: output vpk %q must not replace the input vpk\n", vpk.Name)
+			os.Exit(1)
+		}
+	}
+
+	r, err := tf2vpk.NewReaderOptions(Flags.VPK, root.Flags.Options)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: open vpk: %v\n", err)
+		os.Exit(1)
+	}
+	defer r.Close()
+
+	files := make([][]vpkutil.CopyFile, len(rules))
+	for _, f := range r.Root.File {
+		i, err := vpkutil.MatchSplitRules(rules, f.Path)
+		if err == nil && i == -1 {
+			err = fmt.Errorf("no rule matches %q", f.Path)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(1)
+		}
+		files[i] = append(files[i], vpkutil.CopyFile{Reader: r, File: f})
+	}
+
+	for i, vpk := range outputs {
+		if len(files[i]) == 0 {
+			continue
+		}
+		if !Flags.Force && !Flags.DryRun {
+			if _, err := os.Stat(vpk.Resolve(tf2vpk.ValvePakIndexDir)); err == nil {
+				fmt.Fprintf(os.Stderr, "error: vpk %q already exists (use --force to overwrite it)\n", vpk.Resolve(tf2vpk.ValvePakIndexDir))
+				os.Exit(1)
+			} else if !errors.Is(err, fs.ErrNotExist) {
+				fmt.Fprintf(os.Stderr, "error: check vpk: %v\n", err)
+				os.Exit(1)
+			}
+		}
+		if prefixes, err := vpk.Prefixes(); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			fmt.Fprintf(os.Stderr, "error: find vpk locales: %v\n", err)
+			os.Exit(1)
+		} else {
+			for _, prefix := range prefixes {
+				if prefix != vpk.Prefix {
+					fmt.Fprintf(os.Stderr, "error: blocks of vpk %q are shared with the dir for prefix %q, which would be invalidated by replacing them\n", vpk.Name, prefix)
+					os.Exit(1)
+				}
+			}
+		}
+	}
+
+	if !Flags.DryRun {
+		if err := os.MkdirAll(Flags.Output, 0777); err != nil {
+			fmt.Fprintf(os.Stderr, "error: create output directory: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	ctx, done := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer done()
+
+	for i, vpk := range outputs {
+		if len(files[i]) == 0 {
+			fmt.Printf("%s: no files (not written)\n", vpk.Name)
+			continue
+		}
+		var res vpkutil.CopyResult
+		if _, err := vpkutil.CreateVPK(vpk, root.Flags.Options, Flags.DryRun, func(w *tf2vpk.Writer) (err error) {
+			res, err = vpkutil.CopyChunks(ctx, w, 0, files[i])
+			return err
+		}); err != nil {
+			fmt.Fprintf(os.Stderr, "error: write vpk %q: %v\n", vpk.Name, err)
+			os.Exit(1)
+		}
+		fmt.Printf("%s: %d files (%s; de-duplicated %d/%d chunks, recompressed %d)\n", vpk.Name, res.Files, internal.FormatBytesSI(int64(res.Size)), res.Duplicate, res.Chunks, res.Recompressed)
+		if Flags.Verbose {
+			for _, f := range files[i] {
+				fmt.Printf("--- %s\n", f.File.Path)
+			}
+		}
+	}
+
+	if Flags.Report != "" {
+		var b strings.Builder
+		for i, vpk := range outputs {
+			for _, f := range files[i] {
+				b.WriteString(vpk.Name)
+				b.WriteByte('\t')
+				b.WriteString(f.File.Path)
+				b.WriteByte('\n')
+			}
+		}
+		if Flags.Report == "-" {
+			fmt.Print(b.String())
+		} else if err := os.WriteFile(Flags.Report, []byte(b.String()), 0666); err != nil {
+			fmt.Fprintf(os.Stderr, "error: write report: %v\n", err)
+			os.Exit(1)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package stats
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/pg9182/tf2vpk"
+	"github.com/pg9182/tf2vpk/cmd/root"
+	"github.com/pg9182/tf2vpk/internal"
+	"github.com/pg9182/tf2vpk/vpkutil"
+	"github.com/spf13/cobra"
+)
+
+var Flags struct {
+	VPK  tf2vpk.ValvePakRef
+	JSON bool
+}
+
+var Command = &cobra.Command{
+	GroupID: root.GroupVPKRead.ID,
+	Use:     "stats vpk_path",
+	Short:   "Shows statistics about VPK space usage",
+	Long: `Shows statistics about VPK space usage
+
+For each block (and all of them combined), shows the amount of unused space, the size of the distinct chunks by compression and by the number of files referencing them, and the size of the files by top-level directory and by extension.
+
+Blocks which exist but aren't referenced by the dir (see the gc command) are shown as completely unused.
+
+Sizes are shown as compressed/uncompressed, followed by the compressed percentage. Since chunks can be shared between files, the total size of the files may be larger than the size of the chunks.
+`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		main()
+	},
+}
+
+func init() {
+	root.ArgVPK(&Flags.VPK, Command, -1, false, false, false)
+	Command.Flags().BoolVar(&Flags.JSON, "json", false, "output the statistics as json")
+	root.Command.AddCommand(Command)
+}
+
+func main() {
+	r, err := tf2vpk.NewReaderOptions(Flags.VPK, root.Flags.Options)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: open vpk: %v\n", err)
+		os.Exit(1)
+	}
+	defer r.Close()
+
+	s, err := vpkutil.ComputeStatsVPK(Flags.VPK, r)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: compute stats: %v\n", err)
+		os.Exit(1)
+	}
+
+	if Flags.JSON {
+		e := json.NewEncoder(os.Stdout)
+		e.SetIndent("", "  ")
+		if err := e.Encode(s); err != nil {
+			fmt.Fprintf(os.Stderr, "error: write stats: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	for _, b := range s.Blocks {
+		printBlock(b)
+		fmt.Println()
+	}
+	printBlock(s.Total)
+	fmt.Println()
+	printLine(0, "vpk index", fmt.Sprintf("%9s", formatBytesSIAligned(int64(s.DirSize))))
+}
+
+func printBlock(b vpkutil.StatsBlock) {
+	if b.Unreferenced {
+		printLine(0, b.Block+" (unreferenced)", fmt.Sprintf("%9s", formatBytesSIAligned(int64(b.Size))))
+		printLine(1, "unused", fmt.Sprintf("%9s %9s  %s", formatBytesSIAligned(int64(b.Unused)), "", formatPercent(b.Unused, b.Size)))
+		return
+	}
+	printLine(0, b.Block, fmt.Sprintf("%9s", formatBytesSIAligned(int64(b.Size))))
+	printLine(1, "chunks", "")
+	printLine(2, "unused", fmt.Sprintf("%9s %9s  %s", formatBytesSIAligned(int64(b.Unused)), "", formatPercent(b.Unused, b.Size)))
+	printSize(2, "used", b.Chunks)
+	printLine(3, "by compression", "")
+	printSize(4, "compressed", b.ChunksCompressed)
+	printSize(4, "stored", b.ChunksStored)
+	printLine(3, "by reuse", "")
+	reuse := make([]int, 0, len(b.ChunksByReuse))
+	for n := range b.ChunksByReuse {
+		reuse = append(reuse, n)
+	}
+	slices.Sort(reuse)
+	slices.Reverse(reuse)
+	for _, n := range reuse {
+		if n == 1 {
+			printSize(4, "1 file", b.ChunksByReuse[n])
+		} else {
+			printSize(4, strconv.Itoa(n)+" files", b.ChunksByReuse[n])
+		}
+	}
+	printLine(1, "files", "")
+	printSize(2, "files", b.Files)
+	printLine(3, "by top dir", "")
+	printSizes(4, b.FilesByDir)
+	printLine(3, "by extension", "")
+	printSizes(4, b.FilesByExt)
+}
+
+func printSizes(depth int, m map[string]vpkutil.StatsSize) {
+	ks := make([]string, 0, len(m))
+	for k := range m {
+		ks = append(ks, k)
+	}
+	slices.Sort(ks)
+	for _, k := range ks {
+		if k == "" {
+			printSize(depth, "(none)", m[k])
+		} else {
+			printSize(depth, k, m[k])
+		}
+	}
+}
+
+func printSize(depth int, label string, s vpkutil.StatsSize) {
+	printLine(depth, label+" ("+strconv.Itoa(s.Count)+")", fmt.Sprintf("%9s %9s  %s", formatBytesSIAligned(int64(s.Compressed)), formatBytesSIAligned(int64(s.Uncompressed)), formatPercent(s.Compressed, s.Uncompressed)))
+}
+
+func printLine(depth int, label, value string) {
+	if value == "" {
+		fmt.Printf("%s%s\n", strings.Repeat("  ", depth), label)
+	} else {
+		fmt.Printf("%-32s %s\n", strings.Repeat("  ", depth)+label, value)
+	}
+}
+
+func formatPercent(a, b uint64) string {
+	if b == 0 {
+		return "  0.00 %"
+	}
+	return fmt.Sprintf("%6.2f %%", float64(a)/float64(b)*100)
+}
+
+func formatBytesSIAligned(b int64) string {
+	s := internal.FormatBytesSI(b)
+	s, isB := strings.CutSuffix(s, " B")
+	if isB {
+		s += "  B"
+	}
+	return s
+}
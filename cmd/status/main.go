@@ -0,0 +1,135 @@
+package status
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/pg9182/tf2vpk"
+	"github.com/pg9182/tf2vpk/cmd/root"
+	"github.com/pg9182/tf2vpk/vpkutil"
+	"github.com/spf13/cobra"
+)
+
+var Flags struct {
+	VPK            tf2vpk.ValvePakRef
+	Path           string
+	JSON           bool
+	IncludeExclude func(tf2vpk.ValvePakFile) (bool, error)
+}
+
+var Command = &cobra.Command{
+	GroupID: root.GroupVPKRepack.ID,
+	Use:     "status vpk_path dir",
+	Aliases: []string{"st"},
+	Short:   "Shows the changes in an unpacked directory compared to its VPK",
+	Long: `Shows the changes in an unpacked directory compared to its VPK
+
+Files matching the .vpkignore in the directory are treated as if they didn't exist. Files are compared by their size and CRC32, and, if the directory contains a .vpkflags, the flags it yields for them. Each added (A), deleted (D), or modified (M) file is shown, along with files where only the flags changed (F).
+
+Like diff(1), the exit status is 0 if there are no changes, 1 if there are changes, and 2 if an error occurred.
+`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		Flags.Path = args[1]
+		main()
+	},
+}
+
+func init() {
+	root.ArgVPK(&Flags.VPK, Command, -1, false, false, false)
+	Command.Flags().BoolVar(&Flags.JSON, "json", false, "output the changes as json")
+	root.FlagIncludeExclude(&Flags.IncludeExclude, Command, true)
+	root.Command.AddCommand(Command)
+}
+
+type entry struct {
+	vpkutil.StatusEntry
+	Changed []string `json:"changed,omitempty"`
+}
+
+func main() {
+	r, err := tf2vpk.NewReaderOptions(Flags.VPK, root.Flags.Options)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: open vpk: %v\n", err)
+		os.Exit(2)
+	}
+	defer r.Close()
+
+	if fi, err := os.Stat(Flags.Path); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(2)
+	} else if !fi.IsDir() {
+		fmt.Fprintf(os.Stderr, "error: %q is not a directory\n", Flags.Path)
+		os.Exit(2)
+	}
+
+	es, err := vpkutil.Status(r.Root, os.DirFS(Flags.Path), Flags.IncludeExclude)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: compare directory: %v\n", err)
+		os.Exit(2)
+	}
+
+	var added, deleted, modified, flags int
+	entries := make([]entry, 0, len(es))
+	for _, e := range es {
+		switch e.Kind {
+		case vpkutil.StatusAdded:
+			added++
+		case vpkutil.StatusDeleted:
+			deleted++
+		case vpkutil.StatusModified:
+			modified++
+		case vpkutil.StatusFlags:
+			flags++
+		}
+		entries = append(entries, entry{
+			StatusEntry: e,
+			Changed:     e.Changed(),
+		})
+	}
+
+	if Flags.JSON {
+		e := json.NewEncoder(os.Stdout)
+		e.SetIndent("", "  ")
+		if err := e.Encode(entries); err != nil {
+			fmt.Fprintf(os.Stderr, "error: write changes: %v\n", err)
+			os.Exit(2)
+		}
+	} else {
+		for _, e := range entries {
+			switch e.Kind {
+			case vpkutil.StatusAdded:
+				fmt.Printf("A %s\n", e.Path)
+			case vpkutil.StatusDeleted:
+				fmt.Printf("D %s\n", e.Path)
+			case vpkutil.StatusModified:
+				fmt.Printf("M %s (%s)\n", e.Path, describeChanges(e.StatusEntry))
+			case vpkutil.StatusFlags:
+				fmt.Printf("F %s (%s)\n", e.Path, describeChanges(e.StatusEntry))
+			}
+		}
+		fmt.Fprintf(os.Stderr, "%d added, %d deleted, %d modified, %d with changed flags\n", added, deleted, modified, flags)
+	}
+	if len(entries) != 0 {
+		os.Exit(1)
+	}
+}
+
+func describeChanges(e vpkutil.StatusEntry) string {
+	var s []string
+	for _, c := range e.Changed() {
+		switch c {
+		case "crc32":
+			s = append(s, fmt.Sprintf("crc32 %08X -> %08X", e.VPK.CRC32, e.Local.CRC32))
+		case "size":
+			s = append(s, fmt.Sprintf("size %d -> %d", e.VPK.Size, e.Local.Size))
+		case "load_flags":
+			s = append(s, fmt.Sprintf("load %032b -> %032b", e.VPK.LoadFlags, e.Local.LoadFlags))
+		case "texture_flags":
+			s = append(s, fmt.Sprintf("texture %016b -> %016b", e.VPK.TextureFlags, e.Local.TextureFlags))
+		}
+	}
+	return strings.Join(s, ", ")
+}
@@ -11,6 +11,7 @@ import (
 
 	"github.com/pg9182/tf2vpk"
 	"github.com/pg9182/tf2vpk/cmd/root"
+	"github.com/pg9182/tf2vpk/vpkutil"
 	"github.com/spf13/cobra"
 )
 
@@ -26,12 +27,18 @@ func command(format string) *cobra.Command {
 		Chunks         bool
 		RawChunks      bool
 		Verbose        bool
+		Overlay        func(tf2vpk.ValvePakRef) (*vpkutil.Overlay, error)
+		OnUnsafePath   vpkutil.UnsafePathPolicy
 	}
 	var Command = &cobra.Command{
 		GroupID: root.GroupVPKRead.ID,
 		Use:     format + " vpk_path",
 		Short:   "Streams the contents of VPK as a " + format + " archive",
-		Args:    cobra.ExactArgs(1),
+		Long: "Streams the contents of VPK as a " + format + ` archive
+
+If --all is set, the files from all VPKs in the directory are archived, using the copy from the highest-priority VPK for shadowed files.
+`,
+		Args: cobra.ExactArgs(1),
 		Run: func(cmd *cobra.Command, args []string) {
 			main()
 		},
@@ -42,13 +49,33 @@ func command(format string) *cobra.Command {
 			os.Exit(2)
 		}
 
-		r, err := tf2vpk.NewReader(Flags.VPK)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "error: open vpk: %v\n", err)
+		type entry struct {
+			r *tf2vpk.Reader
+			f tf2vpk.ValvePakFile
+		}
+		var entries []entry
+		if o, err := Flags.Overlay(Flags.VPK); err != nil {
+			fmt.Fprintf(os.Stderr, "error: open vpks: %v\n", err)
 			os.Exit(1)
+		} else if o != nil {
+			for _, x := range o.Files() {
+				entries = append(entries, entry{x.Reader, x.File})
+			}
+		} else {
+			r, err := tf2vpk.NewReaderOptions(Flags.VPK, root.Flags.Options)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "error: open vpk: %v\n", err)
+				os.Exit(1)
+			}
+			for _, f := range r.Root.File {
+				entries = append(entries, entry{r, f})
+			}
 		}
 
-		var w *os.File
+		var (
+			w   *os.File
+			err error
+		)
 		switch Flags.Output {
 		case "":
 			fmt.Fprintf(os.Stderr, "error: no output file specified\n")
@@ -117,58 +144,89 @@ func command(format string) *cobra.Command {
 		default:
 			panic("wtf")
 		}
-		for _, f := range r.Root.File {
-			if skip, err := Flags.IncludeExclude(f); err != nil {
+		var (
+			readers   []*tf2vpk.Reader
+			files     = map[*tf2vpk.Reader][]tf2vpk.ValvePakFile{}
+			sanitizer = vpkutil.NewPathSanitizer(Flags.OnUnsafePath)
+		)
+		for _, e := range entries {
+			if skip, err := Flags.IncludeExclude(e.f); err != nil {
 				fmt.Fprintf(os.Stderr, "error: %v\n", err)
 				os.Exit(1)
 			} else if skip {
 				if Flags.Verbose {
-					fmt.Fprintf(os.Stderr, "%s (skipped)\n", f.Path)
+					fmt.Fprintf(os.Stderr, "%s (skipped)\n", e.f.Path)
+				}
+				continue
+			}
+			if safe, err := sanitizer.Sanitize(e.f.Path); err != nil {
+				fmt.Fprintf(os.Stderr, "error: %v\n", err)
+				os.Exit(1)
+			} else if safe == "" {
+				if Flags.Verbose {
+					fmt.Fprintf(os.Stderr, "%s (skipped unsafe path)\n", e.f.Path)
 				}
 				continue
+			} else if safe != e.f.Path {
+				if Flags.Verbose {
+					fmt.Fprintf(os.Stderr, "%s (renamed unsafe path to %q)\n", e.f.Path, safe)
+				}
+				e.f.Path = safe
 			}
-			if Flags.Verbose {
-				fmt.Fprintf(os.Stderr, "%s\n", f.Path)
+			if _, ok := files[e.r]; !ok {
+				readers = append(readers, e.r)
 			}
+			files[e.r] = append(files[e.r], e.f)
+		}
+		for _, r := range readers {
 			if Flags.Chunks {
-				for i, c := range f.Chunk {
-					var (
-						ext string
-						sz  uint64
-						cr  io.Reader
-						err error
-					)
-					if Flags.RawChunks {
-						if c.IsCompressed() {
-							ext = ".lzham"
-						}
-						sz = c.CompressedSize
-						cr, err = r.OpenChunkRaw(f, c)
-					} else {
-						sz = c.UncompressedSize
-						cr, err = r.OpenChunk(f, c)
+				for _, f := range files[r] {
+					if Flags.Verbose {
+						fmt.Fprintf(os.Stderr, "%s\n", f.Path)
 					}
-					if err != nil {
-						fmt.Fprintf(os.Stderr, "error: read vpk file %q: chunk %d: %v\n", f.Path, i, err)
-						os.Exit(1)
-					}
-					if err = archive(f.Path+"/"+strconv.Itoa(i)+ext, int64(sz), cr); err != nil {
-						fmt.Fprintf(os.Stderr, "error: process vpk file %q: chunk %d: %v\n", f.Path, i, err)
-						os.Exit(1)
+					for i, c := range f.Chunk {
+						var (
+							ext string
+							sz  uint64
+							cr  io.Reader
+							err error
+						)
+						if Flags.RawChunks {
+							if c.IsCompressed() {
+								ext = "." + r.Codec().Name()
+							}
+							sz = c.CompressedSize
+							cr, err = r.OpenChunkRaw(f, c)
+						} else {
+							sz = c.UncompressedSize
+							cr, err = r.OpenChunk(f, c)
+						}
+						if err != nil {
+							fmt.Fprintf(os.Stderr, "error: read vpk file %q: chunk %d: %v\n", f.Path, i, err)
+							os.Exit(1)
+						}
+						if err = archive(f.Path+"/"+strconv.Itoa(i)+ext, int64(sz), cr); err != nil {
+							fmt.Fprintf(os.Stderr, "error: process vpk file %q: chunk %d: %v\n", f.Path, i, err)
+							os.Exit(1)
+						}
 					}
 				}
-			} else {
-				var sz uint64
-				for _, c := range f.Chunk {
-					sz += c.UncompressedSize
+				continue
+			}
+			// files are archived in the order they are stored in the vpk
+			if err := r.Extract(files[r], tf2vpk.ExtractOptions{
+				Threads: max(root.Flags.Threads, 1),
+			}, func(f tf2vpk.ValvePakFile, fr io.Reader) error {
+				if Flags.Verbose {
+					fmt.Fprintf(os.Stderr, "%s\n", f.Path)
 				}
-				if fr, err := r.OpenFileParallel(f, root.Flags.Threads); err != nil {
-					fmt.Fprintf(os.Stderr, "error: read vpk file %q: %v\n", f.Path, err)
-					os.Exit(1)
-				} else if err = archive(f.Path, int64(sz), fr); err != nil {
-					fmt.Fprintf(os.Stderr, "error: process vpk file %q: %v\n", f.Path, err)
-					os.Exit(1)
+				if err := archive(f.Path, int64(f.Size()), fr); err != nil {
+					return fmt.Errorf("process vpk file %q: %w", f.Path, err)
 				}
+				return nil
+			}); err != nil {
+				fmt.Fprintf(os.Stderr, "error: %v\n", err)
+				os.Exit(1)
 			}
 		}
 		if err := finish(); err != nil {
@@ -184,6 +242,8 @@ func command(format string) *cobra.Command {
 	{
 		root.ArgVPK(&Flags.VPK, Command, -1, false, false, false)
 		root.FlagIncludeExclude(&Flags.IncludeExclude, Command, true)
+		root.FlagOverlay(&Flags.Overlay, Command)
+		root.FlagOnUnsafePath(&Flags.OnUnsafePath, Command)
 		Command.Flags().StringVarP(&Flags.Output, "output", "o", "-", "write the archive to a file")
 		Command.Flags().BoolVarP(&Flags.Chunks, "chunks", "c", false, "instead of assembling files, make each file a dir, and output the raw chunks as numbered files within")
 		Command.Flags().BoolVarP(&Flags.RawChunks, "raw-chunks", "C", false, "do not decompress compressed chunks (requires --chunks)")
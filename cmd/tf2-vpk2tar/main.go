@@ -22,10 +22,15 @@ var (
 	Threads = pflag.IntP("threads", "j", runtime.NumCPU(), "The number of decompression threads to use (0 to only decompress chunks as they are read) (defaults to the number of cores)")
 
 	IncludeExclude = vpkutil.NewCLIIncludeExclude(pflag.CommandLine)
+	OnUnsafePath   = vpkutil.UnsafePathReject
 
 	Help = pflag.BoolP("help", "h", false, "Show this help message")
 )
 
+func init() {
+	pflag.Var(&OnUnsafePath, "on-unsafe-path", "What to do with files with paths which are unsafe to extract (e.g., absolute, containing .., invalid on Windows, or differing only in case)")
+}
+
 func main() {
 	pflag.Parse()
 
@@ -75,6 +80,8 @@ func main() {
 		tw = tar.NewWriter(w)
 	}
 
+	sanitizer := vpkutil.NewPathSanitizer(OnUnsafePath)
+
 	for _, f := range r.Root.File {
 		if skip, err := IncludeExclude.Skip(f); err != nil {
 			fmt.Fprintf(os.Stderr, "error: %v\n", err)
@@ -82,10 +89,21 @@ func main() {
 		} else if skip {
 			continue
 		}
-		var sz uint64
-		for _, c := range f.Chunk {
-			sz += c.UncompressedSize
+		name := f.Path
+		if !*Test {
+			if safe, err := sanitizer.Sanitize(f.Path); err != nil {
+				fmt.Fprintf(os.Stderr, "error: %v\n", err)
+				os.Exit(1)
+			} else if safe == "" {
+				if *Verbose {
+					fmt.Fprintf(os.Stderr, "%s (skipped unsafe path)\n", f.Path)
+				}
+				continue
+			} else {
+				name = safe
+			}
 		}
+		sz := f.Size()
 		if *Verbose {
 			fmt.Fprintf(os.Stderr, "%s\n", f.Path)
 		}
@@ -98,7 +116,7 @@ func main() {
 			_, err = io.Copy(io.Discard, fr)
 		} else {
 			if err = tw.WriteHeader(&tar.Header{
-				Name:    f.Path,
+				Name:    name,
 				Size:    int64(sz),
 				Mode:    0666,
 				ModTime: time.Now(),
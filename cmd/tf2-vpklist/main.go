@@ -21,7 +21,6 @@ var (
 	HumanReadableFlags = pflag.BoolP("human-readable-flags", "f", false, "If displaying flags, also show them in human-readable form at the very end of the line (delimited by a #)")
 	Long               = pflag.BoolP("long", "l", false, "Show detailed file metadata (adds the following columns to the beginning: block_index load_flags[binary] texture_flags[binary] crc32[hex] compressed_size[bytes] uncompressed_size[bytes] compressed_percent)")
 	Test               = pflag.BoolP("test", "t", false, "Also attempt to read contents and compute checksums (adds a column with OK/ERR to the end)")
-	//Stats = pflag.BoolP("stats", "s", false, "Show detailed statistics about vpk space utilization")
 
 	Threads = pflag.IntP("threads", "j", runtime.NumCPU(), "The number of decompression threads to use while verifying checksums (0 to only decompress chunks as they are read) (defaults to the number of cores)")
 
@@ -132,8 +131,6 @@ func main() {
 			fmt.Fprintf(os.Stderr, "warning: entry %q: test: %v\n", f.Path, testErr)
 		}
 	}
-	// if *Stats {
-	// }
 	if *Test {
 		fmt.Fprintf(os.Stderr, "%d/%d files valid", testErrCount, len(r.Root.File))
 		if testErrCount != 0 {
@@ -142,45 +139,6 @@ func main() {
 	}
 }
 
-// TODO: stats, something like:
-//     blocks (#)                 #/# MB [%] uncompressed
-//
-//       001                      #/# MB [%] uncompressed
-//         chunks
-//           unused               #/# MB [%] uncompressed
-//           used (#)             #/# MB [%] uncompressed
-//             by compression
-//               compressed (#)   #/# MB [%] uncompressed
-//               uncompressed (#) # MB
-//             by reuse
-//               2 files (#)      #/# MB [%] uncompressed
-//               1 file (#)       #/# MB [%] uncompressed
-//         files
-//           files (#)            #/# MB [%] uncompressed
-//             by top dir
-//               dir (#)          #/# MB [%] uncompressed
-//             by extension
-//               ext (#)          #/# MB [%] uncompressed
-//
-//       all                      #/# MB [%] uncompressed
-//         chunks
-//           unused               #/# MB [%] uncompressed
-//           used (#)             #/# MB [%] uncompressed
-//             by compression
-//               compressed (#)   #/# MB [%] uncompressed
-//               uncompressed (#) # MB
-//             by reuse
-//               2 files (#)      #/# MB [%] uncompressed
-//               1 file (#)       #/# MB [%] uncompressed
-//         files
-//           files (#)            #/# MB [%] uncompressed
-//             by top dir
-//               dir (#)          #/# MB [%] uncompressed
-//             by extension
-//               ext (#)          #/# MB [%] uncompressed
-//
-//     vpk index                    # MB
-
 func formatBytesSIAligned(b int64) string {
 	s := internal.FormatBytesSI(b)
 	s, isB := strings.CutSuffix(s, " B")
@@ -10,7 +10,9 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"strings"
 
+	"github.com/pg9182/tf2vpk"
 	"github.com/pg9182/tf2vpk/internal"
 	"github.com/pg9182/tf2vpk/vpkutil"
 	"github.com/spf13/pflag"
@@ -24,10 +26,15 @@ var (
 	Threads          = pflag.IntP("threads", "j", runtime.NumCPU(), "The number of decompression threads to use while verifying checksums (0 to only decompress chunks as they are read) (defaults to the number of cores)")
 
 	IncludeExclude = vpkutil.NewCLIIncludeExclude(pflag.CommandLine)
+	OnUnsafePath   = vpkutil.UnsafePathReject
 
 	Help = pflag.Bool("help", false, "Show this help message")
 )
 
+func init() {
+	pflag.Var(&OnUnsafePath, "on-unsafe-path", "What to do with files with paths which are unsafe to extract (e.g., absolute, containing .., invalid on Windows, or differing only in case)")
+}
+
 func main() {
 	pflag.Parse()
 
@@ -132,8 +139,13 @@ func main() {
 
 	fmt.Println()
 
-	var excludedCount int
+	var excludedCount, skippedCount, renamedCount int
 	if r != nil {
+		sanitizer := vpkutil.NewPathSanitizer(OnUnsafePath)
+		sanitizer.Reserve(".vpkflags")
+		sanitizer.Reserve(".vpkignore")
+
+		var files []tf2vpk.ValvePakFile
 		for i, f := range r.Root.File {
 			if skip, err := IncludeExclude.Skip(f); err != nil {
 				fmt.Fprintf(os.Stderr, "error: %v\n", err)
@@ -143,59 +155,75 @@ func main() {
 				fmt.Printf("[%4d/%4d] %s (excluded)\n", i+1, len(r.Root.File), f.Path)
 				continue
 			}
-
-			var uncompressed uint64
-			for _, c := range f.Chunk {
-				uncompressed += c.UncompressedSize
+			if safe, err := sanitizer.Sanitize(f.Path); err != nil {
+				fmt.Fprintf(os.Stderr, "error: %v\n", err)
+				os.Exit(1)
+			} else if safe == "" {
+				skippedCount++
+				fmt.Printf("[%4d/%4d] %s (skipped unsafe path)\n", i+1, len(r.Root.File), f.Path)
+				continue
+			} else if safe != f.Path {
+				renamedCount++
+				fmt.Printf("[%4d/%4d] %s (renamed unsafe path to %q)\n", i+1, len(r.Root.File), f.Path, safe)
+				f.Path = safe
 			}
-			fmt.Printf("[%4d/%4d] %s (%s)\n", i+1, len(r.Root.File), f.Path, internal.FormatBytesSI(int64(uncompressed)))
+			files = append(files, f)
+		}
+
+		var n int
+		if err := r.Extract(files, tf2vpk.ExtractOptions{
+			Threads: max(*Threads, 1),
+		}, func(f tf2vpk.ValvePakFile, fr io.Reader) error {
+			n++
+
+			fmt.Printf("[%4d/%4d] %s (%s)\n", n, len(files), f.Path, internal.FormatBytesSI(int64(f.Size())))
 
 			outPath := filepath.Join(vpkOut, filepath.FromSlash(f.Path))
 
 			if err := os.MkdirAll(filepath.Dir(outPath), 0777); err != nil {
-				fmt.Fprintf(os.Stderr, "error: create %q: %v\n", outPath, err)
-				os.Exit(1)
+				return fmt.Errorf("create %q: %w", outPath, err)
 			}
 
 			tf, err := os.CreateTemp(vpkOut, ".vpk*")
 			if err != nil {
-				fmt.Fprintf(os.Stderr, "error: create temp file: %v\n", err)
-				os.Exit(1)
+				return fmt.Errorf("create temp file: %w", err)
 			}
 			defer tf.Close()
 
-			fr, err := r.OpenFileParallel(f, *Threads)
-			if err != nil {
-				os.Remove(tf.Name())
-				fmt.Fprintf(os.Stderr, "error: read vpk file %q: %v\n", f.Path, err)
-				os.Exit(1)
-			}
-
 			if _, err := io.Copy(tf, fr); err != nil {
 				os.Remove(tf.Name())
-				fmt.Fprintf(os.Stderr, "error: extract vpk file %q: %v\n", f.Path, err)
-				os.Exit(1)
+				return fmt.Errorf("extract vpk file %q: %w", f.Path, err)
 			}
 
 			if err := tf.Close(); err != nil {
 				os.Remove(tf.Name())
-				fmt.Fprintf(os.Stderr, "error: extract vpk file %q: %v\n", f.Path, err)
-				os.Exit(1)
+				return fmt.Errorf("extract vpk file %q: %w", f.Path, err)
 			}
 
 			if err := os.Rename(tf.Name(), outPath); err != nil {
-				fmt.Fprintf(os.Stderr, "error: extract vpk file %q: rename temp file: %v\n", f.Path, err)
-				os.Exit(1)
+				return fmt.Errorf("extract vpk file %q: rename temp file: %w", f.Path, err)
 			}
-
-			// TODO: maybe extract files in parallel instead of using a parallel reader, might be faster for small files
+			return nil
+		}); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(1)
 		}
 	}
 
 	fmt.Println()
 
+	var notes []string
 	if excludedCount != 0 {
-		fmt.Printf("success (%d files excluded by command-line filter)\n", excludedCount)
+		notes = append(notes, fmt.Sprintf("%d files excluded by command-line filter", excludedCount))
+	}
+	if skippedCount != 0 {
+		notes = append(notes, fmt.Sprintf("%d files with unsafe paths skipped", skippedCount))
+	}
+	if renamedCount != 0 {
+		notes = append(notes, fmt.Sprintf("%d files with unsafe paths renamed", renamedCount))
+	}
+	if len(notes) != 0 {
+		fmt.Printf("success (%s)\n", strings.Join(notes, ", "))
 	} else {
 		fmt.Printf("success\n")
 	}
@@ -7,6 +7,7 @@ import (
 	"io/fs"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/pg9182/tf2vpk"
 	"github.com/pg9182/tf2vpk/cmd/root"
@@ -21,8 +22,10 @@ var Flags struct {
 	Force            bool
 	VPKFlagsExplicit bool
 	VPKIgnoreEmpty   bool
+	VPKLayout        bool
 	Verbose          bool
 	IncludeExclude   func(tf2vpk.ValvePakFile) (bool, error)
+	OnUnsafePath     vpkutil.UnsafePathPolicy
 }
 
 var Command = &cobra.Command{
@@ -40,9 +43,11 @@ func init() {
 	root.ArgVPK(&Flags.VPK, Command, -1, false, false, false)
 	Command.Flags().BoolVarP(&Flags.VPKFlagsExplicit, "explicit-vpkflags", "x", false, "do not compute inherited vpkflags; generate one line for each file")
 	Command.Flags().BoolVar(&Flags.VPKIgnoreEmpty, "empty-vpkignore", false, "do not add default vpkignore entires")
+	Command.Flags().BoolVarP(&Flags.VPKLayout, "layout", "l", false, "generate a .vpklayout file so pack can reproduce the original vpk exactly if files are unchanged")
 	Command.Flags().BoolVarP(&Flags.Verbose, "verbose", "v", false, "display progress information")
 	Command.Flags().BoolVarP(&Flags.Force, "force", "f", false, "allow extracting over existing non-empty folder") // TODO: merge vpkflags
 	root.FlagIncludeExclude(&Flags.IncludeExclude, Command, true)
+	root.FlagOnUnsafePath(&Flags.OnUnsafePath, Command)
 	root.Command.AddCommand(Command)
 }
 
@@ -51,7 +56,7 @@ func main() {
 		fmt.Printf("unpacking vpk to %q\n", Flags.Path)
 	}
 
-	r, err := tf2vpk.NewReader(Flags.VPK)
+	r, err := tf2vpk.NewReaderOptions(Flags.VPK, root.Flags.Options)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "error: open vpk: %v\n", err)
 		os.Exit(1)
@@ -97,6 +102,17 @@ func main() {
 		os.Exit(1)
 	}
 
+	var vpklayout vpkutil.VPKLayout
+	if Flags.VPKLayout {
+		if Flags.Verbose {
+			fmt.Printf("... generating .vpklayout\n")
+		}
+		if err := vpklayout.Generate(r, max(root.Flags.Threads, 1)); err != nil {
+			fmt.Fprintf(os.Stderr, "error: generate vpklayout: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
 	if Flags.Verbose {
 		fmt.Printf("... creating output directory\n")
 	}
@@ -139,10 +155,30 @@ func main() {
 		os.Exit(1)
 	}
 
+	if Flags.VPKLayout {
+		if Flags.Verbose {
+			fmt.Printf("... saving .vpklayout\n")
+		}
+		if err := os.WriteFile(filepath.Join(Flags.Path, vpkutil.VPKLayoutFilename), []byte(vpklayout.String()), 0666); err != nil {
+			fmt.Fprintf(os.Stderr, "error: write .vpklayout: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
 	if Flags.Verbose {
 		fmt.Println()
 	}
-	var excludedCount int
+	sanitizer := vpkutil.NewPathSanitizer(Flags.OnUnsafePath)
+	sanitizer.Reserve(".vpkflags")
+	sanitizer.Reserve(".vpkignore")
+	sanitizer.Reserve(vpkutil.VPKLayoutFilename)
+
+	var (
+		excludedCount int
+		skippedCount  int
+		renamedCount  int
+		files         []tf2vpk.ValvePakFile
+	)
 	for i, f := range r.Root.File {
 		if skip, err := Flags.IncludeExclude(f); err != nil {
 			fmt.Fprintf(os.Stderr, "error: %v\n", err)
@@ -154,58 +190,79 @@ func main() {
 			}
 			continue
 		}
-
-		var uncompressed uint64
-		for _, c := range f.Chunk {
-			uncompressed += c.UncompressedSize
+		if safe, err := sanitizer.Sanitize(f.Path); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(1)
+		} else if safe == "" {
+			skippedCount++
+			if Flags.Verbose {
+				fmt.Printf("[%4d/%4d] %s (skipped unsafe path)\n", i+1, len(r.Root.File), f.Path)
+			}
+			continue
+		} else if safe != f.Path {
+			renamedCount++
+			if Flags.Verbose {
+				fmt.Printf("[%4d/%4d] %s (renamed unsafe path to %q)\n", i+1, len(r.Root.File), f.Path, safe)
+			}
+			f.Path = safe
 		}
+		files = append(files, f)
+	}
+
+	// files are extracted in the order they are stored in the vpk
+	var n int
+	if err := r.Extract(files, tf2vpk.ExtractOptions{
+		Threads: max(root.Flags.Threads, 1),
+	}, func(f tf2vpk.ValvePakFile, fr io.Reader) error {
+		n++
+
 		if Flags.Verbose {
-			fmt.Printf("[%4d/%4d] %s (%s)\n", i+1, len(r.Root.File), f.Path, internal.FormatBytesSI(int64(uncompressed)))
+			fmt.Printf("[%4d/%4d] %s (%s)\n", n, len(files), f.Path, internal.FormatBytesSI(int64(f.Size())))
 		}
 
 		outPath := filepath.Join(Flags.Path, filepath.FromSlash(f.Path))
 
 		if err := os.MkdirAll(filepath.Dir(outPath), 0777); err != nil {
-			fmt.Fprintf(os.Stderr, "error: create %q: %v\n", outPath, err)
-			os.Exit(1)
+			return fmt.Errorf("create %q: %w", outPath, err)
 		}
 
 		tf, err := os.CreateTemp(Flags.Path, ".vpk*")
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "error: create temp file: %v\n", err)
-			os.Exit(1)
+			return fmt.Errorf("create temp file: %w", err)
 		}
 		defer tf.Close()
 
-		fr, err := r.OpenFileParallel(f, root.Flags.Threads)
-		if err != nil {
-			os.Remove(tf.Name())
-			fmt.Fprintf(os.Stderr, "error: read vpk file %q: %v\n", f.Path, err)
-			os.Exit(1)
-		}
-
 		if _, err := io.Copy(tf, fr); err != nil {
 			os.Remove(tf.Name())
-			fmt.Fprintf(os.Stderr, "error: extract vpk file %q: %v\n", f.Path, err)
-			os.Exit(1)
+			return fmt.Errorf("extract vpk file %q: %w", f.Path, err)
 		}
 
 		if err := tf.Close(); err != nil {
 			os.Remove(tf.Name())
-			fmt.Fprintf(os.Stderr, "error: extract vpk file %q: %v\n", f.Path, err)
-			os.Exit(1)
+			return fmt.Errorf("extract vpk file %q: %w", f.Path, err)
 		}
 
 		if err := os.Rename(tf.Name(), outPath); err != nil {
-			fmt.Fprintf(os.Stderr, "error: extract vpk file %q: rename temp file: %v\n", f.Path, err)
-			os.Exit(1)
+			return fmt.Errorf("extract vpk file %q: rename temp file: %w", f.Path, err)
 		}
-
-		// TODO: maybe extract files in parallel instead of using a parallel reader, might be faster for small files
+		return nil
+	}); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
 	}
 	if Flags.Verbose {
+		var notes []string
 		if excludedCount != 0 {
-			fmt.Printf("\nsuccess (%d files excluded by command-line filter)\n", excludedCount)
+			notes = append(notes, fmt.Sprintf("%d files excluded by command-line filter", excludedCount))
+		}
+		if skippedCount != 0 {
+			notes = append(notes, fmt.Sprintf("%d files with unsafe paths skipped", skippedCount))
+		}
+		if renamedCount != 0 {
+			notes = append(notes, fmt.Sprintf("%d files with unsafe paths renamed", renamedCount))
+		}
+		if len(notes) != 0 {
+			fmt.Printf("\nsuccess (%s)\n", strings.Join(notes, ", "))
 		} else {
 			fmt.Printf("\nsuccess\n")
 		}
@@ -0,0 +1,118 @@
+package update
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/pg9182/tf2vpk"
+	"github.com/pg9182/tf2vpk/cmd/root"
+	"github.com/pg9182/tf2vpk/internal"
+	"github.com/pg9182/tf2vpk/vpkutil"
+	"github.com/spf13/cobra"
+)
+
+var Flags struct {
+	VPK            tf2vpk.ValvePakRef
+	Path           string
+	Compact        bool
+	Verbose        bool
+	DryRun         bool
+	Block          func(tf2vpk.ValvePakRef) (tf2vpk.ValvePakIndex, error)
+	IncludeExclude func(tf2vpk.ValvePakFile) (bool, error)
+}
+
+var Command = &cobra.Command{
+	GroupID: root.GroupVPKRepack.ID,
+	Use:     "update vpk_path in_path",
+	Short:   "Updates a VPK in-place from a modified unpacked directory",
+	Long: `Updates a VPK in-place from a modified unpacked directory
+
+The directory must contain a .vpkflags file (see the init and unpack commands), which is used to set the load/texture flags for each file. If the directory contains a .vpkignore file, matching files are treated as if they didn't exist.
+
+Changed files are found like the status command. Only added and modified files are compressed, and their chunks are appended to the last block of the VPK (or the one selected with --block or --new-block). Deleted files are removed from the dir index, and the flags of files where only the flags changed are updated. The chunks of unchanged files are reused as-is.
+
+The chunks of replaced and deleted files are not removed unless --compact is specified, in which case the gc command is run afterwards.
+`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		Flags.Path = args[1]
+		main()
+	},
+}
+
+func init() {
+	root.ArgVPK(&Flags.VPK, Command, -1, false, false, false)
+	Command.Flags().BoolVarP(&Flags.Compact, "compact", "c", false, "remove unused chunk data from the vpk blocks afterwards")
+	Command.Flags().BoolVarP(&Flags.DryRun, "dry-run", "n", false, "do not write changes")
+	Command.Flags().BoolVarP(&Flags.Verbose, "verbose", "v", false, "print information about each changed file")
+	root.FlagBlock(&Flags.Block, Command)
+	root.FlagIncludeExclude(&Flags.IncludeExclude, Command, true)
+	root.Command.AddCommand(Command)
+}
+
+func main() {
+	if _, err := os.Stat(filepath.Join(Flags.Path, vpkutil.VPKFlagsFilename)); err != nil {
+		fmt.Fprintf(os.Stderr, "error: read %s: %v\n", vpkutil.VPKFlagsFilename, err)
+		os.Exit(1)
+	}
+
+	index, err := Flags.Block(Flags.VPK)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+
+	res, err := vpkutil.Update(Flags.VPK, os.DirFS(Flags.Path), vpkutil.UpdateOptions{
+		Index:   index,
+		Skip:    Flags.IncludeExclude,
+		Threads: root.Flags.Threads,
+		DryRun:  Flags.DryRun,
+		Progress: func(e vpkutil.StatusEntry, f *tf2vpk.ValvePakFile) {
+			if !Flags.Verbose {
+				return
+			}
+			switch e.Kind {
+			case vpkutil.StatusDeleted:
+				fmt.Printf("D %s\n", e.Path)
+			case vpkutil.StatusFlags:
+				fmt.Printf("F %s (flags 0x%08X:0x%04X -> 0x%08X:0x%04X)\n", e.Path, e.VPK.LoadFlags, e.VPK.TextureFlags, e.Local.LoadFlags, e.Local.TextureFlags)
+			case vpkutil.StatusAdded, vpkutil.StatusModified:
+				var compressed, uncompressed uint64
+				for _, c := range f.Chunk {
+					compressed += c.CompressedSize
+					uncompressed += c.UncompressedSize
+				}
+				if e.Kind == vpkutil.StatusAdded {
+					fmt.Printf("A %s (%s -> %s)\n", e.Path, internal.FormatBytesSI(int64(uncompressed)), internal.FormatBytesSI(int64(compressed)))
+				} else {
+					fmt.Printf("M %s (%s -> %s)\n", e.Path, internal.FormatBytesSI(int64(uncompressed)), internal.FormatBytesSI(int64(compressed)))
+				}
+			}
+		},
+		VPK: root.Flags.Options,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("%d added, %d deleted, %d modified, %d with changed flags (wrote %s to block %s)\n", res.Added, res.Deleted, res.Modified, res.Flags, internal.FormatBytesSI(int64(res.Written)), index)
+
+	if Flags.Compact {
+		if Flags.DryRun {
+			// the unused space can't be computed without actually updating it
+			fmt.Printf("would compact vpk\n")
+			return
+		}
+		blocks, err := vpkutil.GC(Flags.VPK, root.Flags.Options, false)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: compact: %v\n", err)
+			os.Exit(1)
+		}
+		var unused uint64
+		for _, b := range blocks {
+			unused += b.Unused()
+		}
+		fmt.Printf("compacted vpk (removed %s of unused chunk data)\n", internal.FormatBytesSI(int64(unused)))
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"slices"
+	"strings"
 
 	"github.com/pg9182/tf2vpk"
 	"github.com/pg9182/tf2vpk/cmd/root"
@@ -19,7 +21,11 @@ var Command = &cobra.Command{
 	GroupID: root.GroupVPKRead.ID,
 	Use:     "verify vpk_path",
 	Short:   "Verifies the contents of a VPK",
-	Args:    cobra.ExactArgs(1),
+	Long: `Verifies the contents of a VPK
+
+Each failure is reported with its category (checksum, decompress, sanity, limit, corrupt, or io).
+`,
+	Args: cobra.ExactArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
 		main()
 	},
@@ -32,40 +38,45 @@ func init() {
 }
 
 func main() {
-	r, err := tf2vpk.NewReader(Flags.VPK)
+	r, err := tf2vpk.NewReaderOptions(Flags.VPK, root.Flags.Options)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "error: open vpk: %v\n", err)
 		os.Exit(1)
 	}
 
 	var failure int
-	for _, f := range r.Root.File {
+	category := map[string]int{}
+	if err := r.Extract(r.Root.File, tf2vpk.ExtractOptions{
+		Threads: max(root.Flags.Threads, 1),
+	}, func(f tf2vpk.ValvePakFile, fr io.Reader) error {
 		if Flags.Verbose {
 			fmt.Printf("%s: ", f.Path)
 			os.Stderr.Sync()
 		}
-		if err := func() error {
-			r, err := r.OpenFileParallel(f, root.Flags.Threads)
-			if err != nil {
-				return err
-			}
-			if _, err := io.Copy(io.Discard, r); err != nil {
-				return err
-			}
-			return nil
-		}(); err != nil {
+		if _, err := io.Copy(io.Discard, fr); err != nil {
 			if Flags.Verbose {
 				fmt.Printf("ERROR\n")
 			}
-			fmt.Fprintf(os.Stderr, "%s: ERROR - %v\n", f.Path, err)
+			fmt.Fprintf(os.Stderr, "%s: ERROR (%s) - %v\n", f.Path, root.ErrorCategory(err), err)
+			category[root.ErrorCategory(err)]++
 			failure++
 		} else {
 			if Flags.Verbose {
 				fmt.Printf("OK\n")
 			}
 		}
+		return nil
+	}); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
 	}
 	if failure != 0 {
+		var cs []string
+		for c, n := range category {
+			cs = append(cs, fmt.Sprintf("%d %s", n, c))
+		}
+		slices.Sort(cs)
+		fmt.Fprintf(os.Stderr, "%d/%d files failed (%s)\n", failure, len(r.Root.File), strings.Join(cs, ", "))
 		os.Exit(1)
 	}
 }
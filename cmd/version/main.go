@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"github.com/pg9182/tf2lzham"
+	"github.com/pg9182/tf2vpk"
 	"github.com/pg9182/tf2vpk/cmd/root"
 	"github.com/spf13/cobra"
 )
@@ -105,4 +106,10 @@ func main() {
 		version += " (native)"
 	}
 	fmt.Println(version)
+
+	version = "lzham decoder " + string(tf2vpk.GetLZHAMDecoder().Resolve())
+	if d := tf2vpk.GetLZHAMDecoder(); d == tf2vpk.LZHAMDecoderAuto {
+		version += " (" + string(d) + ")"
+	}
+	fmt.Println(version)
 }
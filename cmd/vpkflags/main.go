@@ -32,7 +32,7 @@ func init() {
 }
 
 func main() {
-	r, err := tf2vpk.NewReader(Flags.VPK)
+	r, err := tf2vpk.NewReaderOptions(Flags.VPK, root.Flags.Options)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "error: open vpk: %v\n", err)
 		os.Exit(1)
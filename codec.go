@@ -0,0 +1,285 @@
+package tf2vpk
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pg9182/tf2lzham"
+	"github.com/pg9182/tf2vpk/internal/lzham"
+)
+
+// Codec compresses and decompresses chunk data. A chunk is treated as
+// compressed if its compressed and uncompressed sizes differ.
+type Codec interface {
+	// Name returns the name the codec is registered as.
+	Name() string
+
+	// Compress compresses src into dst, returning the number of bytes written.
+	// An error matching io.ErrShortBuffer must be returned if dst is too small.
+	Compress(dst, src []byte) (int, error)
+
+	// Decompress decompresses src into dst, returning the number of bytes
+	// written. An error matching io.ErrShortBuffer must be returned if dst is
+	// too small.
+	Decompress(dst, src []byte) (int, error)
+}
+
+// CodecDetector is implemented by codecs which can recognize their compressed
+// data. It is used when Options.DetectCodec is set.
+type CodecDetector interface {
+	Codec
+
+	// Detect checks if src, the raw contents of a compressed chunk, looks like
+	// it was compressed with the codec.
+	Detect(src []byte) bool
+}
+
+var (
+	codecsMu sync.RWMutex
+	codecs   = map[string]Codec{}
+)
+
+// Built-in codecs.
+var (
+	LZHAM Codec = lzhamCodec{} // used by Titanfall 2 (the default)
+	Zlib  Codec = zlibCodec{}  // pure-Go, mostly for testing
+)
+
+func init() {
+	RegisterCodec(LZHAM)
+	RegisterCodec(Zlib)
+}
+
+// LZHAMDecoder is an implementation used by the LZHAM codec to decompress
+// chunks.
+type LZHAMDecoder string
+
+const (
+	LZHAMDecoderAuto     LZHAMDecoder = "auto"     // native if tf2lzham is using WebAssembly, tf2lzham otherwise
+	LZHAMDecoderNative   LZHAMDecoder = "native"   // pure-Go port of the LZHAM decompressor
+	LZHAMDecoderTF2LZHAM LZHAMDecoder = "tf2lzham" // github.com/pg9182/tf2lzham (cgo or WebAssembly)
+	LZHAMDecoderDiff     LZHAMDecoder = "diff"     // both, failing if the results differ (for testing)
+)
+
+// LZHAMDecoders returns the valid LZHAMDecoder values.
+func LZHAMDecoders() []LZHAMDecoder {
+	return []LZHAMDecoder{LZHAMDecoderAuto, LZHAMDecoderNative, LZHAMDecoderTF2LZHAM, LZHAMDecoderDiff}
+}
+
+// Resolve returns the implementation which will be used for d.
+func (d LZHAMDecoder) Resolve() LZHAMDecoder {
+	if d == LZHAMDecoderAuto {
+		if tf2lzham.WebAssembly {
+			return LZHAMDecoderNative
+		}
+		return LZHAMDecoderTF2LZHAM
+	}
+	return d
+}
+
+var lzhamDecoder atomic.Value // LZHAMDecoder
+
+func init() {
+	lzhamDecoder.Store(LZHAMDecoderAuto)
+	if v, ok := os.LookupEnv("TF2VPK_LZHAM_DECODER"); ok {
+		SetLZHAMDecoder(LZHAMDecoder(v)) // invalid values are ignored
+	}
+}
+
+// SetLZHAMDecoder sets the implementation used by the LZHAM codec to decompress
+// chunks. It is safe to call concurrently with decompression. The initial value
+// is taken from the TF2VPK_LZHAM_DECODER environment variable if set and valid
+// (otherwise it is LZHAMDecoderAuto), which is useful for running tests with
+// LZHAMDecoderDiff.
+func SetLZHAMDecoder(d LZHAMDecoder) error {
+	if !slices.Contains(LZHAMDecoders(), d) {
+		return fmt.Errorf("unknown lzham decoder %q", d)
+	}
+	lzhamDecoder.Store(d)
+	return nil
+}
+
+// GetLZHAMDecoder returns the implementation set by SetLZHAMDecoder.
+func GetLZHAMDecoder() LZHAMDecoder {
+	return lzhamDecoder.Load().(LZHAMDecoder)
+}
+
+// RegisterCodec makes a codec available by name. It panics if a codec with the
+// same name is already registered.
+func RegisterCodec(c Codec) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+
+	if _, dup := codecs[c.Name()]; dup {
+		panic("tf2vpk: RegisterCodec called twice for codec " + c.Name())
+	}
+	codecs[c.Name()] = c
+}
+
+// LookupCodec returns the registered codec with the provided name.
+func LookupCodec(name string) (Codec, bool) {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+
+	c, ok := codecs[name]
+	return c, ok
+}
+
+// Codecs returns the sorted names of the registered codecs.
+func Codecs() []string {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+
+	names := make([]string, 0, len(codecs))
+	for name := range codecs {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// DetectCodec returns the first registered codec (by name) which recognizes
+// src, or nil if none do.
+func DetectCodec(src []byte) Codec {
+	for _, name := range Codecs() {
+		if c, ok := LookupCodec(name); ok {
+			if d, ok := c.(CodecDetector); ok && d.Detect(src) {
+				return c
+			}
+		}
+	}
+	return nil
+}
+
+// codec returns the codec to use for chunks.
+func (opt Options) codec() Codec {
+	if opt.Codec == nil {
+		return LZHAM
+	}
+	return opt.Codec
+}
+
+type lzhamCodec struct{}
+
+func (lzhamCodec) Name() string {
+	return "lzham"
+}
+
+func (lzhamCodec) Compress(dst, src []byte) (int, error) {
+	n, _, _, err := tf2lzham.Compress(dst, src)
+	return n, lzhamError(err)
+}
+
+func (lzhamCodec) Decompress(dst, src []byte) (int, error) {
+	var n int
+	var err error
+	switch GetLZHAMDecoder().Resolve() {
+	case LZHAMDecoderNative:
+		n, _, _, err = lzham.Decompress(dst, src)
+	case LZHAMDecoderDiff:
+		n, err = lzhamDecompressDiff(dst, src)
+	default:
+		n, _, _, err = tf2lzham.Decompress(dst, src)
+		if err != nil && err.Error() == lzham.ErrBadCode.Error() {
+			// tf2lzham also returns this if a match extends past the end of
+			// dst, which the native decoder can tell apart
+			if _, _, _, nerr := lzham.Decompress(dst, src); errors.Is(nerr, lzham.ErrDestBufTooSmall) {
+				err = nerr
+			}
+		}
+	}
+	return n, lzhamError(err)
+}
+
+// lzhamError makes LZHAM errors about dst being too small match
+// io.ErrShortBuffer.
+func lzhamError(err error) error {
+	if err != nil && (errors.Is(err, lzham.ErrDestBufTooSmall) || err.Error() == "lzham: output buffer too small") {
+		return shortBufferError{err}
+	}
+	return err
+}
+
+type shortBufferError struct {
+	error
+}
+
+func (e shortBufferError) Unwrap() []error {
+	return []error{e.error, io.ErrShortBuffer}
+}
+
+// lzhamDecompressDiff decompresses src with both implementations, returning an
+// error if the output, checksums, or errors differ.
+func lzhamDecompressDiff(dst, src []byte) (int, error) {
+	ref := make([]byte, len(dst))
+	n1, adler1, crc1, err1 := tf2lzham.Decompress(ref, src)
+	n2, adler2, crc2, err2 := lzham.Decompress(dst, src)
+	if n1 != n2 || adler1 != adler2 || crc1 != crc2 || fmt.Sprint(err1) != fmt.Sprint(err2) || !bytes.Equal(ref[:n1], dst[:n2]) {
+		return 0, fmt.Errorf("lzham: native decoder mismatch (tf2lzham: n=%d adler32=%08x crc32=%08x err=%v) (native: n=%d adler32=%08x crc32=%08x err=%v)", n1, adler1, crc1, err1, n2, adler2, crc2, err2)
+	}
+	return n2, err2
+}
+
+type zlibCodec struct{}
+
+func (zlibCodec) Name() string {
+	return "zlib"
+}
+
+func (zlibCodec) Compress(dst, src []byte) (int, error) {
+	var b bytes.Buffer
+	zw, err := zlib.NewWriterLevel(&b, zlib.BestCompression)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := zw.Write(src); err != nil {
+		return 0, err
+	}
+	if err := zw.Close(); err != nil {
+		return 0, err
+	}
+	if b.Len() > len(dst) {
+		return 0, io.ErrShortBuffer
+	}
+	return copy(dst, b.Bytes()), nil
+}
+
+func (zlibCodec) Decompress(dst, src []byte) (int, error) {
+	zr, err := zlib.NewReader(bytes.NewReader(src))
+	if err != nil {
+		return 0, err
+	}
+	var n int
+	for n < len(dst) {
+		m, err := zr.Read(dst[n:])
+		n += m
+		if err == io.EOF {
+			return n, nil // the checksum was verified
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+	var b [1]byte
+	if m, err := zr.Read(b[:]); m != 0 {
+		return n, io.ErrShortBuffer
+	} else if err != io.EOF {
+		if err == nil {
+			err = errors.New("expected end of stream")
+		}
+		return n, fmt.Errorf("read end of stream: %w", err)
+	}
+	return n, nil
+}
+
+func (zlibCodec) Detect(src []byte) bool {
+	// RFC 1950: CM=8 (deflate), CINFO<=7, and a valid FCHECK
+	return len(src) >= 2 && src[0]&0x0F == 8 && src[0]>>4 <= 7 && (uint16(src[0])<<8|uint16(src[1]))%31 == 0
+}
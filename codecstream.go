@@ -0,0 +1,377 @@
+package tf2vpk
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/adler32"
+	"hash/crc32"
+	"io"
+	"math"
+)
+
+// A codec stream is a framed container for arbitrary data compressed with a
+// Codec. The data is split into blocks which are compressed independently, so
+// it can be compressed and decompressed incrementally with bounded memory. All
+// integers are little-endian.
+//
+//	header:
+//	  magic      [4]byte         CodecStreamMagic
+//	  version    uint8           1
+//	  name_len   uint8
+//	  name       [name_len]byte  the codec name (see LookupCodec)
+//	  block_size uint32          the maximum uncompressed size of a block
+//	block (repeated):
+//	  csize      uint32          the size of data
+//	  usize      uint32          the uncompressed size (1 to block_size)
+//	  adler32    uint32          of the uncompressed data
+//	  crc32      uint32          of the uncompressed data (IEEE)
+//	  data       [csize]byte     stored as-is if csize equals usize
+//	end:
+//	  csize      uint32          0
+//	  usize      uint32          0
+//	  adler32    uint32          of all uncompressed data
+//	  crc32      uint32          of all uncompressed data (IEEE)
+//
+// The compressed size of a block must not be larger than twice the block size
+// plus 64 bytes.
+const (
+	CodecStreamMagic        = "\x89TFZ"
+	CodecStreamVersion      = 1
+	CodecStreamBlockSize    = int(ValvePakMaxChunkUncompressedSize) // default
+	CodecStreamMaxBlockSize = 1 << 30
+)
+
+// IsCodecStream checks if b starts with CodecStreamMagic.
+func IsCodecStream(b []byte) bool {
+	return bytes.HasPrefix(b, []byte(CodecStreamMagic))
+}
+
+// codecStreamMaxCompressedSize returns the maximum compressed size of a block.
+func codecStreamMaxCompressedSize(blockSize int) int {
+	return blockSize*2 + 64
+}
+
+// CodecWriter compresses data into a codec stream.
+type CodecWriter struct {
+	w     io.Writer
+	codec Codec
+	buf   []byte // pending uncompressed data, with the block size as the capacity
+	zbuf  []byte
+	hdr   [16]byte
+	off   int64
+	adler hash.Hash32
+	crc   hash.Hash32
+	err   error
+}
+
+// NewCodecWriter writes a codec stream header to w, returning a writer which
+// compresses blocks of up to blockSize bytes (or CodecStreamBlockSize if zero).
+// Close must be called to write the last block and the end of the stream.
+func NewCodecWriter(w io.Writer, c Codec, blockSize int) (*CodecWriter, error) {
+	if blockSize == 0 {
+		blockSize = CodecStreamBlockSize
+	}
+	if blockSize < 0 || blockSize > CodecStreamMaxBlockSize {
+		return nil, fmt.Errorf("invalid codec stream block size %d", blockSize)
+	}
+	name := c.Name()
+	if len(name) == 0 || len(name) > 0xFF {
+		return nil, fmt.Errorf("invalid codec name %q", name)
+	}
+
+	hdr := []byte(CodecStreamMagic)
+	hdr = append(hdr, CodecStreamVersion, byte(len(name)))
+	hdr = append(hdr, name...)
+	hdr = binary.LittleEndian.AppendUint32(hdr, uint32(blockSize))
+	if _, err := w.Write(hdr); err != nil {
+		return nil, fmt.Errorf("write codec stream header: %w", err)
+	}
+	return &CodecWriter{
+		w:     w,
+		codec: c,
+		off:   int64(len(hdr)),
+		buf:   make([]byte, 0, blockSize),
+		zbuf:  make([]byte, codecStreamMaxCompressedSize(blockSize)),
+		adler: adler32.New(),
+		crc:   crc32.NewIEEE(),
+	}, nil
+}
+
+// Write buffers and compresses p.
+func (w *CodecWriter) Write(p []byte) (int, error) {
+	var n int
+	for len(p) != 0 {
+		if w.err != nil {
+			return n, w.err
+		}
+		m := min(len(p), cap(w.buf)-len(w.buf))
+		w.buf = append(w.buf, p[:m]...)
+		p = p[m:]
+		n += m
+		if len(w.buf) == cap(w.buf) {
+			w.err = w.flush()
+		}
+	}
+	return n, w.err
+}
+
+// Close writes the last block and the end of the stream. It does not close the
+// underlying writer.
+func (w *CodecWriter) Close() error {
+	if w.err != nil {
+		if w.err == errCodecWriterClosed {
+			return nil
+		}
+		return w.err
+	}
+	if len(w.buf) != 0 {
+		if w.err = w.flush(); w.err != nil {
+			return w.err
+		}
+	}
+	if w.err = w.writeFrame(nil, 0, w.adler.Sum32(), w.crc.Sum32()); w.err != nil {
+		return w.err
+	}
+	w.err = errCodecWriterClosed
+	return nil
+}
+
+// Offset returns the number of bytes written to the underlying writer.
+func (w *CodecWriter) Offset() int64 {
+	return w.off
+}
+
+var errCodecWriterClosed = errors.New("codec stream writer is closed")
+
+// flush compresses and writes the buffered block.
+func (w *CodecWriter) flush() error {
+	b := w.buf
+	w.buf = w.buf[:0]
+
+	_, _ = w.adler.Write(b)
+	_, _ = w.crc.Write(b)
+
+	data := b
+	if n, err := w.codec.Compress(w.zbuf, b); err != nil {
+		if !errors.Is(err, io.ErrShortBuffer) {
+			return fmt.Errorf("compress block: %w", err)
+		}
+	} else if n < len(b) {
+		data = w.zbuf[:n] // note: a block is only treated as compressed if the sizes differ
+	}
+	return w.writeFrame(data, len(b), adler32.Checksum(b), crc32.ChecksumIEEE(b))
+}
+
+func (w *CodecWriter) writeFrame(data []byte, usize int, adler, crc uint32) error {
+	binary.LittleEndian.PutUint32(w.hdr[0:], uint32(len(data)))
+	binary.LittleEndian.PutUint32(w.hdr[4:], uint32(usize))
+	binary.LittleEndian.PutUint32(w.hdr[8:], adler)
+	binary.LittleEndian.PutUint32(w.hdr[12:], crc)
+	if _, err := w.w.Write(w.hdr[:]); err != nil {
+		return fmt.Errorf("write codec stream: %w", err)
+	}
+	if _, err := w.w.Write(data); err != nil {
+		return fmt.Errorf("write codec stream: %w", err)
+	}
+	w.off += int64(len(w.hdr) + len(data))
+	return nil
+}
+
+// CodecReader decompresses a codec stream.
+type CodecReader struct {
+	r         io.Reader
+	codec     Codec
+	blockSize int
+	off       int64 // of the next frame
+	zbuf      []byte
+	buf       []byte
+	rem       []byte // unread part of buf
+	adler     hash.Hash32
+	crc       hash.Hash32
+	err       error
+}
+
+// NewCodecReader reads a codec stream header from r, returning a reader for
+// the decompressed data. The codec is looked up using LookupCodec. Data after
+// the end of the stream is not read.
+func NewCodecReader(r io.Reader) (*CodecReader, error) {
+	var hdr [6]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, fmt.Errorf("read codec stream header: %w", noEOF(err))
+	}
+	if !IsCodecStream(hdr[:]) {
+		return nil, fmt.Errorf("read codec stream header: invalid magic %q", hdr[:4])
+	}
+	if v := hdr[4]; v != CodecStreamVersion {
+		return nil, fmt.Errorf("read codec stream header: unsupported version %d", v)
+	}
+	rest := make([]byte, int(hdr[5])+4)
+	if _, err := io.ReadFull(r, rest); err != nil {
+		return nil, fmt.Errorf("read codec stream header: %w", noEOF(err))
+	}
+	name := string(rest[:hdr[5]])
+	c, ok := LookupCodec(name)
+	if !ok {
+		return nil, fmt.Errorf("read codec stream header: unknown codec %q", name)
+	}
+	blockSize := binary.LittleEndian.Uint32(rest[hdr[5]:])
+	if blockSize == 0 || blockSize > CodecStreamMaxBlockSize {
+		return nil, fmt.Errorf("read codec stream header: invalid block size %d", blockSize)
+	}
+	return &CodecReader{
+		r:         r,
+		codec:     c,
+		blockSize: int(blockSize),
+		off:       int64(len(hdr) + len(rest)),
+		adler:     adler32.New(),
+		crc:       crc32.NewIEEE(),
+	}, nil
+}
+
+// Codec returns the codec the stream was compressed with.
+func (r *CodecReader) Codec() Codec {
+	return r.codec
+}
+
+// BlockSize returns the maximum uncompressed size of a block.
+func (r *CodecReader) BlockSize() int {
+	return r.blockSize
+}
+
+// Offset returns the number of bytes of the stream which have been read from
+// the underlying reader.
+func (r *CodecReader) Offset() int64 {
+	return r.off
+}
+
+// Read reads decompressed data. The checksums of each block are verified
+// before it is returned, and the checksums of the entire stream are verified
+// before io.EOF is returned.
+func (r *CodecReader) Read(p []byte) (int, error) {
+	for len(r.rem) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		r.err = r.next()
+	}
+	n := copy(p, r.rem)
+	r.rem = r.rem[n:]
+	return n, nil
+}
+
+// next reads and decompresses the next block into rem.
+func (r *CodecReader) next() error {
+	var hdr [16]byte
+	if _, err := io.ReadFull(r.r, hdr[:]); err != nil {
+		return fmt.Errorf("read codec stream block at offset %d: %w", r.off, noEOF(err))
+	}
+	var (
+		csize = binary.LittleEndian.Uint32(hdr[0:])
+		usize = binary.LittleEndian.Uint32(hdr[4:])
+		adler = binary.LittleEndian.Uint32(hdr[8:])
+		crc   = binary.LittleEndian.Uint32(hdr[12:])
+		off   = r.off
+	)
+	r.off += int64(len(hdr)) + int64(csize)
+
+	if csize == 0 && usize == 0 {
+		if a, c := r.adler.Sum32(), r.crc.Sum32(); a != adler || c != crc {
+			return fmt.Errorf("codec stream: %w (adler32 %08X crc32 %08X, expected %08X %08X)", ErrChecksum, a, c, adler, crc)
+		}
+		return io.EOF
+	}
+	if usize == 0 || usize > uint32(r.blockSize) {
+		return fmt.Errorf("read codec stream block at offset %d: invalid uncompressed size %d", off, usize)
+	}
+	if csize == 0 || csize > uint32(codecStreamMaxCompressedSize(r.blockSize)) {
+		return fmt.Errorf("read codec stream block at offset %d: invalid compressed size %d", off, csize)
+	}
+
+	if cap(r.zbuf) < int(csize) {
+		r.zbuf = make([]byte, csize)
+	}
+	data := r.zbuf[:csize]
+	if _, err := io.ReadFull(r.r, data); err != nil {
+		return fmt.Errorf("read codec stream block at offset %d: %w", off, noEOF(err))
+	}
+
+	if csize == usize {
+		r.rem = data
+	} else {
+		if cap(r.buf) < int(usize) {
+			r.buf = make([]byte, usize)
+		}
+		n, err := r.codec.Decompress(r.buf[:usize], data)
+		if err == nil && n != int(usize) {
+			err = fmt.Errorf("expected %d bytes, got %d", usize, n)
+		}
+		if err != nil {
+			return &DecompressError{Index: ValvePakIndexEOF, Offset: uint64(off), Err: err}
+		}
+		r.rem = r.buf[:usize]
+	}
+
+	if a, c := adler32.Checksum(r.rem), crc32.ChecksumIEEE(r.rem); a != adler || c != crc {
+		r.rem = nil
+		return fmt.Errorf("codec stream block at offset %d: %w (adler32 %08X crc32 %08X, expected %08X %08X)", off, ErrChecksum, a, c, adler, crc)
+	}
+	_, _ = r.adler.Write(r.rem)
+	_, _ = r.crc.Write(r.rem)
+	return nil
+}
+
+// noEOF converts io.EOF into io.ErrUnexpectedEOF.
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// CodecRawMaxSize is the default limit for the buffers allocated by CompressRaw
+// and DecompressRaw.
+const CodecRawMaxSize = min(1<<32, math.MaxInt)
+
+// CompressRaw compresses src as a single chunk (i.e., without a codec stream),
+// growing the output buffer up to limit (or CodecRawMaxSize if zero) as needed.
+func CompressRaw(c Codec, src []byte, limit int) ([]byte, error) {
+	return codecRaw(c.Compress, src, codecStreamMaxCompressedSize(len(src)), limit)
+}
+
+// DecompressRaw decompresses a single chunk compressed with CompressRaw. Since
+// the uncompressed size is unknown, the output buffer starts at four times the
+// size of src (or 1 MiB if larger), and is doubled up to limit (or
+// CodecRawMaxSize if zero) while the codec reports it as too small.
+func DecompressRaw(c Codec, src []byte, limit int) ([]byte, error) {
+	return codecRaw(c.Decompress, src, max(len(src)*4, 1024*1024), limit)
+}
+
+// codecRaw calls fn with a buffer of the provided size, doubling it up to limit
+// while it fails with io.ErrShortBuffer.
+func codecRaw(fn func(dst, src []byte) (int, error), src []byte, size, limit int) ([]byte, error) {
+	if limit <= 0 {
+		limit = CodecRawMaxSize
+	}
+	size = min(size, limit)
+	for {
+		dst := make([]byte, size)
+		n, err := fn(dst, src)
+		if err == nil {
+			return dst[:n], nil
+		}
+		if !errors.Is(err, io.ErrShortBuffer) {
+			return nil, err
+		}
+		if size >= limit {
+			return nil, fmt.Errorf("output is larger than the %d byte limit: %w", limit, err)
+		}
+		if size > limit/2 {
+			size = limit
+		} else {
+			size *= 2
+		}
+	}
+}
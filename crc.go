@@ -53,6 +53,7 @@ func (d *crc) Sum(in []byte) []byte {
 
 type hashReader struct {
 	r   io.Reader
+	p   string
 	sz  uint64
 	crc uint32
 	h   hash.Hash32
@@ -60,8 +61,8 @@ type hashReader struct {
 	err error
 }
 
-func newCRCReader(r io.Reader, sz uint64, crc uint32) io.Reader {
-	return &hashReader{r, sz, crc, NewCRC(), 0, nil}
+func newCRCReader(r io.Reader, path string, sz uint64, crc uint32) io.Reader {
+	return &hashReader{r, path, sz, crc, NewCRC(), 0, nil}
 }
 
 func (r *hashReader) Read(b []byte) (n int, err error) {
@@ -76,10 +77,10 @@ func (r *hashReader) Read(b []byte) (n int, err error) {
 	}
 	if err == io.EOF {
 		if r.n != r.sz {
-			return 0, io.ErrUnexpectedEOF
+			return 0, fmt.Errorf("%w: %w", ErrCorrupt, io.ErrUnexpectedEOF)
 		}
-		if r.crc != 0 && r.h.Sum32() != r.crc && !debugDisableCRCChecks {
-			err = fmt.Errorf("crc mismatch: expected %08X, got %08X", r.crc, r.h.Sum32())
+		if r.crc != 0 && r.h.Sum32() != r.crc {
+			err = &CRCError{r.p, r.crc, r.h.Sum32()}
 		}
 	}
 	r.err = err
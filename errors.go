@@ -0,0 +1,100 @@
+package tf2vpk
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Errors which can be checked for using [errors.Is] to determine the category
+// of a failure.
+var (
+	ErrCorrupt    = errors.New("corrupt vpk")             // structure or data is invalid or truncated
+	ErrChecksum   = errors.New("checksum mismatch")       // see CRCError
+	ErrDecompress = errors.New("decompression failed")    // see DecompressError
+	ErrSanity     = errors.New("sanity check failed")     // see SanityError
+	ErrLimit      = errors.New("resource limit exceeded") // see LimitError
+)
+
+// CRCError is returned when the contents of a file don't match the CRC32 from
+// the dir index.
+type CRCError struct {
+	Path     string // may be empty if unknown
+	Expected uint32
+	Actual   uint32
+}
+
+func (e *CRCError) Error() string {
+	if e.Path == "" {
+		return fmt.Sprintf("crc mismatch: expected %08X, got %08X", e.Expected, e.Actual)
+	}
+	return fmt.Sprintf("crc mismatch for %q: expected %08X, got %08X", e.Path, e.Expected, e.Actual)
+}
+
+func (e *CRCError) Is(target error) bool {
+	return target == ErrChecksum
+}
+
+// DecompressError is returned when a chunk cannot be decompressed.
+type DecompressError struct {
+	Index  ValvePakIndex // ValvePakIndexEOF if unknown
+	Offset uint64
+	Err    error
+}
+
+func (e *DecompressError) Error() string {
+	if e.Index == ValvePakIndexEOF {
+		return fmt.Sprintf("decompress chunk at offset %d: %v", e.Offset, e.Err)
+	}
+	return fmt.Sprintf("decompress chunk at %s:%d: %v", e.Index, e.Offset, e.Err)
+}
+
+func (e *DecompressError) Unwrap() error {
+	return e.Err
+}
+
+func (e *DecompressError) Is(target error) bool {
+	return target == ErrDecompress
+}
+
+// SanityRule identifies a sanity check. These checks are based on observations
+// of the Titanfall 2 VPKs, and are disabled by Options.Lenient.
+type SanityRule string
+
+const (
+	SanityVersion             SanityRule = "version"               // the dir version is 2.3 (or a Source VPK version)
+	SanityChunkSizeNonZero    SanityRule = "chunk-size-nonzero"    // chunk sizes are non-zero
+	SanityChunkSizeMax        SanityRule = "chunk-size-max"        // chunks are at most ValvePakMaxChunkUncompressedSize
+	SanityUniformLoadFlags    SanityRule = "uniform-load-flags"    // all chunks in a file have the same load flags
+	SanityUniformTextureFlags SanityRule = "uniform-texture-flags" // all chunks in a file have the same texture flags
+	SanityTextureFlagsPath    SanityRule = "texture-flags-path"    // only vtf/vvc/vvd files have texture flags
+	SanityChunkTerminator     SanityRule = "chunk-terminator"      // non-eof chunk terminators are the block index
+)
+
+// SanityError is returned when a sanity check fails.
+type SanityError struct {
+	Rule SanityRule
+	Msg  string
+}
+
+func (e *SanityError) Error() string {
+	return fmt.Sprintf("%s (sanity check %s; use lenient options to ignore this)", e.Msg, e.Rule)
+}
+
+func (e *SanityError) Is(target error) bool {
+	return target == ErrSanity
+}
+
+// LimitError is returned when a limit from Options is exceeded.
+type LimitError struct {
+	Limit string // the name of the limit, e.g., "MaxFiles"
+	Value uint64
+	Max   uint64
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("%d exceeds %s limit of %d", e.Value, e.Limit, e.Max)
+}
+
+func (e *LimitError) Is(target error) bool {
+	return target == ErrLimit
+}
@@ -0,0 +1,228 @@
+package tf2vpk
+
+import (
+	"bytes"
+	"cmp"
+	"io"
+	"runtime"
+	"slices"
+	"sync"
+)
+
+// ExtractOptions configures Reader.Extract.
+type ExtractOptions struct {
+	// Threads is the number of files to decompress concurrently. If zero or
+	// negative, runtime.NumCPU is used.
+	Threads int
+
+	// Memory is the maximum number of bytes of raw and decompressed file data
+	// to buffer at once. If zero or negative, 256 MiB is used. Files larger
+	// than this are not buffered, and are read using OpenFileParallel instead.
+	Memory int64
+}
+
+// Extract reads the contents of files, calling fn for each one.
+//
+// Files are read in the order they are stored (i.e., by block and offset) to
+// avoid random I/O, then decompressed concurrently. fn is called sequentially
+// in the same order, and the reader is only valid until it returns. Errors
+// reading the file, including checksum mismatches, are returned by the reader
+// like OpenFile. If fn returns an error, Extract stops and returns it.
+func (r *Reader) Extract(files []ValvePakFile, opt ExtractOptions, fn func(ValvePakFile, io.Reader) error) error {
+	threads := opt.Threads
+	if threads <= 0 {
+		threads = runtime.NumCPU()
+	}
+	budget := opt.Memory
+	if budget <= 0 {
+		budget = 256 << 20
+	}
+
+	type job struct {
+		f    ValvePakFile
+		size int64         // reserved memory, zero if streamed
+		usz  int64         // uncompressed size
+		raw  io.ReaderAt   // buffered chunk data
+		done chan struct{} // closed when buf/err are set
+		buf  []byte
+		err  error
+	}
+
+	var (
+		mu      sync.Mutex
+		cond    = sync.NewCond(&mu)
+		used    int64
+		stopped bool
+
+		wg    sync.WaitGroup
+		stop  = make(chan struct{})
+		work  = make(chan *job, threads)
+		queue = make(chan *job, threads)
+	)
+
+	// read the chunk data in order
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(work)
+		defer close(queue)
+
+		for _, f := range sortFilesByOffset(files) {
+			j := &job{f: f, done: make(chan struct{})}
+			if b := r.block[f.Index]; b != nil && len(f.Chunk) != 0 {
+				usz := uint64(len(f.Preload))
+				start, end := f.Chunk[0].Offset, f.Chunk[0].Offset
+				for _, c := range f.Chunk {
+					usz += c.UncompressedSize
+					start = min(start, c.Offset)
+					end = max(end, c.Offset+c.CompressedSize)
+				}
+				if size := int64(usz + (end - start)); usz <= uint64(budget) && end-start <= uint64(budget) && size <= budget {
+					mu.Lock()
+					for used+size > budget && !stopped {
+						cond.Wait()
+					}
+					if stopped {
+						mu.Unlock()
+						return
+					}
+					used += size
+					mu.Unlock()
+
+					j.size, j.usz = size, int64(usz)
+					j.raw = newSpanReaderAt(b, int64(start), int64(end-start))
+				}
+			}
+			select {
+			case queue <- j:
+			case <-stop:
+				return
+			}
+			if j.size == 0 {
+				close(j.done)
+				continue
+			}
+			select {
+			case work <- j:
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	// decompress the files concurrently
+	for i := 0; i < threads; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range work {
+				select {
+				case <-stop:
+					close(j.done)
+					continue
+				default:
+				}
+				var b bytes.Buffer
+				if fr, err := j.f.createReaderParallel(j.raw, 1, r.opt); err != nil {
+					j.err = err
+				} else {
+					b.Grow(int(j.usz))
+					_, j.err = b.ReadFrom(fr)
+				}
+				j.raw, j.buf = nil, b.Bytes()
+				close(j.done)
+			}
+		}()
+	}
+
+	finish := func() {
+		mu.Lock()
+		stopped = true
+		cond.Broadcast()
+		mu.Unlock()
+		close(stop)
+		wg.Wait()
+	}
+
+	for j := range queue {
+		<-j.done
+
+		var err error
+		if j.size == 0 {
+			var fr io.Reader
+			if fr, err = r.OpenFileParallel(j.f, threads); err == nil {
+				err = fn(j.f, fr)
+			} else {
+				err = fn(j.f, &errReader{err})
+			}
+		} else {
+			err = fn(j.f, io.MultiReader(bytes.NewReader(j.buf), &errReader{j.err}))
+		}
+		j.buf = nil
+
+		mu.Lock()
+		used -= j.size
+		cond.Broadcast()
+		mu.Unlock()
+
+		if err != nil {
+			finish()
+			return err
+		}
+	}
+	finish()
+	return nil
+}
+
+// sortFilesByOffset returns a copy of files sorted by the block and offset of
+// their first chunk.
+func sortFilesByOffset(files []ValvePakFile) []ValvePakFile {
+	files = slices.Clone(files)
+	slices.SortStableFunc(files, func(a, b ValvePakFile) int {
+		if c := cmp.Compare(a.Index, b.Index); c != 0 {
+			return c
+		}
+		var ao, bo uint64
+		if len(a.Chunk) != 0 {
+			ao = a.Chunk[0].Offset
+		}
+		if len(b.Chunk) != 0 {
+			bo = b.Chunk[0].Offset
+		}
+		return cmp.Compare(ao, bo)
+	})
+	return files
+}
+
+// spanReaderAt reads a span of r into memory, falling back to r for reads
+// outside of it (or if the span couldn't be read completely).
+type spanReaderAt struct {
+	r   io.ReaderAt
+	off int64
+	b   []byte
+}
+
+func newSpanReaderAt(r io.ReaderAt, off, n int64) *spanReaderAt {
+	b := make([]byte, n)
+	n2, _ := r.ReadAt(b, off)
+	return &spanReaderAt{r, off, b[:n2]}
+}
+
+func (s *spanReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off >= s.off && off+int64(len(p)) <= s.off+int64(len(s.b)) {
+		return copy(p, s.b[off-s.off:]), nil
+	}
+	return s.r.ReadAt(p, off)
+}
+
+// errReader returns err, or io.EOF if nil.
+type errReader struct {
+	err error
+}
+
+func (r *errReader) Read(p []byte) (int, error) {
+	if r.err == nil {
+		return 0, io.EOF
+	}
+	return 0, r.err
+}
@@ -0,0 +1,188 @@
+package tf2vpk
+
+import (
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"sort"
+	"sync"
+)
+
+// FileReader reads a file from a VPK with support for random access. Only the
+// chunks containing the requested data are read (and decompressed).
+//
+// The CRC32 is checked at EOF if the file was read sequentially from the
+// beginning using Read (seeking back to the start restarts the check).
+type FileReader struct {
+	f     *ValvePakFile
+	r     io.ReaderAt
+	codec Codec
+	crc   uint32  // zero to skip the check
+	off   []int64 // start offset of each chunk (after the preload data), plus the total size
+	pos   int64
+
+	h  hash.Hash32
+	hn int64 // position the hash has been computed up to, or -1 if not sequential
+
+	m     sync.Mutex
+	cache int // index of the cached chunk, or -1
+	buf   []byte
+}
+
+var (
+	_ io.ReadSeeker = (*FileReader)(nil)
+	_ io.ReaderAt   = (*FileReader)(nil)
+)
+
+// CreateFileReader creates a new random-access reader for the file.
+func (f *ValvePakFile) CreateFileReader(r io.ReaderAt) (*FileReader, error) {
+	return f.createFileReader(r, Options{})
+}
+
+func (f *ValvePakFile) createFileReader(r io.ReaderAt, opt Options) (*FileReader, error) {
+	fr := &FileReader{
+		f:     f,
+		r:     r,
+		crc:   f.CRC32,
+		codec: opt.codec(),
+		off:   make([]int64, len(f.Chunk)+1),
+		h:     NewCRC(),
+		cache: -1,
+	}
+	if opt.NoCRC {
+		fr.crc = 0
+	}
+	fr.off[0] = int64(len(f.Preload))
+	for i, c := range f.Chunk {
+		if c.UncompressedSize > 1<<62 || fr.off[i]+int64(c.UncompressedSize) < fr.off[i] {
+			return nil, fmt.Errorf("chunk %d: invalid uncompressed size", i)
+		}
+		fr.off[i+1] = fr.off[i] + int64(c.UncompressedSize)
+	}
+	return fr, nil
+}
+
+// Size returns the uncompressed size of the file.
+func (fr *FileReader) Size() int64 {
+	return fr.off[len(fr.off)-1]
+}
+
+// Read implements io.Reader.
+func (fr *FileReader) Read(b []byte) (n int, err error) {
+	if fr.pos >= fr.Size() {
+		if fr.hn == fr.Size() {
+			fr.hn = -1 // only check it once
+			if crc := fr.h.Sum32(); fr.crc != 0 && crc != fr.crc {
+				return 0, &CRCError{fr.f.Path, fr.crc, crc}
+			}
+		}
+		return 0, io.EOF
+	}
+	if len(b) == 0 {
+		return 0, nil
+	}
+
+	// only read up to the end of the preload data or the current chunk
+	end := fr.off[0]
+	if fr.pos >= end {
+		end = fr.off[fr.chunk(fr.pos)+1]
+	}
+	if rem := end - fr.pos; int64(len(b)) > rem {
+		b = b[:rem]
+	}
+	n, err = fr.ReadAt(b, fr.pos)
+	if err == io.EOF && n == len(b) {
+		err = nil
+	}
+	if fr.hn == fr.pos {
+		fr.h.Write(b[:n])
+		fr.hn += int64(n)
+	} else {
+		fr.hn = -1
+	}
+	fr.pos += int64(n)
+	return
+}
+
+// Seek implements io.Seeker.
+func (fr *FileReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += fr.pos
+	case io.SeekEnd:
+		offset += fr.Size()
+	default:
+		return 0, errors.New("seek: invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("seek: invalid offset")
+	}
+	if offset == 0 {
+		fr.h.Reset()
+		fr.hn = 0
+	}
+	fr.pos = offset
+	return offset, nil
+}
+
+// ReadAt implements io.ReaderAt. It is safe to call concurrently, but the CRC32
+// is not checked.
+func (fr *FileReader) ReadAt(b []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, errors.New("read: negative offset")
+	}
+	for n < len(b) {
+		if off >= fr.Size() {
+			return n, io.EOF
+		}
+		if off < fr.off[0] {
+			m := copy(b[n:], fr.f.Preload[off:])
+			n += m
+			off += int64(m)
+			continue
+		}
+		i := fr.chunk(off)
+		c := fr.f.Chunk[i]
+		coff := off - fr.off[i]
+
+		var m int
+		if c.IsCompressed() {
+			fr.m.Lock()
+			if fr.cache != i {
+				if fr.buf, err = c.decompress(fr.r, fr.f.Index, fr.codec); err != nil {
+					fr.cache, fr.buf = -1, nil
+					fr.m.Unlock()
+					return n, fmt.Errorf("chunk %d: %w", i, err)
+				}
+				fr.cache = i
+			}
+			m = copy(b[n:], fr.buf[coff:])
+			fr.m.Unlock()
+		} else {
+			x := b[n:]
+			if rem := int64(c.UncompressedSize) - coff; int64(len(x)) > rem {
+				x = x[:rem]
+			}
+			if m, err = fr.r.ReadAt(x, int64(c.Offset)+coff); m != len(x) {
+				if err == nil || err == io.EOF {
+					err = fmt.Errorf("%w: %w", ErrCorrupt, io.ErrUnexpectedEOF)
+				}
+				return n + m, fmt.Errorf("chunk %d: read: %w", i, err)
+			}
+			err = nil
+		}
+		n += m
+		off += int64(m)
+	}
+	return n, nil
+}
+
+// chunk returns the index of the chunk containing off, which must be less than
+// the file size and not within the preload data.
+func (fr *FileReader) chunk(off int64) int {
+	return sort.Search(len(fr.f.Chunk), func(i int) bool {
+		return off < fr.off[i+1]
+	})
+}
@@ -110,3 +110,31 @@ func (v ValvePakRef) List() ([]string, error) {
 	}
 	return ns, nil
 }
+
+// Prefixes returns the prefixes of all dir indexes (e.g., one for each locale)
+// sharing the blocks of the VPK. Since the prefix and name aren't delimited,
+// prefixes are assumed to only contain letters.
+func (v ValvePakRef) Prefixes() ([]string, error) {
+	if v.Path == "" {
+		v.Path = "."
+	}
+	if v.Name == "" {
+		panic("vpk name is required")
+	}
+	ds, err := os.ReadDir(v.Path)
+	if err != nil {
+		return nil, err
+	}
+	var ps []string
+	for _, d := range ds {
+		// ensure it's a vpk dir index belonging to us
+		if name, idx, err := SplitName(d.Name(), ""); err == nil && idx == ValvePakIndexDir {
+			if prefix, ok := strings.CutSuffix(name, v.Name); ok && !strings.ContainsFunc(prefix, func(r rune) bool {
+				return (r < 'a' || r > 'z') && (r < 'A' || r > 'Z')
+			}) {
+				ps = append(ps, prefix)
+			}
+		}
+	}
+	return ps, nil
+}
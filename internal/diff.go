@@ -0,0 +1,228 @@
+package internal
+
+import (
+	"fmt"
+	"strings"
+)
+
+// UnifiedDiff returns a unified diff between a and b with n lines of context,
+// or an empty string if they are identical.
+func UnifiedDiff(aName, bName, a, b string, n int) string {
+	if a == b {
+		return ""
+	}
+	al, bl := splitLines(a), splitLines(b)
+	es := diffLines(al, bl)
+
+	var s strings.Builder
+	fmt.Fprintf(&s, "--- %s\n+++ %s\n", aName, bName)
+	for i := 0; i < len(es); {
+		// find the next change
+		for i < len(es) && es[i].op == ' ' {
+			i++
+		}
+		if i == len(es) {
+			break
+		}
+
+		// extend the hunk while the changes are close enough
+		start, end := max(i-n, 0), i
+		for j := i; j < len(es); j++ {
+			if es[j].op != ' ' {
+				end = j + 1
+			} else if j-end >= 2*n {
+				break
+			}
+		}
+		end = min(end+n, len(es))
+
+		var as, bs, ac, bc int
+		as, bs = es[start].a+1, es[start].b+1
+		for _, e := range es[start:end] {
+			if e.op != '+' {
+				ac++
+			}
+			if e.op != '-' {
+				bc++
+			}
+		}
+		if ac == 0 {
+			as--
+		}
+		if bc == 0 {
+			bs--
+		}
+		fmt.Fprintf(&s, "@@ -%d,%d +%d,%d @@\n", as, ac, bs, bc)
+		for _, e := range es[start:end] {
+			var line string
+			if e.op == '+' {
+				line = bl[e.b]
+			} else {
+				line = al[e.a]
+			}
+			s.WriteByte(e.op)
+			s.WriteString(line)
+			if !strings.HasSuffix(line, "\n") {
+				s.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+		i = end
+	}
+	return s.String()
+}
+
+func splitLines(s string) []string {
+	ls := strings.SplitAfter(s, "\n")
+	if ls[len(ls)-1] == "" {
+		ls = ls[:len(ls)-1]
+	}
+	return ls
+}
+
+// diffEdit is a line in an edit script. For deletions and unchanged lines, a
+// is the index of the line in the old text. For insertions and unchanged
+// lines, b is the index of the line in the new text. Otherwise, they are the
+// index of the next line.
+type diffEdit struct {
+	op   byte // ' ', '-', or '+'
+	a, b int
+}
+
+// diffLines computes the shortest edit script from a to b using the linear
+// space variant of Myers' algorithm. Within each run of changes, deletions are
+// ordered before insertions.
+func diffLines(a, b []string) []diffEdit {
+	// compare line numbers instead of strings
+	ids := map[string]int{}
+	intern := func(ls []string) []int {
+		xs := make([]int, len(ls))
+		for i, l := range ls {
+			id, ok := ids[l]
+			if !ok {
+				id = len(ids)
+				ids[l] = id
+			}
+			xs[i] = id
+		}
+		return xs
+	}
+	d := differ{a: intern(a), b: intern(b)}
+	d.compare(0, len(a), 0, len(b))
+
+	es := make([]diffEdit, 0, len(d.es))
+	for i := 0; i < len(d.es); {
+		if d.es[i].op == ' ' {
+			es = append(es, d.es[i])
+			i++
+			continue
+		}
+		var (
+			x, y   = d.es[i].a, d.es[i].b
+			del, n int
+		)
+		for ; i < len(d.es) && d.es[i].op != ' '; i++ {
+			if d.es[i].op == '-' {
+				del++
+			} else {
+				n++
+			}
+		}
+		for j := 0; j < del; j++ {
+			es = append(es, diffEdit{'-', x + j, y})
+		}
+		for j := 0; j < n; j++ {
+			es = append(es, diffEdit{'+', x + del, y + j})
+		}
+	}
+	return es
+}
+
+type differ struct {
+	a, b []int
+	es   []diffEdit
+}
+
+// compare appends the edit script from a[a0:a1] to b[b0:b1].
+func (d *differ) compare(a0, a1, b0, b1 int) {
+	for a0 < a1 && b0 < b1 && d.a[a0] == d.b[b0] {
+		d.es = append(d.es, diffEdit{' ', a0, b0})
+		a0, b0 = a0+1, b0+1
+	}
+	var suffix int
+	for a1 > a0 && b1 > b0 && d.a[a1-1] == d.b[b1-1] {
+		a1, b1 = a1-1, b1-1
+		suffix++
+	}
+	switch {
+	case a0 == a1:
+		for y := b0; y < b1; y++ {
+			d.es = append(d.es, diffEdit{'+', a0, y})
+		}
+	case b0 == b1:
+		for x := a0; x < a1; x++ {
+			d.es = append(d.es, diffEdit{'-', x, b0})
+		}
+	default:
+		x, y, u, v := d.middleSnake(a0, a1, b0, b1)
+		d.compare(a0, x, b0, y)
+		for ; x < u; x, y = x+1, y+1 {
+			d.es = append(d.es, diffEdit{' ', x, y})
+		}
+		d.compare(u, a1, v, b1)
+	}
+	for i := 0; i < suffix; i++ {
+		d.es = append(d.es, diffEdit{' ', a1 + i, b1 + i})
+	}
+}
+
+// middleSnake finds the middle snake (x, y) to (u, v) of a shortest edit
+// script from a[a0:a1] to b[b0:b1] by searching forwards and backwards at the
+// same time.
+func (d *differ) middleSnake(a0, a1, b0, b1 int) (x, y, u, v int) {
+	var (
+		n, m  = a1 - a0, b1 - b0
+		delta = n - m
+		odd   = delta&1 != 0
+		dmax  = (n + m + 1) / 2
+		off   = dmax + 1
+		vf    = make([]int, 2*off+1) // furthest x on each diagonal k = x - y
+		vb    = make([]int, 2*off+1) // furthest x from the end on each diagonal k = (n - x) - (m - y)
+	)
+	for D := 0; D <= dmax; D++ {
+		for k := -D; k <= D; k += 2 {
+			var x int
+			if k == -D || (k != D && vf[off+k-1] < vf[off+k+1]) {
+				x = vf[off+k+1]
+			} else {
+				x = vf[off+k-1] + 1
+			}
+			y := x - k
+			sx, sy := x, y
+			for x < n && y < m && d.a[a0+x] == d.b[b0+y] {
+				x, y = x+1, y+1
+			}
+			vf[off+k] = x
+			if kb := delta - k; odd && kb >= -(D-1) && kb <= D-1 && x+vb[off+kb] >= n {
+				return a0 + sx, b0 + sy, a0 + x, b0 + y
+			}
+		}
+		for k := -D; k <= D; k += 2 {
+			var x int
+			if k == -D || (k != D && vb[off+k-1] < vb[off+k+1]) {
+				x = vb[off+k+1]
+			} else {
+				x = vb[off+k-1] + 1
+			}
+			y := x - k
+			sx, sy := x, y
+			for x < n && y < m && d.a[a1-1-x] == d.b[b1-1-y] {
+				x, y = x+1, y+1
+			}
+			vb[off+k] = x
+			if kf := delta - k; !odd && kf >= -D && kf <= D && x+vf[off+kf] >= n {
+				return a1 - x, b1 - y, a1 - sx, b1 - sy
+			}
+		}
+	}
+	panic("unreachable")
+}
@@ -0,0 +1,98 @@
+package internal
+
+import (
+	"math/rand"
+	"strconv"
+	"testing"
+)
+
+func TestUnifiedDiff(t *testing.T) {
+	for _, x := range []struct {
+		A, B string
+		Diff string
+	}{
+		{"a\nb\nc\n", "a\nb\nc\n", ""},
+		{"", "a\n", "--- a\n+++ b\n@@ -0,0 +1,1 @@\n+a\n"},
+		{"a\n", "", "--- a\n+++ b\n@@ -1,1 +0,0 @@\n-a\n"},
+		{"a\nb\nc\n", "a\nx\nc\n", "--- a\n+++ b\n@@ -1,3 +1,3 @@\n a\n-b\n+x\n c\n"},
+		{"a\nb", "a\nb\n", "--- a\n+++ b\n@@ -1,2 +1,2 @@\n a\n-b\n\\ No newline at end of file\n+b\n"},
+		{
+			"1\n2\n3\n4\n5\n6\n7\n8\n9\n",
+			"x\n2\n3\n4\n5\n6\n7\n8\ny\n",
+			"--- a\n+++ b\n@@ -1,2 +1,2 @@\n-1\n+x\n 2\n@@ -8,2 +8,2 @@\n 8\n-9\n+y\n",
+		},
+		{
+			"1\n2\n3\n4\n",
+			"x\n2\n3\ny\n",
+			"--- a\n+++ b\n@@ -1,4 +1,4 @@\n-1\n+x\n 2\n 3\n-4\n+y\n",
+		},
+	} {
+		if d := UnifiedDiff("a", "b", x.A, x.B, 1); d != x.Diff {
+			t.Errorf("diff %q %q: expected\n%s\ngot\n%s", x.A, x.B, x.Diff, d)
+		}
+	}
+}
+
+func TestDiffLines(t *testing.T) {
+	rng := rand.New(rand.NewSource(0))
+	gen := func(n int) []string {
+		ls := make([]string, n)
+		for i := range ls {
+			ls[i] = string(rune('a' + rng.Intn(4)))
+		}
+		return ls
+	}
+	for i := 0; i < 1000; i++ {
+		a, b := gen(rng.Intn(30)), gen(rng.Intn(30))
+
+		// longest common subsequence
+		lcs := make([][]int, len(a)+1)
+		for i := range lcs {
+			lcs[i] = make([]int, len(b)+1)
+		}
+		for i := len(a) - 1; i >= 0; i-- {
+			for j := len(b) - 1; j >= 0; j-- {
+				if a[i] == b[j] {
+					lcs[i][j] = lcs[i+1][j+1] + 1
+				} else {
+					lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+				}
+			}
+		}
+
+		var x, y, n int
+		for _, e := range diffLines(a, b) {
+			if e.a != x || e.b != y {
+				t.Fatalf("diff %q %q: edit %c at %d,%d, expected %d,%d", a, b, e.op, e.a, e.b, x, y)
+			}
+			switch e.op {
+			case ' ':
+				if a[x] != b[y] {
+					t.Fatalf("diff %q %q: unchanged line %d,%d differs", a, b, x, y)
+				}
+				x, y = x+1, y+1
+			case '-':
+				x, n = x+1, n+1
+			case '+':
+				y, n = y+1, n+1
+			}
+		}
+		if x != len(a) || y != len(b) {
+			t.Fatalf("diff %q %q: incomplete edit script", a, b)
+		}
+		if exp := len(a) + len(b) - 2*lcs[0][0]; n != exp {
+			t.Fatalf("diff %q %q: expected %d edits, got %d", a, b, exp, n)
+		}
+	}
+}
+
+func TestDiffLinesLarge(t *testing.T) {
+	a, b := make([]string, 10000), make([]string, 10000)
+	for i := range a {
+		a[i] = "a" + strconv.Itoa(i) + "\n"
+		b[i] = "b" + strconv.Itoa(i) + "\n"
+	}
+	if es := diffLines(a, b); len(es) != len(a)+len(b) {
+		t.Errorf("expected %d edits, got %d", len(a)+len(b), len(es))
+	}
+}
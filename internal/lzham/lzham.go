@@ -0,0 +1,590 @@
+// Package lzham is a pure-Go LZHAM decompressor compatible with the streams
+// produced by github.com/pg9182/tf2lzham (i.e., LZHAM alpha with a 2^20 byte
+// dictionary, no zlib header, and the adler32 trailer).
+//
+// It is a port of the unbuffered decompressor from lzham_lzdecomp.cpp, and
+// produces identical output, checksums, and errors for valid streams.
+package lzham
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/adler32"
+	"hash/crc32"
+)
+
+// Errors returned by Decompress, with the same messages as tf2lzham.
+var (
+	ErrZeroLength           = errors.New("lzham: zero-length buffer")
+	ErrNotFinished          = errors.New("lzham: incomplete: more bytes available")
+	ErrDestBufTooSmall      = errors.New("lzham: output buffer too small")
+	ErrExpectedMoreRawBytes = errors.New("lzham: unexpected end of file")
+	ErrBadCode              = errors.New("lzham: bad code")
+	ErrAdler32              = errors.New("lzham: failed adler32 checksum")
+	ErrBadRawBlock          = errors.New("lzham: bad raw block")
+	ErrBadSyncBlock         = errors.New("lzham: bad sync block")
+)
+
+// errMatchPastEnd is returned when a match extends past the end of dst. Like
+// tf2lzham, it is reported as ErrBadCode, but it also matches
+// ErrDestBufTooSmall.
+var errMatchPastEnd error = matchPastEndError{}
+
+type matchPastEndError struct{}
+
+func (matchPastEndError) Error() string {
+	return ErrBadCode.Error()
+}
+
+func (matchPastEndError) Is(target error) bool {
+	return target == ErrBadCode || target == ErrDestBufTooSmall
+}
+
+const (
+	dictSizeLog2 = 20
+
+	minMatchLen         = 2
+	maxMatchLen         = 257
+	numStates           = 12
+	numLitStates        = 7
+	numLitTables        = 64
+	numIsMatchModels    = numStates << 6
+	lowestUsableSlot    = 1
+	numSpecialLengths   = 2
+	numSecondaryLengths = 249
+	numHugeMatchCodes   = 1
+	endOfBlockCode      = 0
+
+	syncBlock = 0
+	compBlock = 1
+	rawBlock  = 2
+	eofBlock  = 3
+)
+
+var (
+	literalNextState = [numStates]uint32{0, 0, 0, 0, 1, 2, 3, 4, 5, 6, 4, 5}
+	hugeMatchBaseLen = [4]uint32{maxMatchLen + 1, maxMatchLen + 1 + 256, maxMatchLen + 1 + 256 + 1024, maxMatchLen + 1 + 256 + 1024 + 4096}
+	hugeMatchCodeLen = [4]int{8, 10, 12, 16}
+)
+
+// position slots for the match distances
+var (
+	numSlots          uint32
+	positionBase      [128]uint32
+	positionExtraBits [128]uint32
+)
+
+func init() {
+	for i, j := 0, uint32(0); i < len(positionBase); i += 2 {
+		positionExtraBits[i] = j
+		positionExtraBits[i+1] = j
+		if i != 0 && j < 25 {
+			j++
+		}
+	}
+	for i, base := 0, uint32(0); i < len(positionBase); i++ {
+		positionBase[i] = base
+		base += 1 << positionExtraBits[i]
+	}
+	for i := range positionBase {
+		if x := uint32(1)<<dictSizeLog2 - 1; x >= positionBase[i] && x < positionBase[i]+1<<positionExtraBits[i] {
+			numSlots = uint32(i) + 1
+			break
+		}
+	}
+}
+
+// Decompress decompresses src into dst, which must be large enough to hold the
+// entire output. It returns the number of bytes written and the checksums of
+// the output.
+func Decompress(dst, src []byte) (n int, adler32, crc32 uint32, err error) {
+	if len(dst) == 0 || len(src) == 0 {
+		return 0, 0, 0, ErrZeroLength
+	}
+	d := decoder{src: src}
+	return d.decompress(dst)
+}
+
+type decoder struct {
+	src []byte
+	pos int
+
+	bitBuf   uint64 // msb-first
+	bitCount int
+
+	arithValue  uint32
+	arithLength uint32
+
+	fastUpdating  bool
+	usePolarCodes bool
+
+	litTable      [numLitTables]model
+	deltaLitTable [numLitTables]model
+	mainTable     model
+	repLenTable   [2]model
+	largeLenTable [2]model
+	distLsbTable  model
+
+	isMatch          [numIsMatchModels]bitModel
+	isRep            [numStates]bitModel
+	isRep0           [numStates]bitModel
+	isRep0SingleByte [numStates]bitModel
+	isRep1           [numStates]bitModel
+	isRep2           [numStates]bitModel
+
+	scratch scratch
+}
+
+// getBits reads n bits, padding with zeros past the end of the input.
+func (d *decoder) getBits(n int) uint32 {
+	for d.bitCount < n {
+		var c byte
+		if d.pos < len(d.src) {
+			c = d.src[d.pos]
+			d.pos++
+		}
+		d.bitCount += 8
+		d.bitBuf |= uint64(c) << (64 - d.bitCount)
+	}
+	if n == 0 {
+		return 0
+	}
+	r := uint32(d.bitBuf >> (64 - n))
+	d.bitBuf <<= n
+	d.bitCount -= n
+	return r
+}
+
+func (d *decoder) alignToByte() {
+	if d.bitCount&7 != 0 {
+		d.getBits(d.bitCount & 7)
+	}
+}
+
+func (d *decoder) arithStart() {
+	d.arithValue = 0
+	for i := 0; i < 4; i++ {
+		d.arithValue = d.arithValue<<8 | d.getBits(8)
+	}
+	d.arithLength = ^uint32(0)
+}
+
+func (d *decoder) decodeBit(m *bitModel) bool {
+	for d.arithLength < arithMinLen {
+		d.arithValue = d.arithValue<<8 | d.getBits(8)
+		d.arithLength <<= 8
+	}
+	x := uint32(*m) * (d.arithLength >> arithProbBits)
+	if d.arithValue < x {
+		*m += (arithProbScale - *m) >> arithProbMoveBits
+		d.arithLength = x
+		return false
+	}
+	*m -= *m >> arithProbMoveBits
+	d.arithValue -= x
+	d.arithLength -= x
+	return true
+}
+
+// decodeSymbol decodes a symbol using the prefix codes from m, then updates
+// the model.
+func (d *decoder) decodeSymbol(m *model) (uint32, error) {
+	if d.bitCount < 24 {
+		if d.pos+4 < len(d.src) {
+			d.bitCount += 32
+			d.bitBuf |= uint64(binary.BigEndian.Uint32(d.src[d.pos:])) << (64 - d.bitCount)
+			d.pos += 4
+		} else {
+			for d.bitCount < 24 {
+				var c byte
+				if d.pos < len(d.src) {
+					c = d.src[d.pos]
+					d.pos++
+				}
+				d.bitCount += 8
+				d.bitBuf |= uint64(c) << (64 - d.bitCount)
+			}
+		}
+	}
+
+	var (
+		t   = &m.tables
+		k   = uint32(d.bitBuf>>48) + 1
+		sym uint32
+		n   uint32
+	)
+	if k <= t.tableMaxCode {
+		e := t.lookup[d.bitBuf>>(64-t.tableBits)]
+		sym, n = e&0xFFFF, e>>16
+	} else {
+		n = t.decodeStartCodeSize
+		for k > t.maxCodes[n-1] {
+			n++
+		}
+		if n > maxExpectedCodeSize {
+			return 0, ErrBadCode
+		}
+		p := t.valPtrs[n-1] + int32(d.bitBuf>>(64-n))
+		if uint32(p) >= m.totalSyms {
+			p = 0
+		}
+		if int(p) >= len(t.sortedSymbolOrder) {
+			return 0, ErrBadCode
+		}
+		sym = uint32(t.sortedSymbolOrder[p])
+	}
+	if sym >= m.totalSyms {
+		return 0, ErrBadCode
+	}
+	d.bitBuf <<= n
+	d.bitCount -= int(n)
+
+	m.symFreq[sym]++
+	if m.symbolsUntilUpdate--; m.symbolsUntilUpdate == 0 {
+		m.update(&d.scratch)
+	}
+	return sym, nil
+}
+
+// decodeHugeMatchLen decodes the length of a match longer than maxMatchLen.
+func (d *decoder) decodeHugeMatchLen() uint32 {
+	var n int
+	for n < 3 && d.getBits(1) != 0 {
+		n++
+	}
+	return hugeMatchBaseLen[n] + d.getBits(hugeMatchCodeLen[n])
+}
+
+func (d *decoder) initTables() {
+	s := &d.scratch
+	d.litTable[0].init(256, d.fastUpdating, d.usePolarCodes, s)
+	for i := 1; i < len(d.litTable); i++ {
+		d.litTable[i].assign(&d.litTable[0])
+	}
+	d.deltaLitTable[0].init(256, d.fastUpdating, d.usePolarCodes, s)
+	for i := 1; i < len(d.deltaLitTable); i++ {
+		d.deltaLitTable[i].assign(&d.deltaLitTable[0])
+	}
+	d.mainTable.init(numSpecialLengths+(numSlots-lowestUsableSlot)*8, d.fastUpdating, d.usePolarCodes, s)
+	for i := range d.repLenTable {
+		d.repLenTable[i].init(numHugeMatchCodes+(maxMatchLen-minMatchLen+1), d.fastUpdating, d.usePolarCodes, s)
+		d.largeLenTable[i].init(numHugeMatchCodes+numSecondaryLengths, d.fastUpdating, d.usePolarCodes, s)
+	}
+	d.distLsbTable.init(16, d.fastUpdating, d.usePolarCodes, s)
+	d.clearBitModels()
+}
+
+func (d *decoder) clearBitModels() {
+	for i := range d.isMatch {
+		d.isMatch[i].clear()
+	}
+	for i := 0; i < numStates; i++ {
+		d.isRep[i].clear()
+		d.isRep0[i].clear()
+		d.isRep0SingleByte[i].clear()
+		d.isRep1[i].clear()
+		d.isRep2[i].clear()
+	}
+}
+
+func (d *decoder) resetAllTables() {
+	s := &d.scratch
+	d.litTable[0].reset(s)
+	for i := 1; i < len(d.litTable); i++ {
+		d.litTable[i].assign(&d.litTable[0])
+	}
+	d.deltaLitTable[0].reset(s)
+	for i := 1; i < len(d.deltaLitTable); i++ {
+		d.deltaLitTable[i].assign(&d.deltaLitTable[0])
+	}
+	d.mainTable.reset(s)
+	for i := range d.repLenTable {
+		d.repLenTable[i].reset(s)
+	}
+	for i := range d.largeLenTable {
+		d.largeLenTable[i].reset(s)
+	}
+	d.distLsbTable.reset(s)
+	d.clearBitModels()
+}
+
+func (d *decoder) resetHuffmanTableUpdateRates() {
+	for i := range d.litTable {
+		d.litTable[i].resetUpdateRate()
+	}
+	for i := range d.deltaLitTable {
+		d.deltaLitTable[i].resetUpdateRate()
+	}
+	d.mainTable.resetUpdateRate()
+	for i := range d.repLenTable {
+		d.repLenTable[i].resetUpdateRate()
+	}
+	for i := range d.largeLenTable {
+		d.largeLenTable[i].resetUpdateRate()
+	}
+	d.distLsbTable.resetUpdateRate()
+}
+
+func (d *decoder) flush(typ uint32) {
+	switch typ {
+	case 1:
+		d.resetHuffmanTableUpdateRates()
+	case 2:
+		d.resetAllTables()
+	}
+}
+
+// decompress decodes the stream into dst, returning the number of bytes
+// written and the checksums.
+func (d *decoder) decompress(dst []byte) (int, uint32, uint32, error) {
+	tmp := d.getBits(2)
+	d.fastUpdating = tmp&2 != 0
+	d.usePolarCodes = tmp&1 != 0
+	d.initTables()
+
+	var dstOfs int
+	for done := false; !done; {
+		switch d.getBits(2) {
+		case syncBlock:
+			typ := d.getBits(2)
+			d.flush(typ)
+			d.alignToByte()
+			if d.getBits(16) != 0 {
+				return 0, 0, 0, ErrBadSyncBlock
+			}
+			if d.getBits(16) != 0xFFFF {
+				return 0, 0, 0, ErrBadSyncBlock
+			}
+			if typ == 2 {
+				// a full flush would return the output so far to the caller,
+				// which isn't possible when decompressing into memory
+				return 0, 0, 0, ErrNotFinished
+			}
+
+		case rawBlock:
+			n := d.getBits(24)
+			if d.getBits(8) != (n^n>>8^n>>16)&0xFF {
+				return 0, 0, 0, ErrBadRawBlock
+			}
+			n++
+
+			d.alignToByte()
+			for n != 0 && d.bitCount >= 8 {
+				b := byte(d.bitBuf >> 56)
+				d.bitBuf <<= 8
+				d.bitCount -= 8
+				if dstOfs >= len(dst) {
+					return 0, 0, 0, ErrDestBufTooSmall
+				}
+				dst[dstOfs] = b
+				dstOfs++
+				n--
+			}
+			for n != 0 {
+				rem := len(d.src) - d.pos
+				if rem == 0 {
+					return 0, 0, 0, ErrExpectedMoreRawBytes
+				}
+				c := min(int(n), rem)
+				if dstOfs+c > len(dst) {
+					return 0, 0, 0, ErrDestBufTooSmall
+				}
+				copy(dst[dstOfs:], d.src[d.pos:d.pos+c])
+				d.pos += c
+				dstOfs += c
+				n -= uint32(c)
+			}
+
+		case compBlock:
+			var err error
+			if dstOfs, err = d.decompressBlock(dst, dstOfs); err != nil {
+				return 0, 0, 0, err
+			}
+			d.alignToByte()
+
+		case eofBlock:
+			done = true
+		}
+	}
+
+	d.alignToByte()
+	stored := d.getBits(16) << 16
+	stored |= d.getBits(16)
+	sum := adler32.Checksum(dst[:dstOfs])
+	if sum != stored {
+		return 0, 0, 0, ErrAdler32
+	}
+	return dstOfs, sum, crc32.ChecksumIEEE(dst[:dstOfs]), nil
+}
+
+// decompressBlock decodes a compressed block into dst at dstOfs, returning the
+// new offset.
+func (d *decoder) decompressBlock(dst []byte, dstOfs int) (int, error) {
+	d.arithStart()
+
+	var (
+		hist0, hist1, hist2, hist3 = 1, 1, 1, 1
+		curState                   uint32
+		prevChar, prevPrevChar     uint32
+	)
+	d.flush(d.getBits(2))
+
+	for {
+		if !d.decodeBit(&d.isMatch[prevChar>>2+curState<<6]) {
+			if dstOfs >= len(dst) {
+				return 0, ErrDestBufTooSmall
+			}
+			var r uint32
+			if curState < numLitStates {
+				sym, err := d.decodeSymbol(&d.litTable[prevChar>>5|(prevPrevChar>>5)<<3])
+				if err != nil {
+					return 0, err
+				}
+				r = sym
+			} else {
+				ofs := dstOfs - hist0
+				if ofs < 1 {
+					return 0, ErrBadCode
+				}
+				repLit0, repLit1 := uint32(dst[ofs]), uint32(dst[ofs-1])
+				sym, err := d.decodeSymbol(&d.deltaLitTable[repLit0>>5|(repLit1>>5)<<3])
+				if err != nil {
+					return 0, err
+				}
+				r = sym ^ repLit0
+			}
+			dst[dstOfs] = byte(r)
+			prevPrevChar = prevChar
+			prevChar = r
+			curState = literalNextState[curState]
+			dstOfs++
+			continue
+		}
+
+		var matchLen uint32 = 1
+		if d.decodeBit(&d.isRep[curState]) {
+			if d.decodeBit(&d.isRep0[curState]) {
+				if d.decodeBit(&d.isRep0SingleByte[curState]) {
+					if curState < numLitStates {
+						curState = 9
+					} else {
+						curState = 11
+					}
+				} else {
+					sym, err := d.decodeSymbol(&d.repLenTable[b2u(curState >= numLitStates)])
+					if err != nil {
+						return 0, err
+					}
+					if matchLen = sym + minMatchLen; matchLen == maxMatchLen+1 {
+						matchLen = d.decodeHugeMatchLen()
+					}
+					if curState < numLitStates {
+						curState = 8
+					} else {
+						curState = 11
+					}
+				}
+			} else {
+				sym, err := d.decodeSymbol(&d.repLenTable[b2u(curState >= numLitStates)])
+				if err != nil {
+					return 0, err
+				}
+				if matchLen = sym + minMatchLen; matchLen == maxMatchLen+1 {
+					matchLen = d.decodeHugeMatchLen()
+				}
+				if d.decodeBit(&d.isRep1[curState]) {
+					hist0, hist1 = hist1, hist0
+				} else if d.decodeBit(&d.isRep2[curState]) {
+					hist0, hist1, hist2 = hist2, hist0, hist1
+				} else {
+					hist0, hist1, hist2, hist3 = hist3, hist0, hist1, hist2
+				}
+				if curState < numLitStates {
+					curState = 8
+				} else {
+					curState = 11
+				}
+			}
+		} else {
+			sym, err := d.decodeSymbol(&d.mainTable)
+			if err != nil {
+				return 0, err
+			}
+			if sym < numSpecialLengths {
+				if sym == endOfBlockCode {
+					break
+				}
+				// partial state reset
+				hist0, hist1, hist2, hist3 = 1, 1, 1, 1
+				curState = 0
+				continue
+			}
+			sym -= numSpecialLengths
+
+			matchLen = sym&7 + 2
+			slot := sym>>3 + lowestUsableSlot
+			if matchLen == 9 {
+				e, err := d.decodeSymbol(&d.largeLenTable[b2u(curState >= numLitStates)])
+				if err != nil {
+					return 0, err
+				}
+				if matchLen += e; matchLen == maxMatchLen+1 {
+					matchLen = d.decodeHugeMatchLen()
+				}
+			}
+
+			var extra uint32
+			if nb := positionExtraBits[slot]; nb < 3 {
+				extra = d.getBits(int(nb))
+			} else {
+				if nb > 4 {
+					extra = d.getBits(int(nb-4)) << 4
+				}
+				j, err := d.decodeSymbol(&d.distLsbTable)
+				if err != nil {
+					return 0, err
+				}
+				extra += j
+			}
+
+			hist3, hist2, hist1 = hist2, hist1, hist0
+			hist0 = int(positionBase[slot] + extra)
+			if curState < numLitStates {
+				curState = numLitStates
+			} else {
+				curState = numLitStates + 3
+			}
+		}
+
+		if hist0 > dstOfs {
+			return 0, ErrBadCode
+		}
+		if dstOfs+int(matchLen) > len(dst) {
+			return 0, errMatchPastEnd
+		}
+		end := dstOfs + int(matchLen)
+		if src := dstOfs - hist0; hist0 >= int(matchLen) {
+			copy(dst[dstOfs:end], dst[src:])
+		} else {
+			for i := dstOfs; i < end; i++ {
+				dst[i] = dst[src]
+				src++
+			}
+		}
+		if matchLen == 1 {
+			prevPrevChar = prevChar
+		} else {
+			prevPrevChar = uint32(dst[end-2])
+		}
+		prevChar = uint32(dst[end-1])
+		dstOfs = end
+	}
+	return dstOfs, nil
+}
+
+func b2u(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,171 @@
+package lzham
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pg9182/tf2lzham"
+)
+
+func testInputs() map[string][]byte {
+	rng := rand.New(rand.NewSource(1))
+	random := func(n int) []byte {
+		b := make([]byte, n)
+		rng.Read(b)
+		return b
+	}
+	text := func(n int) []byte {
+		words := []string{"titanfall", "pilot", "vpk", "chunk", "the", "a", "of", "\n", "models/", "materials/", ".vmt", ".mdl", " ", "  ", "\t"}
+		var b bytes.Buffer
+		for b.Len() < n {
+			b.WriteString(words[rng.Intn(len(words))])
+		}
+		return b.Bytes()[:n]
+	}
+	mixed := func(n int) []byte {
+		var b bytes.Buffer
+		for b.Len() < n {
+			switch rng.Intn(4) {
+			case 0:
+				b.Write(random(rng.Intn(4096)))
+			case 1:
+				b.Write(text(rng.Intn(16384)))
+			case 2:
+				b.Write(bytes.Repeat([]byte{byte(rng.Intn(256))}, rng.Intn(70000)))
+			case 3:
+				if x := b.Bytes(); len(x) != 0 {
+					o := rng.Intn(len(x))
+					b.Write(append([]byte(nil), x[o:min(len(x), o+rng.Intn(8192))]...))
+				}
+			}
+		}
+		return b.Bytes()[:n]
+	}
+	return map[string][]byte{
+		"Byte":       {'x'},
+		"Zero":       make([]byte, 1<<20),
+		"Run":        bytes.Repeat([]byte("ab"), 300000),
+		"Random1K":   random(1024),
+		"Random1M":   random(1 << 20),
+		"Text64K":    text(64 << 10),
+		"Text3M":     text(3 << 20),
+		"Mixed256K":  mixed(256 << 10),
+		"Mixed4M":    mixed(4 << 20),
+		"MixedSmall": mixed(37),
+	}
+}
+
+func TestDecompress(t *testing.T) {
+	for name, src := range testInputs() {
+		t.Run(name, func(t *testing.T) {
+			z := make([]byte, len(src)+len(src)/2+1024)
+			zn, _, _, err := tf2lzham.Compress(z, src)
+			if err != nil {
+				t.Fatalf("compress: %v", err)
+			}
+			z = z[:zn]
+
+			testDecompressDiff(t, make([]byte, len(src)), z)
+			testDecompressDiff(t, make([]byte, len(src)+1), z)
+			if len(src) > 1 {
+				testDecompressDiff(t, make([]byte, len(src)-1), z)
+				testDecompressDiff(t, make([]byte, len(src)/2), z)
+
+				// tf2lzham returns a bad code error if a match extends past the end
+				if _, _, _, err := Decompress(make([]byte, len(src)/2), z); !errors.Is(err, ErrDestBufTooSmall) {
+					t.Errorf("decompress (dst=%d): expected error matching %v, got %v", len(src)/2, ErrDestBufTooSmall, err)
+				}
+			}
+			testDecompressDiff(t, make([]byte, len(src)), z[:len(z)-1])
+			testDecompressDiff(t, make([]byte, len(src)), z[:len(z)/2])
+			testDecompressDiff(t, make([]byte, len(src)), append(z, 0, 1, 2))
+
+			rng := rand.New(rand.NewSource(int64(len(src))))
+			for i := 0; i < 16; i++ {
+				c := bytes.Clone(z)
+				c[rng.Intn(len(c))] ^= 1 << rng.Intn(8)
+				testDecompressDiff(t, make([]byte, len(src)), c)
+			}
+		})
+	}
+}
+
+func testDecompressDiff(t *testing.T, dst, src []byte) {
+	t.Helper()
+	ref := make([]byte, len(dst))
+	n1, a1, c1, err1 := tf2lzham.Decompress(ref, src)
+	n2, a2, c2, err2 := Decompress(dst, src)
+	if r1, r2 := fmt.Sprint(n1, a1, c1, err1), fmt.Sprint(n2, a2, c2, err2); r1 != r2 {
+		t.Errorf("decompress (dst=%d src=%d): expected (%s), got (%s)", len(dst), len(src), r1, r2)
+	} else if err1 == nil && !bytes.Equal(ref[:n1], dst[:n2]) {
+		t.Errorf("decompress (dst=%d src=%d): output differs", len(dst), len(src))
+	}
+}
+
+// TestDecompressLevels tests streams which tf2lzham can't produce since it
+// always compresses with LZHAM_COMP_LEVEL_UBER. The testdata was compressed
+// from testInputs using lzham_compress_memory with a 2^20 byte dictionary.
+func TestDecompressLevels(t *testing.T) {
+	for _, x := range []struct {
+		Name    string
+		Size    int
+		Adler32 uint32
+		CRC32   uint32
+	}{
+		{"text.level0.lzham", 65536, 0x5368399f, 0x7c5a2180},   // fast updating, polar codes
+		{"text.level2.lzham", 65536, 0x5368399f, 0x7c5a2180},   // polar codes
+		{"mixed.level1.lzham", 262144, 0xed433265, 0xbaa39e52}, // fast updating, polar codes
+	} {
+		src, err := os.ReadFile(filepath.Join("testdata", x.Name))
+		if err != nil {
+			t.Fatalf("read testdata: %v", err)
+		}
+		testDecompressDiff(t, make([]byte, x.Size), src)
+
+		n, a, c, err := Decompress(make([]byte, x.Size), src)
+		if err != nil {
+			t.Errorf("%s: decompress: %v", x.Name, err)
+		} else if n != x.Size || a != x.Adler32 || c != x.CRC32 {
+			t.Errorf("%s: expected %d %08x %08x, got %d %08x %08x", x.Name, x.Size, x.Adler32, x.CRC32, n, a, c)
+		}
+	}
+}
+
+func TestDecompressZeroLength(t *testing.T) {
+	if _, _, _, err := Decompress(nil, []byte{0}); err != ErrZeroLength {
+		t.Errorf("expected %v, got %v", ErrZeroLength, err)
+	}
+	if _, _, _, err := Decompress([]byte{0}, nil); err != ErrZeroLength {
+		t.Errorf("expected %v, got %v", ErrZeroLength, err)
+	}
+}
+
+func BenchmarkDecompress(b *testing.B) {
+	src := testInputs()["Mixed4M"]
+	z := make([]byte, len(src)*2)
+	zn, _, _, err := tf2lzham.Compress(z, src)
+	if err != nil {
+		b.Fatalf("compress: %v", err)
+	}
+	z = z[:zn]
+
+	for name, fn := range map[string]func(dst, src []byte) (int, uint32, uint32, error){
+		"Native":   Decompress,
+		"TF2LZHAM": tf2lzham.Decompress,
+	} {
+		b.Run(name, func(b *testing.B) {
+			dst := make([]byte, len(src))
+			b.SetBytes(int64(len(src)))
+			for i := 0; i < b.N; i++ {
+				if _, _, _, err := fn(dst, z); err != nil {
+					b.Fatalf("decompress: %v", err)
+				}
+			}
+		})
+	}
+}
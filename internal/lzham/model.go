@@ -0,0 +1,531 @@
+package lzham
+
+import "math/bits"
+
+const (
+	maxExpectedCodeSize = 16
+	maxSupportedSyms    = 1024
+	maxTableBits        = 11
+)
+
+// bitModel is an adaptive binary probability for the arithmetic coder.
+type bitModel uint16
+
+const (
+	arithProbBits     = 11
+	arithProbScale    = 1 << arithProbBits
+	arithProbMoveBits = 5
+	arithMinLen       = 0x01000000
+)
+
+func (m *bitModel) clear() {
+	*m = 1 << (arithProbBits - 1)
+}
+
+// scratch is the working memory for generating code sizes.
+type scratch struct {
+	syms0, syms1 [maxSupportedSyms]symFreq
+	x            [maxSupportedSyms]int
+}
+
+type symFreq struct {
+	freq uint32
+	sym  uint16
+}
+
+// model is a quasi-adaptive Huffman (or Polar) data model, which periodically
+// regenerates its prefix codes from the symbol frequencies.
+type model struct {
+	totalSyms          uint32
+	maxCycle           uint32
+	updateCycle        uint32
+	symbolsUntilUpdate uint32
+	totalCount         uint32
+	tableBits          uint32
+	fastUpdating       bool
+	usePolarCodes      bool
+
+	symFreq   []uint16
+	codeSizes []uint8
+	tables    decoderTables
+}
+
+func (m *model) init(totalSyms uint32, fastUpdating, usePolarCodes bool, s *scratch) {
+	m.fastUpdating = fastUpdating
+	m.usePolarCodes = usePolarCodes
+	m.symbolsUntilUpdate = 0
+	m.symFreq = make([]uint16, totalSyms)
+	m.codeSizes = make([]uint8, totalSyms)
+	m.totalSyms = totalSyms
+	if totalSyms <= 16 {
+		m.tableBits = 0
+	} else {
+		m.tableBits = min(1+ceilLog2(totalSyms), maxTableBits)
+	}
+	if fastUpdating {
+		m.maxCycle = (max(64, totalSyms) + 6) << 5
+	} else {
+		m.maxCycle = (max(24, totalSyms) + 6) * 12
+	}
+	m.maxCycle = min(m.maxCycle, 32767)
+	m.reset(s)
+}
+
+// assign deep-copies o into m.
+func (m *model) assign(o *model) {
+	symFreq, codeSizes, tables := m.symFreq, m.codeSizes, m.tables
+	*m = *o
+	m.symFreq = append(symFreq[:0], o.symFreq...)
+	m.codeSizes = append(codeSizes[:0], o.codeSizes...)
+	m.tables = o.tables
+	m.tables.lookup = append(tables.lookup[:0], o.tables.lookup...)
+	m.tables.sortedSymbolOrder = append(tables.sortedSymbolOrder[:0], o.tables.sortedSymbolOrder...)
+}
+
+func (m *model) reset(s *scratch) {
+	if m.totalSyms == 0 {
+		return
+	}
+	for i := range m.symFreq {
+		m.symFreq[i] = 1
+	}
+	m.updateCycle = m.totalSyms
+	m.totalCount = 0
+	m.symbolsUntilUpdate = 0
+	m.update(s)
+	m.symbolsUntilUpdate = 8
+	m.updateCycle = 8
+}
+
+func (m *model) rescale() {
+	var total uint32
+	for i, f := range m.symFreq {
+		f = (f + 1) >> 1
+		total += uint32(f)
+		m.symFreq[i] = f
+	}
+	m.totalCount = total
+}
+
+func (m *model) resetUpdateRate() {
+	m.totalCount += m.updateCycle - m.symbolsUntilUpdate
+	if m.totalCount > m.totalSyms {
+		m.rescale()
+	}
+	m.updateCycle = min(8, m.updateCycle)
+	m.symbolsUntilUpdate = m.updateCycle
+}
+
+// update regenerates the decoder tables from the symbol frequencies.
+func (m *model) update(s *scratch) {
+	m.totalCount += m.updateCycle
+	for m.totalCount >= 32768 {
+		m.rescale()
+	}
+
+	var maxCodeSize uint32
+	if m.usePolarCodes {
+		maxCodeSize = polarCodeSizes(s, m.symFreq, m.codeSizes)
+	} else {
+		maxCodeSize = huffmanCodeSizes(s, m.symFreq, m.codeSizes)
+	}
+	if maxCodeSize > maxExpectedCodeSize {
+		limitMaxCodeSize(m.codeSizes, maxExpectedCodeSize)
+	}
+	m.tables.generate(m.codeSizes, m.tableBits)
+
+	if m.fastUpdating {
+		m.updateCycle = 2 * m.updateCycle
+	} else {
+		m.updateCycle = (5 * m.updateCycle) >> 2
+	}
+	if m.updateCycle > m.maxCycle {
+		m.updateCycle = m.maxCycle
+	}
+	m.symbolsUntilUpdate = m.updateCycle
+}
+
+// decoderTables are the canonical prefix code decoding tables for a model.
+type decoderTables struct {
+	tableBits           uint32
+	tableMaxCode        uint32
+	decodeStartCodeSize uint32
+	maxCodes            [maxExpectedCodeSize + 1]uint32
+	valPtrs             [maxExpectedCodeSize + 1]int32
+	lookup              []uint32 // symbol | code size << 16
+	sortedSymbolOrder   []uint16
+}
+
+func (t *decoderTables) generate(codeSizes []uint8, tableBits uint32) {
+	var numCodes [maxExpectedCodeSize + 1]uint32
+	for _, c := range codeSizes {
+		numCodes[c]++
+	}
+
+	var (
+		minCodes        [maxExpectedCodeSize]uint32
+		sortedPositions [maxExpectedCodeSize + 1]uint32
+		nextCode        uint32
+		totalUsedSyms   uint32
+		minCodeSize     uint32 = ^uint32(0)
+		maxCodeSize     uint32
+	)
+	for i := uint32(1); i <= maxExpectedCodeSize; i++ {
+		if n := numCodes[i]; n == 0 {
+			t.maxCodes[i-1] = 0
+		} else {
+			minCodeSize = min(minCodeSize, i)
+			maxCodeSize = max(maxCodeSize, i)
+			minCodes[i-1] = nextCode
+			t.maxCodes[i-1] = 1 + ((nextCode+n-1)<<(16-i) | (1<<(16-i) - 1))
+			t.valPtrs[i-1] = int32(totalUsedSyms)
+			sortedPositions[i] = totalUsedSyms
+			nextCode += n
+			totalUsedSyms += n
+		}
+		nextCode <<= 1
+	}
+
+	if cap(t.sortedSymbolOrder) < int(totalUsedSyms) {
+		t.sortedSymbolOrder = make([]uint16, totalUsedSyms)
+	}
+	t.sortedSymbolOrder = t.sortedSymbolOrder[:totalUsedSyms]
+	for i, c := range codeSizes {
+		if c != 0 {
+			t.sortedSymbolOrder[sortedPositions[c]] = uint16(i)
+			sortedPositions[c]++
+		}
+	}
+
+	if tableBits <= minCodeSize {
+		tableBits = 0
+	}
+	t.tableBits = tableBits
+
+	if tableBits != 0 {
+		if cap(t.lookup) < 1<<tableBits {
+			t.lookup = make([]uint32, 1<<tableBits)
+		}
+		t.lookup = t.lookup[:1<<tableBits]
+		for i := range t.lookup {
+			t.lookup[i] = ^uint32(0)
+		}
+		for codeSize := uint32(1); codeSize <= tableBits; codeSize++ {
+			if numCodes[codeSize] == 0 {
+				continue
+			}
+			fillSize := tableBits - codeSize
+			minCode := minCodes[codeSize-1]
+			maxCode := (t.maxCodes[codeSize-1] - 1) >> (16 - codeSize)
+			valPtr := uint32(t.valPtrs[codeSize-1])
+			for code := minCode; code <= maxCode; code++ {
+				sym := uint32(t.sortedSymbolOrder[valPtr+code-minCode])
+				for j := uint32(0); j < 1<<fillSize; j++ {
+					t.lookup[j+code<<fillSize] = sym | codeSize<<16
+				}
+			}
+		}
+	}
+
+	for i := 0; i < maxExpectedCodeSize; i++ {
+		t.valPtrs[i] -= int32(minCodes[i])
+	}
+
+	t.tableMaxCode = 0
+	t.decodeStartCodeSize = minCodeSize
+	if tableBits != 0 {
+		i := tableBits
+		for ; i >= 1; i-- {
+			if numCodes[i] != 0 {
+				t.tableMaxCode = t.maxCodes[i-1]
+				break
+			}
+		}
+		if i >= 1 {
+			t.decodeStartCodeSize = tableBits + 1
+			for i = tableBits + 1; i <= maxCodeSize; i++ {
+				if numCodes[i] != 0 {
+					t.decodeStartCodeSize = i
+					break
+				}
+			}
+		}
+	}
+
+	// sentinels
+	t.maxCodes[maxExpectedCodeSize] = ^uint32(0)
+	t.valPtrs[maxExpectedCodeSize] = 0xFFFFF
+}
+
+// sortSyms sorts the used symbols by ascending frequency, preserving the
+// symbol order for equal frequencies.
+func sortSyms(s *scratch, n int) []symFreq {
+	var hist [2][256]uint32
+	for _, x := range s.syms0[:n] {
+		hist[0][x.freq&0xFF]++
+		hist[1][(x.freq>>8)&0xFF]++
+	}
+	passes := 2
+	if hist[1][0] == uint32(n) {
+		passes = 1
+	}
+	cur, next := s.syms0[:n], s.syms1[:n]
+	for pass := 0; pass < passes; pass++ {
+		var offsets [256]uint32
+		var ofs uint32
+		for i, h := range hist[pass] {
+			offsets[i] = ofs
+			ofs += h
+		}
+		for _, x := range cur {
+			c := (x.freq >> (pass * 8)) & 0xFF
+			next[offsets[c]] = x
+			offsets[c]++
+		}
+		cur, next = next, cur
+	}
+	return cur
+}
+
+// huffmanCodeSizes computes the Huffman code sizes for freq, returning the max
+// code size.
+func huffmanCodeSizes(s *scratch, freq []uint16, codeSizes []uint8) uint32 {
+	var n int
+	for i, f := range freq {
+		if f == 0 {
+			codeSizes[i] = 0
+		} else {
+			s.syms0[n] = symFreq{uint32(f), uint16(i)}
+			n++
+		}
+	}
+	if n == 1 {
+		codeSizes[s.syms0[0].sym] = 1
+		return 1
+	}
+	syms := sortSyms(s, n)
+
+	x := s.x[:n]
+	for i, sf := range syms {
+		x[i] = int(sf.freq)
+	}
+	calculateMinimumRedundancy(x)
+
+	var maxLen uint32
+	for i, sf := range syms {
+		maxLen = max(maxLen, uint32(x[i]))
+		codeSizes[sf.sym] = uint8(x[i])
+	}
+	return maxLen
+}
+
+// calculateMinimumRedundancy computes in-place Huffman code lengths for the
+// sorted frequencies in A (Moffat and Katajainen, 1996).
+func calculateMinimumRedundancy(A []int) {
+	n := len(A)
+	if n == 0 {
+		return
+	}
+	if n == 1 {
+		A[0] = 0
+		return
+	}
+
+	// first pass, left to right, setting parent pointers
+	A[0] += A[1]
+	root, leaf := 0, 2
+	for next := 1; next < n-1; next++ {
+		// select first item for a pairing
+		if leaf >= n || A[root] < A[leaf] {
+			A[next] = A[root]
+			A[root] = next
+			root++
+		} else {
+			A[next] = A[leaf]
+			leaf++
+		}
+
+		// add on the second item
+		if leaf >= n || (root < next && A[root] < A[leaf]) {
+			A[next] += A[root]
+			A[root] = next
+			root++
+		} else {
+			A[next] += A[leaf]
+			leaf++
+		}
+	}
+
+	// second pass, right to left, setting internal depths
+	A[n-2] = 0
+	for next := n - 3; next >= 0; next-- {
+		A[next] = A[A[next]] + 1
+	}
+
+	// third pass, right to left, setting leaf depths
+	avbl, used, dpth := 1, 0, 0
+	root, next := n-2, n-1
+	for avbl > 0 {
+		for root >= 0 && A[root] == dpth {
+			used++
+			root--
+		}
+		for avbl > used {
+			A[next] = dpth
+			next--
+			avbl--
+		}
+		avbl = 2 * used
+		dpth++
+		used = 0
+	}
+}
+
+// polarCodeSizes computes the Polar code sizes for freq, returning the max code
+// size.
+func polarCodeSizes(s *scratch, freq []uint16, codeSizes []uint8) uint32 {
+	var n int
+	for i, f := range freq {
+		if f == 0 {
+			codeSizes[i] = 0
+		} else {
+			s.syms0[n] = symFreq{uint32(f), uint16(i)}
+			n++
+		}
+	}
+	if n == 1 {
+		codeSizes[s.syms0[0].sym] = 1
+		return 1
+	}
+	syms := sortSyms(s, n)
+
+	// note: tmp is in descending order of frequency
+	tmp := s.x[:n]
+	var origTotal, curTotal uint32
+	for i := range tmp {
+		f := syms[n-1-i].freq
+		origTotal += f
+		tmp[i] = 1 << (bits.Len32(f) - 1)
+		curTotal += uint32(tmp[i])
+	}
+
+	treeTotal := uint32(1) << (bits.Len32(origTotal) - 1)
+	if treeTotal < origTotal {
+		treeTotal <<= 1
+	}
+
+	start := 0
+	for curTotal < treeTotal && start < n {
+		for i := start; i < n; i++ {
+			f := uint32(tmp[i])
+			if curTotal+f <= treeTotal {
+				tmp[i] += int(f)
+				if curTotal += f; curTotal == treeTotal {
+					break
+				}
+			} else {
+				start = i + 1
+			}
+		}
+	}
+
+	var maxCodeSize uint32
+	treeTotalBits := uint32(bits.Len32(treeTotal))
+	for i := range tmp {
+		c := treeTotalBits - uint32(bits.Len32(uint32(tmp[i])))
+		maxCodeSize = max(maxCodeSize, c)
+		codeSizes[syms[n-1-i].sym] = uint8(c)
+	}
+	return maxCodeSize
+}
+
+// limitMaxCodeSize adjusts codeSizes so none are longer than maxCodeSize
+// (using the technique from LHArc).
+func limitMaxCodeSize(codeSizes []uint8, maxCodeSize uint32) bool {
+	const maxEverCodeSize = 34
+
+	if len(codeSizes) == 0 || len(codeSizes) > maxSupportedSyms || maxCodeSize < 1 || maxCodeSize > maxEverCodeSize {
+		return false
+	}
+
+	var numCodes [maxEverCodeSize + 1]uint32
+	var shouldLimit bool
+	for _, c := range codeSizes {
+		if c > maxEverCodeSize {
+			return false
+		}
+		numCodes[c]++
+		if uint32(c) > maxCodeSize {
+			shouldLimit = true
+		}
+	}
+	if !shouldLimit {
+		return true
+	}
+
+	var nextSortedOfs [maxEverCodeSize + 1]uint32
+	var ofs uint32
+	for i := 1; i <= maxEverCodeSize; i++ {
+		nextSortedOfs[i] = ofs
+		ofs += numCodes[i]
+	}
+	if ofs < 2 || ofs > maxSupportedSyms {
+		return true
+	}
+	if ofs > 1<<maxCodeSize {
+		return false
+	}
+
+	for i := maxCodeSize + 1; i <= maxEverCodeSize; i++ {
+		numCodes[maxCodeSize] += numCodes[i]
+	}
+
+	var total uint32
+	for i := maxCodeSize; i > 0; i-- {
+		total += numCodes[i] << (maxCodeSize - i)
+	}
+	if total == 1<<maxCodeSize {
+		return true
+	}
+
+	for {
+		numCodes[maxCodeSize]--
+		i := maxCodeSize - 1
+		for ; i > 0; i-- {
+			if numCodes[i] != 0 {
+				numCodes[i]--
+				numCodes[i+1] += 2
+				break
+			}
+		}
+		if i == 0 {
+			return false
+		}
+		if total--; total == 1<<maxCodeSize {
+			break
+		}
+	}
+
+	var newCodeSizes [maxSupportedSyms]uint8
+	p := newCodeSizes[:0]
+	for i := uint32(1); i <= maxCodeSize; i++ {
+		for j := uint32(0); j < numCodes[i]; j++ {
+			p = append(p, uint8(i))
+		}
+	}
+	for i, c := range codeSizes {
+		if c != 0 {
+			codeSizes[i] = newCodeSizes[nextSortedOfs[c]]
+			nextSortedOfs[c]++
+		}
+	}
+	return true
+}
+
+func ceilLog2(v uint32) uint32 {
+	l := uint32(bits.Len32(v)) - 1 // floor
+	if v > 1<<l {
+		l++
+	}
+	return l
+}
@@ -0,0 +1,103 @@
+package internal
+
+import "sort"
+
+// Range is a half-open byte range.
+type Range struct {
+	Start uint64
+	End   uint64
+}
+
+// Len returns the number of bytes in the range.
+func (r Range) Len() uint64 {
+	return r.End - r.Start
+}
+
+// RangeSet is a set of byte ranges, where overlapping and adjacent ranges are
+// merged together.
+type RangeSet struct {
+	r     []Range
+	pre   []uint64 // compacted start offset of each range
+	dirty bool
+}
+
+// Add adds the range [start, end) to the set. Empty ranges are ignored.
+func (s *RangeSet) Add(start, end uint64) {
+	if end > start {
+		s.r = append(s.r, Range{start, end})
+		s.dirty = true
+	}
+}
+
+// Ranges returns the merged ranges in ascending order.
+func (s *RangeSet) Ranges() []Range {
+	s.normalize()
+	return s.r
+}
+
+// Len returns the total number of bytes covered by the set.
+func (s *RangeSet) Len() uint64 {
+	s.normalize()
+	if len(s.r) == 0 {
+		return 0
+	}
+	return s.pre[len(s.r)-1] + s.r[len(s.r)-1].Len()
+}
+
+// Find returns the index of the merged range containing off.
+func (s *RangeSet) Find(off uint64) (int, bool) {
+	s.normalize()
+	i := sort.Search(len(s.r), func(i int) bool {
+		return s.r[i].End > off
+	})
+	if i == len(s.r) || s.r[i].Start > off {
+		return -1, false
+	}
+	return i, true
+}
+
+// Compact maps off to the offset it would have if only the bytes covered by
+// the set were kept, in order.
+func (s *RangeSet) Compact(off uint64) (uint64, bool) {
+	i, ok := s.Find(off)
+	if !ok {
+		return 0, false
+	}
+	return s.pre[i] + off - s.r[i].Start, true
+}
+
+// CompactRange is like Compact, but only succeeds if the entire range
+// [start, end) is covered by the set.
+func (s *RangeSet) CompactRange(start, end uint64) (uint64, bool) {
+	i, ok := s.Find(start)
+	if !ok || end > s.r[i].End {
+		return 0, false
+	}
+	return s.pre[i] + start - s.r[i].Start, true
+}
+
+func (s *RangeSet) normalize() {
+	if !s.dirty {
+		return
+	}
+	sort.Slice(s.r, func(i, j int) bool {
+		return s.r[i].Start < s.r[j].Start
+	})
+	var n int
+	for _, x := range s.r {
+		if n != 0 && x.Start <= s.r[n-1].End {
+			s.r[n-1].End = max(s.r[n-1].End, x.End)
+		} else {
+			s.r[n] = x
+			n++
+		}
+	}
+	s.r = s.r[:n]
+	s.pre = s.pre[:0]
+	var pre uint64
+	for _, x := range s.r {
+		s.pre = append(s.pre, pre)
+		pre += x.Len()
+	}
+	s.dirty = false
+}
@@ -0,0 +1,59 @@
+package internal
+
+import "testing"
+
+func TestRangeSet(t *testing.T) {
+	var s RangeSet
+	s.Add(10, 20)
+	s.Add(15, 25) // overlapping
+	s.Add(25, 30) // adjacent
+	s.Add(40, 50)
+	s.Add(42, 44) // contained
+	s.Add(60, 60) // empty
+
+	if rs := s.Ranges(); len(rs) != 2 || rs[0] != (Range{10, 30}) || rs[1] != (Range{40, 50}) {
+		t.Errorf("unexpected ranges %v", rs)
+	}
+	if n := s.Len(); n != 30 {
+		t.Errorf("expected length 30, got %d", n)
+	}
+	for _, x := range []struct {
+		Offset  uint64
+		Compact uint64
+		OK      bool
+	}{
+		{0, 0, false},
+		{10, 0, true},
+		{29, 19, true},
+		{30, 0, false},
+		{40, 20, true},
+		{43, 23, true},
+		{50, 0, false},
+	} {
+		if c, ok := s.Compact(x.Offset); c != x.Compact || ok != x.OK {
+			t.Errorf("compact(%d): expected %d %t, got %d %t", x.Offset, x.Compact, x.OK, c, ok)
+		}
+	}
+
+	for _, x := range []struct {
+		Start, End uint64
+		Compact    uint64
+		OK         bool
+	}{
+		{10, 30, 0, true},
+		{12, 20, 2, true},
+		{25, 35, 0, false},
+		{40, 50, 20, true},
+		{35, 45, 0, false},
+		{20, 45, 0, false},
+	} {
+		if c, ok := s.CompactRange(x.Start, x.End); c != x.Compact || ok != x.OK {
+			t.Errorf("compact range(%d, %d): expected %d %t, got %d %t", x.Start, x.End, x.Compact, x.OK, c, ok)
+		}
+	}
+
+	s.Add(0, 5)
+	if c, ok := s.Compact(40); c != 25 || !ok {
+		t.Errorf("compact(40) after add: expected 25 true, got %d %t", c, ok)
+	}
+}
@@ -1,6 +1,7 @@
 package tf2vpk
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
@@ -9,28 +10,45 @@ import (
 	"path"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 )
 
 // Reader reads Titanfall 2 VPKs.
 type Reader struct {
 	Root  ValvePakDir
+	opt   Options
 	block map[ValvePakIndex]io.ReaderAt
 	close map[ValvePakIndex]io.Closer
+
+	index     map[string]*readerInfo
+	indexOnce sync.Once
 }
 
-// NewReader creates a new Reader reading from vpk.
+// NewReader creates a new Reader reading from vpk using the default Options.
 func NewReader(vpk ValvePakRef) (*Reader, error) {
-	return NewReaderFunc(func(i ValvePakIndex) (io.ReaderAt, error) {
+	return NewReaderOptions(vpk, Options{})
+}
+
+// NewReaderOptions creates a new Reader reading from vpk.
+func NewReaderOptions(vpk ValvePakRef, opt Options) (*Reader, error) {
+	return NewReaderFuncOptions(func(i ValvePakIndex) (io.ReaderAt, error) {
 		return os.Open(vpk.Resolve(i))
-	})
+	}, opt)
 }
 
-// NewReaderFunc creates a new Reader reading using the provided function. If
-// the returned [io.ReaderAt] implements [io.Closer], it will be called when the
-// Reader is closed.
+// NewReaderFunc creates a new Reader reading using the provided function and
+// the default Options. If the returned [io.ReaderAt] implements [io.Closer], it
+// will be called when the Reader is closed.
 func NewReaderFunc(open func(ValvePakIndex) (io.ReaderAt, error)) (*Reader, error) {
+	return NewReaderFuncOptions(open, Options{})
+}
+
+// NewReaderFuncOptions is like NewReaderFunc, but uses the provided Options
+// for reading the dir index and files.
+func NewReaderFuncOptions(open func(ValvePakIndex) (io.ReaderAt, error), opt Options) (*Reader, error) {
 	r := &Reader{
+		opt:   opt,
 		block: map[ValvePakIndex]io.ReaderAt{},
 		close: map[ValvePakIndex]io.Closer{},
 	}
@@ -40,7 +58,7 @@ func NewReaderFunc(open func(ValvePakIndex) (io.ReaderAt, error)) (*Reader, erro
 	if err != nil {
 		return nil, fmt.Errorf("open vpk dir index: %w", err)
 	}
-	if err := r.Root.Deserialize(io.NewSectionReader(dir, 0, 1<<63-1)); err != nil {
+	if err := r.Root.DeserializeOptions(io.NewSectionReader(dir, 0, 1<<63-1), opt); err != nil {
 		return nil, fmt.Errorf("read root directory: %w", err)
 	}
 
@@ -52,7 +70,11 @@ func NewReaderFunc(open func(ValvePakIndex) (io.ReaderAt, error)) (*Reader, erro
 	if dir, ok := dir.(io.Closer); ok {
 		r.close[ValvePakIndexDir] = dir
 	}
-	r.block[ValvePakIndexDir] = io.NewSectionReader(dir, int64(chunkOffset), 1<<63-1)
+	if n, ok := readerSize(dir); ok && n >= int64(chunkOffset) {
+		r.block[ValvePakIndexDir] = io.NewSectionReader(dir, int64(chunkOffset), n-int64(chunkOffset))
+	} else {
+		r.block[ValvePakIndexDir] = struct{ io.ReaderAt }{io.NewSectionReader(dir, int64(chunkOffset), 1<<63-1)} // hide the size since we don't know it
+	}
 
 	// open blocks
 	var errs []error
@@ -72,9 +94,71 @@ func NewReaderFunc(open func(ValvePakIndex) (io.ReaderAt, error)) (*Reader, erro
 		_ = r.Close()
 		return nil, fmt.Errorf("open blocks: %w", err)
 	}
+
+	// detect codec
+	if opt.Codec == nil && opt.DetectCodec {
+		if err := r.detectCodec(); err != nil {
+			_ = r.Close()
+			return nil, fmt.Errorf("detect codec: %w", err)
+		}
+	}
 	return r, nil
 }
 
+// detectCodec sets the codec based on the first compressed chunk. Since the
+// detectors only check for a header, the codec is only used if it can also
+// decompress the chunk (otherwise, the default codec is kept).
+func (r *Reader) detectCodec() error {
+	for _, f := range r.Root.File {
+		for _, c := range f.Chunk {
+			if !c.IsCompressed() {
+				continue
+			}
+			if r.opt.MaxChunkSize != 0 && c.CompressedSize > r.opt.MaxChunkSize {
+				return fmt.Errorf("file %q: chunk too large", f.Path)
+			}
+			src := make([]byte, int(c.CompressedSize))
+			if _, err := r.block[f.Index].ReadAt(src, int64(c.Offset)); err != nil {
+				return fmt.Errorf("file %q: read chunk: %w", f.Path, err)
+			}
+			var dst []byte
+			for _, name := range Codecs() {
+				if codec, ok := LookupCodec(name); ok {
+					if d, ok := codec.(CodecDetector); ok && d.Detect(src) {
+						if dst == nil {
+							dst = make([]byte, int(c.UncompressedSize))
+						}
+						if n, err := codec.Decompress(dst, src); err == nil && n == len(dst) {
+							r.opt.Codec = codec
+							return nil
+						}
+					}
+				}
+			}
+			return nil
+		}
+	}
+	return nil
+}
+
+// Codec returns the codec used to decompress chunks.
+func (r *Reader) Codec() Codec {
+	return r.opt.codec()
+}
+
+// readerSize attempts to get the size of r.
+func readerSize(r io.ReaderAt) (int64, bool) {
+	switch r := r.(type) {
+	case interface{ Size() int64 }:
+		return r.Size(), true
+	case interface{ Stat() (fs.FileInfo, error) }:
+		if fi, err := r.Stat(); err == nil && fi.Mode().IsRegular() {
+			return fi.Size(), true
+		}
+	}
+	return 0, false
+}
+
 // Close cleans files opened by the Reader.
 func (r *Reader) Close() error {
 	var errs []error
@@ -93,18 +177,24 @@ func (r *Reader) Close() error {
 
 // OpenFile returns a new reader reading the contents of a specific file. The checksum is verified at EOF.
 func (r *Reader) OpenFile(f ValvePakFile) (io.Reader, error) {
-	return f.CreateReader(r.block[f.Index])
+	return f.createReaderParallel(r.block[f.Index], 1, r.opt)
 }
 
 // OpenFileParallel is like OpenFile, but but decompresses chunks in parallel
 // using n goroutines going no more than n compressed chunks ahead.
 func (r *Reader) OpenFileParallel(f ValvePakFile, n int) (io.Reader, error) {
-	return f.CreateReaderParallel(r.block[f.Index], n)
+	return f.createReaderParallel(r.block[f.Index], n, r.opt)
+}
+
+// OpenFileReader returns a new random-access reader reading the contents of a
+// specific file. The checksum is verified at EOF if it is read sequentially.
+func (r *Reader) OpenFileReader(f ValvePakFile) (*FileReader, error) {
+	return f.createFileReader(r.block[f.Index], r.opt)
 }
 
 // OpenChunk returns a new reader reading the contents of a specific chunk.
 func (r *Reader) OpenChunk(f ValvePakFile, c ValvePakChunk) (io.Reader, error) {
-	return c.CreateReader(r.block[f.Index])
+	return c.createReader(r.block[f.Index], f.Index, r.opt.codec())
 }
 
 // OpenChunkRaw returns a new reader reading the raw contents of a specific chunk.
@@ -112,48 +202,73 @@ func (r *Reader) OpenChunkRaw(f ValvePakFile, c ValvePakChunk) (io.Reader, error
 	return c.CreateReaderRaw(r.block[f.Index])
 }
 
-// OpenBlockRaw opens a new reader reading the contents of a specific block.
+// OpenBlockRaw opens a new reader reading the contents of a specific block. If
+// the size of the underlying reader is known, the returned reader implements
+// Size() int64.
 func (r *Reader) OpenBlockRaw(n ValvePakIndex) (io.ReaderAt, error) {
 	x, ok := r.block[n]
 	if !ok {
 		return nil, fmt.Errorf("block %#v out of range", n)
 	}
+	if _, ok := x.(interface{ Size() int64 }); !ok {
+		if n, ok := readerSize(x); ok {
+			return io.NewSectionReader(x, 0, n), nil
+		}
+	}
 	return x, nil
 }
 
+// SourceSections reads the checksum sections after the file data in the dir of
+// a Source VPK version 2.
+func (r *Reader) SourceSections() (ValvePakSourceSections, error) {
+	var s ValvePakSourceSections
+	if err := s.Deserialize(io.NewSectionReader(r.block[ValvePakIndexDir], int64(r.Root.DataSize), 1<<63-1), r.Root); err != nil {
+		return s, fmt.Errorf("read source vpk sections: %w", err)
+	}
+	return s, nil
+}
+
 var (
 	_ fs.FS          = (*Reader)(nil)
+	_ fs.StatFS      = (*Reader)(nil)
+	_ fs.ReadDirFS   = (*Reader)(nil)
+	_ fs.ReadFileFS  = (*Reader)(nil)
+	_ fs.GlobFS      = (*Reader)(nil)
+	_ fs.SubFS       = (*Reader)(nil)
+	_ fs.FS          = (*readerSub)(nil)
+	_ fs.StatFS      = (*readerSub)(nil)
+	_ fs.ReadDirFS   = (*readerSub)(nil)
+	_ fs.ReadFileFS  = (*readerSub)(nil)
+	_ fs.GlobFS      = (*readerSub)(nil)
+	_ fs.SubFS       = (*readerSub)(nil)
 	_ fs.File        = (*readerFile)(nil)
+	_ io.ReadSeeker  = (*readerFile)(nil)
+	_ io.ReaderAt    = (*readerFile)(nil)
 	_ fs.ReadDirFile = (*readerDir)(nil)
 	_ fs.DirEntry    = (*readerInfo)(nil)
 	_ fs.FileInfo    = (*readerInfo)(nil)
 )
 
 type readerFile struct {
-	info readerInfo
-	rc   io.ReadCloser
+	info *readerInfo
+	*FileReader
 }
 
 func (f *readerFile) Stat() (fs.FileInfo, error) {
-	return &f.info, nil
-}
-
-func (f *readerFile) Read(b []byte) (n int, err error) {
-	return f.rc.Read(b)
+	return f.info, nil
 }
 
 func (f *readerFile) Close() error {
-	return f.rc.Close()
+	return nil
 }
 
 type readerDir struct {
-	info   readerInfo
-	entry  []*readerInfo
+	info   *readerInfo
 	offset int
 }
 
 func (f *readerDir) Stat() (fs.FileInfo, error) {
-	return &f.info, nil
+	return f.info, nil
 }
 
 func (f *readerDir) Read(b []byte) (n int, err error) {
@@ -165,7 +280,7 @@ func (f *readerDir) Close() error {
 }
 
 func (d *readerDir) ReadDir(count int) ([]fs.DirEntry, error) {
-	n := len(d.entry) - d.offset
+	n := len(d.info.child) - d.offset
 	if n == 0 && count > 0 {
 		return nil, io.EOF
 	}
@@ -174,15 +289,16 @@ func (d *readerDir) ReadDir(count int) ([]fs.DirEntry, error) {
 	}
 	list := make([]fs.DirEntry, n)
 	for i := range list {
-		list[i] = d.entry[d.offset+i]
+		list[i] = d.info.child[d.offset+i]
 	}
 	d.offset += n
 	return list, nil
 }
 
 type readerInfo struct {
-	name string
-	file *ValvePakFile
+	name  string
+	file  *ValvePakFile
+	child []*readerInfo // sorted by name, only for dirs
 }
 
 func (i *readerInfo) Info() (fs.FileInfo, error) {
@@ -200,9 +316,7 @@ func (i *readerInfo) Name() string {
 func (i *readerInfo) Size() int64 {
 	var sz uint64
 	if !i.IsDir() {
-		for _, c := range i.file.Chunk {
-			sz += c.UncompressedSize
-		}
+		sz = i.file.Size()
 	}
 	return int64(sz)
 }
@@ -229,52 +343,264 @@ func (i *readerInfo) Sys() interface{} {
 	return *i.file
 }
 
+// lookup finds the child with the provided name.
+func (i *readerInfo) lookup(name string) *readerInfo {
+	if n := sort.Search(len(i.child), func(j int) bool {
+		return i.child[j].name >= name
+	}); n < len(i.child) && i.child[n].name == name {
+		return i.child[n]
+	}
+	return nil
+}
+
+// buildIndex builds the path index used by the fs.FS implementation. Since it
+// is only built once, changes to Root made after using the Reader as a fs.FS
+// will not be reflected. Files with paths which are not valid according to
+// fs.ValidPath are not included. If a file has the same path as a directory
+// containing other files, the file takes precedence.
+func (r *Reader) buildIndex() {
+	r.indexOnce.Do(func() {
+		r.index = map[string]*readerInfo{
+			".": {name: "."},
+		}
+		for fi := range r.Root.File {
+			f := &r.Root.File[fi]
+			if !fs.ValidPath(f.Path) || f.Path == "." {
+				continue
+			}
+			if x, ok := r.index[f.Path]; ok {
+				if x.file == nil {
+					x.file = f // file takes precedence over a dir
+				}
+				continue // duplicate file, first one takes precedence
+			}
+			name, parent := f.Path, &readerInfo{name: path.Base(f.Path), file: f}
+			r.index[name] = parent
+			for name != "." {
+				name = path.Dir(name)
+				if x, ok := r.index[name]; ok {
+					x.child = append(x.child, parent)
+					break
+				}
+				x := &readerInfo{name: path.Base(name), child: []*readerInfo{parent}}
+				r.index[name], parent = x, x
+			}
+		}
+		for _, x := range r.index {
+			sort.Slice(x.child, func(i, j int) bool {
+				return x.child[i].name < x.child[j].name
+			})
+		}
+	})
+}
+
+// stat looks up the index entry for name.
+func (r *Reader) stat(op, name string) (*readerInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	r.buildIndex()
+	if x, ok := r.index[name]; ok {
+		return x, nil
+	}
+	return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+}
+
 // Open implements fs.FS.
 func (r *Reader) Open(name string) (fs.File, error) {
-	if !fs.ValidPath(name) {
-		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	x, err := r.stat("open", name)
+	if err != nil {
+		return nil, err
 	}
-	name = strings.TrimPrefix(name, "./")
-	for fi, f := range r.Root.File {
-		if f.Path == name {
-			if rc, err := r.OpenFile(f); err != nil {
-				return nil, &fs.PathError{Op: "open", Path: name, Err: err}
-			} else {
-				return &readerFile{readerInfo{path.Base(name), &r.Root.File[fi]}, io.NopCloser(rc)}, nil
+	if x.IsDir() {
+		return &readerDir{x, 0}, nil
+	}
+	fr, err := r.OpenFileReader(*x.file)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return &readerFile{x, fr}, nil
+}
+
+// Stat implements fs.StatFS.
+func (r *Reader) Stat(name string) (fs.FileInfo, error) {
+	x, err := r.stat("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// ReadDir implements fs.ReadDirFS.
+func (r *Reader) ReadDir(name string) ([]fs.DirEntry, error) {
+	x, err := r.stat("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	if !x.IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+	}
+	list := make([]fs.DirEntry, len(x.child))
+	for i, c := range x.child {
+		list[i] = c
+	}
+	return list, nil
+}
+
+// ReadFile implements fs.ReadFileFS.
+func (r *Reader) ReadFile(name string) ([]byte, error) {
+	x, err := r.stat("readfile", name)
+	if err != nil {
+		return nil, err
+	}
+	if x.IsDir() {
+		return nil, &fs.PathError{Op: "readfile", Path: name, Err: errors.New("is a directory")}
+	}
+	rc, err := r.OpenFile(*x.file)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readfile", Path: name, Err: err}
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, x.Size()))
+	if _, err := buf.ReadFrom(rc); err != nil {
+		return nil, &fs.PathError{Op: "readfile", Path: name, Err: err}
+	}
+	return buf.Bytes(), nil
+}
+
+// Glob implements fs.GlobFS. Literal path elements are looked up directly
+// rather than matched against every file.
+func (r *Reader) Glob(pattern string) ([]string, error) {
+	r.buildIndex()
+	return r.glob(r.index["."], pattern)
+}
+
+func (r *Reader) glob(dir *readerInfo, pattern string) ([]string, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+	var matches []string
+	var walk func(x *readerInfo, prefix string, elem []string)
+	walk = func(x *readerInfo, prefix string, elem []string) {
+		if len(elem) == 0 {
+			matches = append(matches, prefix)
+			return
+		}
+		if !x.IsDir() {
+			return
+		}
+		join := func(name string) string {
+			if prefix == "" {
+				return name
 			}
+			return prefix + "/" + name
 		}
-	}
-	things := map[string]*ValvePakFile{}
-	if name == "." {
-		for fi, f := range r.Root.File {
-			if i := strings.Index(f.Path, "/"); i < 0 {
-				things[f.Path] = &r.Root.File[fi]
-			} else {
-				things[f.Path[:i]] = nil
+		if !strings.ContainsAny(elem[0], `*?[\`) {
+			if c := x.lookup(elem[0]); c != nil {
+				walk(c, join(c.name), elem[1:])
 			}
+			return
 		}
-	} else {
-		prefix := name + "/"
-		for fi, f := range r.Root.File {
-			if strings.HasPrefix(f.Path, prefix) {
-				tmp := f.Path[len(prefix):]
-				if i := strings.Index(tmp, "/"); i < 0 {
-					things[tmp] = &r.Root.File[fi]
-				} else {
-					things[tmp[:i]] = nil
-				}
+		for _, c := range x.child {
+			if ok, _ := path.Match(elem[0], c.name); ok {
+				walk(c, join(c.name), elem[1:])
 			}
 		}
-		if len(things) == 0 {
-			return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist} // no file with the provided name, and the name isn't a dir prefix of other files
+	}
+	if pattern == "." {
+		return []string{"."}, nil
+	}
+	walk(dir, "", strings.Split(pattern, "/"))
+	return matches, nil
+}
+
+// Sub implements fs.SubFS.
+func (r *Reader) Sub(dir string) (fs.FS, error) {
+	if !fs.ValidPath(dir) {
+		return nil, &fs.PathError{Op: "sub", Path: dir, Err: fs.ErrInvalid}
+	}
+	if dir == "." {
+		return r, nil
+	}
+	return &readerSub{r, dir}, nil
+}
+
+// readerSub is a fs.FS for a subdirectory of a Reader.
+type readerSub struct {
+	r   *Reader
+	dir string
+}
+
+// full returns the path of name in the Reader.
+func (s *readerSub) full(op, name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	return path.Join(s.dir, name), nil
+}
+
+// fixErr removes the directory from the path in errors.
+func (s *readerSub) fixErr(err error) error {
+	if e, ok := err.(*fs.PathError); ok {
+		if name, ok := strings.CutPrefix(e.Path, s.dir+"/"); ok {
+			e.Path = name
+		} else if e.Path == s.dir {
+			e.Path = "."
 		}
 	}
-	var dirents []*readerInfo
-	for thing, file := range things {
-		dirents = append(dirents, &readerInfo{thing, file})
+	return err
+}
+
+func (s *readerSub) Open(name string) (fs.File, error) {
+	full, err := s.full("open", name)
+	if err != nil {
+		return nil, err
 	}
-	sort.Slice(dirents, func(i, j int) bool {
-		return dirents[i].name < dirents[j].name
-	})
-	return &readerDir{readerInfo{name[strings.LastIndex(name, "/")+1:], nil}, dirents, 0}, nil
+	f, err := s.r.Open(full)
+	return f, s.fixErr(err)
+}
+
+func (s *readerSub) Stat(name string) (fs.FileInfo, error) {
+	full, err := s.full("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := s.r.Stat(full)
+	return fi, s.fixErr(err)
+}
+
+func (s *readerSub) ReadDir(name string) ([]fs.DirEntry, error) {
+	full, err := s.full("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	es, err := s.r.ReadDir(full)
+	return es, s.fixErr(err)
+}
+
+func (s *readerSub) ReadFile(name string) ([]byte, error) {
+	full, err := s.full("readfile", name)
+	if err != nil {
+		return nil, err
+	}
+	buf, err := s.r.ReadFile(full)
+	return buf, s.fixErr(err)
+}
+
+func (s *readerSub) Glob(pattern string) ([]string, error) {
+	x, err := s.r.stat("glob", s.dir)
+	if err != nil {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, err
+		}
+		return nil, nil
+	}
+	return s.r.glob(x, pattern)
+}
+
+func (s *readerSub) Sub(dir string) (fs.FS, error) {
+	full, err := s.full("sub", dir)
+	if err != nil {
+		return nil, err
+	}
+	return s.r.Sub(full)
 }
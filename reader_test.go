@@ -0,0 +1,491 @@
+package tf2vpk
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/rand"
+	"slices"
+	"testing"
+	"testing/fstest"
+	"testing/iotest"
+)
+
+func TestReaderFS(t *testing.T) {
+	files := map[string]string{
+		"a.txt":                    "a",
+		"scripts/b.nut":            "b",
+		"scripts/vscripts/c.gnut":  "c",
+		"scripts/vscripts/d.gnut":  "d",
+		"scripts/vscripts/[e].txt": "e",
+		"materials/f.vtf":          "f",
+	}
+
+	blocks := map[ValvePakIndex]*bytes.Buffer{}
+	w := NewWriterFunc(func(i ValvePakIndex) (io.Writer, error) {
+		blocks[i] = new(bytes.Buffer)
+		return blocks[i], nil
+	})
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		if _, err := w.WriteFile(name, bytes.NewReader([]byte(files[name])), 1, 0); err != nil {
+			t.Fatalf("write %q: %v", name, err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	r, err := NewReaderFunc(func(i ValvePakIndex) (io.ReaderAt, error) {
+		if b, ok := blocks[i]; ok {
+			return bytes.NewReader(b.Bytes()), nil
+		}
+		return nil, fmt.Errorf("block %s does not exist", i)
+	})
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+
+	if err := fstest.TestFS(r, names...); err != nil {
+		t.Errorf("fs: %v", err)
+	}
+
+	sub, err := fs.Sub(r, "scripts")
+	if err != nil {
+		t.Fatalf("sub: %v", err)
+	}
+	if err := fstest.TestFS(sub, "b.nut", "vscripts/c.gnut", "vscripts/d.gnut", "vscripts/[e].txt"); err != nil {
+		t.Errorf("sub: %v", err)
+	}
+
+	for _, x := range []struct {
+		FS      fs.FS
+		Pattern string
+		Match   []string
+	}{
+		{r, "*", []string{"a.txt", "materials", "scripts"}},
+		{r, "scripts/*/*.gnut", []string{"scripts/vscripts/c.gnut", "scripts/vscripts/d.gnut"}},
+		{r, `scripts/vscripts/\[e\].txt`, []string{"scripts/vscripts/[e].txt"}},
+		{r, "*/f.vtf", []string{"materials/f.vtf"}},
+		{r, "a.txt/*", nil},
+		{sub, "vscripts/?.gnut", []string{"vscripts/c.gnut", "vscripts/d.gnut"}},
+	} {
+		if m, err := fs.Glob(x.FS, x.Pattern); err != nil {
+			t.Errorf("glob %q: %v", x.Pattern, err)
+		} else if !slices.Equal(m, x.Match) {
+			t.Errorf("glob %q: expected %q, got %q", x.Pattern, x.Match, m)
+		}
+	}
+	if _, err := fs.Glob(r, "[a"); err == nil {
+		t.Errorf("glob: expected error for bad pattern")
+	}
+}
+
+func TestFileReader(t *testing.T) {
+	rng := rand.New(rand.NewSource(0))
+
+	// alternate between compressible and incompressible chunks
+	data := make([]byte, ValvePakMaxChunkUncompressedSize*5/2)
+	for i := 0; i < len(data); i += int(ValvePakMaxChunkUncompressedSize) * 2 {
+		rng.Read(data[i:min(i+int(ValvePakMaxChunkUncompressedSize), len(data))])
+	}
+
+	var block, dir bytes.Buffer
+	w := NewWriterFunc(func(i ValvePakIndex) (io.Writer, error) {
+		if i == ValvePakIndexDir {
+			return &dir, nil
+		}
+		return &block, nil
+	})
+	f, err := w.WriteFile("a.bin", bytes.NewReader(data), 1, 0)
+	if err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	if len(f.Chunk) != 3 || f.Chunk[0].IsCompressed() || !f.Chunk[1].IsCompressed() {
+		t.Fatalf("unexpected chunks %+v", f.Chunk)
+	}
+
+	fr, err := f.CreateFileReader(bytes.NewReader(block.Bytes()))
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	if err := iotest.TestReader(fr, data); err != nil {
+		t.Errorf("read: %v", err)
+	}
+	for i := 0; i < 100; i++ {
+		off := rng.Int63n(int64(len(data)))
+		buf := make([]byte, rng.Intn(int(ValvePakMaxChunkUncompressedSize)*2))
+		n, err := fr.ReadAt(buf, off)
+		if exp := min(len(buf), len(data)-int(off)); n != exp {
+			t.Fatalf("readat %d+%d: expected %d bytes, got %d (err %v)", off, len(buf), exp, n, err)
+		} else if n < len(buf) && err != io.EOF {
+			t.Fatalf("readat %d+%d: expected eof, got %v", off, len(buf), err)
+		} else if n == len(buf) && err != nil {
+			t.Fatalf("readat %d+%d: %v", off, len(buf), err)
+		}
+		if !bytes.Equal(buf[:n], data[off:off+int64(n)]) {
+			t.Fatalf("readat %d+%d: contents do not match", off, len(buf))
+		}
+	}
+
+	f.CRC32++
+	if fr, err := f.CreateFileReader(bytes.NewReader(block.Bytes())); err != nil {
+		t.Fatalf("open: %v", err)
+	} else if _, err := io.ReadAll(fr); err == nil {
+		t.Errorf("expected crc mismatch for sequential read")
+	} else if _, err := fr.Seek(-10, io.SeekEnd); err != nil {
+		t.Errorf("seek: %v", err)
+	} else if buf, err := io.ReadAll(fr); err != nil || !bytes.Equal(buf, data[len(data)-10:]) {
+		t.Errorf("expected no crc check after seeking (err %v)", err)
+	}
+}
+
+func TestPreload(t *testing.T) {
+	data := []byte("preload data, followed by the chunk data")
+	preload := 13
+
+	var block bytes.Buffer
+	w := NewWriterFunc(func(i ValvePakIndex) (io.Writer, error) {
+		if i == ValvePakIndexDir {
+			return io.Discard, nil
+		}
+		return &block, nil
+	})
+	if _, err := w.WriteFile("a.txt", bytes.NewReader(data[preload:]), 1, 0); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	d := w.Root
+	d.DataSize = 1234
+	d.File[0].PreloadBytes = uint16(preload)
+	d.File[0].Preload = data[:preload]
+	h := NewCRC()
+	h.Write(data)
+	d.File[0].CRC32 = h.Sum32()
+
+	var buf bytes.Buffer
+	if err := d.Serialize(&buf); err != nil {
+		t.Fatalf("serialize: %v", err)
+	}
+	var x ValvePakDir
+	if err := x.Deserialize(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatalf("deserialize: %v", err)
+	}
+	if x.DataSize != d.DataSize || !bytes.Equal(x.File[0].Preload, data[:preload]) {
+		t.Errorf("preload data not preserved")
+	}
+	var buf1 bytes.Buffer
+	if err := x.Serialize(&buf1); err != nil {
+		t.Fatalf("serialize: %v", err)
+	} else if !bytes.Equal(buf.Bytes(), buf1.Bytes()) {
+		t.Errorf("round-trip not identical")
+	}
+
+	f := x.File[0]
+	if sz := f.Size(); sz != uint64(len(data)) {
+		t.Errorf("expected size %d, got %d", len(data), sz)
+	}
+	if cr, err := f.CreateReader(bytes.NewReader(block.Bytes())); err != nil {
+		t.Errorf("open: %v", err)
+	} else if b, err := io.ReadAll(cr); err != nil {
+		t.Errorf("read: %v", err)
+	} else if !bytes.Equal(b, data) {
+		t.Errorf("read: expected %q, got %q", data, b)
+	}
+	if fr, err := f.CreateFileReader(bytes.NewReader(block.Bytes())); err != nil {
+		t.Errorf("open: %v", err)
+	} else if err := iotest.TestReader(fr, data); err != nil {
+		t.Errorf("read: %v", err)
+	}
+
+	f.Preload = f.Preload[1:]
+	if err := f.Serialize(io.Discard); err == nil {
+		t.Errorf("expected error for preload data length mismatch")
+	}
+}
+
+func TestReaderSourceEmbedded(t *testing.T) {
+	data := []byte("preload data, followed by the data after the dir index")
+	preload := 13
+
+	h := NewCRC()
+	h.Write(data)
+
+	d := ValvePakDir{
+		Magic:        ValvePakMagic,
+		MajorVersion: ValvePakVersionSource1,
+		File: []ValvePakFile{{
+			Path:         "a.txt",
+			CRC32:        h.Sum32(),
+			PreloadBytes: uint16(preload),
+			Preload:      data[:preload],
+			Index:        ValvePakIndexDir,
+			Chunk: []ValvePakChunk{{
+				CompressedSize:   uint64(len(data) - preload),
+				UncompressedSize: uint64(len(data) - preload),
+			}},
+		}},
+	}
+	var dir bytes.Buffer
+	if err := d.Serialize(&dir); err != nil {
+		t.Fatalf("serialize: %v", err)
+	}
+	dir.Write(data[preload:])
+
+	r, err := NewReaderFunc(func(i ValvePakIndex) (io.ReaderAt, error) {
+		if i == ValvePakIndexDir {
+			return bytes.NewReader(dir.Bytes()), nil
+		}
+		return nil, fmt.Errorf("block %s does not exist", i)
+	})
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if buf, err := r.ReadFile("a.txt"); err != nil {
+		t.Errorf("read: %v", err)
+	} else if !bytes.Equal(buf, data) {
+		t.Errorf("read: expected %q, got %q", data, buf)
+	}
+
+	d.File[0].Chunk[0].LoadFlags = 1
+	if err := d.Serialize(io.Discard); err == nil {
+		t.Errorf("expected error for source vpk file with flags")
+	}
+}
+
+func TestReaderOptions(t *testing.T) {
+	write := func(opt Options, fn func(*Writer)) (map[ValvePakIndex]*bytes.Buffer, error) {
+		blocks := map[ValvePakIndex]*bytes.Buffer{}
+		w := NewWriterFuncOptions(func(i ValvePakIndex) (io.Writer, error) {
+			blocks[i] = new(bytes.Buffer)
+			return blocks[i], nil
+		}, opt)
+		for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+			if _, err := w.WriteFile(name, bytes.NewReader([]byte(name)), 1, 0); err != nil {
+				t.Fatalf("write %q: %v", name, err)
+			}
+		}
+		fn(w)
+		return blocks, w.Close()
+	}
+	read := func(blocks map[ValvePakIndex]*bytes.Buffer, opt Options) (*Reader, error) {
+		return NewReaderFuncOptions(func(i ValvePakIndex) (io.ReaderAt, error) {
+			return bytes.NewReader(blocks[i].Bytes()), nil
+		}, opt)
+	}
+
+	blocks, err := write(Options{}, func(w *Writer) {
+		w.Root.File[0].CRC32++
+	})
+	if err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if r, err := read(blocks, Options{}); err != nil {
+		t.Errorf("read: %v", err)
+	} else if _, err := r.ReadFile("a.txt"); err == nil {
+		t.Errorf("read: expected crc mismatch")
+	}
+	if r, err := read(blocks, Options{NoCRC: true}); err != nil {
+		t.Errorf("read: %v", err)
+	} else if _, err := r.ReadFile("a.txt"); err != nil {
+		t.Errorf("read: expected crc check to be disabled, got %v", err)
+	}
+	if _, err := read(blocks, Options{MaxFiles: 2}); err == nil {
+		t.Errorf("read: expected file limit to be exceeded")
+	}
+	if _, err := read(blocks, Options{MaxTreeSize: 8}); err == nil {
+		t.Errorf("read: expected tree size limit to be exceeded")
+	}
+	if _, err := read(blocks, Options{MaxChunkSize: 4}); err == nil {
+		t.Errorf("read: expected chunk size limit to be exceeded")
+	}
+
+	version := func(w *Writer) {
+		w.Root.MinorVersion++
+	}
+	if _, err := write(Options{}, version); err == nil {
+		t.Errorf("write: expected unsupported version to be rejected")
+	}
+	if blocks, err := write(Options{Lenient: true}, version); err != nil {
+		t.Errorf("write: expected lenient writer to accept unsupported version, got %v", err)
+	} else if _, err := read(blocks, Options{}); err == nil {
+		t.Errorf("read: expected unsupported version to be rejected")
+	} else if _, err := read(blocks, Options{Lenient: true}); err != nil {
+		t.Errorf("read: expected lenient reader to accept unsupported version, got %v", err)
+	}
+}
+
+func TestReaderErrors(t *testing.T) {
+	blocks := map[ValvePakIndex]*bytes.Buffer{}
+	w := NewWriterFunc(func(i ValvePakIndex) (io.Writer, error) {
+		blocks[i] = new(bytes.Buffer)
+		return blocks[i], nil
+	})
+	if _, err := w.WriteFile("a.txt", bytes.NewReader(bytes.Repeat([]byte("a"), 1000)), 1, 0); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if _, err := w.WriteFile("b.txt", bytes.NewReader([]byte("b")), 1, 0); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	read := func(fn func(b []byte) []byte, name string, opt Options) error {
+		r, err := NewReaderFuncOptions(func(i ValvePakIndex) (io.ReaderAt, error) {
+			b := bytes.Clone(blocks[i].Bytes())
+			if i != ValvePakIndexDir {
+				b = fn(b)
+			}
+			return bytes.NewReader(b), nil
+		}, opt)
+		if err != nil {
+			return err
+		}
+		_, err = r.ReadFile(name)
+		return err
+	}
+
+	var crcErr *CRCError
+	if err := read(func(b []byte) []byte {
+		b[len(b)-1]++
+		return b
+	}, "b.txt", Options{}); !errors.As(err, &crcErr) || crcErr.Path != "b.txt" || !errors.Is(err, ErrChecksum) {
+		t.Errorf("expected crc error for b.txt, got %v", err)
+	}
+
+	var decErr *DecompressError
+	if err := read(func(b []byte) []byte {
+		for i := 0; i < len(b)-1; i++ {
+			b[i] = 0xFF
+		}
+		return b
+	}, "a.txt", Options{}); !errors.As(err, &decErr) || decErr.Index != 0 || decErr.Offset != 0 || !errors.Is(err, ErrDecompress) {
+		t.Errorf("expected decompression error for a.txt, got %v", err)
+	}
+
+	if err := read(func(b []byte) []byte {
+		return b[:len(b)-1]
+	}, "b.txt", Options{}); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("expected corrupt error for truncated block, got %v", err)
+	}
+
+	var limErr *LimitError
+	if err := read(func(b []byte) []byte {
+		return b
+	}, "a.txt", Options{MaxFiles: 1}); !errors.As(err, &limErr) || limErr.Limit != "MaxFiles" || !errors.Is(err, ErrLimit) {
+		t.Errorf("expected limit error, got %v", err)
+	}
+
+	var sanErr *SanityError
+	if err := (ValvePakChunk{CompressedSize: 1}).Serialize(io.Discard); !errors.As(err, &sanErr) || sanErr.Rule != SanityChunkSizeNonZero || !errors.Is(err, ErrSanity) {
+		t.Errorf("expected sanity error, got %v", err)
+	}
+}
+
+func TestReaderExtract(t *testing.T) {
+	rng := rand.New(rand.NewSource(0))
+
+	files := map[string][]byte{}
+	blocks := map[ValvePakIndex]*bytes.Buffer{}
+	w := NewWriterFunc(func(i ValvePakIndex) (io.Writer, error) {
+		blocks[i] = new(bytes.Buffer)
+		return blocks[i], nil
+	})
+	for i := 0; i < 60; i++ {
+		name := fmt.Sprintf("%03d.bin", i)
+		switch i % 3 {
+		case 0:
+			files[name] = bytes.Repeat([]byte(name), rng.Intn(10000)) // compressible
+		case 1:
+			files[name] = make([]byte, rng.Intn(10000)) // stored
+			rng.Read(files[name])
+		case 2:
+			files[name] = bytes.Repeat([]byte{byte(i)}, 1<<20+rng.Intn(1<<20)) // multiple chunks
+		}
+		if i == 30 {
+			if err := w.SetIndex(1); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := w.WriteFile(name, bytes.NewReader(files[name]), 1, 0); err != nil {
+			t.Fatalf("write %q: %v", name, err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	r, err := NewReaderFunc(func(i ValvePakIndex) (io.ReaderAt, error) {
+		return bytes.NewReader(blocks[i].Bytes()), nil
+	})
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+
+	// reverse them so we can check the order
+	in := slices.Clone(r.Root.File)
+	slices.Reverse(in)
+
+	for _, opt := range []ExtractOptions{
+		{},
+		{Threads: 1, Memory: 1},
+		{Threads: 3, Memory: 1 << 20},
+	} {
+		var got []string
+		if err := r.Extract(in, opt, func(f ValvePakFile, fr io.Reader) error {
+			got = append(got, f.Path)
+			if buf, err := io.ReadAll(fr); err != nil {
+				t.Errorf("%+v: %s: %v", opt, f.Path, err)
+			} else if !bytes.Equal(buf, files[f.Path]) {
+				t.Errorf("%+v: %s: contents do not match", opt, f.Path)
+			}
+			return nil
+		}); err != nil {
+			t.Fatalf("%+v: extract: %v", opt, err)
+		}
+		if want := sortFilesByOffset(in); len(got) != len(want) {
+			t.Errorf("%+v: expected %d files, got %d", opt, len(want), len(got))
+		} else {
+			for i := range want {
+				if got[i] != want[i].Path {
+					t.Errorf("%+v: expected files in block/offset order", opt)
+					break
+				}
+			}
+		}
+	}
+
+	stop := errors.New("stop")
+	var n int
+	if err := r.Extract(in, ExtractOptions{}, func(f ValvePakFile, fr io.Reader) error {
+		if n++; n == 10 {
+			return stop
+		}
+		return nil
+	}); err != stop || n != 10 {
+		t.Errorf("expected extract to stop after 10 files with the returned error, got %d (err: %v)", n, err)
+	}
+
+	bad := slices.Clone(r.Root.File[:1])
+	bad[0].CRC32++
+	if err := r.Extract(bad, ExtractOptions{}, func(f ValvePakFile, fr io.Reader) error {
+		if _, err := io.ReadAll(fr); !errors.Is(err, ErrChecksum) {
+			t.Errorf("expected checksum error, got %v", err)
+		}
+		return nil
+	}); err != nil {
+		t.Errorf("extract: %v", err)
+	}
+}
@@ -0,0 +1,329 @@
+package tf2vpk
+
+import (
+	"bytes"
+	"cmp"
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+)
+
+// Source engine VPK constants.
+//
+// Source VPKs use the same magic and tree structure as Titanfall 2 VPKs, but
+// have a 32-bit version, and each file has a single uncompressed entry without
+// flags instead of chunks. Version 2 also has some additional sections with
+// checksums and an optional signature after the embedded file data.
+const (
+	ValvePakVersionSource1 uint16 = 1
+	ValvePakVersionSource2 uint16 = 2
+
+	valvePakOtherMD5Size = md5.Size * 3
+)
+
+// IsSource returns true if d is a Source VPK rather than a Titanfall 2 one.
+func (d ValvePakDir) IsSource() bool {
+	return d.MinorVersion == 0 && (d.MajorVersion == ValvePakVersionSource1 || d.MajorVersion == ValvePakVersionSource2)
+}
+
+// isSource2 returns true if d is a Source VPK version 2.
+func (d ValvePakDir) isSource2() bool {
+	return d.IsSource() && d.MajorVersion == ValvePakVersionSource2
+}
+
+// deserializeSourceHeader reads the rest of the header after the tree size.
+func (d *ValvePakDir) deserializeSourceHeader(r io.Reader) error {
+	if !d.isSource2() {
+		return nil
+	}
+	if err := binary.Read(r, binary.LittleEndian, &d.DataSize); err != nil {
+		return fmt.Errorf("read file data section size: %w", err)
+	}
+	if err := binary.Read(r, binary.LittleEndian, &d.ArchiveMD5Size); err != nil {
+		return fmt.Errorf("read archive md5 section size: %w", err)
+	} else if d.ArchiveMD5Size%uint32(binary.Size(valvePakArchiveMD5{})) != 0 {
+		return fmt.Errorf("read archive md5 section size: %w: %d is not a multiple of the entry size", ErrCorrupt, d.ArchiveMD5Size)
+	}
+	if err := binary.Read(r, binary.LittleEndian, &d.OtherMD5Size); err != nil {
+		return fmt.Errorf("read other md5 section size: %w", err)
+	} else if d.OtherMD5Size != valvePakOtherMD5Size {
+		return fmt.Errorf("read other md5 section size: %w: expected %d, got %d", ErrCorrupt, valvePakOtherMD5Size, d.OtherMD5Size)
+	}
+	if err := binary.Read(r, binary.LittleEndian, &d.SignatureSize); err != nil {
+		return fmt.Errorf("read signature section size: %w", err)
+	}
+	return nil
+}
+
+// serializeSourceHeader writes the rest of the header after the tree size.
+func (d ValvePakDir) serializeSourceHeader(w io.Writer) error {
+	if !d.isSource2() {
+		if d.DataSize != 0 || d.ArchiveMD5Size != 0 || d.OtherMD5Size != 0 || d.SignatureSize != 0 {
+			return fmt.Errorf("write header: source vpk version %d does not have section sizes", d.MajorVersion)
+		}
+		return nil
+	}
+	if err := binary.Write(w, binary.LittleEndian, &d.DataSize); err != nil {
+		return fmt.Errorf("write file data section size: %w", err)
+	}
+	if err := binary.Write(w, binary.LittleEndian, &d.ArchiveMD5Size); err != nil {
+		return fmt.Errorf("write archive md5 section size: %w", err)
+	}
+	if err := binary.Write(w, binary.LittleEndian, &d.OtherMD5Size); err != nil {
+		return fmt.Errorf("write other md5 section size: %w", err)
+	}
+	if err := binary.Write(w, binary.LittleEndian, &d.SignatureSize); err != nil {
+		return fmt.Errorf("write signature section size: %w", err)
+	}
+	return nil
+}
+
+// sourceHeaderSize returns the size of the header fields written by
+// serializeSourceHeader.
+func (d ValvePakDir) sourceHeaderSize() uint32 {
+	if !d.isSource2() {
+		return 0
+	}
+	return uint32(binary.Size(d.DataSize)) * 4
+}
+
+// SourceSectionsOffset returns the offset of the ValvePakSourceSections in the
+// dir of a Source VPK version 2 (i.e., after the dir index and the embedded
+// file data).
+func (d ValvePakDir) SourceSectionsOffset() (uint32, error) {
+	if !d.isSource2() {
+		return 0, fmt.Errorf("not a source vpk version 2")
+	}
+	n, err := d.ChunkOffset()
+	if err != nil {
+		return 0, err
+	}
+	return n + d.DataSize, nil
+}
+
+// ValvePakSourceSections contains the sections following the embedded file
+// data in the dir of a Source VPK version 2.
+type ValvePakSourceSections struct {
+	ArchiveMD5           []ValvePakArchiveMD5
+	TreeMD5              [md5.Size]byte
+	ArchiveMD5SectionMD5 [md5.Size]byte
+	WholeFileMD5         [md5.Size]byte // header, tree, file data, archive md5 section, and the two preceding checksums
+	Signature            []byte         // public key and signature, if signed
+}
+
+// ValvePakArchiveMD5 is the checksum of a range of a block in a Source VPK.
+type ValvePakArchiveMD5 struct {
+	Index  ValvePakIndex
+	Offset uint32
+	Size   uint32
+	MD5    [md5.Size]byte
+}
+
+type valvePakArchiveMD5 struct {
+	Index  uint32
+	Offset uint32
+	Size   uint32
+	MD5    [md5.Size]byte
+}
+
+// Deserialize parses the sections from r (which should be at the offset
+// returned by SourceSectionsOffset) using the section sizes from the header of
+// d.
+func (s *ValvePakSourceSections) Deserialize(r io.Reader, d ValvePakDir) error {
+	if !d.isSource2() {
+		return fmt.Errorf("not a source vpk version 2")
+	}
+	s.ArchiveMD5 = make([]ValvePakArchiveMD5, 0, d.ArchiveMD5Size/uint32(binary.Size(valvePakArchiveMD5{})))
+	for i := 0; i < cap(s.ArchiveMD5); i++ {
+		var x valvePakArchiveMD5
+		if err := binary.Read(r, binary.LittleEndian, &x); err != nil {
+			return fmt.Errorf("read archive md5 %d: %w", i, err)
+		} else if x.Index >= uint32(ValvePakIndexEOF) {
+			return fmt.Errorf("read archive md5 %d: %w: invalid archive index %d", i, ErrCorrupt, x.Index)
+		}
+		s.ArchiveMD5 = append(s.ArchiveMD5, ValvePakArchiveMD5{ValvePakIndex(x.Index), x.Offset, x.Size, x.MD5})
+	}
+	if _, err := io.ReadFull(r, s.TreeMD5[:]); err != nil {
+		return fmt.Errorf("read tree md5: %w", err)
+	}
+	if _, err := io.ReadFull(r, s.ArchiveMD5SectionMD5[:]); err != nil {
+		return fmt.Errorf("read archive md5 section md5: %w", err)
+	}
+	if _, err := io.ReadFull(r, s.WholeFileMD5[:]); err != nil {
+		return fmt.Errorf("read whole file md5: %w", err)
+	}
+	s.Signature = make([]byte, d.SignatureSize)
+	if _, err := io.ReadFull(r, s.Signature); err != nil {
+		return fmt.Errorf("read signature: %w", err)
+	}
+	return nil
+}
+
+// Serialize writes the encoded sections to w.
+func (s ValvePakSourceSections) Serialize(w io.Writer) error {
+	if err := s.serializeArchiveMD5(w); err != nil {
+		return err
+	}
+	if _, err := w.Write(s.TreeMD5[:]); err != nil {
+		return fmt.Errorf("write tree md5: %w", err)
+	}
+	if _, err := w.Write(s.ArchiveMD5SectionMD5[:]); err != nil {
+		return fmt.Errorf("write archive md5 section md5: %w", err)
+	}
+	if _, err := w.Write(s.WholeFileMD5[:]); err != nil {
+		return fmt.Errorf("write whole file md5: %w", err)
+	}
+	if _, err := w.Write(s.Signature); err != nil {
+		return fmt.Errorf("write signature: %w", err)
+	}
+	return nil
+}
+
+func (s ValvePakSourceSections) serializeArchiveMD5(w io.Writer) error {
+	for i, x := range s.ArchiveMD5 {
+		if err := binary.Write(w, binary.LittleEndian, valvePakArchiveMD5{uint32(x.Index), x.Offset, x.Size, x.MD5}); err != nil {
+			return fmt.Errorf("write archive md5 %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// SetSizes updates the section sizes in the header of d.
+func (s ValvePakSourceSections) SetSizes(d *ValvePakDir) error {
+	if !d.isSource2() {
+		return fmt.Errorf("not a source vpk version 2")
+	}
+	if n := uint64(len(s.ArchiveMD5)) * uint64(binary.Size(valvePakArchiveMD5{})); n > math.MaxUint32 {
+		return fmt.Errorf("archive md5 section too large")
+	} else {
+		d.ArchiveMD5Size = uint32(n)
+	}
+	if n := uint64(len(s.Signature)); n > math.MaxUint32 {
+		return fmt.Errorf("signature section too large")
+	} else {
+		d.SignatureSize = uint32(n)
+	}
+	d.OtherMD5Size = valvePakOtherMD5Size
+	return nil
+}
+
+// SortArchiveMD5 sorts the archive md5 entries by block index and offset.
+func (s *ValvePakSourceSections) SortArchiveMD5() {
+	slices.SortStableFunc(s.ArchiveMD5, func(a, b ValvePakArchiveMD5) int {
+		if a.Index != b.Index {
+			return cmp.Compare(a.Index, b.Index)
+		}
+		return cmp.Compare(a.Offset, b.Offset)
+	})
+}
+
+// UpdateChecksums updates the section sizes in d, then computes the tree, archive
+// md5 section, and whole file checksums. If d.DataSize is non-zero, data must
+// contain the embedded file data. The archive md5 entries are not changed.
+func (s *ValvePakSourceSections) UpdateChecksums(d *ValvePakDir, data io.Reader) error {
+	if err := s.SetSizes(d); err != nil {
+		return err
+	}
+
+	var tree bytes.Buffer
+	if err := d.writeTree(&tree, sizeOptions); err != nil {
+		return fmt.Errorf("write directory tree: %w", err)
+	}
+	s.TreeMD5 = md5.Sum(tree.Bytes())
+
+	var archive bytes.Buffer
+	if err := s.serializeArchiveMD5(&archive); err != nil {
+		return err
+	}
+	s.ArchiveMD5SectionMD5 = md5.Sum(archive.Bytes())
+
+	h := md5.New()
+	if err := d.SerializeOptions(h, sizeOptions); err != nil {
+		return err
+	}
+	if d.DataSize != 0 {
+		if data == nil {
+			return fmt.Errorf("file data is required to compute the whole file checksum")
+		}
+		if _, err := io.CopyN(h, data, int64(d.DataSize)); err != nil {
+			return fmt.Errorf("read file data: %w", err)
+		}
+	}
+	h.Write(archive.Bytes())
+	h.Write(s.TreeMD5[:])
+	h.Write(s.ArchiveMD5SectionMD5[:])
+	copy(s.WholeFileMD5[:], h.Sum(nil))
+	return nil
+}
+
+func (f *ValvePakFile) deserializeSource(r io.Reader, path string, opt Options) error {
+	f.Path = path
+	if err := binary.Read(r, binary.LittleEndian, &f.CRC32); err != nil {
+		return fmt.Errorf("read file crc32: %w", err)
+	}
+	if err := binary.Read(r, binary.LittleEndian, &f.PreloadBytes); err != nil {
+		return fmt.Errorf("read file preload bytes: %w", err)
+	}
+	if err := binary.Read(r, binary.LittleEndian, &f.Index); err != nil {
+		return fmt.Errorf("read file archive index: %w", err)
+	}
+	var off, sz uint32
+	if err := binary.Read(r, binary.LittleEndian, &off); err != nil {
+		return fmt.Errorf("read file entry offset: %w", err)
+	}
+	if err := binary.Read(r, binary.LittleEndian, &sz); err != nil {
+		return fmt.Errorf("read file entry length: %w", err)
+	} else if opt.MaxChunkSize != 0 && uint64(sz) > opt.MaxChunkSize {
+		return fmt.Errorf("read file entry length: %w", &LimitError{"MaxChunkSize", uint64(sz), opt.MaxChunkSize})
+	}
+	var n ValvePakIndex
+	if err := binary.Read(r, binary.LittleEndian, &n); err != nil {
+		return fmt.Errorf("read file terminator: %w", err)
+	} else if n != ValvePakIndexEOF {
+		return fmt.Errorf("read file terminator: %w: expected %04X, got %04X", ErrCorrupt, ValvePakIndexEOF, n)
+	}
+	f.Chunk = []ValvePakChunk{{
+		Offset:           uint64(off),
+		CompressedSize:   uint64(sz),
+		UncompressedSize: uint64(sz),
+	}}
+	return f.deserializePreload(r)
+}
+
+func (f ValvePakFile) serializeSource(w io.Writer) error {
+	if len(f.Chunk) != 1 {
+		return fmt.Errorf("source vpk files must have exactly one chunk, got %d", len(f.Chunk))
+	}
+	c := f.Chunk[0]
+	if c.IsCompressed() {
+		return fmt.Errorf("source vpk files must not be compressed")
+	}
+	if c.LoadFlags != 0 || c.TextureFlags != 0 {
+		return fmt.Errorf("source vpk files must not have load/texture flags")
+	}
+	if c.Offset > math.MaxUint32 || c.UncompressedSize > math.MaxUint32 {
+		return fmt.Errorf("source vpk file entry offset or length out of range")
+	}
+	if err := binary.Write(w, binary.LittleEndian, &f.CRC32); err != nil {
+		return fmt.Errorf("write file crc32: %w", err)
+	}
+	if err := f.serializePreloadBytes(w); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.LittleEndian, &f.Index); err != nil {
+		return fmt.Errorf("write file archive index: %w", err)
+	}
+	if err := binary.Write(w, binary.LittleEndian, uint32(c.Offset)); err != nil {
+		return fmt.Errorf("write file entry offset: %w", err)
+	}
+	if err := binary.Write(w, binary.LittleEndian, uint32(c.UncompressedSize)); err != nil {
+		return fmt.Errorf("write file entry length: %w", err)
+	}
+	if err := binary.Write(w, binary.LittleEndian, ValvePakIndexEOF); err != nil {
+		return fmt.Errorf("write file terminator: %w", err)
+	}
+	return f.serializePreload(w)
+}
@@ -3,16 +3,14 @@ package tf2vpk
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/binary"
 	"fmt"
 	"io"
-	"os"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
-
-	"github.com/pg9182/tf2lzham"
 )
 
 // Titanfall 2 VPK constants.
@@ -23,22 +21,41 @@ const (
 	ValvePakMaxChunkUncompressedSize uint64 = 0x100000
 )
 
-var (
-	debugDisableSanityChecks bool
-	debugDisableCRCChecks    bool
-)
+// Options configures validation and resource limits when reading and writing
+// VPKs. The zero value is strict, and has no limits.
+type Options struct {
+	// Lenient disables sanity checks which are based on observations of the
+	// Titanfall 2 VPKs (e.g., version numbers, flag consistency, and chunk
+	// sizes) rather than being required to read the structure.
+	Lenient bool
 
-func init() {
-	for _, v := range strings.Split(os.Getenv("TF2VPKDEBUG"), ",") {
-		switch v {
-		case "nosanitycheck":
-			debugDisableSanityChecks = true
-		case "nocrccheck":
-			debugDisableCRCChecks = true
-		}
-	}
+	// NoCRC disables CRC32 verification when reading files.
+	NoCRC bool
+
+	// MaxFiles, if non-zero, limits the number of files in the dir index.
+	MaxFiles int
+
+	// MaxTreeSize, if non-zero, limits the size of the dir tree in bytes.
+	MaxTreeSize uint32
+
+	// MaxChunkSize, if non-zero, limits the compressed and uncompressed size of
+	// each chunk (i.e., the amount of memory used to read it).
+	MaxChunkSize uint64
+
+	// Codec, if non-nil, is used to compress and decompress chunks instead of
+	// LZHAM.
+	Codec Codec
+
+	// DetectCodec, if Codec is nil, makes the Reader detect the codec from the
+	// first compressed chunk using the registered codecs (see CodecDetector),
+	// which must also be able to decompress it, falling back to LZHAM.
+	DetectCodec bool
 }
 
+// sizeOptions are used when serializing the dir to compute sizes, since
+// validation is done when it's actually written.
+var sizeOptions = Options{Lenient: true}
+
 // ValvePakDir is the root directory of a Titanfall 2 VPK, providing
 // byte-for-byte identical serialization/deserialization and validation (it will
 // refuse to read or write invalid structs).
@@ -47,31 +64,46 @@ type ValvePakDir struct {
 	MajorVersion uint16
 	MinorVersion uint16
 	treeSize     uint32 // will be dynamically calculated when writing
-	DataSize     uint32
-	File         []ValvePakFile
+	DataSize     uint32 // size of the file data embedded after the tree (for Source VPKs, only in version 2)
+
+	// Source VPK version 2 only (see ValvePakSourceSections).
+	ArchiveMD5Size uint32
+	OtherMD5Size   uint32
+	SignatureSize  uint32
+
+	File []ValvePakFile
 }
 
-// Deserialize parses a ValvePakDir from r.
+// Deserialize parses a ValvePakDir from r using the default Options.
 func (d *ValvePakDir) Deserialize(r io.Reader) error {
+	return d.DeserializeOptions(r, Options{})
+}
+
+// DeserializeOptions parses a ValvePakDir from r.
+func (d *ValvePakDir) DeserializeOptions(r io.Reader, opt Options) error {
 	if err := binary.Read(r, binary.LittleEndian, &d.Magic); err != nil {
 		return fmt.Errorf("read dir magic: %w", err)
 	} else if d.Magic != ValvePakMagic {
-		return fmt.Errorf("read magic: expected %08X, got %08X", ValvePakMagic, d.Magic)
+		return fmt.Errorf("read magic: %w: expected %08X, got %08X", ErrCorrupt, ValvePakMagic, d.Magic)
 	}
 	if err := binary.Read(r, binary.LittleEndian, &d.MajorVersion); err != nil {
 		return fmt.Errorf("read major version: %w", err)
 	} else if err := binary.Read(r, binary.LittleEndian, &d.MinorVersion); err != nil {
 		return fmt.Errorf("read minor version: %w", err)
-	} else if d.MajorVersion != ValvePakVersionMajor || d.MinorVersion != ValvePakVersionMinor {
-		return fmt.Errorf("unsupported dir version %d.%d (expected %d.%d)", d.MajorVersion, d.MinorVersion, ValvePakVersionMajor, ValvePakVersionMinor)
+	} else if !opt.Lenient && !d.IsSource() && (d.MajorVersion != ValvePakVersionMajor || d.MinorVersion != ValvePakVersionMinor) {
+		return &SanityError{SanityVersion, fmt.Sprintf("unsupported dir version %d.%d (expected %d.%d)", d.MajorVersion, d.MinorVersion, ValvePakVersionMajor, ValvePakVersionMinor)}
 	}
 	if err := binary.Read(r, binary.LittleEndian, &d.treeSize); err != nil {
 		return fmt.Errorf("read tree size: %w", err)
+	} else if opt.MaxTreeSize != 0 && d.treeSize > opt.MaxTreeSize {
+		return fmt.Errorf("read tree size: %w", &LimitError{"MaxTreeSize", uint64(d.treeSize), uint64(opt.MaxTreeSize)})
 	}
-	if err := binary.Read(r, binary.LittleEndian, &d.DataSize); err != nil {
+	if d.IsSource() {
+		if err := d.deserializeSourceHeader(r); err != nil {
+			return err
+		}
+	} else if err := binary.Read(r, binary.LittleEndian, &d.DataSize); err != nil {
 		return fmt.Errorf("read data size: %w", err)
-	} else if d.DataSize != 0 {
-		return fmt.Errorf("preload bytes are not implemented (and they shouldn't be in the TF2 VPKs anyways)")
 	}
 	// note: there isn't really any required order to the tree items as long as the ext/path/name is grouped together (the game builds a lookup table itself when reading the vpk)
 	b := bufio.NewReader(io.LimitReader(r, int64(d.treeSize)))
@@ -105,8 +137,16 @@ func (d *ValvePakDir) Deserialize(r io.Reader) error {
 				} else {
 					fn = xp + "/" + xn + "." + xx
 				}
+				if opt.MaxFiles != 0 && len(d.File) >= opt.MaxFiles {
+					return fmt.Errorf("read directory tree: %w", &LimitError{"MaxFiles", uint64(len(d.File) + 1), uint64(opt.MaxFiles)})
+				}
 				var f ValvePakFile
-				if err := f.Deserialize(b, fn); err != nil {
+				if d.IsSource() {
+					err = f.deserializeSource(b, fn, opt)
+				} else {
+					err = f.deserialize(b, fn, opt)
+				}
+				if err != nil {
 					return fmt.Errorf("read directory tree file data for %q: %w", f.Path, err)
 				}
 				//fmt.Println(xx, xp, xn)
@@ -115,7 +155,7 @@ func (d *ValvePakDir) Deserialize(r io.Reader) error {
 		}
 	}
 	if _, err := b.Peek(1); err != io.EOF {
-		return fmt.Errorf("read directory tree: expected tree size %d, but tree ended before that", d.treeSize)
+		return fmt.Errorf("read directory tree: %w: expected tree size %d, but tree ended before that", ErrCorrupt, d.treeSize)
 	}
 	if x, err := d.TreeSize(); err != nil {
 		panic(fmt.Errorf("serialized tree size mismatch: failed to serialize: %w (this is a bug in the serialization or a mismatch in the validation logic)", err))
@@ -140,9 +180,14 @@ func readNullString(r io.ByteReader) (string, error) {
 	return string(s), nil
 }
 
-// Serialize writes an encoded ValvePakDir to w. The output should be identical
-// byte-for-byte.
+// Serialize writes an encoded ValvePakDir to w using the default Options. The
+// output should be identical byte-for-byte.
 func (d ValvePakDir) Serialize(w io.Writer) error {
+	return d.SerializeOptions(w, Options{})
+}
+
+// SerializeOptions writes an encoded ValvePakDir to w.
+func (d ValvePakDir) SerializeOptions(w io.Writer, opt Options) error {
 	ts, err := d.TreeSize()
 	if err != nil {
 		return fmt.Errorf("calculate tree size: %w", err)
@@ -152,8 +197,8 @@ func (d ValvePakDir) Serialize(w io.Writer) error {
 	} else if err := binary.Write(w, binary.LittleEndian, &d.Magic); err != nil {
 		return fmt.Errorf("write dir magic: %w", err)
 	}
-	if !debugDisableSanityChecks && (d.MajorVersion != ValvePakVersionMajor || d.MinorVersion != ValvePakVersionMinor) {
-		return fmt.Errorf("unsupported dir version %d.%d (expected %d.%d)", d.MajorVersion, d.MinorVersion, ValvePakVersionMajor, ValvePakVersionMinor)
+	if !opt.Lenient && !d.IsSource() && (d.MajorVersion != ValvePakVersionMajor || d.MinorVersion != ValvePakVersionMinor) {
+		return &SanityError{SanityVersion, fmt.Sprintf("unsupported dir version %d.%d (expected %d.%d)", d.MajorVersion, d.MinorVersion, ValvePakVersionMajor, ValvePakVersionMinor)}
 	} else if err := binary.Write(w, binary.LittleEndian, &d.MajorVersion); err != nil {
 		return fmt.Errorf("write major version: %w", err)
 	} else if err := binary.Write(w, binary.LittleEndian, &d.MinorVersion); err != nil {
@@ -162,12 +207,14 @@ func (d ValvePakDir) Serialize(w io.Writer) error {
 	if err := binary.Write(w, binary.LittleEndian, ts); err != nil {
 		return fmt.Errorf("write tree size: %w", err)
 	}
-	if d.DataSize != 0 {
-		return fmt.Errorf("preload bytes are not implemented (and they shouldn't be in the TF2 VPKs anyways)")
+	if d.IsSource() {
+		if err := d.serializeSourceHeader(w); err != nil {
+			return err
+		}
 	} else if err := binary.Write(w, binary.LittleEndian, &d.DataSize); err != nil {
 		return fmt.Errorf("write data size: %w", err)
 	}
-	if err := d.writeTree(w); err != nil {
+	if err := d.writeTree(w, opt); err != nil {
 		return fmt.Errorf("write directory tree: %w", err)
 	}
 	return nil
@@ -209,7 +256,7 @@ func splitPath(p string) (ext, path, base string, err error) {
 
 func (d ValvePakDir) TreeSize() (uint32, error) {
 	var b countWriter
-	if err := d.writeTree(&b); err != nil {
+	if err := d.writeTree(&b, sizeOptions); err != nil {
 		return 0, err
 	}
 	return uint32(b.N), nil
@@ -223,7 +270,11 @@ func (d ValvePakDir) ChunkOffset() (n uint32, err error) {
 	n += uint32(binary.Size(d.MajorVersion))
 	n += uint32(binary.Size(d.MinorVersion))
 	n += uint32(binary.Size(d.treeSize))
-	n += uint32(binary.Size(d.DataSize))
+	if d.IsSource() {
+		n += d.sourceHeaderSize()
+	} else {
+		n += uint32(binary.Size(d.DataSize))
+	}
 
 	treeSize, err := d.TreeSize()
 	if err == nil {
@@ -242,7 +293,7 @@ func (c *countWriter) Write(b []byte) (n int, err error) {
 	return
 }
 
-func (d ValvePakDir) writeTree(w io.Writer) error {
+func (d ValvePakDir) writeTree(w io.Writer, opt Options) error {
 	var seenExt, seenPath, seenBase map[string]struct{}
 	lastExt, lastPath, lastBase := "\xFF", "\xFF", "\xFF"
 
@@ -299,7 +350,13 @@ func (d ValvePakDir) writeTree(w io.Writer) error {
 			if _, err := w.Write(append([]byte(base), '\x00')); err != nil {
 				return fmt.Errorf("add file node %s/%s/%s: %w", ext, path, base, err)
 			}
-			if err := f.Serialize(w); err != nil {
+			var err error
+			if d.IsSource() {
+				err = f.serializeSource(w)
+			} else {
+				err = f.serialize(w, opt)
+			}
+			if err != nil {
 				return fmt.Errorf("add file node %s/%s/%s: %w", ext, path, base, err)
 			}
 		}
@@ -358,6 +415,16 @@ type ValvePakFile struct {
 	PreloadBytes uint16
 	Index        ValvePakIndex
 	Chunk        []ValvePakChunk
+	Preload      []byte // stored in the dir index after the chunks, must be PreloadBytes long
+}
+
+// Size returns the uncompressed size of the file, including the preload data.
+func (f *ValvePakFile) Size() uint64 {
+	n := uint64(len(f.Preload))
+	for _, c := range f.Chunk {
+		n += c.UncompressedSize
+	}
+	return n
 }
 
 // LoadFlags gets the load flags for the file.
@@ -395,17 +462,27 @@ func (f *ValvePakFile) CreateReader(r io.ReaderAt) (io.Reader, error) {
 // parallel using n-1 goroutines going no more than n compressed chunks ahead
 // (i.e., 1 is not parallel).
 func (f *ValvePakFile) CreateReaderParallel(r io.ReaderAt, n int) (io.Reader, error) {
-	rs := make([]io.Reader, len(f.Chunk))
-	var sz uint64
-	var err error
+	return f.createReaderParallel(r, n, Options{})
+}
+
+func (f *ValvePakFile) createReaderParallel(r io.ReaderAt, n int, opt Options) (io.Reader, error) {
+	rs := make([]io.Reader, 0, len(f.Chunk)+1)
+	if len(f.Preload) != 0 {
+		rs = append(rs, bytes.NewReader(f.Preload))
+	}
 	for i, c := range f.Chunk {
-		rs[i], err = c.CreateReader(r)
+		cr, err := c.createReader(r, f.Index, opt.codec())
 		if err != nil {
 			return nil, fmt.Errorf("chunk %d: %w", i, err)
 		}
-		sz += c.UncompressedSize
+		rs = append(rs, cr)
+	}
+	sz := f.Size()
+	crc := f.CRC32
+	if opt.NoCRC {
+		crc = 0
 	}
-	return newCRCReader(newMultiChunkReader(n-1, rs...), sz, f.CRC32), nil
+	return newCRCReader(newMultiChunkReader(n-1, rs...), f.Path, sz, crc), nil
 }
 
 type multiChunkReader struct {
@@ -465,36 +542,38 @@ func (mr *multiChunkReader) WriteTo(w io.Writer) (sum int64, err error) {
 	return sum, nil
 }
 
-// Deserialize parses a ValvePakFile from r.
+// Deserialize parses a ValvePakFile from r using the default Options.
 func (f *ValvePakFile) Deserialize(r io.Reader, path string) error {
+	return f.deserialize(r, path, Options{})
+}
+
+func (f *ValvePakFile) deserialize(r io.Reader, path string, opt Options) error {
 	f.Path = path
 	if err := binary.Read(r, binary.LittleEndian, &f.CRC32); err != nil {
 		return fmt.Errorf("read file crc32: %w", err)
 	}
 	if err := binary.Read(r, binary.LittleEndian, &f.PreloadBytes); err != nil {
 		return fmt.Errorf("read file preload bytes: %w", err)
-	} else if f.PreloadBytes != 0 {
-		return fmt.Errorf("non-zero preload bytes are not implemented (and they shouldn't be in the TF2 VPKs anyways)")
 	}
 	if err := binary.Read(r, binary.LittleEndian, &f.Index); err != nil {
 		return fmt.Errorf("read file archive index: %w", err)
 	}
 	for {
 		var e ValvePakChunk
-		if err := e.Deserialize(r); err != nil {
+		if err := e.deserialize(r, opt); err != nil {
 			return fmt.Errorf("read file chunk: %w", err)
 		}
 		f.Chunk = append(f.Chunk, e)
 
 		// assumptions based on observation
-		if e.LoadFlags != f.Chunk[0].LoadFlags {
-			return fmt.Errorf("read file chunk: expected load flags to be the same for all chunks")
+		if !opt.Lenient && e.LoadFlags != f.Chunk[0].LoadFlags {
+			return fmt.Errorf("read file chunk: %w", &SanityError{SanityUniformLoadFlags, "expected load flags to be the same for all chunks"})
 		}
-		if e.TextureFlags != f.Chunk[0].TextureFlags {
-			return fmt.Errorf("read file chunk: expected texture flags to be the same for all chunks")
+		if !opt.Lenient && e.TextureFlags != f.Chunk[0].TextureFlags {
+			return fmt.Errorf("read file chunk: %w", &SanityError{SanityUniformTextureFlags, "expected texture flags to be the same for all chunks"})
 		}
-		if e.UncompressedSize > ValvePakMaxChunkUncompressedSize {
-			return fmt.Errorf("read file chunk: uncompressed size %d larger than %d", e.UncompressedSize, ValvePakMaxChunkUncompressedSize) // I'm not 100% sure about this limit
+		if !opt.Lenient && e.UncompressedSize > ValvePakMaxChunkUncompressedSize {
+			return fmt.Errorf("read file chunk: %w", &SanityError{SanityChunkSizeMax, fmt.Sprintf("uncompressed size %d larger than %d", e.UncompressedSize, ValvePakMaxChunkUncompressedSize)}) // I'm not 100% sure about this limit
 		}
 
 		var n ValvePakIndex
@@ -503,39 +582,51 @@ func (f *ValvePakFile) Deserialize(r io.Reader, path string) error {
 		}
 		if n == ValvePakIndexEOF {
 			break
-		} else if n != f.Index {
-			return fmt.Errorf("non-eof chunk terminator must equal the block index") // assumption based on observation
+		} else if !opt.Lenient && n != f.Index {
+			return &SanityError{SanityChunkTerminator, "non-eof chunk terminator must equal the block index"} // assumption based on observation
+		}
+	}
+	return f.deserializePreload(r)
+}
+
+func (f *ValvePakFile) deserializePreload(r io.Reader) error {
+	if f.PreloadBytes != 0 {
+		f.Preload = make([]byte, f.PreloadBytes)
+		if _, err := io.ReadFull(r, f.Preload); err != nil {
+			return fmt.Errorf("read file preload data: %w", err)
 		}
 	}
 	return nil
 }
 
-// Serialize writes an encoded ValvePakFile to w.
+// Serialize writes an encoded ValvePakFile to w using the default Options.
 func (f ValvePakFile) Serialize(w io.Writer) error {
+	return f.serialize(w, Options{})
+}
+
+func (f ValvePakFile) serialize(w io.Writer, opt Options) error {
 	if err := binary.Write(w, binary.LittleEndian, &f.CRC32); err != nil {
 		return fmt.Errorf("write file crc32: %w", err)
 	}
-	if f.PreloadBytes != 0 {
-		return fmt.Errorf("non-zero preload bytes are not implemented (and they shouldn't be in the TF2 VPKs anyways)")
-	} else if err := binary.Write(w, binary.LittleEndian, &f.PreloadBytes); err != nil {
-		return fmt.Errorf("write file preload bytes: %w", err)
+	if err := f.serializePreloadBytes(w); err != nil {
+		return err
 	}
 	if err := binary.Write(w, binary.LittleEndian, &f.Index); err != nil {
 		return fmt.Errorf("write file archive index: %w", err)
 	}
 	for i, e := range f.Chunk {
 		// assumptions based on observation
-		if !debugDisableSanityChecks && f.Path != "" && e.TextureFlags != 0 && !strings.HasSuffix(f.Path, ".vtf") && !strings.HasPrefix(f.Path, "vvc/") && !strings.HasPrefix(f.Path, "vvd/") {
-			return fmt.Errorf("write file chunk: expected non-vtf/non-vvc/non-vvd to not have texture flags (set env TF2VPKDEBUG=nosanitycheck to ignore this)")
+		if !opt.Lenient && f.Path != "" && e.TextureFlags != 0 && !strings.HasSuffix(f.Path, ".vtf") && !strings.HasPrefix(f.Path, "vvc/") && !strings.HasPrefix(f.Path, "vvd/") {
+			return fmt.Errorf("write file chunk: %w", &SanityError{SanityTextureFlagsPath, "expected non-vtf/non-vvc/non-vvd to not have texture flags"})
 		}
-		if !debugDisableSanityChecks && e.LoadFlags != f.Chunk[0].LoadFlags {
-			return fmt.Errorf("write file chunk: expected load flags to be the same for all chunks")
+		if !opt.Lenient && e.LoadFlags != f.Chunk[0].LoadFlags {
+			return fmt.Errorf("write file chunk: %w", &SanityError{SanityUniformLoadFlags, "expected load flags to be the same for all chunks"})
 		}
-		if !debugDisableSanityChecks && e.TextureFlags != f.Chunk[0].TextureFlags {
-			return fmt.Errorf("write file chunk: expected texture flags to be the same for all chunks")
+		if !opt.Lenient && e.TextureFlags != f.Chunk[0].TextureFlags {
+			return fmt.Errorf("write file chunk: %w", &SanityError{SanityUniformTextureFlags, "expected texture flags to be the same for all chunks"})
 		}
-		if !debugDisableSanityChecks && e.UncompressedSize > ValvePakMaxChunkUncompressedSize {
-			return fmt.Errorf("write file chunk: uncompressed size %d larger than %d", e.UncompressedSize, ValvePakMaxChunkUncompressedSize) // I'm not 100% sure about this limit
+		if !opt.Lenient && e.UncompressedSize > ValvePakMaxChunkUncompressedSize {
+			return fmt.Errorf("write file chunk: %w", &SanityError{SanityChunkSizeMax, fmt.Sprintf("uncompressed size %d larger than %d", e.UncompressedSize, ValvePakMaxChunkUncompressedSize)}) // I'm not 100% sure about this limit
 		}
 
 		if i != 0 {
@@ -543,13 +634,29 @@ func (f ValvePakFile) Serialize(w io.Writer) error {
 				return fmt.Errorf("write file chunk terminator: %w", err)
 			}
 		}
-		if err := e.Serialize(w); err != nil {
+		if err := e.serialize(w, opt); err != nil {
 			return fmt.Errorf("write file chunk: %w", err)
 		}
 	}
 	if err := binary.Write(w, binary.LittleEndian, uint16(65535)); err != nil {
 		return fmt.Errorf("write file eof chunk terminator: %w", err)
 	}
+	return f.serializePreload(w)
+}
+
+func (f ValvePakFile) serializePreloadBytes(w io.Writer) error {
+	if int(f.PreloadBytes) != len(f.Preload) {
+		return fmt.Errorf("write file preload bytes: expected %d bytes of preload data, got %d", f.PreloadBytes, len(f.Preload))
+	} else if err := binary.Write(w, binary.LittleEndian, &f.PreloadBytes); err != nil {
+		return fmt.Errorf("write file preload bytes: %w", err)
+	}
+	return nil
+}
+
+func (f ValvePakFile) serializePreload(w io.Writer) error {
+	if _, err := w.Write(f.Preload); err != nil {
+		return fmt.Errorf("write file preload data: %w", err)
+	}
 	return nil
 }
 
@@ -611,17 +718,31 @@ func (c ValvePakChunk) IsCompressed() bool {
 	return c.CompressedSize != c.UncompressedSize
 }
 
-// CreateReader creates a new reader for the chunk.
+// CreateReader creates a new reader for the chunk, decompressing it with LZHAM.
 func (c ValvePakChunk) CreateReader(r io.ReaderAt) (io.Reader, error) {
+	return c.CreateReaderCodec(r, LZHAM)
+}
+
+// CreateReaderCodec is like CreateReader, but decompresses the chunk with the
+// provided codec.
+func (c ValvePakChunk) CreateReaderCodec(r io.ReaderAt, codec Codec) (io.Reader, error) {
+	return c.createReader(r, ValvePakIndexEOF, codec)
+}
+
+// createReader is like CreateReaderCodec, but includes the block index in
+// errors.
+func (c ValvePakChunk) createReader(r io.ReaderAt, idx ValvePakIndex, codec Codec) (io.Reader, error) {
 	if c.IsCompressed() {
-		return newLZHAMLazyReader(r, int64(c.Offset), int64(c.CompressedSize), int64(c.UncompressedSize)), nil
+		return newLazyChunkReader(r, idx, codec, int64(c.Offset), int64(c.CompressedSize), int64(c.UncompressedSize)), nil
 	} else {
 		return io.NewSectionReader(r, int64(c.Offset), int64(c.CompressedSize)), nil
 	}
 }
 
-type lzhamLazyReader struct {
+type lazyChunkReader struct {
 	r   io.ReaderAt
+	idx ValvePakIndex
+	cdc Codec
 	off int64
 	csz int64
 	dsz int64
@@ -632,11 +753,11 @@ type lzhamLazyReader struct {
 	n uint64
 }
 
-func newLZHAMLazyReader(r io.ReaderAt, off, csz, dsz int64) io.Reader {
-	return &lzhamLazyReader{r: r, off: off, csz: csz, dsz: dsz}
+func newLazyChunkReader(r io.ReaderAt, idx ValvePakIndex, codec Codec, off, csz, dsz int64) io.Reader {
+	return &lazyChunkReader{r: r, idx: idx, cdc: codec, off: off, csz: csz, dsz: dsz}
 }
 
-func (r *lzhamLazyReader) Read(b []byte) (n int, err error) {
+func (r *lazyChunkReader) Read(b []byte) (n int, err error) {
 	r.m.Lock()
 	defer r.m.Unlock()
 
@@ -656,35 +777,44 @@ func (r *lzhamLazyReader) Read(b []byte) (n int, err error) {
 	return
 }
 
-func (r *lzhamLazyReader) EnsureDecompressed() error {
+func (r *lazyChunkReader) EnsureDecompressed() error {
 	r.m.Lock()
 	defer r.m.Unlock()
 
 	return r.decompress()
 }
 
-func (r *lzhamLazyReader) decompress() error {
+func (r *lazyChunkReader) decompress() error {
 	if r.e != nil {
 		return r.e
 	}
 	if r.b != nil {
 		return nil
 	}
-	src := make([]byte, int(r.csz))
-	if _, err := r.r.ReadAt(src, r.off); err != nil {
-		r.e = fmt.Errorf("read chunk: %w", err)
-		return r.e
+	r.b, r.e = decompressChunk(r.r, r.idx, r.cdc, r.off, r.csz, r.dsz)
+	return r.e
+}
+
+// decompress reads and decompresses the chunk from block idx.
+func (c ValvePakChunk) decompress(r io.ReaderAt, idx ValvePakIndex, codec Codec) ([]byte, error) {
+	return decompressChunk(r, idx, codec, int64(c.Offset), int64(c.CompressedSize), int64(c.UncompressedSize))
+}
+
+func decompressChunk(r io.ReaderAt, idx ValvePakIndex, codec Codec, off, csz, dsz int64) ([]byte, error) {
+	src := make([]byte, int(csz))
+	if _, err := r.ReadAt(src, off); err != nil {
+		if err == io.EOF {
+			err = fmt.Errorf("%w: %w", ErrCorrupt, io.ErrUnexpectedEOF)
+		}
+		return nil, fmt.Errorf("read chunk: %w", err)
 	}
-	dst := make([]byte, int(r.dsz))
-	if n, _, _, err := tf2lzham.Decompress(dst, src); err != nil {
-		r.e = fmt.Errorf("decompress chunk: %w", err)
-		return r.e
+	dst := make([]byte, int(dsz))
+	if n, err := codec.Decompress(dst, src); err != nil {
+		return nil, &DecompressError{idx, uint64(off), err}
 	} else if n != len(dst) {
-		r.e = fmt.Errorf("decompress chunk: %w", err)
-		return r.e
+		return nil, &DecompressError{idx, uint64(off), fmt.Errorf("expected %d bytes, got %d", len(dst), n)}
 	}
-	r.b = dst
-	return nil
+	return dst, nil
 }
 
 // CreateReader creates a new reader for the raw data of the chunk.
@@ -692,8 +822,12 @@ func (c ValvePakChunk) CreateReaderRaw(r io.ReaderAt) (io.Reader, error) {
 	return io.NewSectionReader(r, int64(c.Offset), int64(c.CompressedSize)), nil
 }
 
-// Deserialize parses a ValvePakChunk from r.
+// Deserialize parses a ValvePakChunk from r using the default Options.
 func (c *ValvePakChunk) Deserialize(r io.Reader) error {
+	return c.deserialize(r, Options{})
+}
+
+func (c *ValvePakChunk) deserialize(r io.Reader, opt Options) error {
 	if err := binary.Read(r, binary.LittleEndian, &c.LoadFlags); err != nil {
 		return fmt.Errorf("read chunk entry flags: %w", err)
 	}
@@ -705,19 +839,27 @@ func (c *ValvePakChunk) Deserialize(r io.Reader) error {
 	}
 	if err := binary.Read(r, binary.LittleEndian, &c.CompressedSize); err != nil {
 		return fmt.Errorf("read chunk compressed size: %w", err)
-	} else if !debugDisableSanityChecks && c.CompressedSize == 0 {
-		return fmt.Errorf("read chunk compressed size: must be non-zero")
+	} else if !opt.Lenient && c.CompressedSize == 0 {
+		return fmt.Errorf("read chunk compressed size: %w", &SanityError{SanityChunkSizeNonZero, "must be non-zero"})
+	} else if opt.MaxChunkSize != 0 && c.CompressedSize > opt.MaxChunkSize {
+		return fmt.Errorf("read chunk compressed size: %w", &LimitError{"MaxChunkSize", c.CompressedSize, opt.MaxChunkSize})
 	}
 	if err := binary.Read(r, binary.LittleEndian, &c.UncompressedSize); err != nil {
 		return fmt.Errorf("read chunk uncompressed size: %w", err)
-	} else if !debugDisableSanityChecks && c.UncompressedSize == 0 {
-		return fmt.Errorf("read chunk uncompressed size: must be non-zero")
+	} else if !opt.Lenient && c.UncompressedSize == 0 {
+		return fmt.Errorf("read chunk uncompressed size: %w", &SanityError{SanityChunkSizeNonZero, "must be non-zero"})
+	} else if opt.MaxChunkSize != 0 && c.UncompressedSize > opt.MaxChunkSize {
+		return fmt.Errorf("read chunk uncompressed size: %w", &LimitError{"MaxChunkSize", c.UncompressedSize, opt.MaxChunkSize})
 	}
 	return nil
 }
 
-// Serialize writes an encoded ValvePakChunk to w.
+// Serialize writes an encoded ValvePakChunk to w using the default Options.
 func (c ValvePakChunk) Serialize(w io.Writer) error {
+	return c.serialize(w, Options{})
+}
+
+func (c ValvePakChunk) serialize(w io.Writer, opt Options) error {
 	if err := binary.Write(w, binary.LittleEndian, &c.LoadFlags); err != nil {
 		return fmt.Errorf("write chunk entry flags: %w", err)
 	}
@@ -727,13 +869,13 @@ func (c ValvePakChunk) Serialize(w io.Writer) error {
 	if err := binary.Write(w, binary.LittleEndian, c.Offset); err != nil {
 		return fmt.Errorf("write chunk archive offset: %w", err)
 	}
-	if !debugDisableSanityChecks && c.CompressedSize == 0 {
-		return fmt.Errorf("write chunk compressed size: must be non-zero")
+	if !opt.Lenient && c.CompressedSize == 0 {
+		return fmt.Errorf("write chunk compressed size: %w", &SanityError{SanityChunkSizeNonZero, "must be non-zero"})
 	} else if err := binary.Write(w, binary.LittleEndian, c.CompressedSize); err != nil {
 		return fmt.Errorf("write chunk compressed size: %w", err)
 	}
-	if !debugDisableSanityChecks && c.UncompressedSize == 0 {
-		return fmt.Errorf("write chunk uncompressed size: must be non-zero")
+	if !opt.Lenient && c.UncompressedSize == 0 {
+		return fmt.Errorf("write chunk uncompressed size: %w", &SanityError{SanityChunkSizeNonZero, "must be non-zero"})
 	} else if err := binary.Write(w, binary.LittleEndian, c.UncompressedSize); err != nil {
 		return fmt.Errorf("write chunk uncompressed size: %w", err)
 	}
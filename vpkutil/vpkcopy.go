@@ -0,0 +1,199 @@
+package vpkutil
+
+import (
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"io"
+
+	"github.com/pg9182/tf2vpk"
+)
+
+// ConflictPolicy determines which file is used when copying multiple files
+// with the same path. It implements [pflag.Value].
+type ConflictPolicy string
+
+const (
+	ConflictReject ConflictPolicy = "error" // fail with a *ConflictError
+	ConflictFirst  ConflictPolicy = "first" // keep the first file
+	ConflictLast   ConflictPolicy = "last"  // replace it with the last file
+)
+
+func (p ConflictPolicy) String() string {
+	return string(p)
+}
+
+func (p *ConflictPolicy) Set(s string) error {
+	switch x := ConflictPolicy(s); x {
+	case ConflictReject, ConflictFirst, ConflictLast:
+		*p = x
+		return nil
+	}
+	return fmt.Errorf("must be one of %s, %s, or %s", ConflictReject, ConflictFirst, ConflictLast)
+}
+
+func (p ConflictPolicy) Type() string {
+	return "error|first|last"
+}
+
+// Replace returns whether a file should replace an existing one with the same
+// path. If the policy is empty or ConflictReject, a *ConflictError is
+// returned.
+func (p ConflictPolicy) Replace(path string) (bool, error) {
+	switch p {
+	case ConflictFirst:
+		return false, nil
+	case ConflictLast:
+		return true, nil
+	}
+	return false, &ConflictError{path}
+}
+
+// ConflictError is returned by ConflictPolicy for conflicting paths.
+type ConflictError struct {
+	Path string
+}
+
+func (err *ConflictError) Error() string {
+	return fmt.Sprintf("conflicting file %q", err.Path)
+}
+
+// CopyFile is a file to be copied from a VPK.
+type CopyFile struct {
+	Reader *tf2vpk.Reader
+	File   tf2vpk.ValvePakFile
+}
+
+// ResolveConflicts removes files with the same path as a previous one
+// according to policy. The remaining files are in the order each path first
+// appeared in.
+func ResolveConflicts(files []CopyFile, policy ConflictPolicy) ([]CopyFile, error) {
+	var (
+		res   = make([]CopyFile, 0, len(files))
+		index = make(map[string]int, len(files))
+	)
+	for _, f := range files {
+		if i, ok := index[f.File.Path]; ok {
+			if replace, err := policy.Replace(f.File.Path); err != nil {
+				return nil, err
+			} else if replace {
+				res[i] = f
+			}
+			continue
+		}
+		index[f.File.Path] = len(res)
+		res = append(res, f)
+	}
+	return res, nil
+}
+
+// CopyResult contains statistics about copied files.
+type CopyResult struct {
+	Files        int    // number of files copied
+	Chunks       int    // number of distinct chunks in the input
+	Duplicate    int    // number of chunks replaced by an identical one
+	Recompressed int    // number of chunks recompressed with the codec of the Writer
+	Size         uint64 // total size of the chunk data written
+}
+
+// CopyChunks adds files to w, copying the raw chunk data to block i without
+// recompressing it. The CRC32 and flags of the files are preserved. Identical
+// chunks (including ones from different VPKs) are only written once.
+//
+// Compressed chunks from a Reader with a different codec than w are
+// decompressed and recompressed with the codec of w.
+func CopyChunks(ctx context.Context, w *tf2vpk.Writer, i tf2vpk.ValvePakIndex, files []CopyFile) (CopyResult, error) {
+	type srcChunk struct {
+		Reader *tf2vpk.Reader
+		Index  tf2vpk.ValvePakIndex
+		Offset uint64
+		Size   uint64
+	}
+	type dstChunk struct {
+		Offset uint64
+		Size   uint64
+	}
+	var (
+		res    CopyResult
+		src    = map[srcChunk]dstChunk{}
+		hashed = map[[sha1.Size]byte]uint64{}
+		buf    []byte
+	)
+	for _, x := range files {
+		f := x.File
+		f.Index = i
+		f.Chunk = make([]tf2vpk.ValvePakChunk, len(x.File.Chunk))
+		for j, c := range x.File.Chunk {
+			select {
+			case <-ctx.Done():
+				return res, ctx.Err()
+			default:
+			}
+			k := srcChunk{x.Reader, x.File.Index, c.Offset, c.CompressedSize}
+			d, ok := src[k]
+			if !ok {
+				res.Chunks++
+				cr, err := x.Reader.OpenChunkRaw(x.File, c)
+				if err != nil {
+					return res, fmt.Errorf("copy file %q: read chunk %d: %w", x.File.Path, j, err)
+				}
+				if uint64(cap(buf)) < c.CompressedSize {
+					buf = make([]byte, c.CompressedSize)
+				}
+				buf = buf[:c.CompressedSize]
+				if _, err := io.ReadFull(cr, buf); err != nil {
+					return res, fmt.Errorf("copy file %q: read chunk %d: %w", x.File.Path, j, err)
+				}
+				data := buf
+				if c.IsCompressed() && x.Reader.Codec() != w.Codec() {
+					if data, err = recompressChunk(x.Reader.Codec(), w.Codec(), buf, c.UncompressedSize); err != nil {
+						return res, fmt.Errorf("copy file %q: recompress chunk %d: %w", x.File.Path, j, err)
+					}
+					res.Recompressed++
+				}
+				d.Size = uint64(len(data))
+				h := sha1.Sum(data)
+				if prev, dup := hashed[h]; dup {
+					d.Offset = prev
+					res.Duplicate++
+				} else {
+					if d.Offset, err = w.WriteRaw(i, data); err != nil {
+						return res, fmt.Errorf("copy file %q: %w", x.File.Path, err)
+					}
+					hashed[h] = d.Offset
+					res.Size += d.Size
+				}
+				src[k] = d
+			}
+			f.Chunk[j] = c
+			f.Chunk[j].Offset = d.Offset
+			f.Chunk[j].CompressedSize = d.Size
+		}
+		if err := w.AddFile(f); err != nil {
+			return res, err
+		}
+		res.Files++
+	}
+	return res, nil
+}
+
+// recompressChunk decompresses the raw data of a chunk with one codec and
+// compresses it with another, returning the uncompressed data if it doesn't
+// get smaller (like Writer).
+func recompressChunk(from, to tf2vpk.Codec, b []byte, size uint64) ([]byte, error) {
+	data := make([]byte, size)
+	if n, err := from.Decompress(data, b); err != nil {
+		return nil, fmt.Errorf("decompress with %s: %w", from.Name(), err)
+	} else if uint64(n) != size {
+		return nil, fmt.Errorf("decompress with %s: expected %d bytes, got %d", from.Name(), size, n)
+	}
+	z := make([]byte, len(data)*2+64)
+	n, err := to.Compress(z, data)
+	if err != nil {
+		return nil, fmt.Errorf("compress with %s: %w", to.Name(), err)
+	}
+	if n >= len(data) {
+		return data, nil // note: a chunk is only treated as compressed if the sizes differ
+	}
+	return z[:n], nil
+}
@@ -0,0 +1,155 @@
+package vpkutil
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/pg9182/tf2vpk"
+)
+
+func TestCopyChunks(t *testing.T) {
+	create := func(files map[string]string) *tf2vpk.Reader {
+		m := map[tf2vpk.ValvePakIndex]*bytes.Buffer{}
+		w := tf2vpk.NewWriterFunc(memBlock(m))
+		for name, data := range files {
+			if _, err := w.WriteFile(name, bytes.NewReader(bytes.Repeat([]byte(data), 1000)), 1, 0); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		r, err := tf2vpk.NewReaderFunc(memBlockReader(m))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+	r1 := create(map[string]string{"a.txt": "a", "b/c.nut": "c", "d.txt": "d"})
+	r2 := create(map[string]string{"a.txt": "A", "b/e.nut": "c", "f.txt": "f"})
+
+	var files []CopyFile
+	for _, r := range []*tf2vpk.Reader{r1, r2} {
+		for _, f := range r.Root.File {
+			files = append(files, CopyFile{r, f})
+		}
+	}
+
+	var cerr *ConflictError
+	if _, err := ResolveConflicts(files, ConflictReject); !errors.As(err, &cerr) || cerr.Path != "a.txt" {
+		t.Errorf("expected conflict error for a.txt, got %v", err)
+	}
+	for _, policy := range []ConflictPolicy{ConflictFirst, ConflictLast} {
+		res, err := ResolveConflicts(files, policy)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", policy, err)
+		}
+		if len(res) != 5 {
+			t.Fatalf("%s: expected 5 files, got %d", policy, len(res))
+		}
+
+		m := map[tf2vpk.ValvePakIndex]*bytes.Buffer{}
+		w := tf2vpk.NewWriterFunc(memBlock(m))
+		cres, err := CopyChunks(context.Background(), w, 2, res)
+		if err != nil {
+			t.Fatalf("%s: copy chunks: %v", policy, err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if cres.Files != 5 || cres.Chunks != 5 || cres.Duplicate != 1 {
+			t.Errorf("%s: incorrect result %+v", policy, cres)
+		}
+
+		r, err := tf2vpk.NewReaderFunc(memBlockReader(m))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, x := range res {
+			if buf, err := r.ReadFile(x.File.Path); err != nil {
+				t.Errorf("%s: read %q: %v", policy, x.File.Path, err)
+			} else if exp, _ := x.Reader.ReadFile(x.File.Path); !bytes.Equal(buf, exp) {
+				t.Errorf("%s: read %q: incorrect contents", policy, x.File.Path)
+			}
+		}
+		if buf, _ := r.ReadFile("a.txt"); (buf[0] == 'A') != (policy == ConflictLast) {
+			t.Errorf("%s: wrong a.txt used", policy)
+		}
+		for _, f := range r.Root.File {
+			if f.Index != 2 {
+				t.Errorf("%s: expected %q to be in block 2, got %s", policy, f.Path, f.Index)
+			}
+		}
+	}
+}
+
+func TestCopyChunksCodec(t *testing.T) {
+	files := map[string][]byte{
+		"a.txt": bytes.Repeat([]byte("a"), 1000),
+		"b.txt": bytes.Repeat([]byte("b"), 1000),
+		"c.txt": []byte("c"), // stored uncompressed
+	}
+	create := func(c tf2vpk.Codec) *tf2vpk.Reader {
+		m := map[tf2vpk.ValvePakIndex]*bytes.Buffer{}
+		w := tf2vpk.NewWriterFuncOptions(memBlock(m), tf2vpk.Options{Codec: c})
+		for name, data := range files {
+			if _, err := w.WriteFile(name, bytes.NewReader(data), 1, 0); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		r, err := tf2vpk.NewReaderFuncOptions(memBlockReader(m), tf2vpk.Options{Codec: c})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+	zr, lr := create(tf2vpk.Zlib), create(tf2vpk.LZHAM)
+
+	for _, c := range []tf2vpk.Codec{tf2vpk.LZHAM, tf2vpk.Zlib} {
+		t.Run(c.Name(), func(t *testing.T) {
+			var cf []CopyFile
+			for _, r := range []*tf2vpk.Reader{zr, lr} {
+				for _, f := range r.Root.File {
+					if r == lr {
+						f.Path = "lzham/" + f.Path
+					}
+					cf = append(cf, CopyFile{r, f})
+				}
+			}
+
+			m := map[tf2vpk.ValvePakIndex]*bytes.Buffer{}
+			w := tf2vpk.NewWriterFuncOptions(memBlock(m), tf2vpk.Options{Codec: c})
+			res, err := CopyChunks(context.Background(), w, 0, cf)
+			if err != nil {
+				t.Fatalf("copy chunks: %v", err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if res.Recompressed != 2 {
+				t.Errorf("expected 2 chunks to be recompressed, got %+v", res)
+			}
+			if res.Duplicate != 3 {
+				t.Errorf("expected the recompressed chunks and the uncompressed one to be de-duplicated, got %+v", res)
+			}
+
+			r, err := tf2vpk.NewReaderFuncOptions(memBlockReader(m), tf2vpk.Options{Codec: c})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, x := range cf {
+				if buf, err := r.ReadFile(x.File.Path); err != nil {
+					t.Errorf("read %q: %v", x.File.Path, err)
+				} else if !bytes.Equal(buf, files[strings.TrimPrefix(x.File.Path, "lzham/")]) {
+					t.Errorf("read %q: incorrect contents", x.File.Path)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,129 @@
+package vpkutil
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/pg9182/tf2vpk"
+)
+
+// DiffKind is the type of change to a file.
+type DiffKind string
+
+const (
+	DiffAdded    DiffKind = "added"
+	DiffRemoved  DiffKind = "removed"
+	DiffModified DiffKind = "modified"
+)
+
+// DiffFile contains the metadata of a file compared by Diff.
+type DiffFile struct {
+	CRC32        uint32 `json:"crc32"`
+	Size         uint64 `json:"size"` // uncompressed
+	LoadFlags    uint32 `json:"load_flags"`
+	TextureFlags uint16 `json:"texture_flags"`
+	Chunks       int    `json:"chunks"`
+}
+
+func newDiffFile(f tf2vpk.ValvePakFile) (*DiffFile, error) {
+	load, err := f.LoadFlags()
+	if err != nil {
+		return nil, fmt.Errorf("compute load flags for %q: %w", f.Path, err)
+	}
+	texture, err := f.TextureFlags()
+	if err != nil {
+		return nil, fmt.Errorf("compute texture flags for %q: %w", f.Path, err)
+	}
+	x := &DiffFile{
+		CRC32:        f.CRC32,
+		LoadFlags:    load,
+		TextureFlags: texture,
+		Chunks:       len(f.Chunk),
+		Size:         f.Size(),
+	}
+	return x, nil
+}
+
+// DiffEntry is a changed file.
+type DiffEntry struct {
+	Path string    `json:"path"`
+	Kind DiffKind  `json:"kind"`
+	A    *DiffFile `json:"a,omitempty"` // nil if added
+	B    *DiffFile `json:"b,omitempty"` // nil if removed
+}
+
+// Changed returns the names of the metadata fields which differ (i.e., crc32,
+// size, load_flags, texture_flags, chunks) between A and B.
+func (e DiffEntry) Changed() []string {
+	var c []string
+	if e.A != nil && e.B != nil {
+		if e.A.CRC32 != e.B.CRC32 {
+			c = append(c, "crc32")
+		}
+		if e.A.Size != e.B.Size {
+			c = append(c, "size")
+		}
+		if e.A.LoadFlags != e.B.LoadFlags {
+			c = append(c, "load_flags")
+		}
+		if e.A.TextureFlags != e.B.TextureFlags {
+			c = append(c, "texture_flags")
+		}
+		if e.A.Chunks != e.B.Chunks {
+			c = append(c, "chunks")
+		}
+	}
+	return c
+}
+
+// Diff compares the files in two VPK dir indexes, returning the changes sorted
+// by path. Files are compared by their metadata, so changes to the chunk
+// layout which don't affect the contents are ignored. If skip is not nil,
+// files for which it returns true are not compared.
+func Diff(a, b tf2vpk.ValvePakDir, skip func(tf2vpk.ValvePakFile) (bool, error)) ([]DiffEntry, error) {
+	files := func(root tf2vpk.ValvePakDir) (map[string]*DiffFile, error) {
+		m := make(map[string]*DiffFile, len(root.File))
+		for _, f := range root.File {
+			if skip != nil {
+				if s, err := skip(f); err != nil {
+					return nil, err
+				} else if s {
+					continue
+				}
+			}
+			x, err := newDiffFile(f)
+			if err != nil {
+				return nil, err
+			}
+			m[f.Path] = x
+		}
+		return m, nil
+	}
+	af, err := files(a)
+	if err != nil {
+		return nil, err
+	}
+	bf, err := files(b)
+	if err != nil {
+		return nil, err
+	}
+
+	var es []DiffEntry
+	for p, x := range af {
+		if y, ok := bf[p]; !ok {
+			es = append(es, DiffEntry{Path: p, Kind: DiffRemoved, A: x})
+		} else if *x != *y {
+			es = append(es, DiffEntry{Path: p, Kind: DiffModified, A: x, B: y})
+		}
+	}
+	for p, y := range bf {
+		if _, ok := af[p]; !ok {
+			es = append(es, DiffEntry{Path: p, Kind: DiffAdded, B: y})
+		}
+	}
+	slices.SortFunc(es, func(a, b DiffEntry) int {
+		return strings.Compare(a.Path, b.Path)
+	})
+	return es, nil
+}
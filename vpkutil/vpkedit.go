@@ -4,12 +4,27 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"slices"
 
 	"github.com/pg9182/tf2vpk"
 )
 
-// UpdateDir edits the vpk dir in-place.
+// UpdateDir edits the vpk dir in-place using the default options.
 func UpdateDir(vpk tf2vpk.ValvePakRef, dryRun bool, fn func(*tf2vpk.ValvePakDir) error) error {
+	return UpdateDirOptions(vpk, tf2vpk.Options{}, dryRun, fn)
+}
+
+// UpdateDirOptions edits the vpk dir in-place. For Source VPKs version 2, the
+// checksums after the file data are also updated.
+func UpdateDirOptions(vpk tf2vpk.ValvePakRef, opt tf2vpk.Options, dryRun bool, fn func(*tf2vpk.ValvePakDir) error) error {
+	return updateDir(vpk, opt, dryRun, func(root *tf2vpk.ValvePakDir, _ *tf2vpk.ValvePakSourceSections) error {
+		return fn(root)
+	})
+}
+
+// updateDir is like UpdateDirOptions, but also allows fn to modify the archive
+// md5 entries of Source VPKs version 2 (sections is empty otherwise).
+func updateDir(vpk tf2vpk.ValvePakRef, opt tf2vpk.Options, dryRun bool, fn func(*tf2vpk.ValvePakDir, *tf2vpk.ValvePakSourceSections) error) error {
 	openFlag := os.O_RDWR
 	if dryRun {
 		openFlag = os.O_RDONLY
@@ -22,7 +37,7 @@ func UpdateDir(vpk tf2vpk.ValvePakRef, dryRun bool, fn func(*tf2vpk.ValvePakDir)
 	defer f.Close()
 
 	var root tf2vpk.ValvePakDir
-	if err := root.Deserialize(f); err != nil {
+	if err := root.DeserializeOptions(f, opt); err != nil {
 		return fmt.Errorf("read vpk dir: %w", err)
 	}
 
@@ -37,7 +52,17 @@ func UpdateDir(vpk tf2vpk.ValvePakRef, dryRun bool, fn func(*tf2vpk.ValvePakDir)
 		panic("wtf") // this is a bug in ChunkOffset if it happens
 	}
 
-	if err := fn(&root); err != nil {
+	// the checksum sections after the file data include the tree
+	source2 := root.IsSource() && root.MajorVersion == tf2vpk.ValvePakVersionSource2
+
+	var sections tf2vpk.ValvePakSourceSections
+	if source2 {
+		if err := sections.Deserialize(io.NewSectionReader(f, int64(origSize)+int64(root.DataSize), 1<<63-1), root); err != nil {
+			return fmt.Errorf("read checksum sections: %w", err)
+		}
+	}
+
+	if err := fn(&root, &sections); err != nil {
 		return err
 	}
 
@@ -47,11 +72,11 @@ func UpdateDir(vpk tf2vpk.ValvePakRef, dryRun bool, fn func(*tf2vpk.ValvePakDir)
 	}
 
 	if !dryRun {
-		if newSize == origSize {
+		if newSize == origSize && !source2 {
 			if _, err := f.Seek(0, io.SeekStart); err != nil {
 				return fmt.Errorf("write vpk dir: overwrite dir: %w", err)
 			}
-			if err := root.Serialize(f); err != nil {
+			if err := root.SerializeOptions(f, opt); err != nil {
 				return fmt.Errorf("write vpk dir: overwrite dir: %w", err)
 			}
 		} else {
@@ -71,14 +96,29 @@ func UpdateDir(vpk tf2vpk.ValvePakRef, dryRun bool, fn func(*tf2vpk.ValvePakDir)
 			if _, err := f.Seek(0, io.SeekStart); err != nil {
 				return fmt.Errorf("write vpk dir: write dir: %w", err)
 			}
-			if err := root.Serialize(f); err != nil {
-				return fmt.Errorf("write vpk dir: write dir: %w", err)
-			}
-			if _, err := tf.Seek(0, io.SeekStart); err != nil {
-				return fmt.Errorf("write vpk dir: copy chunks from temp file: %w", err)
-			}
-			if _, err := io.Copy(f, tf); err != nil {
-				return fmt.Errorf("write vpk dir: copy chunks from temp file: %w", err)
+			if source2 {
+				if err := sections.UpdateChecksums(&root, io.NewSectionReader(tf, 0, int64(root.DataSize))); err != nil {
+					return fmt.Errorf("write vpk dir: update checksums: %w", err)
+				}
+				if err := root.SerializeOptions(f, opt); err != nil {
+					return fmt.Errorf("write vpk dir: write dir: %w", err)
+				}
+				if _, err := io.Copy(f, io.NewSectionReader(tf, 0, int64(root.DataSize))); err != nil {
+					return fmt.Errorf("write vpk dir: copy chunks from temp file: %w", err)
+				}
+				if err := sections.Serialize(f); err != nil {
+					return fmt.Errorf("write vpk dir: write checksum sections: %w", err)
+				}
+			} else {
+				if err := root.SerializeOptions(f, opt); err != nil {
+					return fmt.Errorf("write vpk dir: write dir: %w", err)
+				}
+				if _, err := tf.Seek(0, io.SeekStart); err != nil {
+					return fmt.Errorf("write vpk dir: copy chunks from temp file: %w", err)
+				}
+				if _, err := io.Copy(f, tf); err != nil {
+					return fmt.Errorf("write vpk dir: copy chunks from temp file: %w", err)
+				}
 			}
 			if err := f.Close(); err != nil {
 				return fmt.Errorf("write vpk dir: write dir: %w", err)
@@ -91,3 +131,158 @@ func UpdateDir(vpk tf2vpk.ValvePakRef, dryRun bool, fn func(*tf2vpk.ValvePakDir)
 	}
 	return nil
 }
+
+// AppendFiles edits the vpk dir in-place like UpdateDirOptions, but also
+// provides a Writer which appends the chunks of files written to it after the
+// existing contents of the block selected with SetIndex (which is created if it
+// doesn't exist). After fn returns, the written files are added to the dir,
+// replacing existing ones with the same path. The chunks of replaced files are
+// left in the blocks (use GC to remove them).
+//
+// Since existing chunks are never moved, the dir indexes for other locales
+// sharing the blocks remain valid.
+//
+// The Writer uses opt. If opt.DetectCodec is set and opt.Codec is nil, the codec
+// is detected from the existing chunks so the new ones are compressed the same
+// way.
+func AppendFiles(vpk tf2vpk.ValvePakRef, opt tf2vpk.Options, dryRun bool, fn func(*tf2vpk.ValvePakDir, *tf2vpk.Writer) error) error {
+	if opt.Codec == nil && opt.DetectCodec {
+		r, err := tf2vpk.NewReaderOptions(vpk, opt)
+		if err != nil {
+			return fmt.Errorf("detect codec: %w", err)
+		}
+		opt.Codec = r.Codec()
+		r.Close()
+	}
+	return updateDir(vpk, opt, dryRun, func(root *tf2vpk.ValvePakDir, sections *tf2vpk.ValvePakSourceSections) error {
+		w := tf2vpk.NewWriterFuncOptions(func(i tf2vpk.ValvePakIndex) (io.Writer, error) {
+			if dryRun || i == tf2vpk.ValvePakIndexDir {
+				return io.Discard, nil // the dir is written by UpdateDirOptions
+			}
+			return os.OpenFile(vpk.Resolve(i), os.O_RDWR|os.O_CREATE, 0666)
+		}, opt)
+		if root.IsSource() {
+			if err := w.SetSourceVersion(root.MajorVersion); err != nil {
+				return err
+			}
+		}
+		err := fn(root, w)
+		if cerr := w.Close(); err == nil && cerr != nil {
+			err = fmt.Errorf("write vpk blocks: %w", cerr)
+		}
+		if err != nil {
+			return err
+		}
+
+		existing := make(map[string]int, len(root.File))
+		for i, f := range root.File {
+			existing[f.Path] = i
+		}
+		var added bool
+		for _, f := range w.Root.File {
+			if i, ok := existing[f.Path]; ok {
+				root.File[i] = f
+			} else {
+				root.File = append(root.File, f)
+				added = true
+			}
+		}
+		if added {
+			if err := root.SortFiles(); err != nil {
+				return fmt.Errorf("sort files: %w", err)
+			}
+		}
+		if root.IsSource() && root.MajorVersion == tf2vpk.ValvePakVersionSource2 {
+			sections.ArchiveMD5 = append(sections.ArchiveMD5, w.ArchiveMD5()...)
+			sections.SortArchiveMD5()
+		}
+		return nil
+	})
+}
+
+// CreateVPK writes a new VPK using a Writer, replacing any existing one. The
+// blocks and dir index are written to temporary files, which are only renamed
+// (dir last) if fn returns successfully and the Writer is closed without
+// errors. Afterwards, any blocks of the existing VPK which weren't replaced are
+// removed (and returned), so the caller must ensure they aren't shared with
+// other locales.
+func CreateVPK(vpk tf2vpk.ValvePakRef, opt tf2vpk.Options, dryRun bool, fn func(*tf2vpk.Writer) error) ([]tf2vpk.ValvePakIndex, error) {
+	dir := vpk.Path
+	if dir == "" {
+		dir = "."
+	}
+
+	tmp := map[tf2vpk.ValvePakIndex]string{}
+	defer func() {
+		for _, x := range tmp {
+			os.Remove(x)
+		}
+	}()
+
+	w := tf2vpk.NewWriterFuncOptions(func(i tf2vpk.ValvePakIndex) (io.Writer, error) {
+		if dryRun {
+			return io.Discard, nil
+		}
+		tf, err := os.CreateTemp(dir, ".vpk*")
+		if err != nil {
+			return nil, err
+		}
+		tmp[i] = tf.Name()
+
+		perm := os.FileMode(0644)
+		if fi, err := os.Stat(vpk.Resolve(i)); err == nil {
+			perm = fi.Mode().Perm()
+		}
+		if err := tf.Chmod(perm); err != nil {
+			tf.Close()
+			return nil, fmt.Errorf("set temp file permissions: %w", err)
+		}
+		return tf, nil
+	}, opt)
+
+	err := fn(w)
+	if cerr := w.Close(); err == nil && cerr != nil {
+		err = fmt.Errorf("write vpk: %w", cerr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if dryRun {
+		return nil, nil
+	}
+
+	// blocks of the vpk being replaced which weren't overwritten
+	var stale []tf2vpk.ValvePakIndex
+	if names, err := vpk.List(); err != nil {
+		return nil, fmt.Errorf("list vpk blocks: %w", err)
+	} else {
+		for _, name := range names {
+			if _, i, err := tf2vpk.SplitName(name, vpk.Prefix); err == nil && i != tf2vpk.ValvePakIndexDir {
+				if _, ok := tmp[i]; !ok {
+					stale = append(stale, i)
+				}
+			}
+		}
+	}
+	slices.Sort(stale)
+
+	// rename the dir last so a failure doesn't leave a dir pointing at missing blocks
+	idx := make([]tf2vpk.ValvePakIndex, 0, len(tmp))
+	for i := range tmp {
+		idx = append(idx, i)
+	}
+	slices.Sort(idx)
+	for _, i := range idx {
+		if err := os.Rename(tmp[i], vpk.Resolve(i)); err != nil {
+			return nil, fmt.Errorf("rename vpk block %s: %w", i, err)
+		}
+		delete(tmp, i)
+	}
+	for n, i := range stale {
+		if err := os.Remove(vpk.Resolve(i)); err != nil {
+			return stale[:n], fmt.Errorf("remove unused vpk block %s: %w", i, err)
+		}
+	}
+	return stale, nil
+}
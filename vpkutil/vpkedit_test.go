@@ -0,0 +1,194 @@
+package vpkutil
+
+import (
+	"bytes"
+	"crypto/md5"
+	"os"
+	"slices"
+	"testing"
+
+	"github.com/pg9182/tf2vpk"
+)
+
+func TestAppendFiles(t *testing.T) {
+	for _, tc := range []struct {
+		Name   string
+		Source uint16
+		Codec  tf2vpk.Codec   // for the existing chunks
+		Opt    tf2vpk.Options // for AppendFiles
+	}{
+		{Name: "Titanfall"},
+		{Name: "Source2", Source: tf2vpk.ValvePakVersionSource2},
+		{Name: "Zlib", Codec: tf2vpk.Zlib, Opt: tf2vpk.Options{Codec: tf2vpk.Zlib}},
+		{Name: "ZlibDetect", Codec: tf2vpk.Zlib, Opt: tf2vpk.Options{DetectCodec: true}},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			testAppendFiles(t, tc.Source, tc.Codec, tc.Opt)
+		})
+	}
+}
+
+func testAppendFiles(t *testing.T, source uint16, codec tf2vpk.Codec, opt tf2vpk.Options) {
+	vpk := tf2vpk.ValvePakRef{Path: t.TempDir(), Prefix: "english", Name: "test"}
+
+	// source vpks don't have flags
+	var load, textureLoad uint32 = 1, 3
+	var texture uint16 = 4
+	if source != 0 {
+		load, textureLoad, texture = 0, 0, 0
+	}
+
+	files := map[string][]byte{
+		"a.txt":   bytes.Repeat([]byte("a"), 1000),
+		"b/c.nut": bytes.Repeat([]byte("c"), 1000),
+	}
+	w := tf2vpk.NewWriterOptions(vpk, tf2vpk.Options{Codec: codec})
+	if source != 0 {
+		if err := w.SetSourceVersion(source); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"a.txt", "b/c.nut"} {
+		if _, err := w.WriteFile(name, bytes.NewReader(files[name]), load, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	orig, err := os.ReadFile(vpk.Resolve(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files["a.txt"] = []byte("replaced")
+	files["b/d.nut"] = []byte("added")
+	files["e.vtf"] = bytes.Repeat([]byte("e"), 1000)
+	if err := AppendFiles(vpk, opt, false, func(root *tf2vpk.ValvePakDir, w *tf2vpk.Writer) error {
+		for _, name := range []string{"a.txt", "b/d.nut"} {
+			if _, err := w.WriteFile(name, bytes.NewReader(files[name]), load, 0); err != nil {
+				return err
+			}
+		}
+		if err := w.SetIndex(1); err != nil {
+			return err
+		}
+		if _, err := w.WriteFile("e.vtf", bytes.NewReader(files["e.vtf"]), textureLoad, texture); err != nil {
+			return err
+		}
+		return nil
+	}); err != nil {
+		t.Fatalf("append files: %v", err)
+	}
+
+	if buf, err := os.ReadFile(vpk.Resolve(0)); err != nil {
+		t.Fatal(err)
+	} else if !bytes.HasPrefix(buf, orig) || len(buf) == len(orig) {
+		t.Errorf("expected chunks to be appended to the existing block")
+	}
+
+	r, err := tf2vpk.NewReaderOptions(vpk, tf2vpk.Options{Codec: codec})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	if len(r.Root.File) != len(files) {
+		t.Errorf("expected %d files, got %d", len(files), len(r.Root.File))
+	}
+	for name, data := range files {
+		if buf, err := r.ReadFile(name); err != nil {
+			t.Errorf("read %q: %v", name, err)
+		} else if !bytes.Equal(buf, data) {
+			t.Errorf("read %q: incorrect contents", name)
+		}
+	}
+	for _, f := range r.Root.File {
+		if f.Path == "e.vtf" {
+			if f.Index != 1 {
+				t.Errorf("expected e.vtf to be in block 1, got %s", f.Index)
+			}
+			if l, _ := f.LoadFlags(); l != textureLoad {
+				t.Errorf("expected e.vtf to have load flags %d, got %d", textureLoad, l)
+			}
+		}
+	}
+
+	if source != 0 {
+		s, err := r.SourceSections()
+		if err != nil {
+			t.Fatalf("read sections: %v", err)
+		}
+		for _, f := range r.Root.File {
+			for _, c := range f.Chunk {
+				var found bool
+				for _, x := range s.ArchiveMD5 {
+					if x.Index == f.Index && uint64(x.Offset) == c.Offset && uint64(x.Size) == c.CompressedSize {
+						found = true
+					}
+				}
+				if !found {
+					t.Errorf("missing archive checksum for %q", f.Path)
+				}
+			}
+		}
+		for _, x := range s.ArchiveMD5 {
+			if buf, err := os.ReadFile(vpk.Resolve(x.Index)); err != nil {
+				t.Errorf("read block %s: %v", x.Index, err)
+			} else if uint64(x.Offset)+uint64(x.Size) > uint64(len(buf)) || md5.Sum(buf[x.Offset:][:x.Size]) != x.MD5 {
+				t.Errorf("archive checksum mismatch for %s:%d+%d", x.Index, x.Offset, x.Size)
+			}
+		}
+		if !slices.IsSortedFunc(s.ArchiveMD5, func(a, b tf2vpk.ValvePakArchiveMD5) int {
+			if a.Index != b.Index {
+				return int(a.Index) - int(b.Index)
+			}
+			return int(a.Offset) - int(b.Offset)
+		}) {
+			t.Errorf("expected archive checksums to be sorted")
+		}
+	}
+}
+
+func TestCreateVPK(t *testing.T) {
+	vpk := tf2vpk.ValvePakRef{Path: t.TempDir(), Prefix: "english", Name: "test"}
+
+	for _, i := range []tf2vpk.ValvePakIndex{0, 5} {
+		if err := os.WriteFile(vpk.Resolve(i), []byte("old"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	removed, err := CreateVPK(vpk, tf2vpk.Options{}, false, func(w *tf2vpk.Writer) error {
+		_, err := w.WriteFile("a.txt", bytes.NewReader([]byte("new")), 1, 0)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("create vpk: %v", err)
+	}
+	if !slices.Equal(removed, []tf2vpk.ValvePakIndex{5}) {
+		t.Errorf("expected unused block 005 to be reported as removed, got %v", removed)
+	}
+
+	if _, err := os.Stat(vpk.Resolve(5)); !os.IsNotExist(err) {
+		t.Errorf("expected unused block 005 to be removed, got %v", err)
+	}
+	if fi, err := os.Stat(vpk.Resolve(0)); err != nil {
+		t.Fatal(err)
+	} else if fi.Mode().Perm() != 0600 {
+		t.Errorf("expected replaced block to keep its permissions, got %s", fi.Mode())
+	}
+	if fi, err := os.Stat(vpk.Resolve(tf2vpk.ValvePakIndexDir)); err != nil {
+		t.Fatal(err)
+	} else if fi.Mode().Perm() != 0644 {
+		t.Errorf("expected new dir to have the default permissions, got %s", fi.Mode())
+	}
+
+	r, err := tf2vpk.NewReader(vpk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if buf, err := r.ReadFile("a.txt"); err != nil || string(buf) != "new" {
+		t.Errorf("read a.txt: expected %q, got %q (err %v)", "new", buf, err)
+	}
+}
@@ -2,6 +2,7 @@ package vpkutil
 
 import (
 	"bufio"
+	"encoding/binary"
 	"fmt"
 	"os"
 	"sort"
@@ -365,3 +366,38 @@ func (v *VPKFlags) ParseFile(name string) error {
 	}
 	return v.Parse(string(buf))
 }
+
+// ParseFlags parses load and texture flags separated by a colon, each as either
+// 0x-prefixed hex or a fixed-width bit string.
+func ParseFlags(s string) (loadFlags uint32, textureFlags uint16, err error) {
+	load, texture, ok := strings.Cut(s, ":")
+	if !ok {
+		return 0, 0, fmt.Errorf("expected load and texture flags separated by a colon")
+	}
+	if loadFlags, err = parseFlag[uint32](load); err != nil {
+		return 0, 0, fmt.Errorf("parse load flags: %v", err)
+	}
+	if textureFlags, err = parseFlag[uint16](texture); err != nil {
+		return 0, 0, fmt.Errorf("parse texture flags: %v", err)
+	}
+	return loadFlags, textureFlags, nil
+}
+
+func parseFlag[T uint16 | uint32](s string) (T, error) {
+	bits := binary.Size(T(0)) * 8
+	if s, ok := strings.CutPrefix(s, "0x"); ok {
+		if v, err := strconv.ParseUint(s, 16, bits); err != nil {
+			return 0, fmt.Errorf("parse hex flags %q: %w", s, err)
+		} else {
+			return T(v), nil
+		}
+	}
+	if v, err := strconv.ParseUint(s, 2, bits); err == nil {
+		if len(s) != bits {
+			return 0, fmt.Errorf("parse binary flags %q: must be exactly %d bits", s, bits)
+		} else {
+			return T(v), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown flag format %q (expected 0x hex or fixed-width binary)", s)
+}
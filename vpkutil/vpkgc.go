@@ -0,0 +1,353 @@
+package vpkutil
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+
+	"github.com/pg9182/tf2vpk"
+	"github.com/pg9182/tf2vpk/internal"
+)
+
+// GCBlock describes the chunk data stored in a VPK block.
+type GCBlock struct {
+	Prefix string // only set for ValvePakIndexDir, since each locale has its own
+	Index  tf2vpk.ValvePakIndex
+	Size   uint64 // bytes of chunk data in the block
+	Used   uint64 // bytes referenced by at least one chunk
+}
+
+// Unused returns the number of bytes which are not referenced by any chunk.
+func (b GCBlock) Unused() uint64 {
+	return b.Size - b.Used
+}
+
+// GC removes chunk data which isn't referenced by any file from the blocks of
+// a VPK, remapping the chunk offsets in the dir. Chunks shared between files
+// (or overlapping each other) are preserved. Blocks which are not referenced at
+// all are deleted.
+//
+// Since the blocks are shared by the dir indexes for every locale, all of them
+// are updated (see OpenLocales).
+//
+// For Source VPKs version 2, the archive md5 entries are moved along with the
+// chunk data they cover (entries for data which was removed are dropped), and
+// the checksum sections are updated.
+//
+// The new blocks and dirs are written to temporary files, then renamed over the
+// original ones.
+func GC(vpk tf2vpk.ValvePakRef, opt tf2vpk.Options, dryRun bool) ([]GCBlock, error) {
+	ls, err := OpenLocales(vpk, opt)
+	if err != nil {
+		return nil, err
+	}
+	closed := false
+	defer func() {
+		if !closed {
+			CloseLocales(ls)
+		}
+	}()
+
+	used := map[blockID]*internal.RangeSet{}
+	for _, l := range ls {
+		for _, f := range l.Reader.Root.File {
+			b := localeBlock(l.VPK.Prefix, f.Index)
+			rs, ok := used[b]
+			if !ok {
+				rs = new(internal.RangeSet)
+				used[b] = rs
+			}
+			for _, c := range f.Chunk {
+				rs.Add(c.Offset, c.Offset+c.CompressedSize)
+			}
+		}
+	}
+
+	size := map[blockID]uint64{}
+	sections := make([]*tf2vpk.ValvePakSourceSections, len(ls))
+	for i, l := range ls {
+		chunkOffset, err := l.Reader.Root.ChunkOffset()
+		if err != nil {
+			return nil, fmt.Errorf("compute vpk dir size (prefix %q): %w", l.VPK.Prefix, err)
+		}
+		if fi, err := os.Stat(l.VPK.Resolve(tf2vpk.ValvePakIndexDir)); err != nil {
+			return nil, fmt.Errorf("stat vpk dir (prefix %q): %w", l.VPK.Prefix, err)
+		} else if fi.Size() < int64(chunkOffset) {
+			return nil, fmt.Errorf("stat vpk dir (prefix %q): file is smaller than the dir index", l.VPK.Prefix)
+		} else {
+			size[localeBlock(l.VPK.Prefix, tf2vpk.ValvePakIndexDir)] = uint64(fi.Size()) - uint64(chunkOffset)
+		}
+		if sections[i], err = readSourceSections(l.Reader); err != nil {
+			return nil, fmt.Errorf("vpk dir (prefix %q): %w", l.VPK.Prefix, err)
+		} else if sections[i] != nil {
+			// the checksum sections aren't chunk data
+			size[localeBlock(l.VPK.Prefix, tf2vpk.ValvePakIndexDir)] = uint64(l.Reader.Root.DataSize)
+		}
+	}
+	if names, err := vpk.List(); err != nil {
+		return nil, fmt.Errorf("list vpk blocks: %w", err)
+	} else {
+		for _, name := range names {
+			if _, idx, err := tf2vpk.SplitName(name, vpk.Prefix); err == nil && idx != tf2vpk.ValvePakIndexDir {
+				if fi, err := os.Stat(filepath.Join(vpk.Path, name)); err != nil {
+					return nil, fmt.Errorf("stat vpk block %s: %w", idx, err)
+				} else {
+					size[localeBlock("", idx)] = uint64(fi.Size())
+				}
+			}
+		}
+	}
+
+	var blocks []GCBlock
+	for b, sz := range size {
+		x := GCBlock{Prefix: b.Prefix, Index: b.Index, Size: sz}
+		if rs, ok := used[b]; ok {
+			if r := rs.Ranges(); len(r) != 0 && r[len(r)-1].End > sz {
+				return nil, fmt.Errorf("vpk block %s: chunk data extends past the end of the block (%d > %d)", b, r[len(r)-1].End, sz)
+			}
+			x.Used = rs.Len()
+		}
+		if b.Index == tf2vpk.ValvePakIndexDir && x.Size == 0 {
+			continue
+		}
+		blocks = append(blocks, x)
+	}
+	for b := range used {
+		if _, ok := size[b]; !ok {
+			return nil, fmt.Errorf("vpk block %s: referenced by dir, but does not exist", b)
+		}
+	}
+	sort.Slice(blocks, func(i, j int) bool {
+		return localeBlock(blocks[i].Prefix, blocks[i].Index).Less(localeBlock(blocks[j].Prefix, blocks[j].Index))
+	})
+
+	if dryRun {
+		return blocks, nil
+	}
+
+	var changed bool
+	for _, b := range blocks {
+		if b.Unused() != 0 {
+			changed = true
+		}
+	}
+	if !changed {
+		return blocks, nil
+	}
+
+	tmp := map[blockID]string{}
+	defer func() {
+		for _, x := range tmp {
+			os.Remove(x)
+		}
+	}()
+
+	// write the compacted blocks
+	for _, b := range blocks {
+		if b.Index == tf2vpk.ValvePakIndexDir || b.Used == 0 || b.Unused() == 0 {
+			continue
+		}
+		id := localeBlock("", b.Index)
+		if err := func() error {
+			bf, err := os.Open(vpk.Resolve(b.Index))
+			if err != nil {
+				return err
+			}
+			defer bf.Close()
+
+			tmp[id], err = writeTemp(vpk.Resolve(b.Index), func(w io.Writer) error {
+				return copyRanges(w, bf, 0, used[id].Ranges())
+			})
+			return err
+		}(); err != nil {
+			return nil, fmt.Errorf("write vpk block %s: %w", b.Index, err)
+		}
+	}
+
+	// remap the chunks and write the dirs (and the chunk data stored after them)
+	for i, l := range ls {
+		if sections[i] != nil {
+			remapArchiveMD5(sections[i], func(idx tf2vpk.ValvePakIndex, start, end uint64) (tf2vpk.ValvePakIndex, uint64, bool) {
+				if rs, ok := used[localeBlock(l.VPK.Prefix, idx)]; ok {
+					if x, ok := rs.CompactRange(start, end); ok {
+						return idx, x, true
+					}
+				}
+				return 0, 0, false
+			})
+		}
+		root := l.Reader.Root
+		root.File = slices.Clone(root.File)
+		for i, f := range root.File {
+			b := localeBlock(l.VPK.Prefix, f.Index)
+			if _, ok := tmp[b]; ok || f.Index == tf2vpk.ValvePakIndexDir {
+				root.File[i].Chunk = slices.Clone(f.Chunk)
+				for j, c := range f.Chunk {
+					if x, ok := used[b].Compact(c.Offset); !ok {
+						panic("wtf") // every chunk was added to the set
+					} else {
+						root.File[i].Chunk[j].Offset = x
+					}
+				}
+			}
+		}
+		b := localeBlock(l.VPK.Prefix, tf2vpk.ValvePakIndexDir)
+		if x, err := writeTemp(l.VPK.Resolve(tf2vpk.ValvePakIndexDir), func(w io.Writer) error {
+			return writeDir(w, root, sections[i], opt, func(w io.Writer) error {
+				if rs, ok := used[b]; ok {
+					d, err := l.Reader.OpenBlockRaw(tf2vpk.ValvePakIndexDir)
+					if err != nil {
+						return err
+					}
+					return copyRanges(w, d, 0, rs.Ranges())
+				}
+				return nil
+			})
+		}); err != nil {
+			return nil, fmt.Errorf("write vpk dir (prefix %q): %w", l.VPK.Prefix, err)
+		} else {
+			tmp[b] = x
+		}
+	}
+
+	// replace the files (dirs last)
+	closed = true
+	if err := CloseLocales(ls); err != nil {
+		return nil, err
+	}
+	for _, b := range blocks {
+		if b.Index != tf2vpk.ValvePakIndexDir {
+			id := localeBlock("", b.Index)
+			if x, ok := tmp[id]; ok {
+				if err := os.Rename(x, vpk.Resolve(b.Index)); err != nil {
+					return nil, fmt.Errorf("rename vpk block %s: %w", b.Index, err)
+				}
+				delete(tmp, id)
+			}
+		}
+	}
+	for _, l := range ls {
+		b := localeBlock(l.VPK.Prefix, tf2vpk.ValvePakIndexDir)
+		if err := os.Rename(tmp[b], l.VPK.Resolve(tf2vpk.ValvePakIndexDir)); err != nil {
+			return nil, fmt.Errorf("rename vpk dir (prefix %q): %w", l.VPK.Prefix, err)
+		}
+		delete(tmp, b)
+	}
+
+	// delete unreferenced blocks
+	for _, b := range blocks {
+		if b.Index != tf2vpk.ValvePakIndexDir && b.Used == 0 {
+			if err := os.Remove(vpk.Resolve(b.Index)); err != nil {
+				return nil, fmt.Errorf("delete unreferenced vpk block %s: %w", b.Index, err)
+			}
+		}
+	}
+	return blocks, nil
+}
+
+// writeTemp calls fn to write a new temporary file in the same directory as
+// name (with the same permissions if it exists), returning the temporary file
+// name.
+func writeTemp(name string, fn func(io.Writer) error) (string, error) {
+	tf, err := os.CreateTemp(filepath.Dir(name), ".vpk*")
+	if err != nil {
+		return "", fmt.Errorf("create temp file: %w", err)
+	}
+	defer tf.Close()
+
+	perm := os.FileMode(0644)
+	if fi, err := os.Stat(name); err == nil {
+		perm = fi.Mode().Perm()
+	}
+	if err := tf.Chmod(perm); err != nil {
+		os.Remove(tf.Name())
+		return "", fmt.Errorf("set temp file permissions: %w", err)
+	}
+	if err := fn(tf); err != nil {
+		os.Remove(tf.Name())
+		return "", err
+	}
+	if err := tf.Sync(); err != nil {
+		os.Remove(tf.Name())
+		return "", fmt.Errorf("write temp file: %w", err)
+	}
+	if err := tf.Close(); err != nil {
+		os.Remove(tf.Name())
+		return "", fmt.Errorf("write temp file: %w", err)
+	}
+	return tf.Name(), nil
+}
+
+// readSourceSections reads the checksum sections of a Source VPK version 2,
+// returning nil for other VPKs.
+func readSourceSections(r *tf2vpk.Reader) (*tf2vpk.ValvePakSourceSections, error) {
+	if !r.Root.IsSource() || r.Root.MajorVersion != tf2vpk.ValvePakVersionSource2 {
+		return nil, nil
+	}
+	s, err := r.SourceSections()
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// remapArchiveMD5 moves the archive md5 entries of s to the new location of
+// the data they cover, as returned by fn, dropping the ones it returns false
+// for.
+func remapArchiveMD5(s *tf2vpk.ValvePakSourceSections, fn func(idx tf2vpk.ValvePakIndex, start, end uint64) (tf2vpk.ValvePakIndex, uint64, bool)) {
+	es := s.ArchiveMD5[:0]
+	for _, e := range s.ArchiveMD5 {
+		if idx, off, ok := fn(e.Index, uint64(e.Offset), uint64(e.Offset)+uint64(e.Size)); ok && off+uint64(e.Size) <= math.MaxUint32 {
+			e.Index, e.Offset = idx, uint32(off)
+			es = append(es, e)
+		}
+	}
+	s.ArchiveMD5 = es
+	s.SortArchiveMD5()
+}
+
+// writeDir writes root followed by the chunk data stored after it (written by
+// data). If sections is not nil, the embedded data size and checksums are
+// updated, and the sections are written after the data.
+func writeDir(w io.Writer, root tf2vpk.ValvePakDir, sections *tf2vpk.ValvePakSourceSections, opt tf2vpk.Options, data func(io.Writer) error) error {
+	if sections == nil {
+		if err := root.SerializeOptions(w, opt); err != nil {
+			return err
+		}
+		return data(w)
+	}
+	var buf bytes.Buffer
+	if err := data(&buf); err != nil {
+		return err
+	}
+	if buf.Len() > math.MaxUint32 {
+		return fmt.Errorf("embedded file data too large")
+	}
+	root.DataSize = uint32(buf.Len())
+	if err := sections.UpdateChecksums(&root, bytes.NewReader(buf.Bytes())); err != nil {
+		return fmt.Errorf("update checksums: %w", err)
+	}
+	if err := root.SerializeOptions(w, opt); err != nil {
+		return err
+	}
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	return sections.Serialize(w)
+}
+
+// copyRanges copies the provided ranges (relative to base) from r to w.
+func copyRanges(w io.Writer, r io.ReaderAt, base int64, rs []internal.Range) error {
+	buf := make([]byte, 1024*32)
+	for _, x := range rs {
+		if _, err := io.CopyBuffer(w, io.NewSectionReader(r, base+int64(x.Start), int64(x.Len())), buf); err != nil {
+			return fmt.Errorf("copy range %d-%d: %w", x.Start, x.End, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package vpkutil
+
+import (
+	"bytes"
+	"crypto/md5"
+	"io"
+	"os"
+	"slices"
+	"testing"
+
+	"github.com/pg9182/tf2vpk"
+)
+
+func TestGCSource2(t *testing.T) {
+	vpk := tf2vpk.ValvePakRef{Path: t.TempDir(), Prefix: "english", Name: "test"}
+	files := writeTestSource2(t, vpk)
+
+	// remove the first file in block 0 so the chunks after it are moved
+	if err := UpdateDir(vpk, false, func(root *tf2vpk.ValvePakDir) error {
+		root.File = slices.DeleteFunc(root.File, func(f tf2vpk.ValvePakFile) bool {
+			return f.Path == "b.txt"
+		})
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	delete(files, "b.txt")
+
+	blocks, err := GC(vpk, tf2vpk.Options{}, false)
+	if err != nil {
+		t.Fatalf("gc: %v", err)
+	}
+	for _, b := range blocks {
+		if b.Index == tf2vpk.ValvePakIndexDir {
+			t.Errorf("expected the checksum sections not to be treated as chunk data, got %+v", b)
+		}
+	}
+	checkTestSource2(t, vpk, files, 3)
+}
+
+// writeTestSource2 writes a Source VPK version 2 with files in blocks 0 and 1,
+// returning their contents.
+func writeTestSource2(t *testing.T, vpk tf2vpk.ValvePakRef) map[string][]byte {
+	files := map[string][]byte{
+		"b.txt":     bytes.Repeat([]byte("b"), 1000),
+		"a.txt":     bytes.Repeat([]byte("a"), 2000),
+		"dir/c.nut": bytes.Repeat([]byte("c"), 3000),
+		"d.txt":     bytes.Repeat([]byte("d"), 4000),
+	}
+	w := tf2vpk.NewWriter(vpk)
+	if err := w.SetSourceVersion(tf2vpk.ValvePakVersionSource2); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"b.txt", "a.txt", "dir/c.nut", "d.txt"} {
+		if name == "d.txt" {
+			if err := w.SetIndex(1); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := w.WriteFile(name, bytes.NewReader(files[name]), 0, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+// checkTestSource2 checks the contents of the files and the checksum sections
+// (which should have n archive md5 entries) of a Source VPK version 2.
+func checkTestSource2(t *testing.T, vpk tf2vpk.ValvePakRef, files map[string][]byte, n int) {
+	t.Helper()
+
+	r, err := tf2vpk.NewReader(vpk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	if len(r.Root.File) != len(files) {
+		t.Errorf("expected %d files, got %d", len(files), len(r.Root.File))
+	}
+	for name, data := range files {
+		if buf, err := r.ReadFile(name); err != nil {
+			t.Errorf("read %q: %v", name, err)
+		} else if !bytes.Equal(buf, data) {
+			t.Errorf("read %q: incorrect contents", name)
+		}
+	}
+
+	s, err := r.SourceSections()
+	if err != nil {
+		t.Fatalf("read sections: %v", err)
+	}
+	if len(s.ArchiveMD5) != n {
+		t.Errorf("expected %d archive checksums, got %d", n, len(s.ArchiveMD5))
+	}
+	for _, x := range s.ArchiveMD5 {
+		b, err := r.OpenBlockRaw(x.Index)
+		if err != nil {
+			t.Errorf("open block %s: %v", x.Index, err)
+			continue
+		}
+		buf := make([]byte, x.Size)
+		if _, err := b.ReadAt(buf, int64(x.Offset)); err != nil && err != io.EOF {
+			t.Errorf("read block %s: %v", x.Index, err)
+		} else if md5.Sum(buf) != x.MD5 {
+			t.Errorf("archive checksum mismatch for %s:%d+%d", x.Index, x.Offset, x.Size)
+		}
+	}
+	for _, f := range r.Root.File {
+		if !slices.ContainsFunc(s.ArchiveMD5, func(x tf2vpk.ValvePakArchiveMD5) bool {
+			return x.Index == f.Index && uint64(x.Offset) == f.Chunk[0].Offset
+		}) {
+			t.Errorf("missing archive checksum for %q", f.Path)
+		}
+	}
+
+	dir, err := os.ReadFile(vpk.Resolve(tf2vpk.ValvePakIndexDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if off, err := r.Root.SourceSectionsOffset(); err != nil {
+		t.Fatal(err)
+	} else if exp := int(off) + len(s.ArchiveMD5)*28 + 3*md5.Size; len(dir) != exp {
+		t.Errorf("expected dir to be %d bytes, got %d", exp, len(dir))
+	}
+	if md5.Sum(dir[:len(dir)-md5.Size]) != s.WholeFileMD5 {
+		t.Errorf("whole file checksum mismatch")
+	}
+}
@@ -0,0 +1,221 @@
+package vpkutil
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/pg9182/tf2vpk"
+)
+
+// HTTPHandler serves the contents of a VPK over HTTP.
+//
+// Directories are served as HTML listings, and files are served with support
+// for range requests, using the CRC32 as the ETag. If the "meta" query
+// parameter is present, JSON metadata is served instead (see HTTPFileMeta and
+// HTTPDirMeta).
+type HTTPHandler struct {
+	r *tf2vpk.Reader
+}
+
+// NewHTTPHandler creates a new HTTPHandler serving the files in r.
+func NewHTTPHandler(r *tf2vpk.Reader) *HTTPHandler {
+	return &HTTPHandler{r}
+}
+
+// HTTPFileMeta contains the metadata for a file.
+type HTTPFileMeta struct {
+	Path           string          `json:"path"`
+	Block          string          `json:"block"`
+	CRC32          uint32          `json:"crc32"`
+	PreloadBytes   uint16          `json:"preload_bytes"`
+	Size           uint64          `json:"size"`
+	CompressedSize uint64          `json:"compressed_size"`
+	LoadFlags      *uint32         `json:"load_flags,omitempty"`    // nil if not the same for all chunks
+	TextureFlags   *uint16         `json:"texture_flags,omitempty"` // nil if not the same for all chunks
+	Chunks         []HTTPChunkMeta `json:"chunks"`
+}
+
+// HTTPChunkMeta contains the metadata for a chunk.
+type HTTPChunkMeta struct {
+	Offset           uint64 `json:"offset"`
+	CompressedSize   uint64 `json:"compressed_size"`
+	UncompressedSize uint64 `json:"uncompressed_size"`
+	Compressed       bool   `json:"compressed"`
+	LoadFlags        uint32 `json:"load_flags"`
+	TextureFlags     uint16 `json:"texture_flags"`
+}
+
+// HTTPDirMeta contains the metadata for a directory.
+type HTTPDirMeta struct {
+	Path    string             `json:"path"`
+	Entries []HTTPDirEntryMeta `json:"entries"`
+}
+
+// HTTPDirEntryMeta contains the metadata for a directory entry.
+type HTTPDirEntryMeta struct {
+	Name  string `json:"name"`
+	Dir   bool   `json:"dir"`
+	Size  int64  `json:"size"` // uncompressed, zero for directories
+	CRC32 uint32 `json:"crc32"`
+}
+
+func (h *HTTPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := strings.Trim(path.Clean("/"+r.URL.Path), "/")
+	if name == "" {
+		name = "."
+	}
+
+	fi, err := h.r.Stat(name)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) || errors.Is(err, fs.ErrInvalid) {
+			http.NotFound(w, r)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	// like http.FileServer, redirect to the canonical path (relative, since
+	// the handler may be behind http.StripPrefix)
+	if fi.IsDir() != strings.HasSuffix(r.URL.Path, "/") && name != "." {
+		u := url.URL{RawQuery: r.URL.RawQuery}
+		if fi.IsDir() {
+			u.Path = path.Base(name) + "/"
+		} else {
+			u.Path = "../" + path.Base(name)
+		}
+		w.Header().Set("Location", u.String())
+		w.WriteHeader(http.StatusMovedPermanently)
+		return
+	}
+
+	_, meta := r.URL.Query()["meta"]
+	if fi.IsDir() {
+		h.serveDir(w, r, name, meta)
+	} else {
+		h.serveFile(w, r, name, fi.Sys().(tf2vpk.ValvePakFile), meta)
+	}
+}
+
+func (h *HTTPHandler) serveDir(w http.ResponseWriter, r *http.Request, name string, meta bool) {
+	es, err := h.r.ReadDir(name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if meta {
+		m := HTTPDirMeta{
+			Path:    name,
+			Entries: make([]HTTPDirEntryMeta, 0, len(es)),
+		}
+		for _, e := range es {
+			x := HTTPDirEntryMeta{
+				Name: e.Name(),
+				Dir:  e.IsDir(),
+			}
+			if fi, err := e.Info(); err == nil && !fi.IsDir() {
+				x.Size = fi.Size()
+				x.CRC32 = fi.Sys().(tf2vpk.ValvePakFile).CRC32
+			}
+			m.Entries = append(m.Entries, x)
+		}
+		serveJSON(w, r, m)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if r.Method == http.MethodHead {
+		return
+	}
+	io.WriteString(w, "<!DOCTYPE html>\n<meta charset=\"utf-8\">\n<meta name=\"viewport\" content=\"width=device-width\">\n")
+	fmt.Fprintf(w, "<title>%s</title>\n<pre>\n", html.EscapeString("/"+strings.TrimPrefix(name, ".")))
+	if name != "." {
+		io.WriteString(w, "<a href=\"../\">../</a>\n")
+	}
+	for _, e := range es {
+		n := e.Name()
+		if e.IsDir() {
+			n += "/"
+		}
+		fmt.Fprintf(w, "<a href=\"%s\">%s</a>\n", (&url.URL{Path: n}).String(), html.EscapeString(n))
+	}
+	io.WriteString(w, "</pre>\n")
+}
+
+func (h *HTTPHandler) serveFile(w http.ResponseWriter, r *http.Request, name string, vf tf2vpk.ValvePakFile, meta bool) {
+	if meta {
+		m := HTTPFileMeta{
+			Path:         vf.Path,
+			Block:        vf.Index.String(),
+			CRC32:        vf.CRC32,
+			PreloadBytes: vf.PreloadBytes,
+			Size:         uint64(len(vf.Preload)),
+			Chunks:       make([]HTTPChunkMeta, 0, len(vf.Chunk)),
+		}
+		if x, err := vf.LoadFlags(); err == nil {
+			m.LoadFlags = &x
+		}
+		if x, err := vf.TextureFlags(); err == nil {
+			m.TextureFlags = &x
+		}
+		for _, c := range vf.Chunk {
+			m.Size += c.UncompressedSize
+			m.CompressedSize += c.CompressedSize
+			m.Chunks = append(m.Chunks, HTTPChunkMeta{
+				Offset:           c.Offset,
+				CompressedSize:   c.CompressedSize,
+				UncompressedSize: c.UncompressedSize,
+				Compressed:       c.IsCompressed(),
+				LoadFlags:        c.LoadFlags,
+				TextureFlags:     c.TextureFlags,
+			})
+		}
+		serveJSON(w, r, m)
+		return
+	}
+
+	f, err := h.r.Open(name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// ServeContent handles conditional and range requests using the ETag
+	w.Header().Set("ETag", fmt.Sprintf(`"%08x"`, vf.CRC32))
+	http.ServeContent(w, r, fi.Name(), fi.ModTime(), f.(io.ReadSeeker))
+}
+
+func serveJSON(w http.ResponseWriter, r *http.Request, v any) {
+	buf, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", fmt.Sprint(len(buf)+1))
+	if r.Method != http.MethodHead {
+		w.Write(append(buf, '\n'))
+	}
+}
@@ -0,0 +1,87 @@
+package vpkutil
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/pg9182/tf2vpk"
+)
+
+func TestHTTPHandler(t *testing.T) {
+	vpk := tf2vpk.ValvePakRef{Path: t.TempDir(), Prefix: "english", Name: "test"}
+	data := bytes.Repeat([]byte("test\n"), 1000)
+
+	w := tf2vpk.NewWriter(vpk)
+	f, err := w.WriteFile("a/b.txt", bytes.NewReader(data), 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := tf2vpk.NewReader(vpk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	srv := httptest.NewServer(http.StripPrefix("/vpk", NewHTTPHandler(r)))
+	defer srv.Close()
+
+	get := func(path string, hdr ...string) (*http.Response, []byte) {
+		req, err := http.NewRequest(http.MethodGet, srv.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < len(hdr); i += 2 {
+			req.Header.Set(hdr[i], hdr[i+1])
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		buf, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp, buf
+	}
+
+	if resp, buf := get("/vpk/a/b.txt"); resp.StatusCode != http.StatusOK || !bytes.Equal(buf, data) {
+		t.Errorf("get file: unexpected response %d", resp.StatusCode)
+	} else if etag := resp.Header.Get("ETag"); etag != fmt.Sprintf(`"%08x"`, f.CRC32) {
+		t.Errorf("get file: unexpected etag %q", etag)
+	} else if resp, _ := get("/vpk/a/b.txt", "If-None-Match", etag); resp.StatusCode != http.StatusNotModified {
+		t.Errorf("get file: expected not modified, got %d", resp.StatusCode)
+	}
+
+	if resp, buf := get("/vpk/a/b.txt", "Range", "bytes=10-19"); resp.StatusCode != http.StatusPartialContent || !bytes.Equal(buf, data[10:20]) {
+		t.Errorf("get range: unexpected response %d %q", resp.StatusCode, buf)
+	}
+
+	if resp, buf := get("/vpk/a"); resp.StatusCode != http.StatusOK || !bytes.Contains(buf, []byte(`href="b.txt"`)) {
+		t.Errorf("get dir: unexpected response %d %q", resp.StatusCode, buf)
+	} else if resp.Request.URL.Path != "/vpk/a/" {
+		t.Errorf("get dir: expected redirect to /vpk/a/, got %q", resp.Request.URL.Path)
+	}
+
+	var m HTTPFileMeta
+	if resp, buf := get("/vpk/a/b.txt?meta"); resp.StatusCode != http.StatusOK {
+		t.Errorf("get meta: unexpected response %d", resp.StatusCode)
+	} else if err := json.Unmarshal(buf, &m); err != nil {
+		t.Errorf("get meta: %v", err)
+	} else if m.Size != uint64(len(data)) || m.CRC32 != f.CRC32 || len(m.Chunks) != len(f.Chunk) || m.LoadFlags == nil || *m.LoadFlags != 1 {
+		t.Errorf("get meta: unexpected metadata %+v", m)
+	}
+
+	if resp, _ := get("/vpk/a/c.txt"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("get missing: expected not found, got %d", resp.StatusCode)
+	}
+}
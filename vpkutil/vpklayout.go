@@ -0,0 +1,549 @@
+package vpkutil
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/pg9182/tf2vpk"
+	"github.com/pg9182/tf2vpk/internal"
+)
+
+// VPKLayoutFilename is the name of the vpklayout file. It is optional, and
+// should be at the root of the folder to be packed.
+const VPKLayoutFilename = ".vpklayout"
+
+// VPKLayout records the block sizes and chunk placement of a VPK so it can be
+// reproduced byte-for-byte when repacking unchanged files (see WriteLayout).
+type VPKLayout struct {
+	Block []VPKLayoutBlock // sorted by index
+	File  []VPKLayoutFile  // in dir index order
+}
+
+// VPKLayoutBlock is a block in a VPKLayout.
+type VPKLayoutBlock struct {
+	Index tf2vpk.ValvePakIndex
+	Size  uint64
+}
+
+// VPKLayoutFile is a file in a VPKLayout.
+type VPKLayoutFile struct {
+	Path  string
+	CRC32 uint32
+	Index tf2vpk.ValvePakIndex
+	Chunk []VPKLayoutChunk
+}
+
+// VPKLayoutChunk is a chunk in a VPKLayoutFile.
+type VPKLayoutChunk struct {
+	tf2vpk.ValvePakChunk
+	SHA1 [sha1.Size]byte // of the raw (i.e., possibly compressed) data
+}
+
+// Size returns the uncompressed size of the file.
+func (f VPKLayoutFile) Size() uint64 {
+	var n uint64
+	for _, c := range f.Chunk {
+		n += c.UncompressedSize
+	}
+	return n
+}
+
+// ValvePakFile returns the dir index entry for the file.
+func (f VPKLayoutFile) ValvePakFile() tf2vpk.ValvePakFile {
+	x := tf2vpk.ValvePakFile{
+		Path:  f.Path,
+		CRC32: f.CRC32,
+		Index: f.Index,
+		Chunk: make([]tf2vpk.ValvePakChunk, len(f.Chunk)),
+	}
+	for i, c := range f.Chunk {
+		x.Chunk[i] = c.ValvePakChunk
+	}
+	return x
+}
+
+// Generate generates a new VPKLayout from the VPK opened by r, hashing the raw
+// chunk data using n goroutines.
+func (l *VPKLayout) Generate(r *tf2vpk.Reader, n int) error {
+	var (
+		ids  []chunkID
+		seen = map[chunkID]struct{}{}
+		size = map[tf2vpk.ValvePakIndex]uint64{}
+	)
+	for _, f := range r.Root.File {
+		for _, c := range f.Chunk {
+			id := chunkID{localeBlock("", f.Index), c.Offset, c.CompressedSize}
+			if _, ok := seen[id]; !ok {
+				seen[id] = struct{}{}
+				ids = append(ids, id)
+			}
+			size[f.Index] = max(size[f.Index], c.Offset+c.CompressedSize)
+		}
+	}
+	slices.SortFunc(ids, func(a, b chunkID) int {
+		if a.Block.Index != b.Block.Index {
+			return cmp.Compare(a.Block.Index, b.Block.Index)
+		}
+		if a.Offset != b.Offset {
+			return cmp.Compare(a.Offset, b.Offset)
+		}
+		return cmp.Compare(a.Size, b.Size)
+	})
+	hashes, err := hashChunks(context.Background(), func(b blockID) (io.ReaderAt, error) {
+		return r.OpenBlockRaw(b.Index)
+	}, ids, n)
+	if err != nil {
+		return fmt.Errorf("hash chunks: %w", err)
+	}
+
+	var blocks []VPKLayoutBlock
+	for i, n := range size {
+		if i == tf2vpk.ValvePakIndexDir {
+			continue // can't be reproduced since it's after the dir index
+		}
+		if x, err := r.OpenBlockRaw(i); err != nil {
+			return fmt.Errorf("open block %s: %w", i, err)
+		} else if x, ok := x.(interface{ Size() int64 }); ok {
+			n = max(n, uint64(x.Size()))
+		}
+		blocks = append(blocks, VPKLayoutBlock{i, n})
+	}
+	slices.SortFunc(blocks, func(a, b VPKLayoutBlock) int {
+		return cmp.Compare(a.Index, b.Index)
+	})
+
+	files := make([]VPKLayoutFile, len(r.Root.File))
+	for i, f := range r.Root.File {
+		files[i] = VPKLayoutFile{
+			Path:  f.Path,
+			CRC32: f.CRC32,
+			Index: f.Index,
+			Chunk: make([]VPKLayoutChunk, len(f.Chunk)),
+		}
+		for j, c := range f.Chunk {
+			files[i].Chunk[j] = VPKLayoutChunk{c, hashes[chunkID{localeBlock("", f.Index), c.Offset, c.CompressedSize}]}
+		}
+	}
+
+	l.Block = blocks
+	l.File = files
+	return nil
+}
+
+func (l VPKLayout) String() string {
+	var b strings.Builder
+	b.WriteString("# generated by unpack; used by pack to reproduce the original chunk placement for unchanged files\n")
+	b.WriteString("# block index size\n")
+	b.WriteString("# file crc32 index path\n")
+	b.WriteString("# chunk offset compressed_size uncompressed_size load_flags texture_flags sha1\n")
+	for _, x := range l.Block {
+		fmt.Fprintf(&b, "block %d %d\n", x.Index, x.Size)
+	}
+	for _, f := range l.File {
+		fmt.Fprintf(&b, "file %08x %d %s\n", f.CRC32, f.Index, f.Path)
+		for _, c := range f.Chunk {
+			fmt.Fprintf(&b, "chunk %d %d %d %08x %04x %x\n", c.Offset, c.CompressedSize, c.UncompressedSize, c.LoadFlags, c.TextureFlags, c.SHA1)
+		}
+	}
+	return b.String()
+}
+
+// Parse parses a vpklayout string, replacing the existing layout.
+func (l *VPKLayout) Parse(s string) error {
+	var (
+		blocks []VPKLayoutBlock
+		files  []VPKLayoutFile
+		lineNo int
+	)
+	sc := bufio.NewScanner(strings.NewReader(s))
+	sc.Buffer(nil, 1<<20)
+	for sc.Scan() {
+		line := sc.Text()
+		lineNo++
+
+		// paths may contain anything other than newlines, so only full-line
+		// comments are allowed
+		if strings.HasPrefix(line, "#") || strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		kind, rest, _ := strings.Cut(line, " ")
+		switch kind {
+		case "block":
+			fields := strings.Fields(rest)
+			if len(fields) != 2 {
+				return fmt.Errorf("line %d: expected 2 fields (index size) for block, got %d", lineNo, len(fields))
+			}
+			var x VPKLayoutBlock
+			if v, err := strconv.ParseUint(fields[0], 10, 16); err != nil {
+				return fmt.Errorf("line %d: parse block index %q: %w", lineNo, fields[0], err)
+			} else {
+				x.Index = tf2vpk.ValvePakIndex(v)
+			}
+			if v, err := strconv.ParseUint(fields[1], 10, 64); err != nil {
+				return fmt.Errorf("line %d: parse block size %q: %w", lineNo, fields[1], err)
+			} else {
+				x.Size = v
+			}
+			if len(blocks) != 0 && blocks[len(blocks)-1].Index >= x.Index {
+				return fmt.Errorf("line %d: blocks must be sorted by index", lineNo)
+			}
+			blocks = append(blocks, x)
+
+		case "file":
+			fields := strings.SplitN(rest, " ", 3)
+			if len(fields) != 3 || fields[2] == "" {
+				return fmt.Errorf("line %d: expected 3 fields (crc32 index path) for file", lineNo)
+			}
+			x := VPKLayoutFile{
+				Path: fields[2],
+			}
+			if v, err := strconv.ParseUint(fields[0], 16, 32); err != nil {
+				return fmt.Errorf("line %d: parse file crc32 %q: %w", lineNo, fields[0], err)
+			} else {
+				x.CRC32 = uint32(v)
+			}
+			if v, err := strconv.ParseUint(fields[1], 10, 16); err != nil {
+				return fmt.Errorf("line %d: parse file block index %q: %w", lineNo, fields[1], err)
+			} else {
+				x.Index = tf2vpk.ValvePakIndex(v)
+			}
+			files = append(files, x)
+
+		case "chunk":
+			if len(files) == 0 {
+				return fmt.Errorf("line %d: chunk must be after a file", lineNo)
+			}
+			fields := strings.Fields(rest)
+			if len(fields) != 6 {
+				return fmt.Errorf("line %d: expected 6 fields (offset compressed_size uncompressed_size load_flags texture_flags sha1) for chunk, got %d", lineNo, len(fields))
+			}
+			var (
+				x   VPKLayoutChunk
+				err error
+			)
+			if x.Offset, err = strconv.ParseUint(fields[0], 10, 64); err != nil {
+				return fmt.Errorf("line %d: parse chunk offset %q: %w", lineNo, fields[0], err)
+			}
+			if x.CompressedSize, err = strconv.ParseUint(fields[1], 10, 64); err != nil {
+				return fmt.Errorf("line %d: parse chunk compressed size %q: %w", lineNo, fields[1], err)
+			}
+			if x.UncompressedSize, err = strconv.ParseUint(fields[2], 10, 64); err != nil {
+				return fmt.Errorf("line %d: parse chunk uncompressed size %q: %w", lineNo, fields[2], err)
+			}
+			if v, err := strconv.ParseUint(fields[3], 16, 32); err != nil {
+				return fmt.Errorf("line %d: parse chunk load flags %q: %w", lineNo, fields[3], err)
+			} else {
+				x.LoadFlags = uint32(v)
+			}
+			if v, err := strconv.ParseUint(fields[4], 16, 16); err != nil {
+				return fmt.Errorf("line %d: parse chunk texture flags %q: %w", lineNo, fields[4], err)
+			} else {
+				x.TextureFlags = uint16(v)
+			}
+			if v, err := hex.DecodeString(fields[5]); err != nil || len(v) != sha1.Size {
+				return fmt.Errorf("line %d: parse chunk sha1 %q: invalid hash", lineNo, fields[5])
+			} else {
+				copy(x.SHA1[:], v)
+			}
+			files[len(files)-1].Chunk = append(files[len(files)-1].Chunk, x)
+
+		default:
+			return fmt.Errorf("line %d: unknown entry %q", lineNo, kind)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	for _, f := range files {
+		if len(f.Chunk) == 0 {
+			return fmt.Errorf("file %q: no chunks", f.Path)
+		}
+	}
+
+	l.Block = blocks
+	l.File = files
+	return nil
+}
+
+// ParseFile is like Parse, but reads from a file.
+func (l *VPKLayout) ParseFile(name string) error {
+	buf, err := os.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	return l.Parse(string(buf))
+}
+
+// WriteLayout adds the files from l to w, writing their chunks at the original
+// offsets in the original blocks. If all files are unchanged and the original
+// order is preserved (see tf2vpk.Writer.PreserveOrder), the output will be
+// identical to the VPK the layout was generated from. It must be called before
+// anything else is written to w.
+//
+// A file is only written if keep returns true for it, and the file with the
+// same path in fsys has the same size and CRC32. The raw chunk data is copied
+// from src (if not nil) if it matches the recorded hash, and is otherwise
+// re-created from the file contents, which will only work for compressed
+// chunks if the compressor output is identical. If any of the chunks of a file
+// can't be reproduced, it isn't written (the space is zeroed). Data between
+// chunks is copied from src if possible, and is otherwise zeroed.
+//
+// The paths of the files which were written are returned. Other files should
+// be written normally afterwards.
+func WriteLayout(w *tf2vpk.Writer, l VPKLayout, fsys fs.FS, src *tf2vpk.Reader, keep func(VPKLayoutFile) bool) (map[string]bool, error) {
+	type chunkRef struct {
+		File   int
+		Chunk  int
+		Offset uint64 // uncompressed offset in the file
+	}
+	type chunk struct {
+		VPKLayoutChunk
+		Ref []chunkRef
+		OK  bool
+	}
+
+	// find the unchanged files
+	var (
+		files  []int
+		chunks = map[tf2vpk.ValvePakIndex][]*chunk{}
+		byID   = map[chunkID]*chunk{}
+	)
+	for i, f := range l.File {
+		if f.Index == tf2vpk.ValvePakIndexDir || (keep != nil && !keep(f)) {
+			continue
+		}
+		if ok, err := layoutFileUnchanged(fsys, f); err != nil {
+			return nil, fmt.Errorf("check %q: %w", f.Path, err)
+		} else if !ok {
+			continue
+		}
+		files = append(files, i)
+
+		var off uint64
+		for j, c := range f.Chunk {
+			id := chunkID{localeBlock("", f.Index), c.Offset, c.CompressedSize}
+			x, ok := byID[id]
+			if !ok || x.SHA1 != c.SHA1 {
+				x = &chunk{VPKLayoutChunk: c}
+				byID[id] = x
+				chunks[f.Index] = append(chunks[f.Index], x)
+			}
+			x.Ref = append(x.Ref, chunkRef{i, j, off})
+			off += c.UncompressedSize
+		}
+	}
+
+	// write the blocks
+	var (
+		open    io.ReadCloser
+		openIdx = -1
+	)
+	defer func() {
+		if open != nil {
+			open.Close()
+		}
+	}()
+	readFile := func(ref chunkRef) ([]byte, error) {
+		if openIdx != ref.File {
+			if open != nil {
+				open.Close()
+				open = nil
+			}
+			f, err := fsys.Open(l.File[ref.File].Path)
+			if err != nil {
+				return nil, err
+			}
+			open, openIdx = f, ref.File
+		}
+		ra, ok := open.(io.ReaderAt)
+		if !ok {
+			return nil, fmt.Errorf("open %q: file does not implement io.ReaderAt", l.File[ref.File].Path)
+		}
+		buf := make([]byte, l.File[ref.File].Chunk[ref.Chunk].UncompressedSize)
+		if _, err := ra.ReadAt(buf, int64(ref.Offset)); err != nil {
+			return nil, fmt.Errorf("read %q: %w", l.File[ref.File].Path, err)
+		}
+		return buf, nil
+	}
+	for _, b := range l.Block {
+		cs := chunks[b.Index]
+		if len(cs) == 0 {
+			continue
+		}
+		slices.SortStableFunc(cs, func(a, b *chunk) int {
+			if a.Offset != b.Offset {
+				return cmp.Compare(a.Offset, b.Offset)
+			}
+			return cmp.Compare(b.CompressedSize, a.CompressedSize)
+		})
+
+		var sr io.ReaderAt
+		if src != nil {
+			sr, _ = src.OpenBlockRaw(b.Index) // not an error if it doesn't exist
+		}
+
+		var (
+			pos     uint64
+			recrt   internal.RangeSet // data which wasn't copied from src
+			zero    = make([]byte, 1<<20)
+			srcData = func(off, n uint64) []byte {
+				if sr == nil {
+					return nil
+				}
+				buf := make([]byte, n)
+				if _, err := sr.ReadAt(buf, int64(off)); err != nil {
+					return nil
+				}
+				return buf
+			}
+			write = func(buf []byte, fromSrc bool) error {
+				if off, err := w.WriteRaw(b.Index, buf); err != nil {
+					return err
+				} else if off != pos {
+					return fmt.Errorf("write block %s: expected offset %d, got %d (was something already written?)", b.Index, pos, off)
+				}
+				if !fromSrc {
+					recrt.Add(pos, pos+uint64(len(buf)))
+				}
+				pos += uint64(len(buf))
+				return nil
+			}
+			fill = func(end uint64) error {
+				for pos < end {
+					n := min(end-pos, uint64(len(zero)))
+					if buf := srcData(pos, n); buf != nil {
+						if err := write(buf, true); err != nil {
+							return err
+						}
+					} else if err := write(zero[:n], false); err != nil {
+						return err
+					}
+				}
+				return nil
+			}
+		)
+		for _, c := range cs {
+			end := c.Offset + c.CompressedSize
+
+			// overlapping chunks can only be reproduced from src
+			if c.Offset < pos {
+				if buf := srcData(c.Offset, c.CompressedSize); buf != nil && sha1.Sum(buf) == c.SHA1 {
+					overlap := false
+					for _, r := range recrt.Ranges() {
+						if r.Start < min(end, pos) && c.Offset < r.End {
+							overlap = true
+							break
+						}
+					}
+					if !overlap {
+						if end > pos {
+							if err := write(buf[pos-c.Offset:], true); err != nil {
+								return nil, err
+							}
+						}
+						c.OK = true
+					}
+				}
+				if end > pos {
+					if err := fill(end); err != nil {
+						return nil, err
+					}
+				}
+				continue
+			}
+			if err := fill(c.Offset); err != nil {
+				return nil, err
+			}
+
+			// try to copy it from src, then re-create it
+			if buf := srcData(c.Offset, c.CompressedSize); buf != nil && sha1.Sum(buf) == c.SHA1 {
+				if err := write(buf, true); err != nil {
+					return nil, err
+				}
+				c.OK = true
+				continue
+			}
+			buf, err := readFile(c.Ref[0])
+			if err != nil {
+				return nil, err
+			}
+			if c.IsCompressed() {
+				dst := make([]byte, len(buf)*2+64)
+				if n, err := w.Codec().Compress(dst, buf); err == nil {
+					buf = dst[:n]
+				}
+			}
+			if uint64(len(buf)) == c.CompressedSize && sha1.Sum(buf) == c.SHA1 {
+				if err := write(buf, false); err != nil {
+					return nil, err
+				}
+				c.OK = true
+				continue
+			}
+			if err := fill(end); err != nil {
+				return nil, err
+			}
+		}
+		if err := fill(b.Size); err != nil {
+			return nil, err
+		}
+	}
+
+	// add the files which were reproduced
+	ok := map[int]bool{}
+	for _, cs := range chunks {
+		for _, c := range cs {
+			for _, ref := range c.Ref {
+				if v, seen := ok[ref.File]; !seen || v {
+					ok[ref.File] = c.OK
+				}
+			}
+		}
+	}
+	written := map[string]bool{}
+	for _, i := range files {
+		if ok[i] {
+			if err := w.AddFile(l.File[i].ValvePakFile()); err != nil {
+				return nil, err
+			}
+			written[l.File[i].Path] = true
+		}
+	}
+	return written, nil
+}
+
+// layoutFileUnchanged checks if the file in fsys has the same size and CRC32.
+func layoutFileUnchanged(fsys fs.FS, f VPKLayoutFile) (bool, error) {
+	x, err := fsys.Open(f.Path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return false, nil
+		}
+		return false, err
+	}
+	defer x.Close()
+
+	if fi, err := x.Stat(); err != nil {
+		return false, err
+	} else if !fi.Mode().IsRegular() || uint64(fi.Size()) != f.Size() {
+		return false, nil
+	}
+
+	crc := tf2vpk.NewCRC()
+	if _, err := io.Copy(crc, x); err != nil {
+		return false, err
+	}
+	return crc.Sum32() == f.CRC32, nil
+}
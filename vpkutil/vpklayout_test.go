@@ -0,0 +1,170 @@
+package vpkutil
+
+import (
+	"bytes"
+	"io"
+	"maps"
+	"math/rand"
+	"slices"
+	"testing"
+	"testing/fstest"
+
+	"github.com/pg9182/tf2vpk"
+)
+
+func TestLayout(t *testing.T) {
+	rng := rand.New(rand.NewSource(0))
+
+	fsys := fstest.MapFS{}
+	for i, name := range []string{"a.txt", "b/c.nut", "b/d.bin", "e.vtf", "f.txt"} {
+		buf := bytes.Repeat([]byte(name), 1000*(i+1))
+		if name == "b/d.bin" {
+			buf = make([]byte, 1<<20+100) // multiple chunks, stored
+			rng.Read(buf)
+		}
+		fsys[name] = &fstest.MapFile{Data: buf}
+	}
+
+	// write the original vpk with a gap and some shared chunks
+	orig := map[tf2vpk.ValvePakIndex]*bytes.Buffer{}
+	w := tf2vpk.NewWriterFunc(memBlock(orig))
+	for i, name := range []string{"b/d.bin", "a.txt", "e.vtf", "b/c.nut"} {
+		if i == 2 {
+			if err := w.SetIndex(1); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := w.WriteRaw(1, []byte("garbage")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := w.WriteFile(name, bytes.NewReader(fsys[name].Data), 1, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f := w.Root.File[1]
+	f.Path = "f.txt"
+	fsys["f.txt"].Data = fsys["a.txt"].Data
+	if err := w.AddFile(f); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	r, err := tf2vpk.NewReaderFunc(memBlockReader(orig))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var l VPKLayout
+	if err := l.Generate(r, 2); err != nil {
+		t.Fatal(err)
+	}
+	if len(l.Block) != 2 || l.Block[1].Size != uint64(orig[1].Len()) {
+		t.Fatalf("incorrect blocks %v", l.Block)
+	}
+
+	var l2 VPKLayout
+	if err := l2.Parse(l.String()); err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if l2.String() != l.String() {
+		t.Errorf("parse: round-trip mismatch")
+	}
+
+	repack := func(src *tf2vpk.Reader, fsys fstest.MapFS) (map[tf2vpk.ValvePakIndex]*bytes.Buffer, map[string]bool) {
+		out := map[tf2vpk.ValvePakIndex]*bytes.Buffer{}
+		w := tf2vpk.NewWriterFunc(memBlock(out))
+		reused, err := WriteLayout(w, l2, fsys, src, nil)
+		if err != nil {
+			t.Fatalf("write layout: %v", err)
+		}
+		for _, f := range l2.File {
+			if !reused[f.Path] {
+				if x, ok := fsys[f.Path]; ok {
+					if err := w.SetIndex(f.Index); err != nil {
+						t.Fatal(err)
+					}
+					if _, err := w.WriteFile(f.Path, bytes.NewReader(x.Data), 1, 0); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+		}
+		w.PreserveOrder()
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return out, reused
+	}
+
+	// exact with the original data
+	out, reused := repack(r, fsys)
+	if len(reused) != len(l2.File) {
+		t.Errorf("expected all files to be reused, got %v", reused)
+	}
+	for i, b := range orig {
+		if !bytes.Equal(b.Bytes(), out[i].Bytes()) {
+			t.Errorf("block %s: not identical", i)
+		}
+	}
+
+	// without it, only the gap is different since the compressor is the same
+	out, reused = repack(nil, fsys)
+	if len(reused) != len(l2.File) {
+		t.Errorf("expected all files to be reused, got %v", reused)
+	}
+	for i, b := range orig {
+		exp := b.Bytes()
+		if i == 1 {
+			exp = bytes.Replace(exp, []byte("garbage"), make([]byte, 7), 1)
+		}
+		if !bytes.Equal(exp, out[i].Bytes()) {
+			t.Errorf("block %s: not identical", i)
+		}
+	}
+
+	// a modified file is written normally, and the others are the same
+	mod := maps.Clone(fsys)
+	mod["e.vtf"] = &fstest.MapFile{Data: []byte("modified")}
+	out, reused = repack(r, mod)
+	if reused["e.vtf"] || len(reused) != len(l2.File)-1 {
+		t.Errorf("expected all files other than e.vtf to be reused, got %v", reused)
+	}
+	if !bytes.Equal(orig[0].Bytes(), out[0].Bytes()) {
+		t.Errorf("block 000: not identical")
+	}
+	if !bytes.HasPrefix(out[1].Bytes(), orig[1].Bytes()) {
+		t.Errorf("block 001: original data not preserved")
+	}
+	r2, err := tf2vpk.NewReaderFunc(memBlockReader(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, x := range mod {
+		if buf, err := r2.ReadFile(name); err != nil {
+			t.Errorf("read %q: %v", name, err)
+		} else if !bytes.Equal(buf, x.Data) {
+			t.Errorf("read %q: incorrect contents", name)
+		}
+	}
+	if !slices.EqualFunc(r.Root.File, r2.Root.File, func(a, b tf2vpk.ValvePakFile) bool { return a.Path == b.Path }) {
+		t.Errorf("file order not preserved")
+	}
+}
+
+func memBlock(m map[tf2vpk.ValvePakIndex]*bytes.Buffer) func(tf2vpk.ValvePakIndex) (io.Writer, error) {
+	return func(i tf2vpk.ValvePakIndex) (io.Writer, error) {
+		b := new(bytes.Buffer)
+		m[i] = b
+		return b, nil
+	}
+}
+
+func memBlockReader(m map[tf2vpk.ValvePakIndex]*bytes.Buffer) func(tf2vpk.ValvePakIndex) (io.ReaderAt, error) {
+	return func(i tf2vpk.ValvePakIndex) (io.ReaderAt, error) {
+		if b, ok := m[i]; ok {
+			return bytes.NewReader(b.Bytes()), nil
+		}
+		return nil, io.ErrUnexpectedEOF
+	}
+}
@@ -0,0 +1,122 @@
+package vpkutil
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/pg9182/tf2vpk"
+)
+
+// Locale is one of the dir indexes sharing the blocks of a VPK.
+type Locale struct {
+	VPK    tf2vpk.ValvePakRef
+	Reader *tf2vpk.Reader
+}
+
+// OpenLocales opens a reader for every dir index sharing the blocks of vpk (see
+// [tf2vpk.ValvePakRef.Prefixes]), with vpk.Prefix first. Operations which
+// rewrite blocks must update all of them, or the other ones will point to the
+// wrong data.
+//
+// An error is returned if the dir indexes disagree about the chunk layout of a
+// file they both contain.
+func OpenLocales(vpk tf2vpk.ValvePakRef, opt tf2vpk.Options) ([]Locale, error) {
+	prefixes, err := vpk.Prefixes()
+	if err != nil {
+		return nil, fmt.Errorf("find vpk locales: %w", err)
+	}
+	if i := slices.Index(prefixes, vpk.Prefix); i != -1 {
+		prefixes = slices.Delete(prefixes, i, i+1)
+	}
+	slices.Sort(prefixes)
+	prefixes = slices.Insert(prefixes, 0, vpk.Prefix)
+
+	var ls []Locale
+	for _, prefix := range prefixes {
+		l := Locale{VPK: vpk}
+		l.VPK.Prefix = prefix
+		if l.Reader, err = tf2vpk.NewReaderOptions(l.VPK, opt); err != nil {
+			CloseLocales(ls)
+			return nil, fmt.Errorf("open vpk (prefix %q): %w", prefix, err)
+		}
+		ls = append(ls, l)
+	}
+	if err := checkLocaleLayout(ls); err != nil {
+		CloseLocales(ls)
+		return nil, err
+	}
+	return ls, nil
+}
+
+// CloseLocales closes the readers opened by OpenLocales.
+func CloseLocales(ls []Locale) error {
+	var errs []error
+	for _, l := range ls {
+		if err := l.Reader.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("close vpk (prefix %q): %w", l.VPK.Prefix, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// checkLocaleLayout ensures files present in multiple locales have the same
+// chunks. Chunks stored after the dir index are ignored since they aren't
+// shared.
+func checkLocaleLayout(ls []Locale) error {
+	type entry struct {
+		Prefix string
+		File   *tf2vpk.ValvePakFile
+	}
+	seen := map[string]entry{}
+	for _, l := range ls {
+		for i := range l.Reader.Root.File {
+			f := &l.Reader.Root.File[i]
+			e, ok := seen[f.Path]
+			if !ok {
+				seen[f.Path] = entry{l.VPK.Prefix, f}
+				continue
+			}
+			if f.Index == tf2vpk.ValvePakIndexDir && e.File.Index == tf2vpk.ValvePakIndexDir {
+				continue
+			}
+			same := f.Index == e.File.Index && f.CRC32 == e.File.CRC32 && len(f.Chunk) == len(e.File.Chunk)
+			for j := 0; same && j < len(f.Chunk); j++ {
+				a, b := f.Chunk[j], e.File.Chunk[j]
+				same = a.Offset == b.Offset && a.CompressedSize == b.CompressedSize && a.UncompressedSize == b.UncompressedSize
+			}
+			if !same {
+				return fmt.Errorf("vpk locales disagree about chunk layout: entry %q differs between prefix %q and %q", f.Path, e.Prefix, l.VPK.Prefix)
+			}
+		}
+	}
+	return nil
+}
+
+// blockID identifies a block shared by all locales, or the chunk data stored
+// after the dir index of a specific locale.
+type blockID struct {
+	Prefix string // only set for ValvePakIndexDir
+	Index  tf2vpk.ValvePakIndex
+}
+
+func localeBlock(prefix string, i tf2vpk.ValvePakIndex) blockID {
+	if i != tf2vpk.ValvePakIndexDir {
+		prefix = ""
+	}
+	return blockID{prefix, i}
+}
+
+func (b blockID) Less(o blockID) bool {
+	if b.Index != o.Index {
+		return b.Index < o.Index
+	}
+	return b.Prefix < o.Prefix
+}
+
+func (b blockID) String() string {
+	if b.Index == tf2vpk.ValvePakIndexDir {
+		return fmt.Sprintf("%s (prefix %q)", b.Index, b.Prefix)
+	}
+	return b.Index.String()
+}
@@ -0,0 +1,116 @@
+package vpkutil
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"os"
+	"slices"
+	"testing"
+
+	"github.com/pg9182/tf2vpk"
+)
+
+func TestLocales(t *testing.T) {
+	rng := rand.New(rand.NewSource(0))
+
+	files := map[string][]byte{}
+	for _, name := range []string{"a.bin", "b.bin", "c.bin"} {
+		files[name] = make([]byte, 300<<10)
+		rng.Read(files[name])
+	}
+
+	english := tf2vpk.ValvePakRef{Path: t.TempDir(), Prefix: "english", Name: "test"}
+	french := english
+	french.Prefix = "french"
+
+	w := tf2vpk.NewWriter(english)
+	for _, name := range []string{"a.bin", "b.bin", "c.bin"} {
+		if _, err := w.WriteFile(name, bytes.NewReader(files[name]), 1, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if buf, err := os.ReadFile(english.Resolve(tf2vpk.ValvePakIndexDir)); err != nil {
+		t.Fatal(err)
+	} else if err := os.WriteFile(french.Resolve(tf2vpk.ValvePakIndexDir), buf, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	remove := func(vpk tf2vpk.ValvePakRef, name string) {
+		if err := UpdateDir(vpk, false, func(root *tf2vpk.ValvePakDir) error {
+			root.File = slices.DeleteFunc(root.File, func(f tf2vpk.ValvePakFile) bool {
+				return f.Path == name
+			})
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check := func(vpk tf2vpk.ValvePakRef, names ...string) {
+		r, err := tf2vpk.NewReader(vpk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+
+		var got []string
+		for _, f := range r.Root.File {
+			fr, err := r.OpenFile(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if buf, err := io.ReadAll(fr); err != nil {
+				t.Errorf("%s: %s: %v", vpk.Prefix, f.Path, err)
+			} else if !bytes.Equal(buf, files[f.Path]) {
+				t.Errorf("%s: %s: contents do not match", vpk.Prefix, f.Path)
+			}
+			got = append(got, f.Path)
+		}
+		if !slices.Equal(got, names) {
+			t.Errorf("%s: expected files %q, got %q", vpk.Prefix, names, got)
+		}
+	}
+
+	// b.bin is still used by french, so only c.bin can be removed
+	remove(english, "b.bin")
+	remove(english, "c.bin")
+	remove(french, "c.bin")
+
+	if blocks, err := GC(english, tf2vpk.Options{}, false); err != nil {
+		t.Fatal(err)
+	} else if len(blocks) != 1 || blocks[0].Unused() != uint64(len(files["c.bin"])) {
+		t.Errorf("expected only c.bin to be removed, got %+v", blocks)
+	}
+	check(english, "a.bin")
+	check(french, "a.bin", "b.bin")
+
+	out := tf2vpk.ValvePakRef{Path: t.TempDir(), Prefix: french.Prefix, Name: french.Name}
+	if res, err := Optimize(context.Background(), french, out, OptimizeOptions{Merge: true}); err != nil {
+		t.Fatal(err)
+	} else if !slices.Equal(res.Prefixes, []string{"french", "english"}) {
+		t.Errorf("expected both locales to be written, got %q", res.Prefixes)
+	}
+	check(tf2vpk.ValvePakRef{Path: out.Path, Prefix: "english", Name: out.Name}, "a.bin")
+	check(out, "a.bin", "b.bin")
+
+	if _, err := Optimize(context.Background(), french, tf2vpk.ValvePakRef{Path: t.TempDir(), Prefix: french.Prefix, Name: french.Name}, OptimizeOptions{Merge: true, MergeIndex: tf2vpk.ValvePakIndexDir}); err == nil {
+		t.Errorf("expected error when merging into the dir with multiple locales")
+	}
+
+	// make the locales disagree
+	if err := UpdateDir(english, false, func(root *tf2vpk.ValvePakDir) error {
+		root.File[0].Chunk[0].Offset++
+		root.File[0].Chunk[0].CompressedSize--
+		root.File[0].Chunk[0].UncompressedSize--
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := GC(english, tf2vpk.Options{}, true); err == nil {
+		t.Errorf("expected error for inconsistent locales")
+	}
+}
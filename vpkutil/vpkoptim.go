@@ -0,0 +1,383 @@
+package vpkutil
+
+import (
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/pg9182/tf2vpk"
+	"github.com/pg9182/tf2vpk/internal"
+)
+
+// OptimizeOptions configures Optimize.
+type OptimizeOptions struct {
+	// Merge writes the chunks from all blocks into MergeIndex (which may be
+	// ValvePakIndexDir to store them after the dir index).
+	Merge      bool
+	MergeIndex tf2vpk.ValvePakIndex
+
+	// Skip, if set, is called to determine whether to exclude a file.
+	Skip func(tf2vpk.ValvePakFile) (bool, error)
+
+	// Threads is the number of chunks to hash in parallel.
+	Threads int
+
+	// DryRun computes the result without writing anything.
+	DryRun bool
+
+	// VPK is used for reading and writing the VPKs.
+	VPK tf2vpk.Options
+}
+
+// OptimizeResult contains statistics about an optimized VPK.
+type OptimizeResult struct {
+	Prefixes   []string                        // locale prefixes of the dir indexes which were written
+	Files      int                             // number of files in the output (for all locales)
+	Excluded   int                             // number of files excluded by OptimizeOptions.Skip (for all locales)
+	Chunks     int                             // number of distinct chunks in the input
+	Duplicate  int                             // number of chunks replaced by an identical one
+	InputSize  uint64                          // total size of chunk data in the input blocks
+	OutputSize uint64                          // total size of chunk data in the output blocks
+	Block      map[tf2vpk.ValvePakIndex]uint64 // size of each output block (for ValvePakIndexDir, the total for all locales)
+}
+
+type chunkID struct {
+	Block  blockID
+	Offset uint64
+	Size   uint64
+}
+
+// Optimize rewrites the blocks of the VPK in to out, only keeping the chunk
+// data referenced by the (non-excluded) files, de-duplicating identical chunks
+// within each output block, and optionally merging all blocks into one.
+//
+// Since chunks may share data by overlapping or containing each other, the
+// referenced byte ranges of each block are merged and copied as a unit, so the
+// output is never larger than the input.
+//
+// Since the blocks are shared by the dir indexes for every locale, all of them
+// are rewritten (see OpenLocales), using the same prefixes in out. Merging into
+// ValvePakIndexDir is only possible if there is a single locale.
+//
+// For Source VPKs version 2, the archive md5 entries are moved along with the
+// chunk data they cover (entries for data which wasn't kept are dropped), and
+// the checksum sections are updated.
+//
+// The output files are written to temporary files, then renamed.
+func Optimize(ctx context.Context, in, out tf2vpk.ValvePakRef, opt OptimizeOptions) (OptimizeResult, error) {
+	res := OptimizeResult{
+		Block: map[tf2vpk.ValvePakIndex]uint64{},
+	}
+
+	ls, err := OpenLocales(in, opt.VPK)
+	if err != nil {
+		return res, err
+	}
+	defer CloseLocales(ls)
+
+	for _, l := range ls {
+		res.Prefixes = append(res.Prefixes, l.VPK.Prefix)
+	}
+
+	if opt.Merge && opt.MergeIndex == tf2vpk.ValvePakIndexEOF {
+		return res, fmt.Errorf("invalid merge index %#v", opt.MergeIndex)
+	}
+	if opt.Merge && opt.MergeIndex == tf2vpk.ValvePakIndexDir && len(ls) > 1 {
+		return res, fmt.Errorf("cannot merge blocks into the dir index since it would need to be duplicated for each locale (%q)", res.Prefixes)
+	}
+	target := func(b blockID) blockID {
+		if opt.Merge {
+			return localeBlock(ls[0].VPK.Prefix, opt.MergeIndex) // there's only one locale if it's the dir
+		}
+		return b
+	}
+
+	inputSize := map[blockID]uint64{}
+	for _, l := range ls {
+		for _, f := range l.Reader.Root.File {
+			b := localeBlock(l.VPK.Prefix, f.Index)
+			for _, c := range f.Chunk {
+				inputSize[b] = max(inputSize[b], c.Offset+c.CompressedSize)
+			}
+		}
+	}
+	for _, x := range inputSize {
+		res.InputSize += x
+	}
+
+	// filter the files
+	files := make([][]tf2vpk.ValvePakFile, len(ls))
+	for i, l := range ls {
+		files[i] = make([]tf2vpk.ValvePakFile, 0, len(l.Reader.Root.File))
+		for _, f := range l.Reader.Root.File {
+			if opt.Skip != nil {
+				if skip, err := opt.Skip(f); err != nil {
+					return res, err
+				} else if skip {
+					res.Excluded++
+					continue
+				}
+			}
+			files[i] = append(files[i], f)
+		}
+		res.Files += len(files[i])
+	}
+
+	// hash the distinct chunks
+	var ids []chunkID
+	seen := map[chunkID]struct{}{}
+	for i, l := range ls {
+		for _, f := range files[i] {
+			for _, c := range f.Chunk {
+				id := chunkID{localeBlock(l.VPK.Prefix, f.Index), c.Offset, c.CompressedSize}
+				if _, ok := seen[id]; !ok {
+					seen[id] = struct{}{}
+					ids = append(ids, id)
+				}
+			}
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		a, b := ids[i], ids[j]
+		if a.Block != b.Block {
+			return a.Block.Less(b.Block)
+		}
+		if a.Offset != b.Offset {
+			return a.Offset < b.Offset
+		}
+		return a.Size < b.Size
+	})
+	res.Chunks = len(ids)
+
+	open := func(b blockID) (io.ReaderAt, error) {
+		for _, l := range ls {
+			if b.Index != tf2vpk.ValvePakIndexDir || l.VPK.Prefix == b.Prefix {
+				return l.Reader.OpenBlockRaw(b.Index)
+			}
+		}
+		panic("wtf") // every block is from one of the locales
+	}
+
+	hashes, err := hashChunks(ctx, open, ids, opt.Threads)
+	if err != nil {
+		return res, fmt.Errorf("hash chunks: %w", err)
+	}
+
+	// choose the first chunk with each hash in each output block, and find the
+	// byte ranges we need to keep
+	type key struct {
+		Target blockID
+		Hash   [sha1.Size]byte
+	}
+	var (
+		canon = map[key]chunkID{}
+		used  = map[blockID]*internal.RangeSet{}
+		srcs  []blockID
+	)
+	for _, id := range ids {
+		k := key{target(id.Block), hashes[id]}
+		if _, ok := canon[k]; ok {
+			res.Duplicate++
+			continue
+		}
+		canon[k] = id
+
+		rs, ok := used[id.Block]
+		if !ok {
+			rs = new(internal.RangeSet)
+			used[id.Block] = rs
+			srcs = append(srcs, id.Block) // note: ids are sorted
+		}
+		rs.Add(id.Offset, id.Offset+id.Size)
+	}
+
+	// lay out the source blocks in the output blocks
+	var (
+		base = map[blockID]uint64{}
+		size = map[blockID]uint64{}
+	)
+	for _, s := range srcs {
+		t := target(s)
+		base[s] = size[t]
+		size[t] += used[s].Len()
+	}
+	for t, x := range size {
+		res.Block[t.Index] += x
+		res.OutputSize += x
+	}
+
+	// remap the chunks
+	roots := make([]tf2vpk.ValvePakDir, len(ls))
+	sections := make([]*tf2vpk.ValvePakSourceSections, len(ls))
+	for i, l := range ls {
+		if sections[i], err = readSourceSections(l.Reader); err != nil {
+			return res, fmt.Errorf("vpk dir (prefix %q): %w", l.VPK.Prefix, err)
+		} else if sections[i] != nil {
+			remapArchiveMD5(sections[i], func(idx tf2vpk.ValvePakIndex, start, end uint64) (tf2vpk.ValvePakIndex, uint64, bool) {
+				b := localeBlock(l.VPK.Prefix, idx)
+				if rs, ok := used[b]; ok {
+					if x, ok := rs.CompactRange(start, end); ok {
+						return target(b).Index, base[b] + x, true
+					}
+				}
+				return 0, 0, false
+			})
+		}
+		for j, f := range files[i] {
+			b := localeBlock(l.VPK.Prefix, f.Index)
+			files[i][j].Chunk = append([]tf2vpk.ValvePakChunk(nil), f.Chunk...)
+			for k, c := range f.Chunk {
+				id := canon[key{target(b), hashes[chunkID{b, c.Offset, c.CompressedSize}]}]
+				if x, ok := used[id.Block].Compact(id.Offset); !ok {
+					panic("wtf") // every canonical chunk was added to the set
+				} else {
+					files[i][j].Chunk[k].Offset = base[id.Block] + x
+				}
+			}
+			files[i][j].Index = target(b).Index
+		}
+		roots[i] = l.Reader.Root
+		roots[i].File = files[i]
+	}
+
+	if opt.DryRun {
+		for i, l := range ls {
+			if err := roots[i].SerializeOptions(io.Discard, opt.VPK); err != nil {
+				return res, fmt.Errorf("write vpk dir (prefix %q): %w", l.VPK.Prefix, err)
+			}
+		}
+		return res, nil
+	}
+
+	// write the blocks
+	tmp := map[blockID]string{}
+	defer func() {
+		for _, x := range tmp {
+			os.Remove(x)
+		}
+	}()
+	writeBlock := func(w io.Writer, t blockID) error {
+		for _, s := range srcs {
+			if target(s) == t {
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				default:
+				}
+				b, err := open(s)
+				if err != nil {
+					return err
+				}
+				if err := copyRanges(w, b, 0, used[s].Ranges()); err != nil {
+					return fmt.Errorf("copy chunks from vpk block %s: %w", s, err)
+				}
+			}
+		}
+		return nil
+	}
+	for _, s := range srcs {
+		if t := target(s); t.Index != tf2vpk.ValvePakIndexDir {
+			if _, ok := tmp[t]; !ok {
+				if x, err := writeTemp(out.Resolve(t.Index), func(w io.Writer) error {
+					return writeBlock(w, t)
+				}); err != nil {
+					return res, fmt.Errorf("write vpk block %s: %w", t, err)
+				} else {
+					tmp[t] = x
+				}
+			}
+		}
+	}
+	for i, l := range ls {
+		o := out
+		o.Prefix = l.VPK.Prefix
+
+		t := localeBlock(l.VPK.Prefix, tf2vpk.ValvePakIndexDir)
+		if x, err := writeTemp(o.Resolve(tf2vpk.ValvePakIndexDir), func(w io.Writer) error {
+			return writeDir(w, roots[i], sections[i], opt.VPK, func(w io.Writer) error {
+				return writeBlock(w, t)
+			})
+		}); err != nil {
+			return res, fmt.Errorf("write vpk dir (prefix %q): %w", l.VPK.Prefix, err)
+		} else {
+			tmp[t] = x
+		}
+	}
+
+	// rename them (dirs last)
+	select {
+	case <-ctx.Done():
+		return res, ctx.Err()
+	default:
+	}
+	bs := make([]blockID, 0, len(tmp))
+	for b := range tmp {
+		bs = append(bs, b)
+	}
+	sort.Slice(bs, func(i, j int) bool {
+		return bs[i].Less(bs[j])
+	})
+	for _, b := range bs {
+		o := out
+		o.Prefix = b.Prefix
+		if err := os.Rename(tmp[b], o.Resolve(b.Index)); err != nil {
+			return res, fmt.Errorf("rename vpk block %s: %w", b, err)
+		}
+		delete(tmp, b)
+	}
+	return res, nil
+}
+
+// hashChunks computes the SHA-1 hash of the raw data of each chunk using n
+// goroutines.
+func hashChunks(ctx context.Context, open func(blockID) (io.ReaderAt, error), ids []chunkID, n int) (map[chunkID][sha1.Size]byte, error) {
+	hashes := make([][sha1.Size]byte, len(ids))
+	errs := make([]error, max(n, 1))
+
+	var wg sync.WaitGroup
+	for w := range errs {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			h := sha1.New()
+			for i := w; i < len(ids); i += len(errs) {
+				select {
+				case <-ctx.Done():
+					errs[w] = ctx.Err()
+					return
+				default:
+				}
+				b, err := open(ids[i].Block)
+				if err != nil {
+					errs[w] = err
+					return
+				}
+				h.Reset()
+				if n, err := io.Copy(h, io.NewSectionReader(b, int64(ids[i].Offset), int64(ids[i].Size))); err != nil {
+					errs[w] = fmt.Errorf("read chunk %s:%d: %w", ids[i].Block, ids[i].Offset, err)
+					return
+				} else if uint64(n) != ids[i].Size {
+					errs[w] = fmt.Errorf("read chunk %s:%d: %w", ids[i].Block, ids[i].Offset, io.ErrUnexpectedEOF)
+					return
+				}
+				h.Sum(hashes[i][:0])
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	m := make(map[chunkID][sha1.Size]byte, len(ids))
+	for i, id := range ids {
+		m[id] = hashes[i]
+	}
+	return m, nil
+}
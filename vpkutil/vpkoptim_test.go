@@ -0,0 +1,156 @@
+package vpkutil
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"maps"
+	"math/rand"
+	"os"
+	"testing"
+
+	"github.com/pg9182/tf2vpk"
+)
+
+func TestOptimize(t *testing.T) {
+	rng := rand.New(rand.NewSource(0))
+
+	in := tf2vpk.ValvePakRef{Path: t.TempDir(), Prefix: "english", Name: "test"}
+	data := make([]byte, 3<<20)
+	rng.Read(data) // incompressible, so the chunks are stored and can be sliced
+
+	w := tf2vpk.NewWriter(in)
+	a, err := w.WriteFile("a.bin", bytes.NewReader(data), 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.WriteFile("b.txt", bytes.NewReader(bytes.Repeat([]byte("test\n"), 1000)), 1, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.SetIndex(1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.WriteFile("c.bin", bytes.NewReader(data[:1<<20]), 1, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// add some files sharing data with a.bin
+	want := map[string][]byte{
+		"a.bin": data,
+		"b.txt": bytes.Repeat([]byte("test\n"), 1000),
+		"c.bin": data[:1<<20],
+	}
+	if err := UpdateDir(in, false, func(root *tf2vpk.ValvePakDir) error {
+		for _, x := range []struct {
+			Name   string
+			Offset uint64
+			Size   uint64
+		}{
+			{"overlap.bin", a.Chunk[0].Offset + 1000, 1 << 20},           // spans two chunks
+			{"contained.bin", a.Chunk[1].Offset + 5000, 4096},            // inside a chunk
+			{"shared.bin", a.Chunk[2].Offset, a.Chunk[2].CompressedSize}, // identical to a chunk
+		} {
+			f := tf2vpk.ValvePakFile{
+				Path:  x.Name,
+				Index: a.Index,
+				Chunk: []tf2vpk.ValvePakChunk{{
+					LoadFlags:        1,
+					Offset:           x.Offset,
+					CompressedSize:   x.Size,
+					UncompressedSize: x.Size,
+				}},
+			}
+			crc := tf2vpk.NewCRC()
+			crc.Write(data[x.Offset : x.Offset+x.Size])
+			f.CRC32 = crc.Sum32()
+			root.File = append(root.File, f)
+			want[x.Name] = data[x.Offset : x.Offset+x.Size]
+		}
+		return root.SortFiles()
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, x := range []struct {
+		Name string
+		Opt  OptimizeOptions
+	}{
+		{"default", OptimizeOptions{Threads: 2}},
+		{"merge", OptimizeOptions{Merge: true, Threads: 2}},
+		{"merge-dir", OptimizeOptions{Merge: true, MergeIndex: tf2vpk.ValvePakIndexDir}},
+	} {
+		t.Run(x.Name, func(t *testing.T) {
+			out := tf2vpk.ValvePakRef{Path: t.TempDir(), Prefix: in.Prefix, Name: in.Name}
+
+			res, err := Optimize(context.Background(), in, out, x.Opt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.OutputSize > res.InputSize {
+				t.Errorf("output (%d bytes) is larger than input (%d bytes)", res.OutputSize, res.InputSize)
+			}
+			if x.Opt.Merge && res.OutputSize != res.InputSize-1<<20 {
+				t.Errorf("expected the duplicate chunk from block 1 to be removed")
+			}
+
+			r, err := tf2vpk.NewReader(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Close()
+
+			for _, f := range r.Root.File {
+				if x.Opt.Merge && f.Index != x.Opt.MergeIndex {
+					t.Errorf("%s: expected block %s, got %s", f.Path, x.Opt.MergeIndex, f.Index)
+				}
+				fr, err := r.OpenFile(f)
+				if err != nil {
+					t.Fatal(err)
+				}
+				buf, err := io.ReadAll(fr)
+				if err != nil {
+					t.Fatalf("%s: %v", f.Path, err)
+				}
+				if !bytes.Equal(buf, want[f.Path]) {
+					t.Errorf("%s: contents do not match", f.Path)
+				}
+			}
+
+			if x.Opt.MergeIndex == tf2vpk.ValvePakIndexDir && x.Opt.Merge {
+				if _, err := os.Stat(out.Resolve(0)); err == nil {
+					t.Errorf("expected no data blocks")
+				}
+			}
+		})
+	}
+}
+
+func TestOptimizeSource2(t *testing.T) {
+	in := tf2vpk.ValvePakRef{Path: t.TempDir(), Prefix: "english", Name: "test"}
+	files := writeTestSource2(t, in)
+
+	skip := func(f tf2vpk.ValvePakFile) (bool, error) {
+		return f.Path == "b.txt", nil
+	}
+	for _, x := range []struct {
+		Name string
+		Opt  OptimizeOptions
+	}{
+		{"default", OptimizeOptions{Skip: skip}},
+		{"merge", OptimizeOptions{Skip: skip, Merge: true}},
+		{"merge-dir", OptimizeOptions{Skip: skip, Merge: true, MergeIndex: tf2vpk.ValvePakIndexDir}},
+	} {
+		t.Run(x.Name, func(t *testing.T) {
+			out := tf2vpk.ValvePakRef{Path: t.TempDir(), Prefix: in.Prefix, Name: in.Name}
+			if _, err := Optimize(context.Background(), in, out, x.Opt); err != nil {
+				t.Fatal(err)
+			}
+			want := maps.Clone(files)
+			delete(want, "b.txt")
+			checkTestSource2(t, out, want, 3)
+		})
+	}
+}
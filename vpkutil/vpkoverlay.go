@@ -0,0 +1,249 @@
+package vpkutil
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/pg9182/tf2vpk"
+)
+
+// FindVPKs finds the VPKs with the specified prefix in dir, sorted by name.
+func FindVPKs(dir, prefix string) ([]tf2vpk.ValvePakRef, error) {
+	ds, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var vpks []tf2vpk.ValvePakRef
+	for _, d := range ds {
+		if name, idx, err := tf2vpk.SplitName(d.Name(), prefix); err == nil && idx == tf2vpk.ValvePakIndexDir {
+			vpks = append(vpks, tf2vpk.ValvePakRef{
+				Path:   dir,
+				Prefix: prefix,
+				Name:   name,
+			})
+		}
+	}
+	slices.SortFunc(vpks, func(a, b tf2vpk.ValvePakRef) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	return vpks, nil
+}
+
+// Overlay provides a union of the files in multiple VPKs. If a file exists in
+// more than one VPK, the one from the VPK with the highest priority is used,
+// and the others are shadowed by it.
+//
+// Overlay implements [fs.FS], [fs.StatFS], [fs.ReadDirFS], and [fs.ReadFileFS].
+type Overlay struct {
+	vpk   []tf2vpk.ValvePakRef
+	r     []*tf2vpk.Reader
+	files map[string][]OverlayFile
+	names []string
+}
+
+// OverlayFile is a file in a VPK opened by an Overlay.
+type OverlayFile struct {
+	VPK    tf2vpk.ValvePakRef
+	Reader *tf2vpk.Reader
+	File   tf2vpk.ValvePakFile
+}
+
+var (
+	_ fs.FS         = (*Overlay)(nil)
+	_ fs.StatFS     = (*Overlay)(nil)
+	_ fs.ReadDirFS  = (*Overlay)(nil)
+	_ fs.ReadFileFS = (*Overlay)(nil)
+)
+
+// OpenOverlay opens the provided VPKs, which are in descending order of
+// priority.
+func OpenOverlay(vpks []tf2vpk.ValvePakRef, opt tf2vpk.Options) (*Overlay, error) {
+	o := &Overlay{
+		files: map[string][]OverlayFile{},
+	}
+	for _, vpk := range vpks {
+		r, err := tf2vpk.NewReaderOptions(vpk, opt)
+		if err != nil {
+			o.Close()
+			return nil, fmt.Errorf("open vpk %q: %w", vpk.Name, err)
+		}
+		o.vpk = append(o.vpk, vpk)
+		o.r = append(o.r, r)
+
+		seen := map[string]struct{}{}
+		for _, f := range r.Root.File {
+			if !fs.ValidPath(f.Path) || f.Path == "." {
+				continue // like Reader, ignore invalid paths
+			}
+			if _, ok := seen[f.Path]; ok {
+				continue // like Reader, the first one takes precedence
+			}
+			seen[f.Path] = struct{}{}
+			if _, ok := o.files[f.Path]; !ok {
+				o.names = append(o.names, f.Path)
+			}
+			o.files[f.Path] = append(o.files[f.Path], OverlayFile{vpk, r, f})
+		}
+	}
+	slices.Sort(o.names)
+	return o, nil
+}
+
+// Close closes all VPKs.
+func (o *Overlay) Close() error {
+	var errs []error
+	for i, r := range o.r {
+		if err := r.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("close vpk %q: %w", o.vpk[i].Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// VPKs returns the VPKs in descending order of priority.
+func (o *Overlay) VPKs() []tf2vpk.ValvePakRef {
+	return slices.Clone(o.vpk)
+}
+
+// Lookup returns the copies of the file at the specified path in descending
+// order of priority. The first one is used, and the others are shadowed by it.
+func (o *Overlay) Lookup(name string) []OverlayFile {
+	return slices.Clone(o.files[name])
+}
+
+// Files returns the files which are used (i.e., not shadowed), sorted by path.
+func (o *Overlay) Files() []OverlayFile {
+	xs := make([]OverlayFile, 0, len(o.names))
+	for _, name := range o.names {
+		xs = append(xs, o.files[name][0])
+	}
+	return xs
+}
+
+// reader returns the highest-priority reader containing name.
+func (o *Overlay) reader(op, name string) (*tf2vpk.Reader, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	if x, ok := o.files[name]; ok {
+		return x[0].Reader, nil
+	}
+	for _, r := range o.r {
+		if fi, err := r.Stat(name); err == nil && fi.IsDir() {
+			return r, nil
+		}
+	}
+	return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+}
+
+// Open implements fs.FS.
+func (o *Overlay) Open(name string) (fs.File, error) {
+	r, err := o.reader("open", name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := r.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	if d, ok := f.(fs.ReadDirFile); ok {
+		es, err := o.ReadDir(name)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return &overlayDir{d, es, 0}, nil
+	}
+	return f, nil
+}
+
+// Stat implements fs.StatFS.
+func (o *Overlay) Stat(name string) (fs.FileInfo, error) {
+	r, err := o.reader("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return r.Stat(name)
+}
+
+// ReadFile implements fs.ReadFileFS.
+func (o *Overlay) ReadFile(name string) ([]byte, error) {
+	r, err := o.reader("readfile", name)
+	if err != nil {
+		return nil, err
+	}
+	return r.ReadFile(name)
+}
+
+// ReadDir implements fs.ReadDirFS. Entries for files take precedence over
+// directories with the same name.
+func (o *Overlay) ReadDir(name string) ([]fs.DirEntry, error) {
+	if _, err := o.reader("readdir", name); err != nil {
+		return nil, err
+	}
+	if _, isFile := o.files[name]; isFile {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+	}
+	m := map[string]fs.DirEntry{}
+	for _, r := range o.r {
+		es, err := r.ReadDir(name)
+		if err != nil {
+			continue // not a dir in this vpk
+		}
+		for _, e := range es {
+			if x, ok := m[e.Name()]; !ok || (x.IsDir() && !e.IsDir()) {
+				m[e.Name()] = e
+			}
+		}
+	}
+	for n, e := range m {
+		if !e.IsDir() {
+			m[n] = overlayDirEntry{o, path.Join(name, n)} // ensure it's from the highest-priority vpk
+		}
+	}
+	es := make([]fs.DirEntry, 0, len(m))
+	for _, e := range m {
+		es = append(es, e)
+	}
+	slices.SortFunc(es, func(a, b fs.DirEntry) int {
+		return strings.Compare(a.Name(), b.Name())
+	})
+	return es, nil
+}
+
+type overlayDirEntry struct {
+	o    *Overlay
+	name string
+}
+
+func (e overlayDirEntry) Name() string               { return path.Base(e.name) }
+func (e overlayDirEntry) IsDir() bool                { return false }
+func (e overlayDirEntry) Type() fs.FileMode          { return 0 }
+func (e overlayDirEntry) Info() (fs.FileInfo, error) { return e.o.Stat(e.name) }
+
+// overlayDir wraps a directory from the highest-priority VPK to return the
+// merged entries.
+type overlayDir struct {
+	fs.ReadDirFile
+	es     []fs.DirEntry
+	offset int
+}
+
+func (d *overlayDir) ReadDir(count int) ([]fs.DirEntry, error) {
+	n := len(d.es) - d.offset
+	if n == 0 && count > 0 {
+		return nil, io.EOF
+	}
+	if count > 0 && n > count {
+		n = count
+	}
+	list := d.es[d.offset : d.offset+n]
+	d.offset += n
+	return list, nil
+}
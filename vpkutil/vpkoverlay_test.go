@@ -0,0 +1,59 @@
+package vpkutil
+
+import (
+	"bytes"
+	"testing"
+	"testing/fstest"
+
+	"github.com/pg9182/tf2vpk"
+)
+
+func TestOverlay(t *testing.T) {
+	dir := t.TempDir()
+	for name, files := range map[string][]string{
+		"a": {"common/x.txt", "a.txt", "c.d"},
+		"b": {"common/x.txt", "common/y.txt", "b.txt", "c.d/d.txt"},
+	} {
+		w := tf2vpk.NewWriter(tf2vpk.ValvePakRef{Path: dir, Prefix: "english", Name: name})
+		for _, f := range files {
+			if _, err := w.WriteFile(f, bytes.NewReader([]byte(name+":"+f)), 1, 0); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	vpks, err := FindVPKs(dir, "english")
+	if err != nil {
+		t.Fatal(err)
+	} else if len(vpks) != 2 || vpks[0].Name != "a" || vpks[1].Name != "b" {
+		t.Fatalf("unexpected vpks %+v", vpks)
+	}
+
+	for _, order := range [][]tf2vpk.ValvePakRef{vpks, {vpks[1], vpks[0]}} {
+		o, err := OpenOverlay(order, tf2vpk.Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer o.Close()
+
+		first := order[0].Name
+		if x := o.Lookup("common/x.txt"); len(x) != 2 || x[0].VPK.Name != first {
+			t.Errorf("%s: expected common/x.txt to be provided by %s, got %+v", first, first, x)
+		}
+		if buf, err := o.ReadFile("common/x.txt"); err != nil || string(buf) != first+":common/x.txt" {
+			t.Errorf("%s: unexpected contents %q (err: %v)", first, buf, err)
+		}
+		if fi, err := o.Stat("c.d"); err != nil || fi.IsDir() {
+			t.Errorf("%s: expected c.d to be a file since it takes precedence over dirs (err: %v)", first, err)
+		}
+		if n := len(o.Files()); n != 6 {
+			t.Errorf("%s: expected 6 files, got %d", first, n)
+		}
+		if err := fstest.TestFS(o, "a.txt", "b.txt", "c.d", "common/x.txt", "common/y.txt"); err != nil {
+			t.Errorf("%s: %v", first, err)
+		}
+	}
+}
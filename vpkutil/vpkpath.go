@@ -0,0 +1,219 @@
+package vpkutil
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// UnsafePathPolicy determines what PathSanitizer does with unsafe paths. It
+// implements [pflag.Value].
+type UnsafePathPolicy string
+
+const (
+	UnsafePathReject UnsafePathPolicy = "error"  // fail with an *UnsafePathError
+	UnsafePathSkip   UnsafePathPolicy = "skip"   // don't extract the file
+	UnsafePathRename UnsafePathPolicy = "rename" // replace the unsafe parts of the path
+)
+
+func (p UnsafePathPolicy) String() string {
+	return string(p)
+}
+
+func (p *UnsafePathPolicy) Set(s string) error {
+	switch x := UnsafePathPolicy(s); x {
+	case UnsafePathReject, UnsafePathSkip, UnsafePathRename:
+		*p = x
+		return nil
+	}
+	return fmt.Errorf("must be one of %s, %s, or %s", UnsafePathReject, UnsafePathSkip, UnsafePathRename)
+}
+
+func (p UnsafePathPolicy) Type() string {
+	return "error|skip|rename"
+}
+
+// UnsafePathError is returned by PathSanitizer for unsafe paths.
+type UnsafePathError struct {
+	Path   string
+	Reason string
+}
+
+func (err *UnsafePathError) Error() string {
+	return fmt.Sprintf("unsafe path %q: %s", err.Path, err.Reason)
+}
+
+// PathSanitizer checks VPK file paths before they are extracted to a
+// directory or archive.
+//
+// A path is unsafe if it is absolute, is empty or has empty components, has
+// "." or ".." components, contains backslashes, control characters, invalid
+// UTF-8, or characters not allowed on Windows, or has components which are
+// reserved on Windows (e.g., CON or NUL.txt) or end with a dot or space. It
+// is also unsafe if it is the same as a previous path (or one of its parent
+// directories) when compared case-insensitively.
+type PathSanitizer struct {
+	policy UnsafePathPolicy
+	files  map[string]string   // folded -> path
+	dirs   map[string]struct{} // folded
+}
+
+// NewPathSanitizer creates a new PathSanitizer. If policy is empty, it
+// defaults to UnsafePathReject.
+func NewPathSanitizer(policy UnsafePathPolicy) *PathSanitizer {
+	if policy == "" {
+		policy = UnsafePathReject
+	}
+	return &PathSanitizer{
+		policy: policy,
+		files:  map[string]string{},
+		dirs:   map[string]struct{}{},
+	}
+}
+
+// Reserve marks a slash-separated path as being used by something other than
+// a VPK file (e.g., the .vpkflags file when unpacking).
+func (s *PathSanitizer) Reserve(name string) {
+	s.add(name)
+}
+
+// Sanitize checks the slash-separated path of a VPK file. If it is safe, name
+// is returned as-is. Otherwise, depending on the policy, an *UnsafePathError
+// is returned, an empty string is returned (skip), or the renamed path is
+// returned.
+//
+// Since collisions are checked against previous paths, it must only be called
+// once per file, in a consistent order.
+func (s *PathSanitizer) Sanitize(name string) (string, error) {
+	parts, reason := sanitizePath(name)
+	if reason != "" {
+		switch s.policy {
+		case UnsafePathSkip:
+			return "", nil
+		case UnsafePathRename:
+		default:
+			return "", &UnsafePathError{name, reason}
+		}
+	}
+	for i := range parts {
+		base := parts[i]
+		for n := 1; ; n++ {
+			fold := strings.ToLower(strings.Join(parts[:i+1], "/"))
+			other, isFile := s.files[fold]
+			_, isDir := s.dirs[fold]
+			if !isFile && !(isDir && i == len(parts)-1) {
+				break
+			}
+			switch s.policy {
+			case UnsafePathSkip:
+				return "", nil
+			case UnsafePathRename:
+			default:
+				if !isFile {
+					return "", &UnsafePathError{name, "case-insensitive collision with directory " + strconv.Quote(strings.Join(parts[:i+1], "/"))}
+				}
+				return "", &UnsafePathError{name, "case-insensitive collision with " + strconv.Quote(other)}
+			}
+			ext := path.Ext(base)
+			if ext == base {
+				ext = ""
+			}
+			parts[i] = strings.TrimSuffix(base, ext) + "~" + strconv.Itoa(n) + ext
+		}
+	}
+	safe := strings.Join(parts, "/")
+	if !filepath.IsLocal(filepath.FromSlash(safe)) {
+		// should be impossible, but check anyways since it's cheap
+		return "", &UnsafePathError{name, "not a local path"}
+	}
+	s.add(safe)
+	return safe, nil
+}
+
+func (s *PathSanitizer) add(name string) {
+	fold := strings.ToLower(name)
+	s.files[fold] = name
+	for d := path.Dir(fold); d != "." && d != "/"; d = path.Dir(d) {
+		s.dirs[d] = struct{}{}
+	}
+}
+
+// sanitizePath splits name into components, replacing unsafe ones. If any
+// were replaced, the reason for the first one is returned.
+func sanitizePath(name string) (parts []string, reason string) {
+	unsafe := func(r string) {
+		if reason == "" {
+			reason = r
+		}
+	}
+	if name == "" {
+		return []string{"_"}, "empty path"
+	}
+	if strings.HasPrefix(name, "/") || strings.HasPrefix(name, `\`) {
+		unsafe("absolute path")
+	} else if len(name) >= 2 && name[1] == ':' && ('a' <= name[0]|0x20 && name[0]|0x20 <= 'z') {
+		unsafe("absolute path")
+	}
+	if strings.Contains(name, `\`) {
+		unsafe("contains a backslash")
+	}
+	for _, c := range strings.FieldsFunc(name, func(r rune) bool { return r == '/' || r == '\\' }) {
+		switch c {
+		case ".":
+			unsafe("contains a . component")
+			continue
+		case "..":
+			unsafe("contains a .. component")
+			parts = append(parts, "_")
+			continue
+		}
+		if !utf8.ValidString(c) {
+			unsafe("contains invalid utf-8")
+			c = strings.ToValidUTF8(c, "_")
+		}
+		c = strings.Map(func(r rune) rune {
+			switch {
+			case r < 0x20 || r == 0x7f:
+				unsafe("contains a control character")
+			case strings.ContainsRune(`<>:"|?*`, r):
+				unsafe("contains " + strconv.QuoteRune(r))
+			default:
+				return r
+			}
+			return '_'
+		}, c)
+		if strings.HasSuffix(c, ".") || strings.HasSuffix(c, " ") {
+			unsafe("component ends with a dot or space")
+			c = c[:len(c)-1] + "_"
+		}
+		if isReservedName(c) {
+			unsafe("component " + strconv.Quote(c) + " is reserved on windows")
+			c = "_" + c
+		}
+		parts = append(parts, c)
+	}
+	if len(parts) != strings.Count(strings.ReplaceAll(name, `\`, "/"), "/")+1 {
+		unsafe("contains an empty component")
+	}
+	if len(parts) == 0 {
+		parts = append(parts, "_")
+	}
+	return parts, reason
+}
+
+// isReservedName checks if a path component is a reserved device name on
+// Windows (with or without an extension).
+func isReservedName(c string) bool {
+	c, _, _ = strings.Cut(c, ".")
+	switch c = strings.ToUpper(strings.TrimRight(c, " ")); c {
+	case "CON", "PRN", "AUX", "NUL", "CONIN$", "CONOUT$":
+		return true
+	}
+	if len(c) == 4 && (strings.HasPrefix(c, "COM") || strings.HasPrefix(c, "LPT")) {
+		return '1' <= c[3] && c[3] <= '9'
+	}
+	return false
+}
@@ -0,0 +1,99 @@
+package vpkutil
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestPathSanitizer(t *testing.T) {
+	for _, tc := range []struct {
+		Path   string
+		Unsafe bool
+		Rename string
+	}{
+		{"a.txt", false, "a.txt"},
+		{"scripts/vscripts/a.nut", false, "scripts/vscripts/a.nut"},
+		{"...nut", false, "...nut"},
+		{"", true, "_"},
+		{"/etc/passwd", true, "etc/passwd"},
+		{"C:/x.txt", true, "C_/x.txt"},
+		{`a\..\..\b.txt`, true, "a/_/_/b.txt"},
+		{"../../b.txt", true, "_/_/b.txt"},
+		{"a/./b.txt", true, "a/b.txt"},
+		{"a//b.txt", true, "a/b.txt"},
+		{"a/", true, "a"},
+		{"a\x00.txt", true, "a_.txt"},
+		{"a\xff.txt", true, "a_.txt"},
+		{"a?.txt", true, "a_.txt"},
+		{"a/b. ", true, "a/b._"},
+		{"con", true, "_con"},
+		{"x/Nul.tar.gz", true, "x/_Nul.tar.gz"},
+		{"com1.txt", true, "_com1.txt"},
+		{"com0.txt", false, "com0.txt"},
+		{"console.txt", false, "console.txt"},
+	} {
+		for _, policy := range []UnsafePathPolicy{UnsafePathReject, UnsafePathSkip, UnsafePathRename} {
+			s := NewPathSanitizer(policy)
+			safe, err := s.Sanitize(tc.Path)
+			if err != nil {
+				var uerr *UnsafePathError
+				if !errors.As(err, &uerr) {
+					t.Errorf("%s: %q: unexpected error type %T", policy, tc.Path, err)
+				} else if !tc.Unsafe || policy != UnsafePathReject {
+					t.Errorf("%s: %q: unexpected error: %v", policy, tc.Path, err)
+				}
+				continue
+			}
+			var exp string
+			switch {
+			case !tc.Unsafe:
+				exp = tc.Path
+			case policy == UnsafePathReject:
+				t.Errorf("%s: %q: expected error", policy, tc.Path)
+				continue
+			case policy == UnsafePathRename:
+				exp = tc.Rename
+			}
+			if safe != exp {
+				t.Errorf("%s: %q: expected %q, got %q", policy, tc.Path, exp, safe)
+			}
+		}
+	}
+}
+
+func TestPathSanitizerCollision(t *testing.T) {
+	paths := []string{"a/b.txt", "A/B.TXT", "a/B.txt", "a", "a/b.txt/c", "x", "x/y", ".vpkflags", ".VPKFlags"}
+
+	s := NewPathSanitizer(UnsafePathRename)
+	s.Reserve(".vpkflags")
+	var act []string
+	for _, p := range paths {
+		safe, err := s.Sanitize(p)
+		if err != nil {
+			t.Fatalf("%q: unexpected error: %v", p, err)
+		}
+		act = append(act, safe)
+	}
+	exp := []string{"a/b.txt", "A/B~1.TXT", "a/B~2.txt", "a~1", "a/b~3.txt/c", "x", "x~1/y", ".vpkflags~1", ".VPKFlags~2"}
+	for i := range exp {
+		if act[i] != exp[i] {
+			t.Errorf("%q: expected %q, got %q", paths[i], exp[i], act[i])
+		}
+	}
+
+	s = NewPathSanitizer(UnsafePathReject)
+	for i, p := range paths[:2] {
+		if _, err := s.Sanitize(p); (err != nil) != (i == 1) {
+			t.Errorf("%q: unexpected error state: %v", p, err)
+		}
+	}
+
+	s = NewPathSanitizer(UnsafePathSkip)
+	for i, p := range paths[:2] {
+		if safe, err := s.Sanitize(p); err != nil {
+			t.Errorf("%q: unexpected error: %v", p, err)
+		} else if (safe == "") != (i == 1) {
+			t.Errorf("%q: unexpected result %q", p, safe)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package vpkutil
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pg9182/tf2vpk/internal"
+)
+
+// SplitRule assigns files matching any of the globs (or under a directory
+// matching one) to the VPK with the specified name. A rule without any globs
+// matches all files.
+type SplitRule struct {
+	Name string
+	Glob []string
+}
+
+// ParseSplitRule parses a rule in the form name=glob[,glob...].
+func ParseSplitRule(s string) (SplitRule, error) {
+	name, globs, ok := strings.Cut(s, "=")
+	if !ok || name == "" || globs == "" {
+		return SplitRule{}, fmt.Errorf("invalid rule %q: expected name=glob[,glob...]", s)
+	}
+	if strings.ContainsAny(name, `/\`) {
+		return SplitRule{}, fmt.Errorf("invalid rule %q: invalid vpk name %q", s, name)
+	}
+	return SplitRule{name, strings.Split(globs, ",")}, nil
+}
+
+// MatchSplitRules returns the index of the first rule matching name, or -1 if
+// none match.
+func MatchSplitRules(rules []SplitRule, name string) (int, error) {
+	for i, rule := range rules {
+		if rule.Glob == nil {
+			return i, nil
+		}
+		for _, glob := range rule.Glob {
+			if m, err := internal.MatchGlobParents(glob, name); err != nil {
+				return -1, fmt.Errorf("match %q against glob %q for vpk %q: %w", name, glob, rule.Name, err)
+			} else if m {
+				return i, nil
+			}
+		}
+	}
+	return -1, nil
+}
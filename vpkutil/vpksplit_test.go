@@ -0,0 +1,138 @@
+package vpkutil
+
+import (
+	"bytes"
+	"context"
+	"slices"
+	"testing"
+
+	"github.com/pg9182/tf2vpk"
+)
+
+func TestParseSplitRule(t *testing.T) {
+	for _, x := range []struct {
+		Rule string
+		Name string
+		Glob []string
+	}{
+		{"maps=maps", "maps", []string{"maps"}},
+		{"scripts=scripts/vscripts,*.nut", "scripts", []string{"scripts/vscripts", "*.nut"}},
+		{"a=b=c", "a", []string{"b=c"}},
+		{"maps", "", nil},
+		{"=maps", "", nil},
+		{"maps=", "", nil},
+		{"a/b=maps", "", nil},
+	} {
+		r, err := ParseSplitRule(x.Rule)
+		if x.Glob == nil {
+			if err == nil {
+				t.Errorf("parse %q: expected error", x.Rule)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parse %q: unexpected error: %v", x.Rule, err)
+		} else if r.Name != x.Name || !slices.Equal(r.Glob, x.Glob) {
+			t.Errorf("parse %q: expected %s %q, got %s %q", x.Rule, x.Name, x.Glob, r.Name, r.Glob)
+		}
+	}
+}
+
+func TestMatchSplitRules(t *testing.T) {
+	rules := []SplitRule{
+		{"sounds", []string{"sound", "*.wav"}},
+		{"scripts", []string{"scripts/vscripts"}},
+		{"all_scripts", []string{"scripts"}},
+	}
+	for _, x := range []struct {
+		Name  string
+		Index int
+	}{
+		{"sound/a.wav", 0},
+		{"scripts/b.wav", 0}, // first match wins
+		{"scripts/vscripts/a.nut", 1},
+		{"scripts/kb_act.lst", 2},
+		{"materials/a.vmt", -1},
+	} {
+		if i, err := MatchSplitRules(rules, x.Name); err != nil {
+			t.Errorf("match %q: unexpected error: %v", x.Name, err)
+		} else if i != x.Index {
+			t.Errorf("match %q: expected rule %d, got %d", x.Name, x.Index, i)
+		}
+	}
+
+	rules = append(rules, SplitRule{Name: "remainder"})
+	if i, err := MatchSplitRules(rules, "materials/a.vmt"); err != nil || i != 3 {
+		t.Errorf("match with remainder: expected rule 3, got %d (err %v)", i, err)
+	}
+	if _, err := MatchSplitRules([]SplitRule{{"bad", []string{"["}}}, "a"); err == nil {
+		t.Errorf("expected error for invalid glob")
+	}
+}
+
+func TestSplit(t *testing.T) {
+	dir := t.TempDir()
+	vpk := tf2vpk.ValvePakRef{Path: dir, Prefix: "english", Name: "test"}
+
+	files := map[string][]byte{
+		"scripts/a.nut": bytes.Repeat([]byte("a"), 1000),
+		"scripts/b.nut": bytes.Repeat([]byte("a"), 1000),
+		"maps/c.bsp":    bytes.Repeat([]byte("c"), 1000),
+	}
+	w := tf2vpk.NewWriter(vpk)
+	for _, name := range []string{"maps/c.bsp", "scripts/a.nut", "scripts/b.nut"} {
+		if _, err := w.WriteFile(name, bytes.NewReader(files[name]), 1, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := tf2vpk.NewReader(vpk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	rules := []SplitRule{
+		{"scripts", []string{"*.nut"}},
+		{Name: "rest"},
+	}
+	split := make([][]CopyFile, len(rules))
+	for _, f := range r.Root.File {
+		i, err := MatchSplitRules(rules, f.Path)
+		if err != nil || i == -1 {
+			t.Fatalf("match %q: got %d (err %v)", f.Path, i, err)
+		}
+		split[i] = append(split[i], CopyFile{Reader: r, File: f})
+	}
+	for i, rule := range rules {
+		out := tf2vpk.ValvePakRef{Path: dir, Prefix: "english", Name: rule.Name}
+		if _, err := CreateVPK(out, tf2vpk.Options{}, false, func(w *tf2vpk.Writer) error {
+			res, err := CopyChunks(context.Background(), w, 0, split[i])
+			if err == nil && rule.Name == "scripts" && res.Duplicate != 1 {
+				t.Errorf("expected the identical chunk to be de-duplicated, got %+v", res)
+			}
+			return err
+		}); err != nil {
+			t.Fatalf("create vpk %q: %v", rule.Name, err)
+		}
+
+		sr, err := tf2vpk.NewReader(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer sr.Close()
+		if len(sr.Root.File) != len(split[i]) {
+			t.Errorf("vpk %q: expected %d files, got %d", rule.Name, len(split[i]), len(sr.Root.File))
+		}
+		for _, f := range split[i] {
+			if buf, err := sr.ReadFile(f.File.Path); err != nil {
+				t.Errorf("vpk %q: read %q: %v", rule.Name, f.File.Path, err)
+			} else if !bytes.Equal(buf, files[f.File.Path]) {
+				t.Errorf("vpk %q: read %q: incorrect contents", rule.Name, f.File.Path)
+			}
+		}
+	}
+}
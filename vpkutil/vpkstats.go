@@ -0,0 +1,244 @@
+package vpkutil
+
+import (
+	"cmp"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/pg9182/tf2vpk"
+	"github.com/pg9182/tf2vpk/internal"
+)
+
+// StatsSize is the number of items and their total size.
+type StatsSize struct {
+	Count        int    `json:"count"`
+	Compressed   uint64 `json:"compressed"`
+	Uncompressed uint64 `json:"uncompressed"`
+}
+
+func (s *StatsSize) add(compressed, uncompressed uint64) {
+	s.Count++
+	s.Compressed += compressed
+	s.Uncompressed += uncompressed
+}
+
+func (s *StatsSize) merge(o StatsSize) {
+	s.Count += o.Count
+	s.Compressed += o.Compressed
+	s.Uncompressed += o.Uncompressed
+}
+
+// StatsBlock contains statistics about the space used in a block.
+type StatsBlock struct {
+	Block        string `json:"block"`                  // the block index (or "all" for the totals)
+	Unreferenced bool   `json:"unreferenced,omitempty"` // if the block exists, but isn't referenced by the dir
+
+	Size   uint64 `json:"size"`   // bytes of chunk data in the block
+	Unused uint64 `json:"unused"` // bytes not referenced by any chunk
+
+	Chunks           StatsSize         `json:"chunks"`            // distinct chunks
+	ChunksCompressed StatsSize         `json:"chunks_compressed"` // distinct compressed chunks
+	ChunksStored     StatsSize         `json:"chunks_stored"`     // distinct uncompressed chunks
+	ChunksByReuse    map[int]StatsSize `json:"chunks_by_reuse"`   // distinct chunks by the number of files referencing them
+
+	Files      StatsSize            `json:"files"`        // files (chunks shared between files are counted for each)
+	FilesByDir map[string]StatsSize `json:"files_by_dir"` // files by top-level directory ("." for the root)
+	FilesByExt map[string]StatsSize `json:"files_by_ext"` // files by extension
+}
+
+func newStatsBlock(name string) StatsBlock {
+	return StatsBlock{
+		Block:         name,
+		ChunksByReuse: map[int]StatsSize{},
+		FilesByDir:    map[string]StatsSize{},
+		FilesByExt:    map[string]StatsSize{},
+	}
+}
+
+// Used returns the number of bytes referenced by at least one chunk.
+func (b StatsBlock) Used() uint64 {
+	return b.Size - b.Unused
+}
+
+func (b *StatsBlock) merge(o StatsBlock) {
+	b.Size += o.Size
+	b.Unused += o.Unused
+	b.Chunks.merge(o.Chunks)
+	b.ChunksCompressed.merge(o.ChunksCompressed)
+	b.ChunksStored.merge(o.ChunksStored)
+	for k, v := range o.ChunksByReuse {
+		x := b.ChunksByReuse[k]
+		x.merge(v)
+		b.ChunksByReuse[k] = x
+	}
+	b.Files.merge(o.Files)
+	for k, v := range o.FilesByDir {
+		x := b.FilesByDir[k]
+		x.merge(v)
+		b.FilesByDir[k] = x
+	}
+	for k, v := range o.FilesByExt {
+		x := b.FilesByExt[k]
+		x.merge(v)
+		b.FilesByExt[k] = x
+	}
+}
+
+// Stats contains statistics about the space used by a VPK.
+type Stats struct {
+	DirSize uint64       `json:"dir_size"` // size of the dir index (excluding chunk data stored after it)
+	Blocks  []StatsBlock `json:"blocks"`   // sorted by index
+	Total   StatsBlock   `json:"total"`
+}
+
+// ComputeStats computes statistics about the space used by the VPK opened by
+// r. Only blocks referenced by the dir are included (see ComputeStatsVPK). Block sizes are determined using [tf2vpk.Reader.OpenBlockRaw] if possible,
+// or the end of the last chunk otherwise.
+func ComputeStats(r *tf2vpk.Reader) (*Stats, error) {
+	dirSize, err := r.Root.ChunkOffset()
+	if err != nil {
+		return nil, fmt.Errorf("compute dir size: %w", err)
+	}
+
+	type chunkKey struct {
+		Index  tf2vpk.ValvePakIndex
+		Offset uint64
+		Size   uint64
+	}
+	var (
+		blocks = map[tf2vpk.ValvePakIndex]*StatsBlock{}
+		ranges = map[tf2vpk.ValvePakIndex]*internal.RangeSet{}
+		chunks = map[chunkKey]tf2vpk.ValvePakChunk{}
+		reuse  = map[chunkKey]int{}
+	)
+	for _, f := range r.Root.File {
+		b, ok := blocks[f.Index]
+		if !ok {
+			x := newStatsBlock(f.Index.String())
+			b = &x
+			blocks[f.Index] = b
+			ranges[f.Index] = new(internal.RangeSet)
+		}
+
+		var compressed, uncompressed uint64
+		seen := map[chunkKey]struct{}{}
+		for _, c := range f.Chunk {
+			k := chunkKey{f.Index, c.Offset, c.CompressedSize}
+			if _, ok := seen[k]; !ok {
+				seen[k] = struct{}{}
+				reuse[k]++
+			}
+			chunks[k] = c
+			ranges[f.Index].Add(c.Offset, c.Offset+c.CompressedSize)
+			compressed += c.CompressedSize
+			uncompressed += c.UncompressedSize
+		}
+
+		dir, _, ok := strings.Cut(f.Path, "/")
+		if !ok {
+			dir = "."
+		}
+		ext := strings.TrimPrefix(path.Ext(f.Path), ".")
+
+		b.Files.add(compressed, uncompressed)
+		x := b.FilesByDir[dir]
+		x.add(compressed, uncompressed)
+		b.FilesByDir[dir] = x
+		x = b.FilesByExt[ext]
+		x.add(compressed, uncompressed)
+		b.FilesByExt[ext] = x
+	}
+	for k, c := range chunks {
+		b := blocks[k.Index]
+		b.Chunks.add(c.CompressedSize, c.UncompressedSize)
+		if c.IsCompressed() {
+			b.ChunksCompressed.add(c.CompressedSize, c.UncompressedSize)
+		} else {
+			b.ChunksStored.add(c.CompressedSize, c.UncompressedSize)
+		}
+		x := b.ChunksByReuse[reuse[k]]
+		x.add(c.CompressedSize, c.UncompressedSize)
+		b.ChunksByReuse[reuse[k]] = x
+	}
+
+	s := &Stats{
+		DirSize: uint64(dirSize),
+		Total:   newStatsBlock("all"),
+	}
+	idx := make([]tf2vpk.ValvePakIndex, 0, len(blocks))
+	for i := range blocks {
+		idx = append(idx, i)
+	}
+	slices.Sort(idx)
+	for _, i := range idx {
+		b := blocks[i]
+		used := ranges[i].Len()
+		b.Size = used
+		if rs := ranges[i].Ranges(); len(rs) != 0 {
+			b.Size = rs[len(rs)-1].End
+		}
+		if x, err := r.OpenBlockRaw(i); err != nil {
+			return nil, fmt.Errorf("open block %s: %w", i, err)
+		} else if x, ok := x.(interface{ Size() int64 }); ok {
+			b.Size = max(b.Size, uint64(x.Size()))
+		}
+		b.Unused = b.Size - used
+		s.Blocks = append(s.Blocks, *b)
+	}
+	for _, b := range s.Blocks {
+		s.Total.merge(b)
+	}
+	return s, nil
+}
+
+// ComputeStatsVPK is like ComputeStats, but also includes blocks of vpk which
+// exist, but aren't referenced by the dir (e.g., ones left behind after
+// removing files), as completely unused.
+func ComputeStatsVPK(vpk tf2vpk.ValvePakRef, r *tf2vpk.Reader) (*Stats, error) {
+	s, err := ComputeStats(r)
+	if err != nil {
+		return nil, err
+	}
+
+	names, err := vpk.List()
+	if err != nil {
+		return nil, fmt.Errorf("list vpk blocks: %w", err)
+	}
+	var extra bool
+	for _, name := range names {
+		_, i, err := tf2vpk.SplitName(name, vpk.Prefix)
+		if err != nil || i == tf2vpk.ValvePakIndexDir {
+			continue
+		}
+		if slices.ContainsFunc(r.Root.File, func(f tf2vpk.ValvePakFile) bool {
+			return f.Index == i
+		}) {
+			continue
+		}
+		fi, err := os.Stat(filepath.Join(vpk.Path, name))
+		if err != nil {
+			return nil, fmt.Errorf("stat vpk block %s: %w", i, err)
+		}
+		b := newStatsBlock(i.String())
+		b.Unreferenced = true
+		b.Size = uint64(fi.Size())
+		b.Unused = b.Size
+		s.Blocks = append(s.Blocks, b)
+		s.Total.Size += b.Size
+		s.Total.Unused += b.Unused
+		extra = true
+	}
+	if extra {
+		slices.SortStableFunc(s.Blocks, func(a, b StatsBlock) int {
+			if len(a.Block) != len(b.Block) {
+				return cmp.Compare(len(a.Block), len(b.Block)) // numeric
+			}
+			return strings.Compare(a.Block, b.Block)
+		})
+	}
+	return s, nil
+}
@@ -0,0 +1,93 @@
+package vpkutil
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"slices"
+	"testing"
+
+	"github.com/pg9182/tf2vpk"
+)
+
+func TestStats(t *testing.T) {
+	rng := rand.New(rand.NewSource(0))
+
+	vpk := tf2vpk.ValvePakRef{Path: t.TempDir(), Prefix: "english", Name: "test"}
+	data := make([]byte, 1<<20+1000)
+	rng.Read(data) // incompressible, so the chunks are stored
+
+	w := tf2vpk.NewWriter(vpk)
+	a, err := w.WriteFile("bin/a.bin", bytes.NewReader(data), 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.WriteFile("b.txt", bytes.NewReader(bytes.Repeat([]byte("test\n"), 1000)), 1, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := UpdateDir(vpk, false, func(root *tf2vpk.ValvePakDir) error {
+		root.File = append(root.File, tf2vpk.ValvePakFile{
+			Path:  "bin/shared.bin",
+			Index: a.Index,
+			Chunk: a.Chunk[1:],
+		})
+		root.File = slices.DeleteFunc(root.File, func(f tf2vpk.ValvePakFile) bool {
+			return f.Path == "b.txt"
+		})
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := tf2vpk.NewReader(vpk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	s, err := ComputeStats(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Blocks) != 1 {
+		t.Fatalf("expected one block, got %d", len(s.Blocks))
+	}
+	b := s.Blocks[0]
+	if b.Chunks.Count != 2 || b.ChunksStored.Count != 2 || b.ChunksCompressed.Count != 0 {
+		t.Errorf("expected two stored chunks, got %+v", b)
+	}
+	if x := b.ChunksByReuse[2]; x.Count != 1 || x.Compressed != 1000 {
+		t.Errorf("expected the last chunk to be shared, got %+v", b.ChunksByReuse)
+	}
+	if b.Used() != uint64(len(data)) || b.Unused == 0 {
+		t.Errorf("expected only the removed b.txt to be unused, got size %d unused %d", b.Size, b.Unused)
+	}
+	if x := b.FilesByDir["bin"]; x.Count != 2 || x.Uncompressed != uint64(len(data))+1000 {
+		t.Errorf("expected both files in bin, got %+v", b.FilesByDir)
+	}
+	if x := b.FilesByExt["bin"]; x.Count != 2 {
+		t.Errorf("expected both files with the bin extension, got %+v", b.FilesByExt)
+	}
+	if s.Total.Size != b.Size || s.Total.Files != b.Files {
+		t.Errorf("expected totals to match the only block, got %+v", s.Total)
+	}
+
+	if err := os.WriteFile(vpk.Resolve(2), make([]byte, 1234), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if s, err = ComputeStatsVPK(vpk, r); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Blocks) != 2 {
+		t.Fatalf("expected two blocks, got %d", len(s.Blocks))
+	}
+	if x := s.Blocks[1]; x.Block != "002" || !x.Unreferenced || x.Size != 1234 || x.Unused != 1234 {
+		t.Errorf("expected unreferenced block 002 to be completely unused, got %+v", x)
+	}
+	if s.Total.Size != b.Size+1234 || s.Total.Unused != b.Unused+1234 {
+		t.Errorf("expected totals to include the unreferenced block, got %+v", s.Total)
+	}
+}
@@ -0,0 +1,301 @@
+package vpkutil
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"slices"
+	"strings"
+
+	"github.com/pg9182/tf2vpk"
+)
+
+// StatusKind is the type of change to a file in an unpacked directory.
+type StatusKind string
+
+const (
+	StatusAdded    StatusKind = "added"
+	StatusDeleted  StatusKind = "deleted"
+	StatusModified StatusKind = "modified"
+	StatusFlags    StatusKind = "flags" // only the flags from the vpkflags changed
+)
+
+// StatusFile contains the metadata of a file compared by Status.
+type StatusFile struct {
+	CRC32        uint32 `json:"crc32"`
+	Size         uint64 `json:"size"` // uncompressed
+	LoadFlags    uint32 `json:"load_flags"`
+	TextureFlags uint16 `json:"texture_flags"`
+}
+
+// StatusEntry is a changed file.
+type StatusEntry struct {
+	Path  string      `json:"path"`
+	Kind  StatusKind  `json:"kind"`
+	VPK   *StatusFile `json:"vpk,omitempty"`   // nil if added
+	Local *StatusFile `json:"local,omitempty"` // nil if deleted
+}
+
+// Changed returns the names of the metadata fields which differ (i.e., crc32,
+// size, load_flags, texture_flags) between VPK and Local.
+func (e StatusEntry) Changed() []string {
+	var c []string
+	if e.VPK != nil && e.Local != nil {
+		if e.VPK.CRC32 != e.Local.CRC32 {
+			c = append(c, "crc32")
+		}
+		if e.VPK.Size != e.Local.Size {
+			c = append(c, "size")
+		}
+		if e.VPK.LoadFlags != e.Local.LoadFlags {
+			c = append(c, "load_flags")
+		}
+		if e.VPK.TextureFlags != e.Local.TextureFlags {
+			c = append(c, "texture_flags")
+		}
+	}
+	return c
+}
+
+// Status compares the files in fsys (e.g., a directory created by the unpack
+// command) against the files in the VPK dir index, returning the changes sorted
+// by path.
+//
+// Files matching the VPKIgnore in fsys are treated as if they didn't exist.
+// Files are compared by their size and CRC32, and, if fsys contains a VPKFlags,
+// the flags it yields for them. If skip is not nil, files for which it returns
+// true are not compared.
+func Status(root tf2vpk.ValvePakDir, fsys fs.FS, skip func(tf2vpk.ValvePakFile) (bool, error)) ([]StatusEntry, error) {
+	var vpkflags *VPKFlags
+	if buf, err := fs.ReadFile(fsys, VPKFlagsFilename); err == nil {
+		vpkflags = new(VPKFlags)
+		if err := vpkflags.Parse(string(buf)); err != nil {
+			return nil, fmt.Errorf("read %s: %w", VPKFlagsFilename, err)
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("read %s: %w", VPKFlagsFilename, err)
+	}
+
+	var vpkignore VPKIgnore
+	if buf, err := fs.ReadFile(fsys, VPKIgnoreFilename); err == nil {
+		if err := vpkignore.Parse(string(buf)); err != nil {
+			return nil, fmt.Errorf("read %s: %w", VPKIgnoreFilename, err)
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("read %s: %w", VPKIgnoreFilename, err)
+	}
+
+	vf := make(map[string]*StatusFile, len(root.File))
+	for _, f := range root.File {
+		if skip != nil {
+			if s, err := skip(f); err != nil {
+				return nil, err
+			} else if s {
+				continue
+			}
+		}
+		load, err := f.LoadFlags()
+		if err != nil {
+			return nil, fmt.Errorf("compute load flags for %q: %w", f.Path, err)
+		}
+		texture, err := f.TextureFlags()
+		if err != nil {
+			return nil, fmt.Errorf("compute texture flags for %q: %w", f.Path, err)
+		}
+		x := &StatusFile{
+			CRC32:        f.CRC32,
+			LoadFlags:    load,
+			TextureFlags: texture,
+			Size:         f.Size(),
+		}
+		vf[f.Path] = x
+	}
+
+	var (
+		es   []StatusEntry
+		seen = map[string]bool{}
+	)
+	if err := fs.WalkDir(fsys, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == "." {
+			return nil
+		}
+		if p == VPKFlagsFilename || p == VPKIgnoreFilename || p == VPKLayoutFilename || vpkignore.Match(p) {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			return nil
+		}
+		if skip != nil {
+			if s, err := skip(tf2vpk.ValvePakFile{Path: p}); err != nil {
+				return err
+			} else if s {
+				return nil
+			}
+		}
+		seen[p] = true
+
+		x, err := statusFile(fsys, p)
+		if err != nil {
+			return err
+		}
+		y, ok := vf[p]
+		if !ok {
+			if vpkflags != nil {
+				x.LoadFlags, x.TextureFlags = vpkflags.Match(p)
+			}
+			es = append(es, StatusEntry{Path: p, Kind: StatusAdded, Local: x})
+			return nil
+		}
+		if vpkflags != nil {
+			x.LoadFlags, x.TextureFlags = vpkflags.Match(p)
+		} else {
+			x.LoadFlags, x.TextureFlags = y.LoadFlags, y.TextureFlags
+		}
+		switch {
+		case x.CRC32 != y.CRC32 || x.Size != y.Size:
+			es = append(es, StatusEntry{Path: p, Kind: StatusModified, VPK: y, Local: x})
+		case *x != *y:
+			es = append(es, StatusEntry{Path: p, Kind: StatusFlags, VPK: y, Local: x})
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	for p, y := range vf {
+		if !seen[p] {
+			es = append(es, StatusEntry{Path: p, Kind: StatusDeleted, VPK: y})
+		}
+	}
+	slices.SortFunc(es, func(a, b StatusEntry) int {
+		return strings.Compare(a.Path, b.Path)
+	})
+	return es, nil
+}
+
+// statusFile computes the size and CRC32 of a file.
+func statusFile(fsys fs.FS, name string) (*StatusFile, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	crc := tf2vpk.NewCRC()
+	n, err := io.Copy(crc, f)
+	if err != nil {
+		return nil, fmt.Errorf("read %q: %w", name, err)
+	}
+	return &StatusFile{
+		CRC32: crc.Sum32(),
+		Size:  uint64(n),
+	}, nil
+}
+
+// UpdateOptions configures Update.
+type UpdateOptions struct {
+	// Index is the block to append the chunks of added and modified files to.
+	Index tf2vpk.ValvePakIndex
+
+	// Skip, if set, is called to determine whether to exclude a file (see
+	// Status).
+	Skip func(tf2vpk.ValvePakFile) (bool, error)
+
+	// Threads is the number of chunks to compress in parallel.
+	Threads int
+
+	// DryRun computes the result without writing anything.
+	DryRun bool
+
+	// Progress, if set, is called after each change is applied, with the new
+	// file for added and modified files.
+	Progress func(StatusEntry, *tf2vpk.ValvePakFile)
+
+	// VPK is used for reading and writing the VPK.
+	VPK tf2vpk.Options
+}
+
+// UpdateResult contains statistics about an updated VPK.
+type UpdateResult struct {
+	Added    int    // number of files added
+	Deleted  int    // number of files deleted
+	Modified int    // number of files replaced
+	Flags    int    // number of files where only the flags were changed
+	Written  uint64 // total size of the chunks written
+}
+
+// Update updates the VPK in-place to match the files in fsys, which are
+// compared like Status. The chunks of added and modified files are appended to
+// UpdateOptions.Index, deleted files are removed from the dir index, and the
+// flags of files where only the flags changed are updated. The chunks of
+// replaced and deleted files are left as-is (see GC).
+func Update(vpk tf2vpk.ValvePakRef, fsys fs.FS, opt UpdateOptions) (UpdateResult, error) {
+	var res UpdateResult
+	err := AppendFiles(vpk, opt.VPK, opt.DryRun, func(dir *tf2vpk.ValvePakDir, w *tf2vpk.Writer) error {
+		es, err := Status(*dir, fsys, opt.Skip)
+		if err != nil {
+			return fmt.Errorf("compare directory: %w", err)
+		}
+		if err := w.SetIndex(opt.Index); err != nil {
+			return err
+		}
+		for _, e := range es {
+			var vf *tf2vpk.ValvePakFile
+			switch e.Kind {
+			case StatusDeleted:
+				dir.File = slices.DeleteFunc(dir.File, func(f tf2vpk.ValvePakFile) bool {
+					return f.Path == e.Path
+				})
+				res.Deleted++
+
+			case StatusFlags:
+				for i, f := range dir.File {
+					if f.Path == e.Path {
+						for j := range f.Chunk {
+							dir.File[i].Chunk[j].LoadFlags = e.Local.LoadFlags
+							dir.File[i].Chunk[j].TextureFlags = e.Local.TextureFlags
+						}
+					}
+				}
+				res.Flags++
+
+			case StatusAdded, StatusModified:
+				f, err := updateFile(w, fsys, e, opt.Threads)
+				if err != nil {
+					return fmt.Errorf("pack %q: %w", e.Path, err)
+				}
+				for _, c := range f.Chunk {
+					res.Written += c.CompressedSize
+				}
+				if e.Kind == StatusAdded {
+					res.Added++
+				} else {
+					res.Modified++
+				}
+				vf = &f
+			}
+			if opt.Progress != nil {
+				opt.Progress(e, vf)
+			}
+		}
+		return nil
+	})
+	return res, err
+}
+
+// updateFile writes the local file for e.
+func updateFile(w *tf2vpk.Writer, fsys fs.FS, e StatusEntry, n int) (tf2vpk.ValvePakFile, error) {
+	f, err := fsys.Open(e.Path)
+	if err != nil {
+		return tf2vpk.ValvePakFile{}, err
+	}
+	defer f.Close()
+
+	return w.WriteFileParallel(e.Path, f, e.Local.LoadFlags, e.Local.TextureFlags, n)
+}
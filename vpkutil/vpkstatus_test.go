@@ -0,0 +1,157 @@
+package vpkutil
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"testing/fstest"
+
+	"github.com/pg9182/tf2vpk"
+)
+
+func TestStatus(t *testing.T) {
+	w := tf2vpk.NewWriterFunc(memBlock(map[tf2vpk.ValvePakIndex]*bytes.Buffer{}))
+	for _, name := range []string{"a.txt", "b/c.nut", "b/d.nut", "e.txt", "f.txt", "g.txt"} {
+		if _, err := w.WriteFile(name, bytes.NewReader([]byte(name)), 1, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	fsys := fstest.MapFS{
+		VPKFlagsFilename:  &fstest.MapFile{Data: []byte("00000000000000000000000000000001 0000000000000000 /\n00000000000000000000000100000001 0000000000000000 e.txt\n")},
+		VPKIgnoreFilename: &fstest.MapFile{Data: []byte("*.bak\n")},
+		"a.txt":           &fstest.MapFile{Data: []byte("a.txt")},                // unchanged
+		"b/c.nut":         &fstest.MapFile{Data: []byte("modified")},             // modified
+		"e.txt":           &fstest.MapFile{Data: []byte("e.txt")},                // flags
+		"f.txt":           &fstest.MapFile{Data: []byte("f.tx!")},                // modified (same size)
+		"g.txt":           &fstest.MapFile{Data: []byte("g.txt")},                // excluded
+		"h.txt":           &fstest.MapFile{Data: []byte("h.txt")},                // added
+		"i.bak":           &fstest.MapFile{Data: []byte("ignored")},              // ignored
+		"j/k.bak/l.txt":   &fstest.MapFile{Data: []byte("ignored (parent dir)")}, // ignored
+	}
+	es, err := Status(w.Root, fsys, func(f tf2vpk.ValvePakFile) (bool, error) {
+		return f.Path == "g.txt", nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	exp := []struct {
+		Path string
+		Kind StatusKind
+	}{
+		{"b/c.nut", StatusModified},
+		{"b/d.nut", StatusDeleted},
+		{"e.txt", StatusFlags},
+		{"f.txt", StatusModified},
+		{"h.txt", StatusAdded},
+	}
+	if len(es) != len(exp) {
+		t.Fatalf("expected %d changes, got %v", len(exp), es)
+	}
+	for i, e := range es {
+		if e.Path != exp[i].Path || e.Kind != exp[i].Kind {
+			t.Errorf("expected %s %s, got %s %s", exp[i].Kind, exp[i].Path, e.Kind, e.Path)
+		}
+	}
+	if c := es[2].Changed(); len(c) != 1 || c[0] != "load_flags" {
+		t.Errorf("expected only load flags to change for e.txt, got %v", c)
+	}
+	if c := es[3].Changed(); len(c) != 1 || c[0] != "crc32" {
+		t.Errorf("expected only crc32 to change for f.txt, got %v", c)
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	vpk := tf2vpk.ValvePakRef{Path: t.TempDir(), Prefix: "english", Name: "test"}
+
+	w := tf2vpk.NewWriter(vpk)
+	for _, name := range []string{"a.txt", "b/c.nut", "b/d.nut", "e.txt", "g.txt"} {
+		if _, err := w.WriteFile(name, bytes.NewReader([]byte(name)), 1, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	fsys := fstest.MapFS{
+		VPKFlagsFilename: &fstest.MapFile{Data: []byte("00000000000000000000000000000001 0000000000000000 /\n00000000000000000000000100000001 0000000000000000 e.txt\n")},
+		"a.txt":          &fstest.MapFile{Data: []byte("a.txt")},                            // unchanged
+		"b/c.nut":        &fstest.MapFile{Data: bytes.Repeat([]byte("modified\n"), 100000)}, // modified
+		"e.txt":          &fstest.MapFile{Data: []byte("e.txt")},                            // flags
+		"h/i.txt":        &fstest.MapFile{Data: []byte("added")},                            // added
+	}
+	skip := func(f tf2vpk.ValvePakFile) (bool, error) {
+		return f.Path == "g.txt", nil // excluded, so not deleted
+	}
+
+	orig, err := os.ReadFile(vpk.Resolve(tf2vpk.ValvePakIndexDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res, err := Update(vpk, fsys, UpdateOptions{Index: 1, Skip: skip, DryRun: true}); err != nil {
+		t.Fatalf("update (dry run): %v", err)
+	} else if res.Added != 1 || res.Deleted != 1 || res.Modified != 1 || res.Flags != 1 {
+		t.Errorf("update (dry run): unexpected result %+v", res)
+	}
+	if buf, err := os.ReadFile(vpk.Resolve(tf2vpk.ValvePakIndexDir)); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(buf, orig) {
+		t.Errorf("update (dry run): dir was modified")
+	}
+
+	var progress []string
+	res, err := Update(vpk, fsys, UpdateOptions{
+		Index: 1,
+		Skip:  skip,
+		Progress: func(e StatusEntry, f *tf2vpk.ValvePakFile) {
+			if (f != nil) != (e.Kind == StatusAdded || e.Kind == StatusModified) {
+				t.Errorf("progress %s %s: unexpected file %v", e.Kind, e.Path, f)
+			}
+			progress = append(progress, e.Path)
+		},
+	})
+	if err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	if res.Added != 1 || res.Deleted != 1 || res.Modified != 1 || res.Flags != 1 || res.Written == 0 {
+		t.Errorf("update: unexpected result %+v", res)
+	}
+	if len(progress) != 4 {
+		t.Errorf("update: expected progress for 4 changes, got %q", progress)
+	}
+
+	r, err := tf2vpk.NewReader(vpk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	if es, err := Status(r.Root, fsys, skip); err != nil {
+		t.Fatalf("status: %v", err)
+	} else if len(es) != 0 {
+		t.Errorf("status: expected no changes after update, got %v", es)
+	}
+	for name, f := range fsys {
+		if name == VPKFlagsFilename {
+			continue
+		}
+		if buf, err := r.ReadFile(name); err != nil {
+			t.Errorf("read %q: %v", name, err)
+		} else if !bytes.Equal(buf, f.Data) {
+			t.Errorf("read %q: incorrect contents", name)
+		}
+	}
+	if _, err := r.ReadFile("g.txt"); err != nil {
+		t.Errorf("expected excluded file to be kept, got %v", err)
+	}
+	for _, f := range r.Root.File {
+		if (f.Path == "b/c.nut" || f.Path == "h/i.txt") != (f.Index == 1) {
+			t.Errorf("expected only written files to be in block 1, got %s in %s", f.Path, f.Index)
+		}
+	}
+}
@@ -0,0 +1,394 @@
+package tf2vpk
+
+import (
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sync"
+)
+
+// Writer writes Titanfall 2 VPKs.
+//
+// Files are compressed and appended to the current block as they are written,
+// and the dir index is written when the Writer is closed.
+type Writer struct {
+	Root   ValvePakDir
+	opt    Options
+	index  ValvePakIndex
+	create func(ValvePakIndex) (io.Writer, error)
+	block  map[ValvePakIndex]io.Writer
+	offset map[ValvePakIndex]uint64
+	close  map[ValvePakIndex]io.Closer
+	path   map[string]struct{}
+	order  bool
+	done   bool
+	source ValvePakSourceSections // for Source VPKs version 2
+}
+
+// NewWriter creates a new Writer writing to vpk, replacing any existing files,
+// using the default Options.
+func NewWriter(vpk ValvePakRef) *Writer {
+	return NewWriterOptions(vpk, Options{})
+}
+
+// NewWriterOptions creates a new Writer writing to vpk, replacing any existing
+// files.
+func NewWriterOptions(vpk ValvePakRef, opt Options) *Writer {
+	return NewWriterFuncOptions(func(i ValvePakIndex) (io.Writer, error) {
+		return os.Create(vpk.Resolve(i))
+	}, opt)
+}
+
+// NewWriterFunc creates a new Writer writing using the provided function, which
+// will be called at most once for each block, and the default Options. If the
+// returned [io.Writer] implements [io.Closer], it will be called when the
+// Writer is closed. If it implements [io.Seeker], chunks are appended after the
+// existing contents of the block.
+func NewWriterFunc(create func(ValvePakIndex) (io.Writer, error)) *Writer {
+	return NewWriterFuncOptions(create, Options{})
+}
+
+// NewWriterFuncOptions is like NewWriterFunc, but uses the provided Options
+// when writing the dir index.
+func NewWriterFuncOptions(create func(ValvePakIndex) (io.Writer, error), opt Options) *Writer {
+	return &Writer{
+		opt: opt,
+		Root: ValvePakDir{
+			Magic:        ValvePakMagic,
+			MajorVersion: ValvePakVersionMajor,
+			MinorVersion: ValvePakVersionMinor,
+		},
+		create: create,
+		block:  map[ValvePakIndex]io.Writer{},
+		offset: map[ValvePakIndex]uint64{},
+		close:  map[ValvePakIndex]io.Closer{},
+		path:   map[string]struct{}{},
+	}
+}
+
+// SetIndex sets the block which chunks for subsequent files will be written to.
+// The default is block 0.
+func (w *Writer) SetIndex(i ValvePakIndex) error {
+	if i == ValvePakIndexDir || i == ValvePakIndexEOF {
+		return fmt.Errorf("cannot write chunks to block %#v", i)
+	}
+	w.index = i
+	return nil
+}
+
+// SetSourceVersion makes the Writer write a Source VPK (version 1 or 2)
+// instead of a Titanfall 2 one. It must be called before any files are added.
+//
+// Files are written uncompressed as a single contiguous entry, and must not
+// have load/texture flags. For version 2, the checksum of each write to a block
+// is recorded, and the checksum sections are written after the dir index.
+func (w *Writer) SetSourceVersion(version uint16) error {
+	if version != ValvePakVersionSource1 && version != ValvePakVersionSource2 {
+		return fmt.Errorf("unsupported source vpk version %d", version)
+	}
+	if len(w.Root.File) != 0 || len(w.block) != 0 {
+		return fmt.Errorf("cannot change the version after writing files")
+	}
+	w.Root.MajorVersion = version
+	w.Root.MinorVersion = 0
+	return nil
+}
+
+// PreserveOrder makes Close write the files to the dir index in the order they
+// were added instead of sorting them. Files must still be grouped by extension,
+// then directory (see ValvePakDir.SortFiles), or Close will fail.
+func (w *Writer) PreserveOrder() {
+	w.order = true
+}
+
+// WriteRaw appends b to block i without adding a file, returning the offset
+// it was written at. It can be used with AddFile to write chunk data which is
+// already compressed, or to control the exact contents of a block.
+func (w *Writer) WriteRaw(i ValvePakIndex, b []byte) (uint64, error) {
+	if w.done {
+		return 0, fmt.Errorf("write raw data: writer is closed")
+	}
+	if i == ValvePakIndexDir || i == ValvePakIndexEOF {
+		return 0, fmt.Errorf("cannot write raw data to block %#v", i)
+	}
+	return w.writeChunk(i, b)
+}
+
+// AddFile adds an entry for a file with chunks which have already been written
+// (e.g., using WriteRaw). The chunks are not checked.
+func (w *Writer) AddFile(f ValvePakFile) error {
+	if w.done {
+		return fmt.Errorf("add file %q: writer is closed", f.Path)
+	}
+	if _, _, _, err := splitPath(f.Path); err != nil {
+		return fmt.Errorf("add file %q: %w", f.Path, err)
+	}
+	if _, exists := w.path[f.Path]; exists {
+		return fmt.Errorf("add file %q: already exists", f.Path)
+	}
+	if len(f.Chunk) == 0 {
+		return fmt.Errorf("add file %q: empty files are not supported", f.Path)
+	}
+	w.Root.File = append(w.Root.File, f)
+	w.path[f.Path] = struct{}{}
+	return nil
+}
+
+// WriteFile compresses the contents of r into chunks in the current block, and
+// adds an entry for it with the provided flags.
+func (w *Writer) WriteFile(path string, r io.Reader, loadFlags uint32, textureFlags uint16) (ValvePakFile, error) {
+	return w.WriteFileParallel(path, r, loadFlags, textureFlags, 1)
+}
+
+// WriteFileParallel is like WriteFile, but compresses up to n chunks in
+// parallel (i.e., 1 is not parallel).
+func (w *Writer) WriteFileParallel(path string, r io.Reader, loadFlags uint32, textureFlags uint16, n int) (ValvePakFile, error) {
+	if w.done {
+		return ValvePakFile{}, fmt.Errorf("write file %q: writer is closed", path)
+	}
+	if _, _, _, err := splitPath(path); err != nil {
+		return ValvePakFile{}, fmt.Errorf("write file %q: %w", path, err)
+	}
+	if _, exists := w.path[path]; exists {
+		return ValvePakFile{}, fmt.Errorf("write file %q: already exists", path)
+	}
+	if n < 1 {
+		n = 1
+	}
+	if w.Root.IsSource() {
+		return w.writeFileSource(path, r, loadFlags, textureFlags)
+	}
+
+	f := ValvePakFile{
+		Path:  path,
+		Index: w.index,
+	}
+	crc := NewCRC()
+
+	bufs := make([][]byte, n)
+	for i := range bufs {
+		bufs[i] = make([]byte, ValvePakMaxChunkUncompressedSize)
+	}
+	for eof := false; !eof; {
+		// read the next batch of chunks
+		var raw [][]byte
+		for i := 0; i < n && !eof; i++ {
+			m, err := io.ReadFull(r, bufs[i])
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				eof = true
+			} else if err != nil {
+				return ValvePakFile{}, fmt.Errorf("write file %q: read data: %w", path, err)
+			}
+			if m != 0 {
+				_, _ = crc.Write(bufs[i][:m])
+				raw = append(raw, bufs[i][:m])
+			}
+		}
+
+		// compress them
+		cmp := make([][]byte, len(raw))
+		errs := make([]error, len(raw))
+		if len(raw) == 1 {
+			cmp[0], errs[0] = w.compressChunk(raw[0])
+		} else {
+			var wg sync.WaitGroup
+			for i := range raw {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					cmp[i], errs[i] = w.compressChunk(raw[i])
+				}(i)
+			}
+			wg.Wait()
+		}
+		if err := errors.Join(errs...); err != nil {
+			return ValvePakFile{}, fmt.Errorf("write file %q: compress chunk: %w", path, err)
+		}
+
+		// write them
+		for i := range raw {
+			c := ValvePakChunk{
+				LoadFlags:        loadFlags,
+				TextureFlags:     textureFlags,
+				UncompressedSize: uint64(len(raw[i])),
+			}
+			data := raw[i]
+			if cmp[i] != nil {
+				data = cmp[i]
+			}
+			off, err := w.writeChunk(w.index, data)
+			if err != nil {
+				return ValvePakFile{}, fmt.Errorf("write file %q: %w", path, err)
+			}
+			c.Offset = off
+			c.CompressedSize = uint64(len(data))
+			f.Chunk = append(f.Chunk, c)
+		}
+	}
+	if len(f.Chunk) == 0 {
+		return ValvePakFile{}, fmt.Errorf("write file %q: empty files are not supported", path)
+	}
+	f.CRC32 = crc.Sum32()
+
+	w.Root.File = append(w.Root.File, f)
+	w.path[path] = struct{}{}
+	return f, nil
+}
+
+// writeFileSource writes the contents of r uncompressed as a single entry.
+func (w *Writer) writeFileSource(path string, r io.Reader, loadFlags uint32, textureFlags uint16) (ValvePakFile, error) {
+	if loadFlags != 0 || textureFlags != 0 {
+		return ValvePakFile{}, fmt.Errorf("write file %q: source vpks do not support load/texture flags", path)
+	}
+
+	f := ValvePakFile{
+		Path:  path,
+		Index: w.index,
+		Chunk: []ValvePakChunk{{}},
+	}
+	crc := NewCRC()
+
+	buf := make([]byte, ValvePakMaxChunkUncompressedSize)
+	for eof := false; !eof; {
+		m, err := io.ReadFull(r, buf)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			eof = true
+		} else if err != nil {
+			return ValvePakFile{}, fmt.Errorf("write file %q: read data: %w", path, err)
+		}
+		if m == 0 {
+			continue
+		}
+		_, _ = crc.Write(buf[:m])
+
+		off, err := w.writeChunk(w.index, buf[:m])
+		if err != nil {
+			return ValvePakFile{}, fmt.Errorf("write file %q: %w", path, err)
+		}
+		if f.Chunk[0].UncompressedSize == 0 {
+			f.Chunk[0].Offset = off
+		}
+		f.Chunk[0].UncompressedSize += uint64(m)
+		f.Chunk[0].CompressedSize += uint64(m)
+	}
+	if f.Chunk[0].UncompressedSize == 0 {
+		return ValvePakFile{}, fmt.Errorf("write file %q: empty files are not supported", path)
+	}
+	if f.Chunk[0].Offset+f.Chunk[0].UncompressedSize > math.MaxUint32 {
+		return ValvePakFile{}, fmt.Errorf("write file %q: source vpk blocks are limited to 4 GiB", path)
+	}
+	f.CRC32 = crc.Sum32()
+
+	w.Root.File = append(w.Root.File, f)
+	w.path[path] = struct{}{}
+	return f, nil
+}
+
+// Codec returns the codec used to compress chunks.
+func (w *Writer) Codec() Codec {
+	return w.opt.codec()
+}
+
+// ArchiveMD5 returns the archive md5 entries for the chunks written to the
+// blocks of a Source VPK version 2. They are sorted by Close.
+func (w *Writer) ArchiveMD5() []ValvePakArchiveMD5 {
+	return w.source.ArchiveMD5
+}
+
+// compressChunk compresses b, returning nil if it should be stored
+// uncompressed.
+func (w *Writer) compressChunk(b []byte) ([]byte, error) {
+	dst := make([]byte, len(b)*2+64)
+	n, err := w.opt.codec().Compress(dst, b)
+	if err != nil {
+		return nil, err
+	}
+	if n >= len(b) {
+		return nil, nil // note: a chunk is only treated as compressed if the sizes differ
+	}
+	return dst[:n], nil
+}
+
+// writeChunk appends b to block i, returning the offset it was written at.
+func (w *Writer) writeChunk(i ValvePakIndex, b []byte) (uint64, error) {
+	x, ok := w.block[i]
+	if !ok {
+		var err error
+		if x, err = w.create(i); err != nil {
+			return 0, fmt.Errorf("create vpk block %s: %w", i, err)
+		}
+		if c, ok := x.(io.Closer); ok {
+			w.close[i] = c
+		}
+		if s, ok := x.(io.Seeker); ok {
+			off, err := s.Seek(0, io.SeekEnd)
+			if err != nil {
+				return 0, fmt.Errorf("seek to end of vpk block %s: %w", i, err)
+			}
+			w.offset[i] = uint64(off)
+		}
+		w.block[i] = x
+	}
+	off := w.offset[i]
+	if _, err := x.Write(b); err != nil {
+		return 0, fmt.Errorf("write chunk to vpk block %s at offset %d: %w", i, off, err)
+	}
+	if w.Root.isSource2() && off+uint64(len(b)) <= math.MaxUint32 {
+		w.source.ArchiveMD5 = append(w.source.ArchiveMD5, ValvePakArchiveMD5{
+			Index:  i,
+			Offset: uint32(off),
+			Size:   uint32(len(b)),
+			MD5:    md5.Sum(b),
+		})
+	}
+	w.offset[i] += uint64(len(b))
+	return off, nil
+}
+
+// Close writes the dir index and closes files opened by the Writer.
+func (w *Writer) Close() error {
+	if w.done {
+		return nil
+	}
+	w.done = true
+
+	var errs []error
+	if w.order {
+		if _, err := w.Root.TreeSize(); err != nil {
+			errs = append(errs, fmt.Errorf("check file order: %w", err))
+		}
+	} else if err := w.Root.SortFiles(); err != nil {
+		errs = append(errs, fmt.Errorf("sort files: %w", err))
+	}
+	if len(errs) == 0 && w.Root.isSource2() {
+		w.source.SortArchiveMD5()
+		if err := w.source.UpdateChecksums(&w.Root, nil); err != nil {
+			errs = append(errs, fmt.Errorf("compute checksums: %w", err))
+		}
+	}
+	if len(errs) != 0 {
+		// don't write an invalid dir index
+	} else if dir, err := w.create(ValvePakIndexDir); err != nil {
+		errs = append(errs, fmt.Errorf("create vpk dir index: %w", err))
+	} else {
+		if c, ok := dir.(io.Closer); ok {
+			w.close[ValvePakIndexDir] = c
+		}
+		if err := w.Root.SerializeOptions(dir, w.opt); err != nil {
+			errs = append(errs, fmt.Errorf("write vpk dir index: %w", err))
+		} else if w.Root.isSource2() {
+			if err := w.source.Serialize(dir); err != nil {
+				errs = append(errs, fmt.Errorf("write vpk dir checksums: %w", err))
+			}
+		}
+	}
+	for i, x := range w.close {
+		if err := x.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("close data writer for index %d: %w", i, err))
+		}
+	}
+	return errors.Join(errs...)
+}
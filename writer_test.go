@@ -0,0 +1,457 @@
+package tf2vpk
+
+import (
+	"bytes"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+func TestWriterRoundTrip(t *testing.T) {
+	rng := rand.New(rand.NewSource(0))
+
+	files := map[string][]byte{
+		"a.txt":                   []byte("hello world"),
+		"scripts/b.nut":           bytes.Repeat([]byte("print(1)\n"), 300000),
+		"scripts/vscripts/c.gnut": bytes.Repeat([]byte{0}, int(ValvePakMaxChunkUncompressedSize)),
+		"materials/d.vtf":         make([]byte, ValvePakMaxChunkUncompressedSize*2+1),
+	}
+	rng.Read(files["materials/d.vtf"])
+
+	blocks := map[ValvePakIndex]*bytes.Buffer{}
+	w := NewWriterFunc(func(i ValvePakIndex) (io.Writer, error) {
+		if _, ok := blocks[i]; ok {
+			return nil, fmt.Errorf("block %s created twice", i)
+		}
+		blocks[i] = new(bytes.Buffer)
+		return blocks[i], nil
+	})
+	for _, name := range []string{"scripts/b.nut", "a.txt", "materials/d.vtf", "scripts/vscripts/c.gnut"} {
+		var texture uint16
+		if name == "materials/d.vtf" {
+			texture = 0b1000
+		}
+		if _, err := w.WriteFileParallel(name, bytes.NewReader(files[name]), 0b100000001, texture, 3); err != nil {
+			t.Fatalf("write %q: %v", name, err)
+		}
+	}
+	if _, err := w.WriteFile("a.txt", bytes.NewReader(nil), 0, 0); err == nil {
+		t.Errorf("expected error when writing duplicate file")
+	}
+	if _, err := w.WriteFile("empty.txt", bytes.NewReader(nil), 0, 0); err == nil {
+		t.Errorf("expected error when writing empty file")
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	r, err := NewReaderFunc(func(i ValvePakIndex) (io.ReaderAt, error) {
+		if b, ok := blocks[i]; ok {
+			return bytes.NewReader(b.Bytes()), nil
+		}
+		return nil, fmt.Errorf("block %s does not exist", i)
+	})
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if len(r.Root.File) != len(files) {
+		t.Fatalf("expected %d files, got %d", len(files), len(r.Root.File))
+	}
+	for _, f := range r.Root.File {
+		fr, err := r.OpenFile(f)
+		if err != nil {
+			t.Fatalf("open %q: %v", f.Path, err)
+		}
+		buf, err := io.ReadAll(fr)
+		if err != nil {
+			t.Fatalf("read %q: %v", f.Path, err)
+		}
+		if !bytes.Equal(buf, files[f.Path]) {
+			t.Errorf("read %q: contents do not match", f.Path)
+		}
+		for i, c := range f.Chunk {
+			if c.UncompressedSize > ValvePakMaxChunkUncompressedSize {
+				t.Errorf("read %q: chunk %d: too large", f.Path, i)
+			}
+		}
+	}
+}
+
+func TestWriterSource(t *testing.T) {
+	files := map[string][]byte{
+		"a.txt":         []byte("hello world"),
+		"scripts/b.nut": bytes.Repeat([]byte("print(1)\n"), 300000),
+	}
+	for _, version := range []uint16{ValvePakVersionSource1, ValvePakVersionSource2} {
+		t.Run(fmt.Sprint(version), func(t *testing.T) {
+			blocks := map[ValvePakIndex]*bytes.Buffer{}
+			w := NewWriterFunc(func(i ValvePakIndex) (io.Writer, error) {
+				blocks[i] = new(bytes.Buffer)
+				return blocks[i], nil
+			})
+			if err := w.SetSourceVersion(version); err != nil {
+				t.Fatalf("set version: %v", err)
+			}
+			for _, name := range []string{"scripts/b.nut", "a.txt"} {
+				if _, err := w.WriteFile(name, bytes.NewReader(files[name]), 0, 0); err != nil {
+					t.Fatalf("write %q: %v", name, err)
+				}
+			}
+			if _, err := w.WriteFile("c.txt", bytes.NewReader([]byte("c")), 1, 0); err == nil {
+				t.Errorf("expected error when writing file with flags")
+			}
+			if err := w.Close(); err != nil {
+				t.Fatalf("close: %v", err)
+			}
+
+			r, err := NewReaderFunc(func(i ValvePakIndex) (io.ReaderAt, error) {
+				if b, ok := blocks[i]; ok {
+					return bytes.NewReader(b.Bytes()), nil
+				}
+				return nil, fmt.Errorf("block %s does not exist", i)
+			})
+			if err != nil {
+				t.Fatalf("read: %v", err)
+			}
+			if !r.Root.IsSource() || r.Root.MajorVersion != version {
+				t.Errorf("expected source vpk version %d, got %d.%d", version, r.Root.MajorVersion, r.Root.MinorVersion)
+			}
+			for _, f := range r.Root.File {
+				if buf, err := r.ReadFile(f.Path); err != nil {
+					t.Errorf("read %q: %v", f.Path, err)
+				} else if !bytes.Equal(buf, files[f.Path]) {
+					t.Errorf("read %q: contents do not match", f.Path)
+				}
+				if len(f.Chunk) != 1 || f.Chunk[0].IsCompressed() {
+					t.Errorf("read %q: expected a single uncompressed chunk, got %+v", f.Path, f.Chunk)
+				}
+			}
+
+			dir := blocks[ValvePakIndexDir].Bytes()
+			n, err := r.Root.ChunkOffset()
+			if err != nil {
+				t.Fatalf("chunk offset: %v", err)
+			}
+			var buf bytes.Buffer
+			if err := r.Root.Serialize(&buf); err != nil {
+				t.Fatalf("serialize: %v", err)
+			} else if !bytes.Equal(buf.Bytes(), dir[:n]) {
+				t.Errorf("round-trip not identical")
+			}
+
+			if version == ValvePakVersionSource1 {
+				if len(dir) != int(n) {
+					t.Errorf("expected nothing after the dir index, got %d bytes", len(dir)-int(n))
+				}
+				return
+			}
+			s, err := r.SourceSections()
+			if err != nil {
+				t.Fatalf("read sections: %v", err)
+			}
+			if len(s.ArchiveMD5) == 0 {
+				t.Errorf("expected archive checksums")
+			}
+			for _, x := range s.ArchiveMD5 {
+				if md5.Sum(blocks[x.Index].Bytes()[x.Offset:][:x.Size]) != x.MD5 {
+					t.Errorf("archive checksum mismatch for %s:%d+%d", x.Index, x.Offset, x.Size)
+				}
+			}
+			if md5.Sum(dir[:len(dir)-md5.Size]) != s.WholeFileMD5 {
+				t.Errorf("whole file checksum mismatch")
+			}
+			if md5.Sum(dir[n-r.Root.treeSize:n]) != s.TreeMD5 {
+				t.Errorf("tree checksum mismatch")
+			}
+		})
+	}
+}
+
+func TestWriterCodec(t *testing.T) {
+	data := bytes.Repeat([]byte("print(1)\n"), 300000)
+
+	blocks := map[ValvePakIndex]*bytes.Buffer{}
+	w := NewWriterFuncOptions(func(i ValvePakIndex) (io.Writer, error) {
+		blocks[i] = new(bytes.Buffer)
+		return blocks[i], nil
+	}, Options{Codec: Zlib})
+	if _, err := w.WriteFile("scripts/b.nut", bytes.NewReader(data), 0, 0); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	open := func(opt Options) (*Reader, error) {
+		return NewReaderFuncOptions(func(i ValvePakIndex) (io.ReaderAt, error) {
+			if b, ok := blocks[i]; ok {
+				return bytes.NewReader(b.Bytes()), nil
+			}
+			return nil, fmt.Errorf("block %s does not exist", i)
+		}, opt)
+	}
+	for _, tc := range []struct {
+		Name  string
+		Opt   Options
+		Codec Codec
+	}{
+		{"Explicit", Options{Codec: Zlib}, Zlib},
+		{"Detect", Options{DetectCodec: true}, Zlib},
+		{"Default", Options{}, LZHAM},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			r, err := open(tc.Opt)
+			if err != nil {
+				t.Fatalf("read: %v", err)
+			}
+			if r.Codec() != tc.Codec {
+				t.Fatalf("expected codec %s, got %s", tc.Codec.Name(), r.Codec().Name())
+			}
+			buf, err := r.ReadFile("scripts/b.nut")
+			if tc.Codec != Zlib {
+				if !errors.Is(err, ErrDecompress) {
+					t.Errorf("expected decompress error, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("read file: %v", err)
+			} else if !bytes.Equal(buf, data) {
+				t.Errorf("read file: contents do not match")
+			}
+			if !r.Root.File[0].Chunk[0].IsCompressed() {
+				t.Errorf("expected chunk to be compressed")
+			}
+		})
+	}
+
+	// a chunk which only has a valid zlib header shouldn't be detected as zlib
+	t.Run("DetectHeaderOnly", func(t *testing.T) {
+		r, err := open(Options{})
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		c := r.Root.File[0].Chunk[0]
+		chunk := blocks[r.Root.File[0].Index].Bytes()[c.Offset:][:c.CompressedSize]
+		if !Zlib.(CodecDetector).Detect(chunk) {
+			t.Fatalf("expected chunk to have a zlib header")
+		}
+		orig := bytes.Clone(chunk)
+		defer copy(chunk, orig)
+
+		for i := range chunk[2:] {
+			chunk[2+i] = byte(i)
+		}
+		if r, err = open(Options{DetectCodec: true}); err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		if r.Codec() != LZHAM {
+			t.Errorf("expected codec %s, got %s", LZHAM.Name(), r.Codec().Name())
+		}
+	})
+
+	if c, ok := LookupCodec("zlib"); !ok || c != Zlib {
+		t.Errorf("expected zlib codec to be registered")
+	}
+	if c := DetectCodec([]byte("not zlib")); c != nil {
+		t.Errorf("expected no codec to be detected, got %s", c.Name())
+	}
+}
+
+func TestLZHAMDecoder(t *testing.T) {
+	defer SetLZHAMDecoder(GetLZHAMDecoder())
+
+	data := bytes.Repeat([]byte("print(1)\n"), 300000)
+
+	blocks := map[ValvePakIndex]*bytes.Buffer{}
+	w := NewWriterFunc(func(i ValvePakIndex) (io.Writer, error) {
+		blocks[i] = new(bytes.Buffer)
+		return blocks[i], nil
+	})
+	if _, err := w.WriteFile("scripts/b.nut", bytes.NewReader(data), 0, 0); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	for _, d := range LZHAMDecoders() {
+		t.Run(string(d), func(t *testing.T) {
+			if err := SetLZHAMDecoder(d); err != nil {
+				t.Fatalf("set decoder: %v", err)
+			}
+			r, err := NewReaderFunc(func(i ValvePakIndex) (io.ReaderAt, error) {
+				if b, ok := blocks[i]; ok {
+					return bytes.NewReader(b.Bytes()), nil
+				}
+				return nil, fmt.Errorf("block %s does not exist", i)
+			})
+			if err != nil {
+				t.Fatalf("read: %v", err)
+			}
+			if buf, err := r.ReadFile("scripts/b.nut"); err != nil {
+				t.Fatalf("read file: %v", err)
+			} else if !bytes.Equal(buf, data) {
+				t.Errorf("read file: contents do not match")
+			}
+		})
+	}
+
+	if err := SetLZHAMDecoder("bogus"); err == nil {
+		t.Errorf("expected error for unknown decoder")
+	}
+}
+
+func TestCodecStream(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	random := make([]byte, 5000)
+	rng.Read(random)
+
+	var data []byte
+	data = append(data, bytes.Repeat([]byte("print(1)\n"), 1000)...)
+	data = append(data, random...) // incompressible, so stored as-is
+	data = append(data, bytes.Repeat([]byte{0}, 10000)...)
+
+	for _, c := range []Codec{LZHAM, Zlib} {
+		t.Run(c.Name(), func(t *testing.T) {
+			for _, x := range []struct {
+				Name      string
+				Data      []byte
+				BlockSize int
+			}{
+				{"Empty", nil, 0},
+				{"Single", data, 0},
+				{"Blocks", data, 4096},
+			} {
+				var buf bytes.Buffer
+				w, err := NewCodecWriter(&buf, c, x.BlockSize)
+				if err != nil {
+					t.Fatalf("%s: new writer: %v", x.Name, err)
+				}
+				if _, err := io.Copy(w, bytes.NewReader(x.Data)); err != nil {
+					t.Fatalf("%s: write: %v", x.Name, err)
+				}
+				if err := w.Close(); err != nil {
+					t.Fatalf("%s: close: %v", x.Name, err)
+				}
+				if w.Offset() != int64(buf.Len()) {
+					t.Errorf("%s: expected offset %d, got %d", x.Name, buf.Len(), w.Offset())
+				}
+				z := buf.Bytes()
+
+				r, err := NewCodecReader(bytes.NewReader(z))
+				if err != nil {
+					t.Fatalf("%s: new reader: %v", x.Name, err)
+				}
+				if r.Codec() != c {
+					t.Errorf("%s: expected codec %s, got %s", x.Name, c.Name(), r.Codec().Name())
+				}
+				if out, err := io.ReadAll(r); err != nil {
+					t.Errorf("%s: read: %v", x.Name, err)
+				} else if !bytes.Equal(out, x.Data) {
+					t.Errorf("%s: contents do not match", x.Name)
+				}
+
+				if _, err := codecStreamReadAll(z[:len(z)-1]); !errors.Is(err, io.ErrUnexpectedEOF) {
+					t.Errorf("%s: truncated: expected %v, got %v", x.Name, io.ErrUnexpectedEOF, err)
+				}
+
+				bad := bytes.Clone(z)
+				bad[len(bad)-1] ^= 1
+				if _, err := codecStreamReadAll(bad); !errors.Is(err, ErrChecksum) {
+					t.Errorf("%s: bad checksum: expected %v, got %v", x.Name, ErrChecksum, err)
+				}
+			}
+
+			z := make([]byte, 1024)
+			n, err := c.Compress(z, data)
+			if !errors.Is(err, io.ErrShortBuffer) {
+				t.Errorf("compress: expected %v, got %v", io.ErrShortBuffer, err)
+			}
+			z = make([]byte, len(data)*2+64)
+			if n, err = c.Compress(z, data); err != nil {
+				t.Fatalf("compress: %v", err)
+			}
+			if _, err := c.Decompress(make([]byte, len(data)/2), z[:n]); !errors.Is(err, io.ErrShortBuffer) {
+				t.Errorf("decompress: expected %v, got %v", io.ErrShortBuffer, err)
+			}
+		})
+	}
+
+	if _, err := codecStreamReadAll([]byte("\x89TFZ\x01\x05bogus\x00\x00\x01\x00")); err == nil {
+		t.Errorf("expected error for unknown codec")
+	}
+	if _, err := codecStreamReadAll([]byte("PK\x03\x04\x01\x05bogus\x00\x00\x01\x00")); err == nil {
+		t.Errorf("expected error for invalid magic")
+	}
+}
+
+func TestCodecRaw(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+	random := make([]byte, 100)
+	rng.Read(random)
+
+	// compresses to much less than a quarter of the size, so the initial
+	// decompression buffer is too small
+	var data []byte
+	for len(data) < 8*1024*1024 {
+		data = append(data, bytes.Repeat([]byte("print(1)\n"), 10000)...)
+		data = append(data, random[:rng.Intn(100)]...)
+	}
+
+	for _, c := range []Codec{LZHAM, Zlib} {
+		t.Run(c.Name(), func(t *testing.T) {
+			z, err := CompressRaw(c, data, 0)
+			if err != nil {
+				t.Fatalf("compress: %v", err)
+			}
+			if len(z)*4 >= len(data) {
+				t.Fatalf("expected data to be compressed to less than a quarter of the size, got %d/%d", len(z), len(data))
+			}
+			if buf, err := DecompressRaw(c, z, 0); err != nil {
+				t.Errorf("decompress: %v", err)
+			} else if !bytes.Equal(buf, data) {
+				t.Errorf("decompress: incorrect output")
+			}
+			if _, err := DecompressRaw(c, z, len(data)/2); err == nil {
+				t.Errorf("decompress: expected error when the output is larger than the limit")
+			}
+			if _, err := CompressRaw(c, data, 1024); err == nil {
+				t.Errorf("compress: expected error when the output is larger than the limit")
+			}
+
+			// invalid data shouldn't make it allocate larger buffers
+			junk := make([]byte, 1024)
+			for i := 0; i < 100; i++ {
+				rng.Read(junk)
+				cc := &countingCodec{Codec: c}
+				if _, err := DecompressRaw(cc, junk, 0); err == nil {
+					t.Errorf("decompress junk: expected error")
+				} else if cc.Calls != 1 {
+					t.Errorf("decompress junk: expected 1 attempt, got %d (err: %v)", cc.Calls, err)
+				}
+			}
+		})
+	}
+}
+
+type countingCodec struct {
+	Codec
+	Calls int
+}
+
+func (c *countingCodec) Decompress(dst, src []byte) (int, error) {
+	c.Calls++
+	return c.Codec.Decompress(dst, src)
+}
+
+func codecStreamReadAll(b []byte) ([]byte, error) {
+	r, err := NewCodecReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}